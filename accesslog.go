@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Journal d'accès, une ligne par requête quel que soit le protocole, indépendant de la trace
+// Exemple : go run . http3 -quiet -access-log - -access-format json
+var accessLogOptions struct {
+	path    string
+	format  string
+	maxSize int
+	backups int
+}
+
+func registerAccessLogFlags(fs *flag.FlagSet) {
+	fs.StringVar(&accessLogOptions.path, "access-log", "", "fichier du journal d'accès (- pour la sortie standard)")
+	fs.StringVar(&accessLogOptions.format, "access-format", "combined", "format du journal d'accès (common, combined ou json)")
+	fs.IntVar(&accessLogOptions.maxSize, "access-max-size", 10, "taille (Mo) à partir de laquelle le journal est archivé (0 pour ne jamais l'archiver)")
+	fs.IntVar(&accessLogOptions.backups, "access-backups", 5, "nombre d'archives du journal conservées")
+}
+
+// nil si le journal n'est pas activé
+var accessLog io.Writer
+
+func setupAccessLog() {
+	switch accessLogOptions.format {
+	case "common", "combined", "json":
+	default:
+		log.Fatalf("Format de journal %q inconnu, common, combined ou json attendu", accessLogOptions.format)
+	}
+	switch accessLogOptions.path {
+	case "":
+		return
+	case "-":
+		accessLog = os.Stdout
+	default:
+		w, err := newRotatingFile(accessLogOptions.path, int64(accessLogOptions.maxSize)<<20, accessLogOptions.backups)
+		if err != nil {
+			log.Fatalf("Impossible d'ouvrir le journal d'accès, %v", err)
+		}
+		accessLog = w
+		fmt.Printf("📝 Journal d'accès écrit dans %s\n", accessLogOptions.path)
+	}
+}
+
+var accessLogMu sync.Mutex
+
+// Requête en cours, la ligne est écrite une fois la réponse envoyée
+type accessEntry struct {
+	start     time.Time
+	remote    string
+	protocol  string
+	method    string
+	target    string
+	referer   string
+	userAgent string
+	// Les métriques ne comptent la requête qu'une fois, qu'elle aboutisse ou soit annulée
+	done sync.Once
+}
+
+func newAccessEntry(r *Request, protocol string, remote string, start time.Time) *accessEntry {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	streamsActive.inc(metricProtocol(protocol))
+	return &accessEntry{
+		start:     start,
+		remote:    remote,
+		protocol:  protocol,
+		method:    r.Method,
+		target:    r.URI,
+		referer:   r.Header("Referer"),
+		userAgent: r.Header("User-Agent"),
+	}
+}
+
+/**
+* Écrit la ligne de la requête, size est la taille du corps de la réponse
+*
+* ```
+* 127.0.0.1 - - [19/Oct/2026:08:12:01 +0200] "GET /main.css HTTP/2.0" 200 47 "https://localhost/" "Mozilla/5.0 ..." 0.002
+* {"time":"2026-10-19T08:12:01+02:00","remote":"127.0.0.1","protocol":"HTTP/2.0",...}
+* ```
+**/
+func (e *accessEntry) log(status int, size int64) {
+	if e == nil {
+		return
+	}
+	duration := time.Since(e.start)
+	e.done.Do(func() {
+		protocol := metricProtocol(e.protocol)
+		streamsActive.add(-1, protocol)
+		requestsTotal.inc(protocol, strconv.Itoa(status))
+		requestDuration.observe(duration.Seconds(), protocol)
+	})
+	if accessLog == nil {
+		return
+	}
+	var line []byte
+	if accessLogOptions.format == "json" {
+		line, _ = json.Marshal(struct {
+			Time       time.Time `json:"time"`
+			Remote     string    `json:"remote"`
+			Protocol   string    `json:"protocol"`
+			Method     string    `json:"method"`
+			Path       string    `json:"path"`
+			Status     int       `json:"status"`
+			Size       int64     `json:"size"`
+			Referer    string    `json:"referer,omitempty"`
+			UserAgent  string    `json:"user_agent,omitempty"`
+			DurationMs float64   `json:"duration_ms"`
+		}{e.start, e.remote, e.protocol, e.method, e.target, status, size, e.referer, e.userAgent,
+			float64(duration.Microseconds()) / 1000})
+	} else {
+		// La durée (en secondes) est ajoutée en fin de ligne comme le $request_time de nginx
+		line = fmt.Appendf(nil, "%s - - [%s] %s %v %s", e.remote, e.start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.method+" "+e.target+" "+e.protocol), status, clfSize(size))
+		if accessLogOptions.format == "combined" {
+			line = fmt.Appendf(line, " %s %s", clfField(e.referer), clfField(e.userAgent))
+		}
+		line = fmt.Appendf(line, " %.3f", duration.Seconds())
+	}
+	line = append(line, '\n')
+
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	accessLog.Write(line)
+}
+
+// Stream annulé ou connexion fermée avant la réponse, rien n'est écrit dans le journal
+func (e *accessEntry) abort() {
+	if e == nil {
+		return
+	}
+	e.done.Do(func() {
+		streamsActive.add(-1, metricProtocol(e.protocol))
+	})
+}
+
+func clfSize(size int64) string {
+	if size <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+func clfField(v string) string {
+	if v == "" {
+		return `"-"`
+	}
+	return strconv.Quote(v)
+}
+
+// Fichier archivé (journal.log.1, journal.log.2...) quand il dépasse sa taille maximale
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func newRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Printf("Impossible d'archiver le journal d'accès, %v", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Décale les archives, la plus ancienne est écrasée
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	if r.backups > 0 {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			r.open()
+			return err
+		}
+	} else if err := os.Truncate(r.path, 0); err != nil {
+		r.open()
+		return err
+	}
+	return r.open()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Commande bench : charge une page de public/ et ses ressources avec chaque protocole
+// sur des serveurs locaux, à travers un réseau simulé (voir impairOptions)
+// Exemple : go run . bench -delay 25ms -loss 0.02 -c 6 -runs 5
+var benchOptions struct {
+	page        string
+	protocols   string
+	concurrency int
+	runs        int
+	json        string
+	trace       bool
+}
+
+func registerBenchFlags(fs *flag.FlagSet) {
+	fs.StringVar(&benchOptions.page, "page", "index.html", "page de public/ chargée avec ses ressources")
+	fs.StringVar(&benchOptions.protocols, "proto", "http1,http2,http3", "protocoles comparés, séparés par des virgules")
+	fs.IntVar(&benchOptions.concurrency, "c", 6, "nombre maximum de requêtes simultanées (de connexions en HTTP1)")
+	fs.IntVar(&benchOptions.runs, "runs", 3, "nombre de chargements par protocole, les résultats sont moyennés")
+	fs.StringVar(&benchOptions.json, "json", "", "fichier où écrire les résultats en JSON (- pour la sortie standard)")
+	fs.BoolVar(&benchOptions.trace, "trace", false, "affiche la trace des échanges")
+}
+
+// Ressources chargées par la page : feuilles de style, scripts, images...
+var resourcePattern = regexp.MustCompile(`<(?:link|script|img|source|video|audio)\b[^>]*?\b(?:href|src)="([^"]+)"`)
+
+// Chemins des ressources de la page servies par le même site, le navigateur demande
+// aussi /favicon.ico même si la page ne le déclare pas
+func pageResources(page string) ([]string, error) {
+	html, err := os.ReadFile(filepath.Join("public", page))
+	if err != nil {
+		return nil, fmt.Errorf("impossible de lire la page, %w", err)
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, m := range resourcePattern.FindAllSubmatch(html, -1) {
+		u, err := url.Parse(string(m[1]))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			continue
+		}
+		add("/" + strings.TrimPrefix(u.Path, "/"))
+	}
+	if _, err := os.Stat("public/favicon.ico"); err == nil {
+		add("/favicon.ico")
+	}
+	return paths, nil
+}
+
+// Mesures d'un chargement de la page
+type benchRun struct {
+	conns        int64
+	setup        time.Duration
+	ttfb         time.Duration
+	total        time.Duration
+	sent         int64
+	received     int64
+	headerBytes  int
+	encodedBytes int
+}
+
+// Résultats moyennés d'un protocole
+type benchResult struct {
+	Protocol           string  `json:"protocol"`
+	Requests           int     `json:"requests"`
+	Connections        float64 `json:"connections"`
+	SetupMs            float64 `json:"setup_ms"`
+	TTFBMs             float64 `json:"ttfb_ms"`
+	TotalMs            float64 `json:"total_ms"`
+	BytesSent          int64   `json:"bytes_sent"`
+	BytesReceived      int64   `json:"bytes_received"`
+	HeaderBytes        int     `json:"header_bytes"`
+	EncodedHeaderBytes int     `json:"encoded_header_bytes"`
+	CompressionRatio   float64 `json:"header_compression_ratio"`
+}
+
+type benchReport struct {
+	Page          string        `json:"page"`
+	Runs          int           `json:"runs"`
+	Concurrency   int           `json:"concurrency"`
+	DelayMs       float64       `json:"delay_ms"`
+	JitterMs      float64       `json:"jitter_ms"`
+	BandwidthKbps int           `json:"bandwidth_kbps"`
+	Loss          float64       `json:"loss"`
+	Reorder       float64       `json:"reorder"`
+	Results       []benchResult `json:"results"`
+}
+
+func newBenchResult(protocol string, requests int, runs []benchRun) benchResult {
+	r := benchResult{Protocol: protocol, Requests: requests}
+	n := len(runs)
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond) / float64(n)
+	}
+	var setup, ttfb, total time.Duration
+	for _, run := range runs {
+		r.Connections += float64(run.conns) / float64(n)
+		setup += run.setup
+		ttfb += run.ttfb
+		total += run.total
+		r.BytesSent += run.sent
+		r.BytesReceived += run.received
+		r.HeaderBytes += run.headerBytes
+		r.EncodedHeaderBytes += run.encodedBytes
+	}
+	r.SetupMs, r.TTFBMs, r.TotalMs = ms(setup), ms(ttfb), ms(total)
+	r.BytesSent /= int64(n)
+	r.BytesReceived /= int64(n)
+	r.HeaderBytes /= n
+	r.EncodedHeaderBytes /= n
+	if r.EncodedHeaderBytes > 0 {
+		r.CompressionRatio = float64(r.HeaderBytes) / float64(r.EncodedHeaderBytes)
+	}
+	return r
+}
+
+func runBench(args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Utilisation : go run . bench [options]")
+	}
+	resources, err := pageResources(benchOptions.page)
+	if err != nil {
+		log.Fatalf("Erreur : %v", err)
+	}
+	if !benchOptions.trace {
+		traceOutput.w = io.Discard
+	}
+	// Les serveurs locaux utilisent le certificat de développement
+	clientOptions.insecure = true
+
+	im := impairOptions
+	servers, err := startBenchServers(im)
+	if err != nil {
+		log.Fatalf("Erreur : %v", err)
+	}
+
+	report := benchReport{
+		Page:          benchOptions.page,
+		Runs:          max(benchOptions.runs, 1),
+		Concurrency:   benchOptions.concurrency,
+		DelayMs:       float64(im.delay) / float64(time.Millisecond),
+		JitterMs:      float64(im.jitter) / float64(time.Millisecond),
+		BandwidthKbps: im.bandwidth,
+		Loss:          im.loss,
+		Reorder:       im.reorder,
+	}
+	fmt.Printf("⏱️ Chargement de %s et %v ressources, %v fois par protocole\n", benchOptions.page, len(resources), report.Runs)
+	if im.active() {
+		fmt.Printf("🐌 Réseau dégradé : %s\n", im)
+	}
+	for _, protocol := range strings.Split(benchOptions.protocols, ",") {
+		protocol = strings.TrimSpace(protocol)
+		u, ok := servers[protocol]
+		if !ok {
+			log.Fatalf("Protocole invalide '%s'. http1, http2, http3 accepté", protocol)
+		}
+		var runs []benchRun
+		for range report.Runs {
+			run, err := benchLoad(protocol, u, resources, im)
+			if err != nil {
+				log.Fatalf("Erreur (%s) : %v", protocol, err)
+			}
+			runs = append(runs, run)
+		}
+		report.Results = append(report.Results, newBenchResult(protocol, len(resources)+1, runs))
+	}
+
+	printBenchResults(report.Results)
+	if benchOptions.json != "" {
+		if err := writeBenchReport(benchOptions.json, report); err != nil {
+			log.Fatalf("Erreur : %v", err)
+		}
+	}
+}
+
+// Lance un serveur local par protocole sur un port libre, le réseau est dégradé
+// par le serveur dans les deux sens
+func startBenchServers(im impairment) (map[string]*url.URL, error) {
+	servers := make(map[string]*url.URL)
+	for name, protocol := range map[string]string{"http1": HTTP1, "http2": HTTP2} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("impossible d'écouter en TCP, %w", err)
+		}
+		if im.active() {
+			ln = impairedListener{ln, im}
+		}
+		go serveTCP(ln, protocol)
+		servers[name] = localURL(ln.Addr())
+	}
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("impossible d'écouter en UDP, %w", err)
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	if im.active() {
+		tr.Conn = newImpairedPacketConn(udpConn, im)
+	}
+	ln, err := tr.ListenEarly(loadTLSConfig(HTTP3), quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("impossible d'écouter les connexions QUIC, %w", err)
+	}
+	go serveHTTP3(context.Background(), ln)
+	servers["http3"] = localURL(udpConn.LocalAddr())
+	return servers, nil
+}
+
+// URL d'un serveur local, le certificat est émis pour localhost
+func localURL(addr net.Addr) *url.URL {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return &url.URL{Scheme: "https", Host: "localhost:" + port, Path: "/"}
+}
+
+// Charge la page puis ses ressources avec une nouvelle connexion, comme un navigateur
+// sans cache, les octets sont comptés au niveau des sockets du client (TLS et QUIC compris)
+func benchLoad(protocol string, u *url.URL, resources []string, im impairment) (benchRun, error) {
+	var run benchRun
+	var sent, received, conns atomic.Int64
+	dialTCP = func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conns.Add(1)
+		// Le handshake TCP (SYN, SYN-ACK) n'est pas retardé par impairedConn
+		time.Sleep(2 * im.delay)
+		return countingConn{conn, &sent, &received}, nil
+	}
+	listenUDP = func() (net.PacketConn, error) {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		conns.Add(1)
+		return countingPacketConn{conn, &sent, &received}, nil
+	}
+
+	start := time.Now()
+	conn, err := dialClient(u, protocol)
+	if err != nil {
+		return run, err
+	}
+	defer conn.close()
+	page := benchRequest(u, "/"+benchOptions.page)
+	if err := conn.fetch(page); err != nil {
+		return run, err
+	}
+	run.ttfb = page.timings.start.Sub(start) + page.timings.at("premier octet")
+	reqs := make([]*clientRequest, len(resources))
+	for i, path := range resources {
+		reqs[i] = benchRequest(u, path)
+	}
+	if err := fetchAll(reqs, conn.fetch, benchOptions.concurrency); err != nil {
+		return run, err
+	}
+	run.total = time.Since(start)
+	run.setup = conn.setupTime()
+
+	for _, r := range append(reqs, page) {
+		run.headerBytes += r.headerBytes
+		run.encodedBytes += r.encodedBytes
+	}
+	run.conns = conns.Load()
+	run.sent, run.received = sent.Load(), received.Load()
+	return run, nil
+}
+
+func benchRequest(u *url.URL, path string) *clientRequest {
+	ru := *u
+	ru.Path = path
+	return &clientRequest{
+		Method:  "GET",
+		URL:     &ru,
+		Headers: []HeaderField{{Name: "Accept", Value: "*/*"}, {Name: "Accept-Language", Value: "fr-FR,fr;q=0.9"}},
+	}
+}
+
+/**
+* Compare les protocoles, la compression des en-têtes est le rapport entre leur
+* taille en clair et leur taille une fois compressés par HPACK / QPACK
+*
+* ```
+* Protocole  Connexions  Établissement  TTFB    Total    Envoyés  Reçus   En-têtes
+* http1      3           2.1ms          3.0ms   6.2ms    2.1 Ko   9.8 Ko  614 o → 614 o (x1.00)
+* http2      1           1.9ms          2.6ms   3.4ms    1.3 Ko   6.2 Ko  541 o → 182 o (x2.97)
+* ```
+**/
+func printBenchResults(results []benchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Protocole\tConnexions\tÉtablissement\tTTFB\tTotal\tEnvoyés\tReçus\tEn-têtes")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%.4g\t%.1fms\t%.1fms\t%.1fms\t%s\t%s\t%s → %s (x%.2f)\n",
+			r.Protocol, r.Connections, r.SetupMs, r.TTFBMs, r.TotalMs,
+			formatBytes(r.BytesSent), formatBytes(r.BytesReceived),
+			formatBytes(int64(r.HeaderBytes)), formatBytes(int64(r.EncodedHeaderBytes)), r.CompressionRatio)
+	}
+	w.Flush()
+}
+
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%v o", n)
+	}
+	return fmt.Sprintf("%.1f Ko", float64(n)/1024)
+}
+
+func writeBenchReport(path string, report benchReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Compte les octets lus et écrits sur la connexion
+type countingConn struct {
+	net.Conn
+	sent, received *atomic.Int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+type countingPacketConn struct {
+	net.PacketConn
+	sent, received *atomic.Int64
+}
+
+func (c countingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.received.Add(int64(n))
+	return n, addr, err
+}
+
+func (c countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.sent.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPageResources(t *testing.T) {
+	paths, err := pageResources("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// La feuille de style déclarée par la page, puis le favicon demandé par le navigateur
+	if !slices.Equal(paths, []string{"/main.css", "/favicon.ico"}) {
+		t.Fatalf("ressources %v", paths)
+	}
+	if _, err := pageResources("absente.html"); err == nil {
+		t.Fatal("erreur attendue pour une page absente")
+	}
+}
+
+func TestNewBenchResult(t *testing.T) {
+	runs := []benchRun{
+		{conns: 1, setup: 2 * time.Millisecond, ttfb: 4 * time.Millisecond, total: 10 * time.Millisecond, sent: 100, received: 1000, headerBytes: 300, encodedBytes: 100},
+		{conns: 2, setup: 4 * time.Millisecond, ttfb: 6 * time.Millisecond, total: 20 * time.Millisecond, sent: 200, received: 3000, headerBytes: 300, encodedBytes: 50},
+	}
+	r := newBenchResult("http2", 3, runs)
+	want := benchResult{Protocol: "http2", Requests: 3, Connections: 1.5, SetupMs: 3, TTFBMs: 5, TotalMs: 15,
+		BytesSent: 150, BytesReceived: 2000, HeaderBytes: 300, EncodedHeaderBytes: 75, CompressionRatio: 4}
+	if r != want {
+		t.Fatalf("résultat %+v, %+v attendu", r, want)
+	}
+	// Sans en-têtes compressés le rapport reste nul
+	if r := newBenchResult("http1", 1, []benchRun{{}}); r.CompressionRatio != 0 {
+		t.Fatalf("rapport %v", r.CompressionRatio)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 o", 1023: "1023 o", 1024: "1.0 Ko", 2560: "2.5 Ko"} {
+		if s := formatBytes(n); s != want {
+			t.Errorf("formatBytes(%v) = %q, %q attendu", n, s, want)
+		}
+	}
+}
+
+func TestWriteBenchReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.json")
+	report := benchReport{Page: "index.html", Runs: 2, DelayMs: 25, Results: []benchResult{{Protocol: "http3", Requests: 3}}}
+	if err := writeBenchReport(path, report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read benchReport
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if read.Page != report.Page || read.DelayMs != 25 || len(read.Results) != 1 || read.Results[0].Protocol != "http3" {
+		t.Fatalf("rapport %+v", read)
+	}
+}
+
+// Chargement complet de la page sur les serveurs locaux, sans dégradation du réseau
+// Les serveurs ne s'arrêtent pas, le test est lancé dans un processus à part pour que
+// leurs connexions ne lisent pas les options modifiées par les tests suivants
+func TestBenchLoad(t *testing.T) {
+	if runInSubprocess(t) {
+		return
+	}
+	setOption(t, &benchOptions.page, "index.html")
+	setOption(t, &benchOptions.concurrency, 6)
+	setOption(t, &clientOptions.insecure, true)
+	setOption(t, &dialTCP, dialTCP)
+	setOption(t, &listenUDP, listenUDP)
+	resources, err := pageResources(benchOptions.page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := startBenchServers(impairment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, protocol := range []string{"http1", "http2", "http3"} {
+		t.Run(protocol, func(t *testing.T) {
+			run, err := benchLoad(protocol, servers[protocol], resources, impairment{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Une seule connexion multiplexée en HTTP/2 et HTTP/3
+			if run.conns < 1 || (protocol != "http1" && run.conns != 1) {
+				t.Errorf("%v connexions", run.conns)
+			}
+			if run.sent == 0 || run.received == 0 || run.ttfb <= 0 || run.total < run.ttfb {
+				t.Errorf("mesures %+v", run)
+			}
+			if run.headerBytes == 0 || (protocol != "http1" && run.encodedBytes >= run.headerBytes) {
+				t.Errorf("en-têtes %v octets, %v compressés", run.headerBytes, run.encodedBytes)
+			}
+		})
+	}
+}
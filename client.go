@@ -0,0 +1,790 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Commande client : envoie des requêtes en HTTP/1.1, HTTP/2 ou HTTP/3 avec les mêmes
+// codecs et le même affichage que le serveur (les requêtes restent en bleu)
+// Exemple : go run . client -proto http3 -k -n 3 https://localhost/
+var clientOptions struct {
+	protocol string
+	method   string
+	headers  headerFlags
+	body     string
+	count    int
+	insecure bool
+}
+
+func registerClientFlags(fs *flag.FlagSet) {
+	fs.StringVar(&clientOptions.protocol, "proto", "http2", "protocole utilisé (http1, http2 ou http3)")
+	fs.StringVar(&clientOptions.method, "X", "GET", "méthode de la requête")
+	fs.Var(&clientOptions.headers, "H", "en-tête ajouté à la requête (\"Nom: valeur\"), peut être répété")
+	fs.StringVar(&clientOptions.body, "d", "", "corps de la requête")
+	fs.IntVar(&clientOptions.count, "n", 1, "nombre de requêtes envoyées en parallèle")
+	fs.BoolVar(&clientOptions.insecure, "k", false, "accepte un certificat non vérifié (certificat local par exemple)")
+}
+
+const clientUserAgent = "gohttp"
+
+// En-têtes passés avec -H
+type headerFlags Header
+
+func (h *headerFlags) String() string {
+	var s []string
+	for _, f := range *h {
+		s = append(s, f.Name+": "+f.Value)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || !validFieldName(name) || !validFieldValue(value) {
+		return fmt.Errorf("en-tête invalide %q, format attendu \"Nom: valeur\"", v)
+	}
+	(*Header)(h).Add(name, value)
+	return nil
+}
+
+// Étape d'un échange et l'instant où elle se termine
+type clientPhase struct {
+	Name string
+	At   time.Duration
+}
+
+// En HTTP2 le premier octet de la réponse est marqué par la goroutine qui lit les frames,
+// parfois avant que la requête soit marquée comme envoyée
+type clientTimings struct {
+	start  time.Time
+	mu     sync.Mutex
+	phases []clientPhase
+}
+
+func newClientTimings() *clientTimings {
+	return &clientTimings{start: time.Now()}
+}
+
+func (tm *clientTimings) mark(name string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.phases = append(tm.phases, clientPhase{name, time.Since(tm.start)})
+}
+
+// Instant où l'étape s'est terminée, 0 si elle n'a pas eu lieu
+func (tm *clientTimings) at(name string) time.Duration {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for _, p := range tm.phases {
+		if p.Name == name {
+			return p.At
+		}
+	}
+	return 0
+}
+
+// Durée jusqu'à la dernière étape
+func (tm *clientTimings) elapsed() time.Duration {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if len(tm.phases) == 0 {
+		return 0
+	}
+	return tm.phases[len(tm.phases)-1].At
+}
+
+/**
+* Affiche la durée de chaque étape, depuis le début et depuis l'étape précédente
+*
+* ```
+* | DNS:              0.2ms (+0.2ms)
+* | TCP:              0.5ms (+0.3ms)
+* | TLS:              4.1ms (+3.6ms)
+* ```
+**/
+func printTimings(t *traceConn, stream uint64, tm *clientTimings) {
+	t.lock(stream)
+	defer t.unlock()
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tracef("+- TIMING\n")
+	var prev time.Duration
+	for _, p := range tm.phases {
+		tracef("| %-18s %8s (+%s)\n", p.Name+":", formatDuration(p.At), formatDuration(p.At-prev))
+		prev = p.At
+	}
+	tracef("|\n")
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+// Requête envoyée par la commande client
+type clientRequest struct {
+	Method  string
+	URL     *url.URL
+	Headers Header
+	Body    []byte
+
+	timings  *clientTimings
+	received bool
+	// Taille des en-têtes échangés, écrits en clair et une fois compressés
+	headerBytes  int
+	encodedBytes int
+
+	// Fin de la réponse lue par la connexion HTTP2
+	done chan struct{}
+	err  error
+}
+
+// Le premier octet de la réponse n'est compté qu'une fois
+func (r *clientRequest) firstByte() {
+	if !r.received {
+		r.received = true
+		r.timings.mark("premier octet")
+	}
+}
+
+// Comptabilise des en-têtes, leur taille compressée est connue une fois passés par
+// HPACK / QPACK (en HTTP1 ils sont envoyés en clair)
+func (r *clientRequest) countHeaders(fields []HeaderField) {
+	for _, h := range fields {
+		size := len(h.Name) + len(h.Value) + 4
+		r.headerBytes += size
+		if h.Encoding != nil {
+			size -= h.Encoding.Saved(h)
+		}
+		r.encodedBytes += size
+	}
+}
+
+// En-têtes HTTP2 / HTTP3 : les pseudo-en-têtes d'abord, les noms en minuscules
+func (r *clientRequest) fields() []HeaderField {
+	fields := []HeaderField{
+		{Name: ":method", Value: r.Method},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: r.URL.Host},
+		{Name: ":path", Value: r.URL.RequestURI()},
+		{Name: "user-agent", Value: clientUserAgent},
+	}
+	fields = append(fields, r.Headers.Fields()...)
+	if len(r.Body) > 0 {
+		fields = append(fields, HeaderField{Name: "content-length", Value: strconv.Itoa(len(r.Body))})
+	}
+	return fields
+}
+
+func runClient(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Utilisation : go run . client [options] <url>")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		log.Fatalf("URL invalide %q, seules les URL https:// sont acceptées", args[0])
+	}
+
+	reqs := make([]*clientRequest, max(clientOptions.count, 1))
+	for i := range reqs {
+		reqs[i] = &clientRequest{
+			Method:  clientOptions.method,
+			URL:     u,
+			Headers: Header(clientOptions.headers),
+			Body:    []byte(clientOptions.body),
+		}
+	}
+
+	conn, err := dialClient(u, clientOptions.protocol)
+	if err != nil {
+		log.Fatalf("Erreur : %v", err)
+	}
+	err = fetchAll(reqs, conn.fetch, len(reqs))
+	conn.close()
+	if err != nil {
+		log.Fatalf("Erreur : %v", err)
+	}
+}
+
+// Connexion utilisée par les requêtes du client
+type clientConn interface {
+	fetch(r *clientRequest) error
+	// Durée d'établissement de la (première) connexion
+	setupTime() time.Duration
+	close()
+}
+
+func dialClient(u *url.URL, protocol string) (clientConn, error) {
+	switch protocol {
+	case "http1":
+		return &h1Client{}, nil
+	case "http2":
+		return dialHTTP2(u)
+	case "http3":
+		return dialHTTP3(u)
+	}
+	return nil, fmt.Errorf("protocole invalide '%s'. http1, http2, http3 accepté", protocol)
+}
+
+// Lance les requêtes en parallèle (au plus concurrency à la fois) et renvoie la première
+// erreur rencontrée
+func fetchAll(reqs []*clientRequest, fetch func(*clientRequest) error, concurrency int) error {
+	errs := make(chan error, len(reqs))
+	slots := make(chan struct{}, max(concurrency, 1))
+	for _, r := range reqs {
+		go func() {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			errs <- fetch(r)
+		}()
+	}
+	var first error
+	for range reqs {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Ouverture des sockets du client, remplacée par la commande bench pour simuler
+// le réseau et compter les octets échangés
+var (
+	dialTCP   = func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+	listenUDP = func() (net.PacketConn, error) { return net.ListenUDP("udp", nil) }
+)
+
+func clientTLSConfig(u *url.URL, protocol string) *tls.Config {
+	return &tls.Config{
+		ServerName:         u.Hostname(),
+		NextProtos:         []string{protocol},
+		InsecureSkipVerify: clientOptions.insecure,
+		KeyLogWriter:       keyLogWriter(),
+	}
+}
+
+// Résout le nom du serveur (une adresse IPv4 de préférence), le port par défaut est 443
+func resolveAddr(u *url.URL, tm *clientTimings) (string, error) {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addrs, err := net.DefaultResolver.LookupHost(context.Background(), u.Hostname())
+	if err != nil {
+		return "", fmt.Errorf("impossible de résoudre %s, %w", u.Hostname(), err)
+	}
+	tm.mark("DNS")
+	addr := addrs[0]
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			addr = a
+			break
+		}
+	}
+	return net.JoinHostPort(addr, port), nil
+}
+
+// Ouvre une connexion TCP + TLS en négociant le protocole par ALPN
+func dialTLS(u *url.URL, protocol string, tm *clientTimings) (*tls.Conn, error) {
+	addr, err := resolveAddr(u, tm)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialTCP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("impossible de se connecter à %s, %w", addr, err)
+	}
+	tm.mark("TCP")
+	tc := tls.Client(conn, clientTLSConfig(u, protocol))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("échec du handshake TLS, %w", err)
+	}
+	tm.mark("TLS")
+	// Un serveur HTTP/1.1 peut ignorer ALPN
+	if p := tc.ConnectionState().NegotiatedProtocol; p != protocol && !(protocol == HTTP1 && p == "") {
+		tc.Close()
+		return nil, fmt.Errorf("le serveur n'a pas accepté %s (ALPN : %q)", protocol, p)
+	}
+	return tc, nil
+}
+
+// En HTTP1, chaque requête ouvre sa propre connexion, fermée par le serveur après la réponse
+type h1Client struct {
+	mu    sync.Mutex
+	setup time.Duration
+}
+
+func (c *h1Client) setupTime() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setup
+}
+
+func (c *h1Client) close() {}
+
+func (c *h1Client) fetch(r *clientRequest) error {
+	r.timings = newClientTimings()
+	conn, err := dialTLS(r.URL, HTTP1, r.timings)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.mu.Lock()
+	if c.setup == 0 {
+		c.setup = r.timings.elapsed()
+	}
+	c.mu.Unlock()
+	t := newTraceConn(HTTP1, conn.RemoteAddr().String())
+	t.Client = true
+	t.open(tlsState(conn))
+	defer t.close()
+
+	line := fmt.Sprintf("%s %s HTTP/1.1", r.Method, r.URL.RequestURI())
+	headers := []HeaderField{
+		{Name: "Host", Value: r.URL.Host},
+		{Name: "User-Agent", Value: clientUserAgent},
+		{Name: "Connection", Value: "close"},
+	}
+	headers = append(headers, r.Headers...)
+	if len(r.Body) > 0 {
+		headers = append(headers, HeaderField{Name: "Content-Length", Value: strconv.Itoa(len(r.Body))})
+	}
+
+	var b bytes.Buffer
+	b.WriteString(line + "\r\n")
+	printLine(t, line, false)
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.Name, h.Value)
+		printHeader(t, h.Name, h.Value, false)
+	}
+	b.WriteString("\r\n")
+	printLine(t, "", false)
+	b.Write(r.Body)
+	if len(r.Body) > 0 {
+		printLine(t, string(r.Body), false)
+	}
+	t.message(false, line, headers, nil, r.Body)
+	r.countHeaders(headers)
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+	r.timings.mark("requête envoyée")
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("impossible de lire la ligne de statut, %w", err)
+	}
+	r.firstByte()
+	status = strings.TrimSpace(status)
+	printLine(t, status, true)
+	var fields Header
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("impossible de lire les en-têtes, %w", err)
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			printLine(t, "", true)
+			break
+		}
+		if err := fields.parseLine(line); err != nil {
+			return err
+		}
+		h := fields[len(fields)-1]
+		printHeader(t, h.Name, h.Value, true)
+	}
+	r.countHeaders(fields)
+
+	// Sans taille ni chunks, le corps se termine avec la connexion
+	var body io.Reader = br
+	if strings.EqualFold(fields.Get("Transfer-Encoding"), "chunked") {
+		body = httputil.NewChunkedReader(br)
+	} else if n, err := strconv.ParseInt(fields.Get("Content-Length"), 10, 64); err == nil {
+		body = io.LimitReader(br, n)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("impossible de lire le corps de la réponse, %w", err)
+	}
+	printLine(t, fmt.Sprintf("... (%v octets)", len(data)), true)
+	t.message(true, status, fields, nil, data)
+	r.timings.mark("terminée")
+	printTimings(t, noStream, r.timings)
+	return nil
+}
+
+// Les requêtes HTTP2 partagent une connexion, chacune sur son propre stream (1, 3, 5...)
+// Les réponses sont lues en tâche de fond et remises aux requêtes qui les attendent
+type h2Client struct {
+	*h2Conn
+	conn    net.Conn
+	timings *clientTimings
+
+	// Les identifiants de stream doivent croître dans l'ordre d'envoi des HEADERS
+	sendMu sync.Mutex
+	nextID uint32
+
+	pendingMu sync.Mutex
+	pending   map[uint32]*clientRequest
+	// Fermé quand la connexion ne peut plus recevoir de réponse
+	closed chan struct{}
+	err    error
+}
+
+func dialHTTP2(u *url.URL) (*h2Client, error) {
+	tm := newClientTimings()
+	conn, err := dialTLS(u, HTTP2, tm)
+	if err != nil {
+		return nil, err
+	}
+	c := &h2Client{
+		h2Conn:  newH2Conn(conn, conn.RemoteAddr().String()),
+		conn:    conn,
+		timings: tm,
+		nextID:  1,
+		pending: make(map[uint32]*clientRequest),
+		closed:  make(chan struct{}),
+	}
+	c.trace.Client = true
+	c.decoder, c.encoder = newHeaderCodec()
+	c.trace.open(tlsState(conn))
+	printTimings(c.trace, noStream, tm)
+
+	// La connexion commence par la préface, suivie des SETTINGS du client
+	if _, err := io.WriteString(conn, h2Preface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.trace.lock(noStream)
+	dirColor(false).Printf("+- Preface : %q\n|\n", h2Preface)
+	c.trace.unlock()
+	err = c.writeFrame(Frame{
+		Type:     frameTypeSettings,
+		Settings: []H2Setting{{ID: h2SettingEnablePush, Value: 0}},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readResponses()
+	return c, nil
+}
+
+func (c *h2Client) setupTime() time.Duration {
+	return c.timings.elapsed()
+}
+
+func (c *h2Client) close() {
+	c.writeFrame(Frame{Type: frameTypeGoAway, ErrorCode: H2ErrCodeNoError})
+	c.conn.Close()
+	<-c.closed
+	c.trace.close()
+}
+
+func (c *h2Client) fetch(r *clientRequest) error {
+	r.timings = newClientTimings()
+	r.done = make(chan struct{})
+	fields := r.fields()
+
+	c.sendMu.Lock()
+	id := c.nextID
+	c.nextID += 2
+	c.pendingMu.Lock()
+	c.pending[id] = r
+	c.pendingMu.Unlock()
+	c.openWindow(id)
+	err := c.writeHeaders(id, len(r.Body) == 0, fields)
+	c.sendMu.Unlock()
+	if err != nil {
+		return err
+	}
+	r.countHeaders(fields)
+	if len(r.Body) > 0 {
+		if err := c.writeData(id, true, r.Body); err != nil {
+			return err
+		}
+	}
+	r.timings.mark("requête envoyée")
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-c.closed:
+		if c.err != nil {
+			return c.err
+		}
+		return errors.New("connexion fermée avant la fin de la réponse")
+	}
+}
+
+// Requête en attente sur le stream, retirée des requêtes en cours si end est vrai
+func (c *h2Client) request(id uint32, end bool) *clientRequest {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	r := c.pending[id]
+	if end {
+		delete(c.pending, id)
+	}
+	return r
+}
+
+func (c *h2Client) readResponses() {
+	c.err = c.readFrames()
+	c.closeWindows()
+	close(c.closed)
+}
+
+// Lit les frames du serveur jusqu'à la fermeture de la connexion
+func (c *h2Client) readFrames() error {
+	var pending *Frame
+	var block []byte
+	var fields []HeaderField
+	for {
+		f, err := NewFrame(c.conn, defaultMaxFrameSize)
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pending != nil && (f.Type != frameTypeContinuation || f.StreamID != pending.StreamID) {
+			return newH2Error(H2ErrCodeProtocolError, "CONTINUATION attendue sur le stream #%v, reçu %s", pending.StreamID, f.Type)
+		}
+		if req := c.request(f.StreamID, false); req != nil {
+			req.firstByte()
+		}
+
+		end := false
+		fields = nil
+		switch f.Type {
+		case frameTypeSettings:
+			c.printFrame(f, true)
+			if !f.Has(flagAck) {
+				if err := c.applySettings(f.Settings); err != nil {
+					return err
+				}
+				if err := c.writeFrame(Frame{Type: frameTypeSettings, Flags: flagAck}); err != nil {
+					return err
+				}
+			}
+		case frameTypeHeaders, frameTypeContinuation:
+			if f.Type == frameTypeContinuation && pending == nil {
+				return newH2Error(H2ErrCodeProtocolError, "CONTINUATION sans HEADERS")
+			}
+			if f.Type == frameTypeHeaders {
+				pending = &f
+				block = nil
+			}
+			block = append(block, f.BlockFragment...)
+			if !f.Has(flagEndHeaders) {
+				c.printFrame(f, true)
+				continue
+			}
+			fields, err = c.decoder.DecodeFull(block)
+			if err != nil {
+				return newH2Error(H2ErrCodeCompressionError, "impossible de décoder les en-têtes, %s", err.Error())
+			}
+			c.printFrame(f, true, fields...)
+			end = pending.Has(flagEndStream)
+			pending = nil
+		case frameTypeData:
+			c.printFrame(f, true)
+			if f.Length > 0 {
+				c.writeFrame(Frame{Type: frameTypeWindowUpdate, WindowIncrement: f.Length})
+				c.writeFrame(Frame{Type: frameTypeWindowUpdate, StreamID: f.StreamID, WindowIncrement: f.Length})
+			}
+			end = f.Has(flagEndStream)
+		case frameTypeRSTStream:
+			c.printFrame(f, true)
+			c.dropWindow(f.StreamID)
+			end = true
+		case frameTypeWindowUpdate:
+			c.printFrame(f, true)
+			if err := c.windowUpdate(f); err != nil {
+				if f.StreamID == 0 {
+					return err
+				}
+				c.resetStream(f.StreamID, err)
+				if req := c.request(f.StreamID, true); req != nil {
+					req.err = err
+					close(req.done)
+				}
+			}
+		case frameTypePing:
+			c.printFrame(f, true)
+			if !f.Has(flagAck) {
+				c.writeFrame(Frame{Type: frameTypePing, Flags: flagAck, PingData: f.PingData})
+			}
+		case frameTypeGoAway:
+			c.printFrame(f, true)
+			if f.ErrorCode != H2ErrCodeNoError {
+				return fmt.Errorf("connexion fermée par le serveur (%s)", f.ErrorCode)
+			}
+			return nil
+		default:
+			c.printFrame(f, true)
+		}
+
+		req := c.request(f.StreamID, end)
+		if req == nil {
+			continue
+		}
+		req.countHeaders(fields)
+		if end {
+			if f.Type == frameTypeRSTStream {
+				req.err = fmt.Errorf("stream #%v annulé par le serveur (%s)", f.StreamID, f.ErrorCode)
+			}
+			req.timings.mark("terminée")
+			printTimings(c.trace, uint64(f.StreamID), req.timings)
+			close(req.done)
+		}
+	}
+}
+
+// Paramètres annoncés par le client sur son flux de contrôle
+func clientSettings() SettingsFrame {
+	return SettingsFrame{Settings: []Setting{
+		{settingQPACKMaxTableCapacity, qpackMaxTableCapacity},
+		{settingQPACKBlockedStreams, qpackBlockedStreams},
+	}}
+}
+
+// Les requêtes HTTP3 partagent une connexion QUIC, chacune sur son propre stream bidirectionnel
+type h3Client struct {
+	*h3Conn
+	transport *quic.Transport
+	timings   *clientTimings
+}
+
+func dialHTTP3(u *url.URL) (*h3Client, error) {
+	tm := newClientTimings()
+	addr, err := resolveAddr(u, tm)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := listenUDP()
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer la connexion UDP, %w", err)
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	conn, err := tr.DialEarly(context.Background(), udpAddr, clientTLSConfig(u, HTTP3), quicConfig())
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, fmt.Errorf("impossible d'établir la connexion QUIC, %w", err)
+	}
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		tr.Close()
+		udpConn.Close()
+		return nil, context.Cause(conn.Context())
+	}
+	tm.mark("QUIC + TLS")
+
+	c := &h3Client{
+		h3Conn: &h3Conn{
+			EarlyConnection: conn,
+			sessions:        make(map[quic.StreamID]*wtSession),
+			peerStreams:     make(map[uint64]bool),
+			encoder:         NewQPACKEncoder(),
+			trace:           newTraceConn(HTTP3, conn.RemoteAddr().String()),
+		},
+		transport: tr,
+		timings:   tm,
+	}
+	c.trace.Client = true
+	c.encoder.trace = c.trace
+	c.trace.open(nil)
+	printQUICConnection(c.trace, conn)
+	printTimings(c.trace, noStream, tm)
+
+	if err := c.openControlStream(clientSettings()); err != nil {
+		c.close()
+		return nil, err
+	}
+	if err := c.openQPACKStreams(); err != nil {
+		c.close()
+		return nil, err
+	}
+	go c.listenUniStreams()
+	return c, nil
+}
+
+func (c *h3Client) setupTime() time.Duration {
+	return c.timings.elapsed()
+}
+
+func (c *h3Client) close() {
+	c.CloseWithError(quic.ApplicationErrorCode(ErrCodeNoError), "")
+	// Le transport ne ferme pas la connexion UDP qu'on lui a fournie
+	c.transport.Close()
+	c.transport.Conn.Close()
+	c.trace.close()
+}
+
+// Envoie une requête sur un nouveau stream et lit la réponse jusqu'à la fin du stream
+func (c *h3Conn) fetch(r *clientRequest) error {
+	r.timings = newClientTimings()
+	str, err := c.OpenStreamSync(context.Background())
+	if err != nil {
+		return fmt.Errorf("impossible d'ouvrir un stream %w", err)
+	}
+	fields := r.fields()
+	if err := c.writeHeaders(str, HeadersFrame{Headers: fields}); err != nil {
+		return err
+	}
+	r.countHeaders(fields)
+	if len(r.Body) > 0 {
+		df := DataFrame{Data: r.Body}
+		c.printFrame(str.StreamID(), df, false)
+		if err := df.Write(str); err != nil {
+			return err
+		}
+	}
+	// Fermer le sens client -> serveur indique la fin de la requête
+	str.Close()
+	r.timings.mark("requête envoyée")
+
+	fp := NewFrameParser(str, qpackStreamDecoder{c.decoder, uint64(str.StreamID())})
+	for {
+		f, err := fp.NextFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		r.firstByte()
+		c.printFrame(str.StreamID(), f, true)
+		if hf, ok := f.(HeadersFrame); ok {
+			r.countHeaders(hf.Headers)
+		}
+	}
+	r.timings.mark("terminée")
+	printTimings(c.trace, uint64(str.StreamID()), r.timings)
+	return nil
+}
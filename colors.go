@@ -8,3 +8,12 @@ var red = color.RGB(247, 118, 142)
 var redLight = color.RGB(255, 220, 242)
 var green = color.RGB(157, 204, 101)
 var blue = color.RGB(122, 162, 247)
+
+// Couleurs attribuées aux connexions (option -conn-colors)
+var connColors = []*color.Color{
+	color.RGB(224, 175, 104),
+	color.RGB(187, 154, 247),
+	color.RGB(125, 207, 255),
+	color.RGB(255, 158, 100),
+	color.RGB(115, 218, 202),
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression des fichiers servis selon l'en-tête Accept-Encoding du client
+// Un fichier précompressé (main.css.br par exemple) est envoyé tel quel s'il existe
+// Exemple : go run . http2 -compress-min 512
+var compressOptions struct {
+	enabled bool
+	minSize int
+}
+
+func registerCompressFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&compressOptions.enabled, "compress", true, "compresse les réponses selon l'en-tête Accept-Encoding (gzip, br, zstd)")
+	fs.IntVar(&compressOptions.minSize, "compress-min", 1024, "taille minimale (octets) d'un fichier compressé à la volée")
+}
+
+// Encodages pris en charge, par ordre de préférence du serveur à qualité égale
+var contentEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+/**
+* Lit un fichier du dossier root et choisit l'encodage à partir des préférences du client
+*
+* ```
+* Accept-Encoding: gzip;q=0.8, br, *;q=0.1
+* ```
+**/
+func loadStaticFile(root string, name string, acceptEncoding string) staticFile {
+	f := staticFile{Status: http.StatusOK, Path: name, ContentType: "text/" + getFileExtension(name)}
+	content, err := os.ReadFile(path.Join(root, name))
+	if err != nil {
+		log.Printf("Cannot read file %s", name)
+		return notFoundFile(name)
+	}
+	f.Body, f.Size = content, len(content)
+	if !compressOptions.enabled {
+		return f
+	}
+
+	// Les versions précompressées sont prioritaires, elles sont produites avec le meilleur niveau
+	var precompressed []string
+	for _, e := range contentEncodings {
+		if _, err := os.Stat(path.Join(root, name+e.ext)); err == nil {
+			precompressed = append(precompressed, e.name)
+		}
+	}
+	compressible := isCompressible(name) && len(content) >= compressOptions.minSize
+	f.Vary = compressible || len(precompressed) > 0
+	prefs := parseAcceptEncoding(acceptEncoding)
+	if encoding := negotiateEncoding(prefs, precompressed); encoding != "" {
+		data, err := os.ReadFile(path.Join(root, name+encodingExt(encoding)))
+		if err == nil {
+			f.Body, f.Encoding, f.Precompressed = data, encoding, true
+			return f
+		}
+	}
+	if compressible {
+		f.compress(prefs)
+	}
+	return f
+}
+
+// Compresse le contenu à la volée avec l'encodage préféré du client
+func (f *staticFile) compress(prefs []encodingPreference) {
+	f.Vary = true
+	encoding := negotiateEncoding(prefs, []string{"br", "zstd", "gzip"})
+	if encoding == "" {
+		return
+	}
+	data, err := compress(encoding, f.Body)
+	// Une compression inutile n'est pas envoyée
+	if err != nil || len(data) >= len(f.Body) {
+		return
+	}
+	f.Body, f.Encoding = data, encoding
+}
+
+/**
+* Taux de compression affiché à côté de la réponse
+*
+* ```
+* | Compression: br, 12.4 Ko → 3.1 Ko (25%, précompressé)
+* ```
+**/
+func printCompression(t *traceConn, stream uint64, f staticFile) {
+	if f.Encoding == "" {
+		return
+	}
+	t.lock(stream)
+	defer t.unlock()
+	detail := fmt.Sprintf("%v%%", len(f.Body)*100/max(f.Size, 1))
+	if f.Precompressed {
+		detail += ", précompressé"
+	}
+	dirColor(false).Printf("| Compression:")
+	tracef(" %s, %s → %s (%s)\n|\n", f.Encoding, formatBytes(int64(f.Size)), formatBytes(int64(len(f.Body))), detail)
+}
+
+// Les formats déjà compressés (images, vidéos, polices woff2...) ne gagnent rien à l'être à nouveau
+func isCompressible(name string) bool {
+	contentType, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(name)), ";")
+	switch {
+	case strings.HasPrefix(contentType, "text/"):
+		return true
+	case strings.HasSuffix(contentType, "+xml"), strings.HasSuffix(contentType, "+json"):
+		return true
+	}
+	return slices.Contains([]string{
+		"application/javascript", "application/json", "application/xml",
+		"application/wasm", "image/x-icon", "image/vnd.microsoft.icon",
+	}, contentType)
+}
+
+type encodingPreference struct {
+	name string
+	q    float64
+}
+
+// Lit les encodages acceptés et leur qualité (1 par défaut)
+func parseAcceptEncoding(header string) []encodingPreference {
+	var prefs []encodingPreference
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		prefs = append(prefs, encodingPreference{name, q})
+	}
+	return prefs
+}
+
+// Choisit l'encodage de plus grande qualité parmi ceux disponibles, vide pour envoyer le contenu
+// tel quel (encodages refusés avec q=0, ou identity préférée)
+func negotiateEncoding(prefs []encodingPreference, available []string) string {
+	quality := func(name string) float64 {
+		wildcard := -1.0
+		for _, p := range prefs {
+			if p.name == name {
+				return p.q
+			}
+			if p.name == "*" {
+				wildcard = p.q
+			}
+		}
+		if wildcard >= 0 {
+			return wildcard
+		}
+		// Sans mention explicite, identity reste acceptable et les autres encodages non
+		if name == "identity" {
+			return 0.001
+		}
+		return 0
+	}
+	best, bestQ := "", 0.0
+	for _, e := range contentEncodings {
+		if !slices.Contains(available, e.name) {
+			continue
+		}
+		if q := quality(e.name); q > bestQ {
+			best, bestQ = e.name, q
+		}
+	}
+	if quality("identity") > bestQ {
+		return ""
+	}
+	return best
+}
+
+func encodingExt(encoding string) string {
+	for _, e := range contentEncodings {
+		if e.name == encoding {
+			return e.ext
+		}
+	}
+	return ""
+}
+
+func compress(encoding string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("encodage %q non pris en charge", encoding)
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	all := []string{"br", "zstd", "gzip"}
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		available      []string
+		encoding       string
+	}{
+		{"sans en-tête", "", all, ""},
+		{"un encodage", "gzip", all, "gzip"},
+		{"préférence du serveur à qualité égale", "gzip, zstd, br", all, "br"},
+		{"qualité", "gzip;q=1, br;q=0.5", all, "gzip"},
+		{"qualité avec espaces", "br ; q=0.2 , gzip ; q=0.9", all, "gzip"},
+		{"casse", "GZIP;Q=0.5, br;q=0.1", all, "gzip"},
+		{"encodage refusé", "br;q=0, gzip", all, "gzip"},
+		{"qualité invalide", "gzip;q=2, br;q=0.5", all, "gzip"},
+		{"encodage inconnu", "compress, deflate", all, ""},
+		{"joker", "*", all, "br"},
+		{"joker moins bien noté", "*;q=0.5, gzip;q=0.8", all, "gzip"},
+		{"joker avec un refus", "*, br;q=0", all, "zstd"},
+		{"joker refusé", "*;q=0", all, ""},
+		{"identity préférée", "gzip;q=0.5, identity", all, ""},
+		{"identity par le joker", "gzip;q=0.5, *", []string{"gzip"}, ""},
+		{"identity refusée", "gzip;q=0.1, identity;q=0", all, "gzip"},
+		{"identity seule refusée", "identity;q=0", all, ""},
+		{"seulement un précompressé", "br, gzip;q=0.5", []string{"gzip"}, "gzip"},
+		{"aucun précompressé", "br, gzip", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if encoding := negotiateEncoding(parseAcceptEncoding(tt.acceptEncoding), tt.available); encoding != tt.encoding {
+				t.Errorf("encodage %q, %q attendu", encoding, tt.encoding)
+			}
+		})
+	}
+}
+
+// Les fichiers précompressés sont préférés, sinon le fichier est compressé à la volée
+func TestLoadStaticFileEncoding(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"small.css":    "body{}",
+		"small.css.gz": "gzip précompressé",
+		"app.js":       strings.Repeat("console.log('gohttp');\n", 200),
+		"app.js.br":    "br précompressé",
+		"logo.png":     strings.Repeat("\x89PNG", 500),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name           string
+		file           string
+		acceptEncoding string
+		encoding       string
+		precompressed  bool
+		vary           bool
+	}{
+		{"précompressé", "small.css", "br, gzip", "gzip", true, true},
+		{"petit fichier sans précompressé", "small.css", "br", "", false, true},
+		{"précompressé préféré", "app.js", "gzip, br", "br", true, true},
+		{"compressé à la volée", "app.js", "gzip, zstd;q=0.5", "gzip", false, true},
+		{"sans Accept-Encoding", "app.js", "", "", false, true},
+		{"format déjà compressé", "logo.png", "gzip", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := loadStaticFile(root, tt.file, tt.acceptEncoding)
+			if f.Encoding != tt.encoding || f.Precompressed != tt.precompressed || f.Vary != tt.vary {
+				t.Fatalf("encodage %q, précompressé %v, Vary %v", f.Encoding, f.Precompressed, f.Vary)
+			}
+			if tt.precompressed && string(f.Body) != files[tt.file+encodingExt(tt.encoding)] {
+				t.Errorf("corps %q, fichier précompressé attendu", f.Body)
+			}
+			if tt.encoding == "" && string(f.Body) != files[tt.file] {
+				t.Errorf("corps modifié sans encodage")
+			}
+			if f.Size != len(files[tt.file]) {
+				t.Errorf("taille %v, %v attendue", f.Size, len(files[tt.file]))
+			}
+		})
+	}
+}
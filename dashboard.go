@@ -0,0 +1,289 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tableau de bord web affichant les traces en direct, servi sur un port séparé en HTTP/1.1
+// Exemple : go run . http2 -ui localhost:8080 puis ouvrir http://localhost:8080
+var uiOptions struct {
+	addr string
+}
+
+func registerUIFlags(fs *flag.FlagSet) {
+	fs.StringVar(&uiOptions.addr, "ui", "", "adresse du tableau de bord web (ex: localhost:8080), désactivé si vide")
+}
+
+//go:embed ui/index.html
+var dashboardPage []byte
+
+// Chemin du flux Server-Sent Events transportant les traces
+const tracesPath = "/traces"
+
+// Évènements conservés pour les onglets ouverts après le début des échanges
+const traceHistorySize = 2000
+
+// Au-delà, les données (corps, frame DATA) ne sont pas transmises en entier
+const traceMaxDataBytes = 4096
+
+// Évènement de trace : une frame, un message HTTP1 ou l'ouverture / fermeture d'une connexion
+type TraceEvent struct {
+	Seq      uint64        `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Conn     uint64        `json:"conn"`
+	Protocol string        `json:"protocol"`
+	Stream   uint64        `json:"stream"`
+	In       bool          `json:"in"`
+	Type     string        `json:"type"`
+	Summary  string        `json:"summary,omitempty"`
+	Headers  []traceHeader `json:"headers,omitempty"`
+	Fields   []traceField  `json:"fields,omitempty"`
+	Data     string        `json:"data,omitempty"`
+}
+
+type traceHeader struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Champ du message brut, équivalent de l'affichage -hex
+type traceField struct {
+	Label string `json:"label"`
+	Hex   string `json:"hex"`
+	More  int    `json:"more,omitempty"`
+}
+
+func (t *traceConn) publish(e TraceEvent) {
+	e.Conn = t.ID
+	e.Protocol = t.Protocol
+	// Côté client, une flèche → désigne aussi une requête
+	if t.Client && e.Type != "OPEN" {
+		e.In = !e.In
+	}
+	traces.publish(e)
+}
+
+// Frame HTTP2, fields contient les en-têtes décodés du bloc HPACK
+func (t *traceConn) frame(f Frame, in bool, fields []HeaderField) {
+	if !traces.enabled() {
+		return
+	}
+	e := TraceEvent{
+		Stream:  uint64(f.StreamID),
+		In:      in,
+		Type:    f.Type.String(),
+		Summary: f.flagNames(),
+		Headers: traceHeaders(fields),
+		Fields:  traceFields(f.hexFields(fields)),
+	}
+	switch f.Type {
+	case frameTypeData:
+		e.Summary = fmt.Sprintf("%v octets %s", len(f.Data), e.Summary)
+		e.Data = traceData(f.Data)
+	case frameTypeWindowUpdate:
+		e.Summary = fmt.Sprintf("+%v", f.WindowIncrement)
+	case frameTypeRSTStream:
+		e.Summary = f.ErrorCode.String()
+	case frameTypeGoAway:
+		e.Summary = fmt.Sprintf("%s (dernier stream #%v)", f.ErrorCode, f.LastStreamID)
+		e.Data = string(f.DebugData)
+	}
+	t.publish(e)
+}
+
+// Frame HTTP3 reçue ou envoyée sur le stream QUIC indiqué
+func (t *traceConn) h3Frame(stream uint64, f interface{}, in bool) {
+	if !traces.enabled() {
+		return
+	}
+	e := TraceEvent{
+		Stream: stream,
+		In:     in,
+		Type:   frameName(f),
+		Fields: traceFields(h3HexFields(f)),
+	}
+	switch f := f.(type) {
+	case HeadersFrame:
+		e.Headers = traceHeaders(f.Headers)
+	case DataFrame:
+		e.Summary = fmt.Sprintf("%v octets", len(f.Data))
+		e.Data = traceData(f.Data)
+	case GoAwayFrame:
+		e.Summary = fmt.Sprintf("#%v", f.ID)
+	}
+	t.publish(e)
+}
+
+// Requête ou réponse HTTP1, line contient la ligne de requête ou de statut
+func (t *traceConn) message(in bool, line string, headers []HeaderField, dump []hexField, body []byte) {
+	if !traces.enabled() {
+		return
+	}
+	kind := "RESPONSE"
+	if in != t.Client {
+		kind = "REQUEST"
+	}
+	t.publish(TraceEvent{
+		In:      in,
+		Type:    kind,
+		Summary: line,
+		Headers: traceHeaders(headers),
+		Fields:  traceFields(dump),
+		Data:    traceData(body),
+	})
+}
+
+func traceHeaders(fields []HeaderField) []traceHeader {
+	var out []traceHeader
+	for _, h := range fields {
+		th := traceHeader{Name: h.Name, Value: h.Value}
+		if h.Encoding != nil {
+			th.Encoding = h.Encoding.String()
+		}
+		out = append(out, th)
+	}
+	return out
+}
+
+func traceFields(fields []hexField) []traceField {
+	var out []traceField
+	for _, f := range fields {
+		b := f.Bytes
+		if len(b) > traceMaxDataBytes {
+			b = b[:traceMaxDataBytes]
+		}
+		out = append(out, traceField{Label: f.Label, Hex: fmt.Sprintf("% x", b), More: len(f.Bytes) - len(b)})
+	}
+	return out
+}
+
+func traceData(b []byte) string {
+	if len(b) > traceMaxDataBytes {
+		return string(b[:traceMaxDataBytes]) + "..."
+	}
+	return string(b)
+}
+
+// Diffuse les évènements aux onglets connectés, un onglet trop lent perd des évènements
+// plutôt que de bloquer le serveur
+type traceBroker struct {
+	mu          sync.Mutex
+	seq         uint64
+	history     []TraceEvent
+	subscribers map[chan TraceEvent]bool
+}
+
+var traces = &traceBroker{subscribers: make(map[chan TraceEvent]bool)}
+
+func (b *traceBroker) enabled() bool {
+	return uiOptions.addr != ""
+}
+
+func (b *traceBroker) publish(e TraceEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	e.Time = time.Now()
+	b.history = append(b.history, e)
+	if len(b.history) > traceHistorySize {
+		b.history = b.history[len(b.history)-traceHistorySize:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Abonne un onglet, les évènements déjà émis après lastSeq sont renvoyés pour rattraper le retard
+func (b *traceBroker) subscribe(lastSeq uint64) (chan TraceEvent, []TraceEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan TraceEvent, 256)
+	b.subscribers[ch] = true
+	var missed []TraceEvent
+	for _, e := range b.history {
+		if e.Seq > lastSeq {
+			missed = append(missed, e)
+		}
+	}
+	return ch, missed
+}
+
+func (b *traceBroker) unsubscribe(ch chan TraceEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// Lance le serveur du tableau de bord, la page reçoit les traces par Server-Sent Events
+func serveDashboard(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	mux.HandleFunc(tracesPath, serveTraces)
+	fmt.Printf("📊 Tableau de bord sur http://%s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("impossible de lancer le tableau de bord %v", err)
+	}
+}
+
+func serveTraces(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming non supporté", http.StatusInternalServerError)
+		return
+	}
+	lastSeq, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	ch, missed := traces.subscribe(lastSeq)
+	defer traces.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(e TraceEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		ev := Event{ID: strconv.FormatUint(e.Seq, 10), Event: "trace", Data: string(data)}
+		if _, err := w.Write(ev.Bytes()); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for _, e := range missed {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case e := <-ch:
+			if err := send(e); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
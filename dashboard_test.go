@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Remplace le diffuseur global le temps du test, les traces ne sont publiées qu'avec -ui
+func newTestBroker(t *testing.T) *traceBroker {
+	b := &traceBroker{subscribers: make(map[chan TraceEvent]bool)}
+	setOption(t, &traces, b)
+	setOption(t, &uiOptions.addr, "localhost:0")
+	return b
+}
+
+func TestTraceBroker(t *testing.T) {
+	b := newTestBroker(t)
+	for i := 0; i < 3; i++ {
+		b.publish(TraceEvent{Type: "DATA"})
+	}
+	// Un onglet qui se reconnecte reçoit les évènements manqués depuis Last-Event-ID
+	ch, missed := b.subscribe(1)
+	defer b.unsubscribe(ch)
+	if len(missed) != 2 || missed[0].Seq != 2 || missed[1].Seq != 3 {
+		t.Fatalf("évènements manqués %v", missed)
+	}
+	b.publish(TraceEvent{Type: "PING"})
+	if e := <-ch; e.Seq != 4 || e.Type != "PING" {
+		t.Fatalf("évènement %v", e)
+	}
+
+	// Un onglet qui ne lit pas ne bloque pas la publication, l'historique reste borné
+	for i := 0; i < traceHistorySize+10; i++ {
+		b.publish(TraceEvent{Type: "DATA"})
+	}
+	if len(b.history) != traceHistorySize || b.history[0].Seq != 15 {
+		t.Fatalf("historique de %v évènements commençant à %v", len(b.history), b.history[0].Seq)
+	}
+}
+
+func TestTraceEvents(t *testing.T) {
+	b := newTestBroker(t)
+	server := newTraceConn(HTTP2, "test")
+	server.frame(Frame{Type: frameTypeData, Flags: flagEndStream, StreamID: 3, Data: []byte("bonjour")}, false, nil)
+	server.frame(Frame{Type: frameTypeGoAway, ErrorCode: H2ErrCodeProtocolError, LastStreamID: 5, DebugData: []byte("raison")}, false, nil)
+
+	client := newTraceConn(HTTP1, "test")
+	client.Client = true
+	client.message(false, "GET / HTTP/1.1", fieldsOf("Host", "localhost"), nil, nil)
+	client.message(true, "HTTP/1.1 200 OK", nil, nil, bytes.Repeat([]byte("a"), traceMaxDataBytes+1))
+
+	tests := []TraceEvent{
+		{Conn: server.ID, Protocol: HTTP2, Stream: 3, Type: "DATA", Summary: "7 octets END_STREAM", Data: "bonjour"},
+		{Conn: server.ID, Protocol: HTTP2, Type: "GOAWAY", Summary: "PROTOCOL_ERROR (dernier stream #5)", Data: "raison"},
+		// Côté client la requête envoyée est affichée comme une requête reçue par un serveur
+		{Conn: client.ID, Protocol: HTTP1, In: true, Type: "REQUEST", Summary: "GET / HTTP/1.1"},
+		{Conn: client.ID, Protocol: HTTP1, Type: "RESPONSE", Summary: "HTTP/1.1 200 OK", Data: strings.Repeat("a", traceMaxDataBytes) + "..."},
+	}
+	if len(b.history) != len(tests) {
+		t.Fatalf("%v évènements, %v attendus", len(b.history), len(tests))
+	}
+	for i, want := range tests {
+		e := b.history[i]
+		if e.Conn != want.Conn || e.Protocol != want.Protocol || e.Stream != want.Stream || e.In != want.In ||
+			e.Type != want.Type || e.Summary != want.Summary || e.Data != want.Data {
+			t.Errorf("évènement %v : %+v", i, e)
+		}
+	}
+	if len(b.history[0].Fields) == 0 || b.history[0].Fields[0].Label != "Length (7)" {
+		t.Errorf("champs %v", b.history[0].Fields)
+	}
+	if h := b.history[2].Headers; len(h) != 1 || h[0].Name != "Host" {
+		t.Errorf("en-têtes %v", h)
+	}
+}
+
+func TestTraceFields(t *testing.T) {
+	fields := traceFields([]hexField{{"Type", []byte{0x01}}, {"Data", make([]byte, traceMaxDataBytes+3)}})
+	if fields[0].Hex != "01" || fields[0].More != 0 {
+		t.Errorf("champ %+v", fields[0])
+	}
+	if fields[1].More != 3 || len(fields[1].Hex) != traceMaxDataBytes*3-1 {
+		t.Errorf("champ de %v caractères, %v octets de plus", len(fields[1].Hex), fields[1].More)
+	}
+}
+
+// Le flux SSE du tableau de bord reprend après Last-Event-ID
+func TestServeTraces(t *testing.T) {
+	b := newTestBroker(t)
+	b.publish(TraceEvent{Type: "OPEN"})
+	b.publish(TraceEvent{Type: "HEADERS"})
+
+	server := httptest.NewServer(http.HandlerFunc(serveTraces))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+tracesPath, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("type %q", resp.Header.Get("Content-Type"))
+	}
+
+	br := bufio.NewReader(resp.Body)
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\n" {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if len(lines) != 3 || lines[0] != "id: 2" || lines[1] != "event: trace" {
+		t.Fatalf("évènement %q", lines)
+	}
+	var e TraceEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e); err != nil || e.Seq != 2 || e.Type != "HEADERS" {
+		t.Fatalf("évènement %+v (%v)", e, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Endpoint Server-Sent Events
+// Pour tester : curl -N --insecure https://localhost/events (ou public/events.html)
+const eventsPath = "/events"
+
+// Nombre d'évènements envoyés avant que le serveur ne ferme le flux,
+// le navigateur se reconnecte ensuite en envoyant Last-Event-ID
+const eventsPerStream = 20
+
+const eventsInterval = 500 * time.Millisecond
+
+// Délai de reconnexion (en ms) communiqué au client
+const eventsRetry = 3000
+
+// Évènement au format text/event-stream
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry int
+}
+
+/**
+* Sérialise l'évènement, chaque champ occupe une ligne et une ligne vide termine l'évènement
+*
+* ```
+* id: 3
+* event: tick
+* data: 15:04:05
+*
+* ```
+**/
+func (e Event) Bytes() []byte {
+	var b strings.Builder
+	if e.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry)
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// Émet des évènements à intervalle régulier, chaque évènement correspond à une écriture
+// (chunk en HTTP/1.1, frame DATA en HTTP/2 et HTTP/3)
+func serveEvents(w io.Writer, lastEventID string, t *traceConn, stream uint64) error {
+	id, _ := strconv.Atoi(lastEventID)
+	ticker := time.NewTicker(eventsInterval)
+	defer ticker.Stop()
+
+	for i := 0; i < eventsPerStream; i++ {
+		id++
+		e := Event{
+			ID:    strconv.Itoa(id),
+			Event: "tick",
+			Data:  time.Now().Format(time.TimeOnly),
+		}
+		// Le premier évènement indique le délai de reconnexion
+		if i == 0 {
+			e.Retry = eventsRetry
+		}
+		printEvent(t, stream, e)
+		if _, err := w.Write(e.Bytes()); err != nil {
+			return err
+		}
+		<-ticker.C
+	}
+	return nil
+}
+
+func printEvent(t *traceConn, stream uint64, e Event) {
+	t.lock(stream)
+	defer t.unlock()
+	color := dirColor(false)
+	defer color.Printf("|\n")
+	color.Printf("+- EVENT %s", e.Event)
+	tracef(" #%s", e.ID)
+	tracef("\n")
+	if e.Retry > 0 {
+		printKeyValue("retry", e.Retry, false)
+	}
+	printKeyValue("data", e.Data, false)
+}
+
+// Corps HTTP/1.1 envoyé en "Transfer-Encoding: chunked"
+// Chaque chunk contient sa taille en hexadécimal suivie des données, un chunk vide termine le corps
+type chunkedWriter struct {
+	w io.Writer
+	t *traceConn
+}
+
+func (c chunkedWriter) Write(p []byte) (int, error) {
+	printLine(c.t, fmt.Sprintf("%x", len(p)), false)
+	if _, err := fmt.Fprintf(c.w, "%x\r\n%s\r\n", len(p), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c chunkedWriter) Close() error {
+	printLine(c.t, "0", false)
+	_, err := io.WriteString(c.w, "0\r\n\r\n")
+	return err
+}
+
+// Réponse HTTP/3 envoyée sous forme d'une frame DATA par écriture
+type h3DataWriter struct {
+	c   *h3Conn
+	str quic.Stream
+}
+
+func (d h3DataWriter) Write(p []byte) (int, error) {
+	f := DataFrame{Data: p}
+	d.c.printFrame(d.str.StreamID(), f, false)
+	if err := f.Write(d.str); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
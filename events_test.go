@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httputil"
+	"testing"
+)
+
+func TestEventBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{"données seules", Event{Data: "bonjour"}, "data: bonjour\n\n"},
+		{"tous les champs", Event{ID: "3", Event: "tick", Retry: 3000, Data: "15:04:05"}, "id: 3\nevent: tick\nretry: 3000\ndata: 15:04:05\n\n"},
+		{"données sur plusieurs lignes", Event{Data: "a\nb"}, "data: a\ndata: b\n\n"},
+		{"données vides", Event{ID: "1"}, "id: 1\ndata: \n\n"},
+	}
+	for _, tt := range tests {
+		if b := string(tt.event.Bytes()); b != tt.want {
+			t.Errorf("%s : %q, %q attendu", tt.name, b, tt.want)
+		}
+	}
+}
+
+// Écrivain qui échoue après un certain nombre d'écritures, comme un client qui se déconnecte
+type failingWriter struct {
+	writes [][]byte
+	max    int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(w.writes) == w.max {
+		return 0, io.ErrClosedPipe
+	}
+	w.writes = append(w.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+// Le flux reprend après Last-Event-ID et s'arrête quand le client n'écoute plus
+func TestServeEvents(t *testing.T) {
+	w := &failingWriter{max: 2}
+	err := serveEvents(w, "41", newTraceConn(HTTP1, "test"), noStream)
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("erreur %v", err)
+	}
+	if len(w.writes) != 2 {
+		t.Fatalf("%v écritures, une par évènement attendue", len(w.writes))
+	}
+	first, second := string(w.writes[0]), string(w.writes[1])
+	if !bytes.HasPrefix(w.writes[0], []byte("id: 42\nevent: tick\nretry: 3000\n")) {
+		t.Errorf("premier évènement %q", first)
+	}
+	if !bytes.HasPrefix(w.writes[1], []byte("id: 43\nevent: tick\ndata: ")) {
+		t.Errorf("second évènement %q", second)
+	}
+}
+
+func TestChunkedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := chunkedWriter{w: &buf, t: newTraceConn(HTTP1, "test")}
+	events := []string{"data: 1\n\n", "data: deux\n\n"}
+	for _, e := range events {
+		w.Write([]byte(e))
+	}
+	w.Close()
+	if want := "9\r\ndata: 1\n\n\r\nc\r\ndata: deux\n\n\r\n0\r\n\r\n"; buf.String() != want {
+		t.Fatalf("corps %q, %q attendu", buf.String(), want)
+	}
+	body, err := io.ReadAll(httputil.NewChunkedReader(&buf))
+	if err != nil || string(body) != events[0]+events[1] {
+		t.Fatalf("corps décodé %q (%v)", body, err)
+	}
+}
+
+// Chaque évènement part dans sa propre frame DATA en HTTP/3
+func TestH3DataWriter(t *testing.T) {
+	str := &h3TestStream{}
+	w := h3DataWriter{c: newH3TestConn(t), str: str}
+	w.Write([]byte("data: 1\n\n"))
+	w.Write([]byte("data: 2\n\n"))
+	fp := NewFrameParser(&str.response, nil)
+	for _, want := range []string{"data: 1\n\n", "data: 2\n\n"} {
+		f, err := fp.NextFrame()
+		if df, ok := f.(DataFrame); err != nil || !ok || string(df.Data) != want {
+			t.Fatalf("frame %#v, DATA %q attendue (%v)", f, want, err)
+		}
+	}
+}
@@ -1,105 +1,430 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 )
 
-const frameTypeSetting = 0x04
+// https://httpwg.org/specs/rfc9113.html#FrameTypes
 
-// https://httpwg.org/specs/rfc7540.html#ConnectionHeader
+type FrameType uint8
 
-func readByte(r io.Reader) (byte, error) {
-	bytes, err := readBytes(r, 1)
-	if err != nil {
-		return 0, err
+const (
+	frameTypeData         FrameType = 0x00
+	frameTypeHeaders      FrameType = 0x01
+	frameTypePriority     FrameType = 0x02
+	frameTypeRSTStream    FrameType = 0x03
+	frameTypeSettings     FrameType = 0x04
+	frameTypePushPromise  FrameType = 0x05
+	frameTypePing         FrameType = 0x06
+	frameTypeGoAway       FrameType = 0x07
+	frameTypeWindowUpdate FrameType = 0x08
+	frameTypeContinuation FrameType = 0x09
+)
+
+var frameTypeNames = map[FrameType]string{
+	frameTypeData:         "DATA",
+	frameTypeHeaders:      "HEADERS",
+	frameTypePriority:     "PRIORITY",
+	frameTypeRSTStream:    "RST_STREAM",
+	frameTypeSettings:     "SETTINGS",
+	frameTypePushPromise:  "PUSH_PROMISE",
+	frameTypePing:         "PING",
+	frameTypeGoAway:       "GOAWAY",
+	frameTypeWindowUpdate: "WINDOW_UPDATE",
+	frameTypeContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
 	}
+	return fmt.Sprintf("UNKNOWN_%#x", uint8(t))
+}
 
-	return bytes[0], nil
+// Un même bit a une signification différente selon le type de frame
+const (
+	flagEndStream  = 0x01
+	flagAck        = 0x01
+	flagEndHeaders = 0x04
+	flagPadded     = 0x08
+	flagPriority   = 0x20
+)
+
+// Taille de l'en-tête commun à toutes les frames
+const frameHeaderLength = 9
+
+// Taille maximale d'une frame tant que le pair n'a pas annoncé SETTINGS_MAX_FRAME_SIZE
+const defaultMaxFrameSize = 1 << 14
+
+// Limite haute de SETTINGS_MAX_FRAME_SIZE (longueur codée sur 24 bits)
+const maxFrameSizeLimit = 1<<24 - 1
+
+// Fenêtre de contrôle de flux d'une connexion, et d'un stream tant que le pair
+// n'a pas annoncé SETTINGS_INITIAL_WINDOW_SIZE
+const defaultInitialWindowSize = 1<<16 - 1
+
+// Une fenêtre ne peut pas dépasser 2^31-1 octets
+const maxWindowSize = 1<<31 - 1
+
+// Identifiants des paramètres SETTINGS
+const (
+	h2SettingHeaderTableSize       = 0x1
+	h2SettingEnablePush            = 0x2
+	h2SettingMaxConcurrentStreams  = 0x3
+	h2SettingInitialWindowSize     = 0x4
+	h2SettingMaxFrameSize          = 0x5
+	h2SettingMaxHeaderListSize     = 0x6
+	h2SettingEnableConnectProtocol = 0x8
+)
+
+var h2SettingNames = map[uint16]string{
+	h2SettingHeaderTableSize:       "HEADER_TABLE_SIZE",
+	h2SettingEnablePush:            "ENABLE_PUSH",
+	h2SettingMaxConcurrentStreams:  "MAX_CONCURRENT_STREAMS",
+	h2SettingInitialWindowSize:     "INITIAL_WINDOW_SIZE",
+	h2SettingMaxFrameSize:          "MAX_FRAME_SIZE",
+	h2SettingMaxHeaderListSize:     "MAX_HEADER_LIST_SIZE",
+	h2SettingEnableConnectProtocol: "ENABLE_CONNECT_PROTOCOL",
 }
 
-type Frame struct {
-	Length     int32
-	Type       []byte
-	Flags      []byte
-	R          byte
-	Identifier []byte
-	Payload    []byte
+type H2ErrCode uint32
+
+const (
+	H2ErrCodeNoError            H2ErrCode = 0x0
+	H2ErrCodeProtocolError      H2ErrCode = 0x1
+	H2ErrCodeInternalError      H2ErrCode = 0x2
+	H2ErrCodeFlowControlError   H2ErrCode = 0x3
+	H2ErrCodeSettingsTimeout    H2ErrCode = 0x4
+	H2ErrCodeStreamClosed       H2ErrCode = 0x5
+	H2ErrCodeFrameSizeError     H2ErrCode = 0x6
+	H2ErrCodeRefusedStream      H2ErrCode = 0x7
+	H2ErrCodeCancel             H2ErrCode = 0x8
+	H2ErrCodeCompressionError   H2ErrCode = 0x9
+	H2ErrCodeConnectError       H2ErrCode = 0xa
+	H2ErrCodeEnhanceYourCalm    H2ErrCode = 0xb
+	H2ErrCodeInadequateSecurity H2ErrCode = 0xc
+	H2ErrCodeHTTP11Required     H2ErrCode = 0xd
+)
+
+var h2ErrCodeNames = map[H2ErrCode]string{
+	H2ErrCodeNoError:            "NO_ERROR",
+	H2ErrCodeProtocolError:      "PROTOCOL_ERROR",
+	H2ErrCodeInternalError:      "INTERNAL_ERROR",
+	H2ErrCodeFlowControlError:   "FLOW_CONTROL_ERROR",
+	H2ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	H2ErrCodeStreamClosed:       "STREAM_CLOSED",
+	H2ErrCodeFrameSizeError:     "FRAME_SIZE_ERROR",
+	H2ErrCodeRefusedStream:      "REFUSED_STREAM",
+	H2ErrCodeCancel:             "CANCEL",
+	H2ErrCodeCompressionError:   "COMPRESSION_ERROR",
+	H2ErrCodeConnectError:       "CONNECT_ERROR",
+	H2ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	H2ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	H2ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
 }
 
-func NewFrame(r io.Reader) interface{} {
-	length, err := readUint24(r)
-	if err != nil {
-		log.Println("Cannot read length for the frame")
-	}
-	frameType, err := readByte(r)
-	if err != nil {
-		log.Println("Cannot read length for the frame")
+func (e H2ErrCode) String() string {
+	if name, ok := h2ErrCodeNames[e]; ok {
+		return name
 	}
+	return fmt.Sprintf("UNKNOWN_%#x", uint32(e))
+}
+
+// Erreur de connexion HTTP2, la connexion est fermée avec une frame GOAWAY
+type h2Error struct {
+	Code H2ErrCode
+	Msg  string
+}
+
+func newH2Error(code H2ErrCode, format string, a ...interface{}) *h2Error {
+	return &h2Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *h2Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Msg)
+}
+
+type H2Setting struct {
+	ID    uint16
+	Value uint32
+}
 
-	flags, err := readByte(r)
+// Dépendance d'un stream (HEADERS avec le flag PRIORITY et PRIORITY)
+type Priority struct {
+	Exclusive bool
+	StreamDep uint32
+	Weight    uint8
+}
+
+/**
+* Frame HTTP2 (RFC 9113 section 4.1)
+*
+* ```
+* +-----------------------------------------------+
+* |                 Length (24)                   |
+* +---------------+---------------+---------------+
+* |   Type (8)    |   Flags (8)   |
+* +-+-------------+---------------+-------------------------------+
+* |R|                 Stream Identifier (31)                      |
+* +=+=============================================================+
+* |                   Frame Payload (0...)                      ...
+* +---------------------------------------------------------------+
+* ```
+*
+* Les champs après Payload sont décodés (ou encodés) en fonction du type de frame
+**/
+type Frame struct {
+	Length   uint32
+	Type     FrameType
+	Flags    byte
+	R        bool
+	StreamID uint32
+	Payload  []byte
+
+	PadLength        uint8
+	Priority         Priority    // HEADERS, PRIORITY
+	Data             []byte      // DATA
+	BlockFragment    []byte      // HEADERS, PUSH_PROMISE, CONTINUATION
+	PromisedStreamID uint32      // PUSH_PROMISE
+	Settings         []H2Setting // SETTINGS
+	ErrorCode        H2ErrCode   // RST_STREAM, GOAWAY
+	LastStreamID     uint32      // GOAWAY
+	DebugData        []byte      // GOAWAY
+	PingData         [8]byte     // PING
+	WindowIncrement  uint32      // WINDOW_UPDATE
+}
+
+func (f Frame) Has(flag byte) bool {
+	return f.Flags&flag != 0
+}
+
+func readByte(r io.Reader) (byte, error) {
+	bytes, err := readBytes(r, 1)
 	if err != nil {
-		log.Println("Cannot read flag for the frame")
+		return 0, err
 	}
 
-	_, err = readBytes(r, 4)
-	if err != nil {
-		log.Println("Cannot read streamidentifier")
+	return bytes[0], nil
+}
+
+// Lit la frame suivante, une frame plus grande que maxSize est une erreur FRAME_SIZE_ERROR
+func NewFrame(r io.Reader, maxSize uint32) (Frame, error) {
+	f := Frame{}
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return f, err
 	}
+	f.Length = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	f.Type = FrameType(header[3])
+	f.Flags = header[4]
+	f.R = readBit(header[5], 0)
+	f.StreamID = binary.BigEndian.Uint32(header[5:9]) & 0x7fffffff
 
-	fmt.Printf("> Frame type: %v (%v)\n", frameType, length)
-	if frameType == 0x04 {
-		return NewSettingFrame(r, length)
+	if f.Length > maxSize {
+		return f, newH2Error(H2ErrCodeFrameSizeError, "frame %s de %v octets (maximum %v)", f.Type, f.Length, maxSize)
 	}
-	if frameType == 0x01 {
-		//	return NewHeadersFrame(r, length, flags)
+	f.Payload = make([]byte, f.Length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, err
 	}
+	return f, f.decodePayload()
+}
+
+// Interprète le payload en fonction du type de frame
+func (f *Frame) decodePayload() error {
+	p := f.Payload
+	onStream := f.StreamID != 0
 
-	UNUSED(flags)
+	switch f.Type {
+	case frameTypeData, frameTypeHeaders, frameTypePriority, frameTypeRSTStream,
+		frameTypePushPromise, frameTypeContinuation:
+		if !onStream {
+			return newH2Error(H2ErrCodeProtocolError, "frame %s sur le stream 0", f.Type)
+		}
+	case frameTypeSettings, frameTypePing, frameTypeGoAway:
+		if onStream {
+			return newH2Error(H2ErrCodeProtocolError, "frame %s sur le stream #%v", f.Type, f.StreamID)
+		}
+	}
 
-	// Unknown frame type, skip the value
-	readBytes(r, int(length))
+	// Le padding est retiré avant de lire le reste du payload
+	if f.Has(flagPadded) && (f.Type == frameTypeData || f.Type == frameTypeHeaders || f.Type == frameTypePushPromise) {
+		if len(p) < 1 {
+			return newH2Error(H2ErrCodeFrameSizeError, "frame %s sans longueur de padding", f.Type)
+		}
+		f.PadLength = p[0]
+		if int(f.PadLength) >= len(p) {
+			return newH2Error(H2ErrCodeProtocolError, "padding de %v octets plus long que la frame", f.PadLength)
+		}
+		p = p[1 : len(p)-int(f.PadLength)]
+	}
 
+	switch f.Type {
+	case frameTypeData:
+		f.Data = p
+	case frameTypeHeaders:
+		if f.Has(flagPriority) {
+			if len(p) < 5 {
+				return newH2Error(H2ErrCodeFrameSizeError, "priorité tronquée")
+			}
+			f.Priority = decodePriority(p)
+			p = p[5:]
+		}
+		f.BlockFragment = p
+	case frameTypePriority:
+		if len(p) != 5 {
+			return newH2Error(H2ErrCodeFrameSizeError, "PRIORITY de %v octets au lieu de 5", len(p))
+		}
+		f.Priority = decodePriority(p)
+	case frameTypeRSTStream:
+		if len(p) != 4 {
+			return newH2Error(H2ErrCodeFrameSizeError, "RST_STREAM de %v octets au lieu de 4", len(p))
+		}
+		f.ErrorCode = H2ErrCode(binary.BigEndian.Uint32(p))
+	case frameTypeSettings:
+		return f.decodeSettings(p)
+	case frameTypePushPromise:
+		if len(p) < 4 {
+			return newH2Error(H2ErrCodeFrameSizeError, "PUSH_PROMISE tronquée")
+		}
+		f.PromisedStreamID = binary.BigEndian.Uint32(p) & 0x7fffffff
+		f.BlockFragment = p[4:]
+	case frameTypePing:
+		if len(p) != 8 {
+			return newH2Error(H2ErrCodeFrameSizeError, "PING de %v octets au lieu de 8", len(p))
+		}
+		copy(f.PingData[:], p)
+	case frameTypeGoAway:
+		if len(p) < 8 {
+			return newH2Error(H2ErrCodeFrameSizeError, "GOAWAY tronquée")
+		}
+		f.LastStreamID = binary.BigEndian.Uint32(p) & 0x7fffffff
+		f.ErrorCode = H2ErrCode(binary.BigEndian.Uint32(p[4:]))
+		f.DebugData = p[8:]
+	case frameTypeWindowUpdate:
+		if len(p) != 4 {
+			return newH2Error(H2ErrCodeFrameSizeError, "WINDOW_UPDATE de %v octets au lieu de 4", len(p))
+		}
+		// Un incrément nul est une erreur du stream concerné, vérifiée par windowUpdate
+		f.WindowIncrement = binary.BigEndian.Uint32(p) & 0x7fffffff
+	case frameTypeContinuation:
+		f.BlockFragment = p
+	}
+	// Les types de frames inconnus sont ignorés
 	return nil
 }
 
-func NewSettingFrame(r io.Reader, length uint32) interface{} {
-	paramsLength := int(length / 6)
-	for i := 0; i < paramsLength; i++ {
-		idenfitier, err := readBytes(r, 2)
-		value, err := readBytes(r, 4)
-		UNUSED(idenfitier, value, err)
+func decodePriority(p []byte) Priority {
+	dep := binary.BigEndian.Uint32(p)
+	return Priority{
+		Exclusive: readBit(p[0], 0),
+		StreamDep: dep & 0x7fffffff,
+		Weight:    p[4],
 	}
-	return nil
 }
 
-func NewHeadersFrame(r io.Reader, length uint32, flags byte) interface{} {
-	isPadded := readBit(flags, 4)
-	isPriority := readBit(flags, 2)
+// Chaque paramètre occupe 6 octets : identifiant (16 bits) et valeur (32 bits)
+func (f *Frame) decodeSettings(p []byte) error {
+	if f.Has(flagAck) {
+		if len(p) != 0 {
+			return newH2Error(H2ErrCodeFrameSizeError, "SETTINGS ACK avec un payload")
+		}
+		return nil
+	}
+	if len(p)%6 != 0 {
+		return newH2Error(H2ErrCodeFrameSizeError, "SETTINGS de %v octets (multiple de 6 attendu)", len(p))
+	}
+	for i := 0; i < len(p); i += 6 {
+		s := H2Setting{ID: binary.BigEndian.Uint16(p[i:]), Value: binary.BigEndian.Uint32(p[i+2:])}
+		switch {
+		case s.ID == h2SettingEnablePush && s.Value > 1:
+			return newH2Error(H2ErrCodeProtocolError, "ENABLE_PUSH doit valoir 0 ou 1")
+		case s.ID == h2SettingInitialWindowSize && s.Value > maxWindowSize:
+			return newH2Error(H2ErrCodeFlowControlError, "INITIAL_WINDOW_SIZE trop grand")
+		case s.ID == h2SettingMaxFrameSize && (s.Value < defaultMaxFrameSize || s.Value > maxFrameSizeLimit):
+			return newH2Error(H2ErrCodeProtocolError, "MAX_FRAME_SIZE %v invalide", s.Value)
+		}
+		f.Settings = append(f.Settings, s)
+	}
+	return nil
+}
 
-	if isPadded {
-		padLength, err := readByte(r)
-		UNUSED(padLength, err)
+// Construit le payload à partir des champs spécifiques au type de frame
+func (f Frame) encodePayload() []byte {
+	var p []byte
+	if f.Has(flagPadded) {
+		p = append(p, f.PadLength)
 	}
+	switch f.Type {
+	case frameTypeData:
+		p = append(p, f.Data...)
+	case frameTypeHeaders:
+		if f.Has(flagPriority) {
+			p = f.Priority.append(p)
+		}
+		p = append(p, f.BlockFragment...)
+	case frameTypePriority:
+		p = f.Priority.append(p)
+	case frameTypeRSTStream:
+		p = binary.BigEndian.AppendUint32(p, uint32(f.ErrorCode))
+	case frameTypeSettings:
+		for _, s := range f.Settings {
+			p = binary.BigEndian.AppendUint16(p, s.ID)
+			p = binary.BigEndian.AppendUint32(p, s.Value)
+		}
+	case frameTypePushPromise:
+		p = binary.BigEndian.AppendUint32(p, f.PromisedStreamID&0x7fffffff)
+		p = append(p, f.BlockFragment...)
+	case frameTypePing:
+		p = append(p, f.PingData[:]...)
+	case frameTypeGoAway:
+		p = binary.BigEndian.AppendUint32(p, f.LastStreamID&0x7fffffff)
+		p = binary.BigEndian.AppendUint32(p, uint32(f.ErrorCode))
+		p = append(p, f.DebugData...)
+	case frameTypeWindowUpdate:
+		p = binary.BigEndian.AppendUint32(p, f.WindowIncrement&0x7fffffff)
+	case frameTypeContinuation:
+		p = append(p, f.BlockFragment...)
+	default:
+		p = append(p, f.Payload...)
+	}
+	if f.Has(flagPadded) {
+		p = append(p, make([]byte, f.PadLength)...)
+	}
+	return p
+}
 
-	if isPriority {
-		deps, err := readBytes(r, 4)
-		weight, err := readBytes(r, 1)
-		UNUSED(deps, err, weight)
+func (p Priority) append(b []byte) []byte {
+	dep := p.StreamDep & 0x7fffffff
+	if p.Exclusive {
+		dep |= 1 << 31
 	}
+	b = binary.BigEndian.AppendUint32(b, dep)
+	return append(b, p.Weight)
+}
 
-	return nil
+// Encode la frame, la longueur et le payload sont calculés à partir des champs
+func (f Frame) Bytes() ([]byte, error) {
+	payload := f.encodePayload()
+	if len(payload) > maxFrameSizeLimit {
+		return nil, newH2Error(H2ErrCodeFrameSizeError, "frame %s de %v octets", f.Type, len(payload))
+	}
+	b := make([]byte, 0, frameHeaderLength+len(payload))
+	b = append(b, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	b = append(b, byte(f.Type), f.Flags)
+	b = binary.BigEndian.AppendUint32(b, f.StreamID&0x7fffffff)
+	return append(b, payload...), nil
 }
 
-func readUint24(r io.Reader) (uint32, error) {
-	buf := make([]byte, 3)
-	_, err := io.ReadFull(r, buf)
+func (f Frame) Write(w io.Writer) error {
+	b, err := f.Bytes()
 	if err != nil {
-		return 0, err
+		return err
 	}
-
-	return uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2]), nil
+	_, err = w.Write(b)
+	return err
 }
 
 // Lit un bit dans un octet (true si bit = 1)
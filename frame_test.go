@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{"DATA", Frame{Type: frameTypeData, Flags: flagEndStream, StreamID: 1, Data: []byte("hello")}},
+		{"DATA avec padding", Frame{Type: frameTypeData, Flags: flagPadded, StreamID: 3, PadLength: 4, Data: []byte("hello")}},
+		{"HEADERS", Frame{Type: frameTypeHeaders, Flags: flagEndHeaders, StreamID: 1, BlockFragment: []byte{0x82, 0x86}}},
+		{"HEADERS avec priorité et padding", Frame{Type: frameTypeHeaders, Flags: flagEndHeaders | flagPriority | flagPadded, StreamID: 5, PadLength: 2,
+			Priority: Priority{Exclusive: true, StreamDep: 3, Weight: 200}, BlockFragment: []byte{0x82}}},
+		{"PRIORITY", Frame{Type: frameTypePriority, StreamID: 7, Priority: Priority{StreamDep: 1, Weight: 15}}},
+		{"RST_STREAM", Frame{Type: frameTypeRSTStream, StreamID: 1, ErrorCode: H2ErrCodeCancel}},
+		{"SETTINGS", Frame{Type: frameTypeSettings, Settings: []H2Setting{
+			{ID: h2SettingHeaderTableSize, Value: 8192},
+			{ID: h2SettingInitialWindowSize, Value: maxWindowSize},
+			{ID: h2SettingMaxFrameSize, Value: maxFrameSizeLimit},
+		}}},
+		{"SETTINGS ACK", Frame{Type: frameTypeSettings, Flags: flagAck}},
+		{"PUSH_PROMISE", Frame{Type: frameTypePushPromise, Flags: flagEndHeaders, StreamID: 1, PromisedStreamID: 2, BlockFragment: []byte{0x82}}},
+		{"PING", Frame{Type: frameTypePing, Flags: flagAck, PingData: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"GOAWAY", Frame{Type: frameTypeGoAway, LastStreamID: 9, ErrorCode: H2ErrCodeProtocolError, DebugData: []byte("debug")}},
+		{"WINDOW_UPDATE", Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: maxWindowSize}},
+		{"CONTINUATION", Frame{Type: frameTypeContinuation, Flags: flagEndHeaders, StreamID: 1, BlockFragment: []byte{0x84}}},
+		{"type inconnu", Frame{Type: 0xfa, StreamID: 1, Payload: []byte{1, 2, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.frame.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := NewFrame(bytes.NewReader(b), maxFrameSizeLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(f.Length) != len(b)-frameHeaderLength {
+				t.Errorf("longueur %v, %v attendue", f.Length, len(b)-frameHeaderLength)
+			}
+			// Les champs décodés sont ceux de la frame d'origine, le payload en plus
+			want := tt.frame
+			want.Length, want.Payload = f.Length, f.Payload
+			if !reflect.DeepEqual(normalizeFrame(f), normalizeFrame(want)) {
+				t.Errorf("frame %+v\n%+v attendue", f, want)
+			}
+		})
+	}
+}
+
+// Les tranches vides et nil sont équivalentes pour la comparaison
+func normalizeFrame(f Frame) Frame {
+	for _, b := range []*[]byte{&f.Data, &f.BlockFragment, &f.DebugData, &f.Payload} {
+		if len(*b) == 0 {
+			*b = nil
+		}
+	}
+	return f
+}
+
+// En-tête de frame écrit à la main, pour des frames que Bytes ne sait pas produire
+func rawFrame(typ FrameType, flags byte, streamID uint32, payload ...byte) []byte {
+	l := len(payload)
+	return append([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(typ), flags,
+		byte(streamID >> 24), byte(streamID >> 16), byte(streamID >> 8), byte(streamID)}, payload...)
+}
+
+func TestFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		code H2ErrCode
+	}{
+		{"trop grande", rawFrame(frameTypeData, 0, 1, make([]byte, defaultMaxFrameSize+1)...), H2ErrCodeFrameSizeError},
+		{"DATA sur le stream 0", rawFrame(frameTypeData, 0, 0, 'a'), H2ErrCodeProtocolError},
+		{"HEADERS sur le stream 0", rawFrame(frameTypeHeaders, flagEndHeaders, 0, 0x82), H2ErrCodeProtocolError},
+		{"SETTINGS sur un stream", rawFrame(frameTypeSettings, 0, 1), H2ErrCodeProtocolError},
+		{"PING sur un stream", rawFrame(frameTypePing, 0, 1, make([]byte, 8)...), H2ErrCodeProtocolError},
+		{"padding sans longueur", rawFrame(frameTypeData, flagPadded, 1), H2ErrCodeFrameSizeError},
+		{"padding plus long que la frame", rawFrame(frameTypeData, flagPadded, 1, 4, 'a', 0, 0), H2ErrCodeProtocolError},
+		{"priorité tronquée", rawFrame(frameTypeHeaders, flagPriority, 1, 0, 0, 0), H2ErrCodeFrameSizeError},
+		{"PRIORITY trop courte", rawFrame(frameTypePriority, 0, 1, 0, 0, 0, 1), H2ErrCodeFrameSizeError},
+		{"RST_STREAM trop longue", rawFrame(frameTypeRSTStream, 0, 1, 0, 0, 0, 0, 0), H2ErrCodeFrameSizeError},
+		{"SETTINGS incomplet", rawFrame(frameTypeSettings, 0, 0, 0, 1, 0, 0, 0), H2ErrCodeFrameSizeError},
+		{"SETTINGS ACK avec payload", rawFrame(frameTypeSettings, flagAck, 0, 0, 1, 0, 0, 0, 0), H2ErrCodeFrameSizeError},
+		{"ENABLE_PUSH invalide", rawFrame(frameTypeSettings, 0, 0, 0, 2, 0, 0, 0, 2), H2ErrCodeProtocolError},
+		{"INITIAL_WINDOW_SIZE trop grand", rawFrame(frameTypeSettings, 0, 0, 0, 4, 0x80, 0, 0, 0), H2ErrCodeFlowControlError},
+		{"MAX_FRAME_SIZE trop petit", rawFrame(frameTypeSettings, 0, 0, 0, 5, 0, 0, 0x3f, 0xff), H2ErrCodeProtocolError},
+		{"MAX_FRAME_SIZE trop grand", rawFrame(frameTypeSettings, 0, 0, 0, 5, 0x01, 0, 0, 0), H2ErrCodeProtocolError},
+		{"PING trop courte", rawFrame(frameTypePing, 0, 0, 1, 2, 3), H2ErrCodeFrameSizeError},
+		{"GOAWAY tronquée", rawFrame(frameTypeGoAway, 0, 0, 0, 0, 0, 1), H2ErrCodeFrameSizeError},
+		{"WINDOW_UPDATE trop longue", rawFrame(frameTypeWindowUpdate, 0, 0, 0, 0, 0, 1, 0), H2ErrCodeFrameSizeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFrame(bytes.NewReader(tt.raw), defaultMaxFrameSize)
+			var h2Err *h2Error
+			if !errors.As(err, &h2Err) || h2Err.Code != tt.code {
+				t.Errorf("erreur %v, %s attendue", err, tt.code)
+			}
+		})
+	}
+}
+
+// Le bit réservé et le bit de poids fort des identifiants sont ignorés à la lecture
+func TestFrameReservedBits(t *testing.T) {
+	raw := rawFrame(frameTypeWindowUpdate, 0, 0x80000001, 0x80, 0, 0, 10)
+	f, err := NewFrame(bytes.NewReader(raw), defaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.R || f.StreamID != 1 || f.WindowIncrement != 10 {
+		t.Errorf("R %v, stream %v, incrément %v", f.R, f.StreamID, f.WindowIncrement)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+* Taille du corps d'une requête HTTP1 selon les règles strictes de la RFC 9112 (section 6).
+* Un proxy devant ce serveur peut lire le message autrement si les en-têtes sont ambigus,
+* la fin de la requête qu'il voit n'est alors pas la nôtre (request smuggling) : on refuse
+*
+* ```
+* Content-Length: 5 + Transfer-Encoding: chunked → 400
+* Content-Length: 5, 6                           → 400
+* Transfer-Encoding: chunked, gzip               → 400
+* Transfer-Encoding: gzip, chunked               → 501
+* ```
+*
+* Renvoie -1 pour un corps en chunks, 0 sans corps
+**/
+func requestFraming(r *Request) (int64, error) {
+	te := r.Headers.Values("Transfer-Encoding")
+	cl := r.Headers.Values("Content-Length")
+	if len(te) > 0 && len(cl) > 0 {
+		return 0, newRequestError(http.StatusBadRequest, "Transfer-Encoding et Content-Length sont présents ensemble")
+	}
+	if len(te) > 0 {
+		if r.Protocol == "HTTP/1.0" {
+			return 0, newRequestError(http.StatusBadRequest, "Transfer-Encoding n'existe pas en HTTP/1.0")
+		}
+		codings := strings.Split(strings.Join(te, ","), ",")
+		for i, coding := range codings {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			switch {
+			case coding == "chunked" && i == len(codings)-1:
+			case coding == "chunked" || i == len(codings)-1:
+				return 0, newRequestError(http.StatusBadRequest, "chunked doit être le dernier codage de Transfer-Encoding")
+			default:
+				return 0, newRequestError(http.StatusNotImplemented, "codage %q non pris en charge", coding)
+			}
+		}
+		return -1, nil
+	}
+	if len(cl) == 0 {
+		return 0, nil
+	}
+
+	// Plusieurs valeurs identiques (en-tête répété ou liste) valent une seule valeur
+	length := ""
+	for _, value := range strings.Split(strings.Join(cl, ","), ",") {
+		value = strings.TrimSpace(value)
+		if !isDigits(value) {
+			return 0, newRequestError(http.StatusBadRequest, "Content-Length invalide %q", value)
+		}
+		if length != "" && value != length {
+			return 0, newRequestError(http.StatusBadRequest, "valeurs de Content-Length différentes (%s et %s)", length, value)
+		}
+		length = value
+	}
+	n, err := strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return 0, newRequestError(http.StatusBadRequest, "Content-Length trop grand %q", length)
+	}
+	// La valeur unique remplace les doublons pour ceux qui relisent l'en-tête (proxy)
+	r.Headers.Set("Content-Length", length)
+	return n, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Ligne terminée par CRLF, un LF seul est refusé car d'autres serveurs l'interprètent différemment
+func checkCRLF(raw string) error {
+	if !strings.HasSuffix(raw, "\r\n") || strings.Count(raw, "\r") != 1 {
+		return fmt.Errorf("fin de ligne invalide %q, CRLF attendu", raw)
+	}
+	return nil
+}
+
+// Corps de Content-Length octets, une connexion fermée avant la fin est une erreur
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+/**
+* Décode un corps en chunks en refusant tout ce qui n'est pas strictement conforme :
+* taille en hexadécimal sans espace ni préfixe, CRLF après chaque ligne et chaque chunk
+*
+* ```
+* 1a;ext=1\r\n
+* ...26 octets...\r\n
+* 0\r\n
+* \r\n
+* ```
+**/
+type chunkedReader struct {
+	r *bufio.Reader
+	// Octets restant dans le chunk en cours
+	remaining int64
+	err       error
+}
+
+func newChunkedReader(r *bufio.Reader) *chunkedReader {
+	return &chunkedReader{r: r}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining == 0 && err == nil {
+		err = c.readCRLF()
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// Lit la taille du chunk suivant, io.EOF une fois le dernier chunk et les trailers lus
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	size, _, _ := strings.Cut(line, ";")
+	if size == "" || len(size) > 15 || strings.Trim(size, "0123456789abcdefABCDEF") != "" {
+		return newRequestError(http.StatusBadRequest, "taille de chunk invalide %q", line)
+	}
+	c.remaining, _ = strconv.ParseInt(size, 16, 64)
+	if c.remaining > 0 {
+		return nil
+	}
+	// Dernier chunk : les trailers sont ignorés jusqu'à la ligne vide
+	for {
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
+
+func (c *chunkedReader) line() (string, error) {
+	raw, err := readLimitedLine(c.r, 4096)
+	if err != nil {
+		if errors.Is(err, errLineTooLong) {
+			return "", newRequestError(http.StatusBadRequest, "ligne de chunk trop longue")
+		}
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if err := checkCRLF(raw); err != nil {
+		return "", newRequestError(http.StatusBadRequest, "%v", err)
+	}
+	return strings.TrimSuffix(raw, "\r\n"), nil
+}
+
+func (c *chunkedReader) readCRLF() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(c.r, crlf[:]); err != nil {
+		return err
+	}
+	if string(crlf[:]) != "\r\n" {
+		return newRequestError(http.StatusBadRequest, "CRLF attendu après les données du chunk")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		headers  Header
+		length   int64
+		status   int
+	}{
+		{"sans corps", "HTTP/1.1", nil, 0, http.StatusOK},
+		{"Content-Length", "HTTP/1.1", Header{{Name: "Content-Length", Value: "5"}}, 5, http.StatusOK},
+		{"chunked", "HTTP/1.1", Header{{Name: "Transfer-Encoding", Value: "chunked"}}, -1, http.StatusOK},
+		{"chunked sans tenir compte de la casse", "HTTP/1.1", Header{{Name: "transfer-encoding", Value: "Chunked"}}, -1, http.StatusOK},
+		{"Content-Length et Transfer-Encoding", "HTTP/1.1", Header{
+			{Name: "Content-Length", Value: "5"},
+			{Name: "Transfer-Encoding", Value: "chunked"},
+		}, 0, http.StatusBadRequest},
+		{"Content-Length répété identique", "HTTP/1.1", Header{
+			{Name: "Content-Length", Value: "5"},
+			{Name: "Content-Length", Value: "5"},
+		}, 5, http.StatusOK},
+		{"Content-Length répété différent", "HTTP/1.1", Header{
+			{Name: "Content-Length", Value: "5"},
+			{Name: "Content-Length", Value: "6"},
+		}, 0, http.StatusBadRequest},
+		{"Content-Length en liste différente", "HTTP/1.1", Header{{Name: "Content-Length", Value: "5, 6"}}, 0, http.StatusBadRequest},
+		{"Content-Length signé", "HTTP/1.1", Header{{Name: "Content-Length", Value: "+5"}}, 0, http.StatusBadRequest},
+		{"Content-Length hexadécimal", "HTTP/1.1", Header{{Name: "Content-Length", Value: "0x5"}}, 0, http.StatusBadRequest},
+		{"Content-Length vide", "HTTP/1.1", Header{{Name: "Content-Length", Value: ""}}, 0, http.StatusBadRequest},
+		{"Content-Length trop grand", "HTTP/1.1", Header{{Name: "Content-Length", Value: "99999999999999999999"}}, 0, http.StatusBadRequest},
+		{"chunked avant un autre codage", "HTTP/1.1", Header{{Name: "Transfer-Encoding", Value: "chunked, gzip"}}, 0, http.StatusBadRequest},
+		{"chunked répété", "HTTP/1.1", Header{
+			{Name: "Transfer-Encoding", Value: "chunked"},
+			{Name: "Transfer-Encoding", Value: "chunked"},
+		}, 0, http.StatusBadRequest},
+		{"codage sans chunked", "HTTP/1.1", Header{{Name: "Transfer-Encoding", Value: "gzip"}}, 0, http.StatusBadRequest},
+		{"gzip, chunked", "HTTP/1.1", Header{{Name: "Transfer-Encoding", Value: "gzip, chunked"}}, 0, http.StatusNotImplemented},
+		{"Transfer-Encoding en HTTP/1.0", "HTTP/1.0", Header{{Name: "Transfer-Encoding", Value: "chunked"}}, 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Request{Protocol: tt.protocol, Headers: tt.headers}
+			length, err := requestFraming(r)
+			if status := requestStatus(err); status != tt.status {
+				t.Fatalf("statut %v, %v attendu (%v)", status, tt.status, err)
+			}
+			if length != tt.length {
+				t.Errorf("taille %v, %v attendue", length, tt.length)
+			}
+		})
+	}
+}
+
+// Les doublons identiques sont remplacés par une seule valeur pour le serveur amont
+func TestRequestFramingNormalizesContentLength(t *testing.T) {
+	r := &Request{Protocol: "HTTP/1.1", Headers: Header{{Name: "Content-Length", Value: "5, 5"}, {Name: "Content-Length", Value: "5"}}}
+	if _, err := requestFraming(r); err != nil {
+		t.Fatal(err)
+	}
+	if values := r.Headers.Values("Content-Length"); len(values) != 1 || values[0] != "5" {
+		t.Errorf("Content-Length %q, [5] attendu", values)
+	}
+}
+
+func TestCheckCRLF(t *testing.T) {
+	tests := []struct {
+		raw string
+		ok  bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"\r\n", true},
+		{"GET / HTTP/1.1\n", false},
+		{"\n", false},
+		{"Host: a\rb\r\n", false},
+		{"GET / HTTP/1.1\r\r\n", false},
+		{"GET / HTTP/1.1", false},
+	}
+	for _, tt := range tests {
+		if err := checkCRLF(tt.raw); (err == nil) != tt.ok {
+			t.Errorf("checkCRLF(%q) = %v", tt.raw, err)
+		}
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		body string
+		// 0 pour un corps valide, -1 pour un corps tronqué
+		status int
+	}{
+		{"valide", "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "hello world", 0},
+		{"taille en majuscules", "A\r\n0123456789\r\n0\r\n\r\n", "0123456789", 0},
+		{"extension", "5;name=value\r\nhello\r\n0\r\n\r\n", "hello", 0},
+		{"trailers", "5\r\nhello\r\n0\r\nExpires: never\r\nX-A: 1\r\n\r\n", "hello", 0},
+		{"taille invalide", "zz\r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"taille vide", "\r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"taille avec espace", "5 \r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"taille préfixée", "0x5\r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"taille signée", "-5\r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"taille démesurée", "fffffffffffffffff\r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"extension trop longue", "5;" + strings.Repeat("a", 4096) + "\r\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"LF seul après la taille", "5\nhello\r\n0\r\n\r\n", "", http.StatusBadRequest},
+		{"CRLF manquant après les données", "5\r\nhelloX\r\n0\r\n\r\n", "hello", http.StatusBadRequest},
+		{"LF seul après les données", "5\r\nhello\n0\r\n\r\n", "hello", http.StatusBadRequest},
+		{"LF seul dans les trailers", "5\r\nhello\r\n0\r\nX-A: 1\n\r\n", "hello", http.StatusBadRequest},
+		{"données tronquées", "5\r\nhel", "hel", -1},
+		{"dernier chunk absent", "5\r\nhello\r\n", "hello", -1},
+		{"trailers tronqués", "5\r\nhello\r\n0\r\nX-A: 1\r\n", "hello", -1},
+		{"ligne vide finale absente", "5\r\nhello\r\n0\r\n", "hello", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := io.ReadAll(newChunkedReader(bufio.NewReader(strings.NewReader(tt.raw))))
+			if string(body) != tt.body {
+				t.Errorf("corps %q, %q attendu", body, tt.body)
+			}
+			switch tt.status {
+			case 0:
+				if err != nil {
+					t.Errorf("erreur inattendue %v", err)
+				}
+			case -1:
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("erreur %v, io.ErrUnexpectedEOF attendue", err)
+				}
+			default:
+				if status := requestStatus(err); status != tt.status {
+					t.Errorf("statut %v, %v attendu (%v)", status, tt.status, err)
+				}
+			}
+		})
+	}
+}
+
+// Le corps en chunks est vérifié quelle que soit la route, et pas seulement par le proxy
+func TestMalformedChunkedBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"taille invalide", "POST /index.html HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"CRLF manquant", "POST /index.html HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcX\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"LF seul dans les en-têtes", "POST /index.html HTTP/1.1\r\nHost: localhost\nContent-Length: 0\r\n\r\n", http.StatusBadRequest},
+		{"Content-Length et chunked", "POST /index.html HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"valide", "POST /index.html HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRawRequest([]string{tt.request}, 0)
+			if status := requestStatus(err); status != tt.status {
+				t.Errorf("statut %v, %v attendu (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
@@ -3,8 +3,9 @@ module grafikart/gohttp
 go 1.23.2
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/fatih/color v1.18.0
-	github.com/quic-go/qpack v0.5.1
+	github.com/klauspost/compress v1.17.11
 	github.com/quic-go/quic-go v0.48.1
 	golang.org/x/net v0.30.0
 )
@@ -20,6 +21,5 @@ require (
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.17.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/text v0.19.0 // indirect
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
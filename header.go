@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+/**
+* En-têtes d'un message dans leur ordre d'arrivée, commun aux trois protocoles.
+* Un nom peut apparaître plusieurs fois et la recherche ne tient pas compte de la casse :
+* HTTP1 écrit Content-Length, HTTP2 et HTTP3 content-length
+*
+* ```
+* cookie: a=1
+* accept: text/html
+* cookie: b=2       → Get("Cookie") = "a=1; b=2"
+* ```
+**/
+type Header []HeaderField
+
+// Valeurs d'un en-tête combinées en une seule (RFC 9110 section 5.3), les cookies découpés
+// par HTTP2 et HTTP3 sont rassemblés avec "; " (RFC 9113 section 8.2.3)
+func (h Header) Get(name string) string {
+	values := h.Values(name)
+	if strings.EqualFold(name, "Cookie") {
+		return strings.Join(values, "; ")
+	}
+	return strings.Join(values, ", ")
+}
+
+// Toutes les valeurs d'un en-tête, Set-Cookie ne peut pas être combiné et se lit ainsi
+func (h Header) Values(name string) []string {
+	var values []string
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+func (h Header) Has(name string) bool {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Header) Add(name string, value string) {
+	*h = append(*h, HeaderField{Name: name, Value: value})
+}
+
+// Remplace toutes les valeurs d'un en-tête, il garde la place de sa première apparition
+func (h *Header) Set(name string, value string) {
+	for i, f := range *h {
+		if strings.EqualFold(f.Name, name) {
+			(*h)[i].Value = value
+			*h = append((*h)[:i+1], Header((*h)[i+1:]).without(name)...)
+			return
+		}
+	}
+	h.Add(name, value)
+}
+
+func (h *Header) Del(name string) {
+	*h = h.without(name)
+}
+
+func (h Header) without(name string) Header {
+	kept := h[:0]
+	for _, f := range h {
+		if !strings.EqualFold(f.Name, name) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// Liste envoyée à HPACK ou QPACK, les noms sont obligatoirement en minuscules
+func (h Header) Fields() []HeaderField {
+	fields := make([]HeaderField, len(h))
+	for i, f := range h {
+		f.Name = strings.ToLower(f.Name)
+		fields[i] = f
+	}
+	return fields
+}
+
+// Noms écrits comme en HTTP1 (Content-Type), les pseudo-en-têtes ne sont pas transmis
+func (h Header) Canonical() Header {
+	canonical := make(Header, 0, len(h))
+	for _, f := range h {
+		if strings.HasPrefix(f.Name, ":") {
+			continue
+		}
+		f.Name = textproto.CanonicalMIMEHeaderKey(f.Name)
+		canonical = append(canonical, f)
+	}
+	return canonical
+}
+
+/**
+* Ajoute une ligne d'en-tête HTTP1 (sans la ligne vide finale). Une ligne commençant par
+* une espace prolonge la valeur précédente (obs-fold), remplacée par une espace (RFC 9112 section 5.2)
+*
+* ```
+* X-Long: début
+*   suite         → X-Long: début suite
+* ```
+**/
+func (h *Header) parseLine(raw string) error {
+	line := strings.TrimRight(raw, "\r\n")
+	if line != "" && (line[0] == ' ' || line[0] == '\t') {
+		if len(*h) == 0 {
+			return fmt.Errorf("ligne de continuation %q sans en-tête", line)
+		}
+		last := &(*h)[len(*h)-1]
+		value := strings.Trim(line, " \t")
+		if !validFieldValue(value) {
+			return fmt.Errorf("valeur invalide pour l'en-tête %s", last.Name)
+		}
+		last.Value = strings.Trim(last.Value+" "+value, " ")
+		return nil
+	}
+	// Aucune espace n'est permise entre le nom et ":" (RFC 9112 section 5.1)
+	name, value, ok := strings.Cut(line, ":")
+	if !ok || !validFieldName(name) {
+		return fmt.Errorf("en-tête invalide %q", line)
+	}
+	value = strings.Trim(value, " \t")
+	if !validFieldValue(value) {
+		return fmt.Errorf("valeur invalide pour l'en-tête %s", name)
+	}
+	h.Add(name, value)
+	return nil
+}
+
+// Vérifie les en-têtes reçus en HTTP2 ou HTTP3 : noms en minuscules, pas d'espace autour des valeurs
+func (h Header) validate() error {
+	for _, f := range h {
+		name, _ := strings.CutPrefix(f.Name, ":")
+		if !validFieldName(name) || strings.ToLower(f.Name) != f.Name {
+			return fmt.Errorf("nom d'en-tête invalide %q", f.Name)
+		}
+		if !validFieldValue(f.Value) || strings.Trim(f.Value, " \t") != f.Value {
+			return fmt.Errorf("valeur invalide pour l'en-tête %s", f.Name)
+		}
+	}
+	return nil
+}
+
+// HTTP2 et HTTP3 n'ont pas d'en-têtes spécifiques à la connexion,
+// seul te: trailers reste permis (RFC 9113 section 8.2.2, RFC 9114 section 4.2)
+func (h Header) checkConnectionFields() error {
+	for _, f := range h {
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return fmt.Errorf("en-tête %s spécifique à la connexion", f.Name)
+		case "te":
+			if f.Value != "trailers" {
+				return fmt.Errorf("seule la valeur \"trailers\" est acceptée pour te")
+			}
+		}
+	}
+	return nil
+}
+
+// Un nom d'en-tête est un token (RFC 9110 section 5.1)
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Une valeur ne contient ni retour à la ligne ni caractère de contrôle (RFC 9110 section 5.5)
+func validFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
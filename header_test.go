@@ -0,0 +1,177 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHeaderGet(t *testing.T) {
+	h := Header{
+		{Name: "cookie", Value: "a=1"},
+		{Name: "Accept", Value: "text/html"},
+		{Name: "Cookie", Value: "b=2"},
+		{Name: "accept", Value: "*/*"},
+		{Name: "Set-Cookie", Value: "c=3; Path=/"},
+		{Name: "set-cookie", Value: "d=4"},
+	}
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"Cookie", "a=1; b=2"},
+		{"ACCEPT", "text/html, */*"},
+		{"Set-Cookie", "c=3; Path=/, d=4"},
+		{"Host", ""},
+	}
+	for _, tt := range tests {
+		if value := h.Get(tt.name); value != tt.value {
+			t.Errorf("Get(%q) = %q, %q attendu", tt.name, value, tt.value)
+		}
+	}
+	if values := h.Values("set-cookie"); !slices.Equal(values, []string{"c=3; Path=/", "d=4"}) {
+		t.Errorf("Values(set-cookie) = %q", values)
+	}
+	if !h.Has("COOKIE") || h.Has("Host") {
+		t.Errorf("Has ne tient pas compte de la casse")
+	}
+}
+
+func TestHeaderSetDel(t *testing.T) {
+	tests := []struct {
+		name   string
+		apply  func(h *Header)
+		result Header
+	}{
+		{"Set remplace à la première place", func(h *Header) { h.Set("accept", "*/*") }, Header{
+			{Name: "Host", Value: "localhost"},
+			{Name: "Accept", Value: "*/*"},
+			{Name: "X-A", Value: "1"},
+		}},
+		{"Set ajoute à la fin", func(h *Header) { h.Set("X-B", "2") }, Header{
+			{Name: "Host", Value: "localhost"},
+			{Name: "Accept", Value: "text/html"},
+			{Name: "X-A", Value: "1"},
+			{Name: "ACCEPT", Value: "image/png"},
+			{Name: "X-B", Value: "2"},
+		}},
+		{"Del retire toutes les valeurs", func(h *Header) { h.Del("Accept") }, Header{
+			{Name: "Host", Value: "localhost"},
+			{Name: "X-A", Value: "1"},
+		}},
+		{"Add garde les doublons", func(h *Header) { h.Add("x-a", "2") }, Header{
+			{Name: "Host", Value: "localhost"},
+			{Name: "Accept", Value: "text/html"},
+			{Name: "X-A", Value: "1"},
+			{Name: "ACCEPT", Value: "image/png"},
+			{Name: "x-a", Value: "2"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "Accept", Value: "text/html"},
+				{Name: "X-A", Value: "1"},
+				{Name: "ACCEPT", Value: "image/png"},
+			}
+			tt.apply(&h)
+			if !slices.Equal(h, tt.result) {
+				t.Errorf("en-têtes %v, %v attendus", h, tt.result)
+			}
+		})
+	}
+}
+
+func TestHeaderFields(t *testing.T) {
+	h := Header{{Name: ":status", Value: "200"}, {Name: "Content-Type", Value: "text/html"}, {Name: "x-custom-header", Value: "1"}}
+	fields := h.Fields()
+	if fields[1].Name != "content-type" || h[1].Name != "Content-Type" {
+		t.Errorf("Fields doit renvoyer une copie en minuscules, %v", fields)
+	}
+	canonical := h.Canonical()
+	want := Header{{Name: "Content-Type", Value: "text/html"}, {Name: "X-Custom-Header", Value: "1"}}
+	if !slices.Equal(canonical, want) {
+		t.Errorf("Canonical() = %v, %v attendu", canonical, want)
+	}
+}
+
+func TestHeaderParseLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		result Header
+		ok     bool
+	}{
+		{"en-tête simple", []string{"Host: localhost\r\n"}, Header{{Name: "Host", Value: "localhost"}}, true},
+		{"espaces autour de la valeur", []string{"Host: \t localhost \t\r\n"}, Header{{Name: "Host", Value: "localhost"}}, true},
+		{"valeur vide", []string{"X-Empty:\r\n"}, Header{{Name: "X-Empty", Value: ""}}, true},
+		{"obs-fold", []string{"X-Long: début\r\n", "   suite\r\n", "\tfin\r\n"}, Header{{Name: "X-Long", Value: "début suite fin"}}, true},
+		{"obs-fold d'une valeur vide", []string{"X-Long:\r\n", " suite\r\n"}, Header{{Name: "X-Long", Value: "suite"}}, true},
+		{"continuation sans en-tête", []string{" suite\r\n"}, nil, false},
+		{"espace avant les deux points", []string{"Host : localhost\r\n"}, nil, false},
+		{"tabulation avant les deux points", []string{"Host\t: localhost\r\n"}, nil, false},
+		{"sans deux points", []string{"Host localhost\r\n"}, nil, false},
+		{"nom vide", []string{": localhost\r\n"}, nil, false},
+		{"nom invalide", []string{"Ho(st: localhost\r\n"}, nil, false},
+		{"caractère de contrôle", []string{"X-A: a\x00b\r\n"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Header
+			var err error
+			for _, line := range tt.lines {
+				if err = h.parseLine(line); err != nil {
+					break
+				}
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("erreur %v", err)
+			}
+			if tt.ok && !slices.Equal(h, tt.result) {
+				t.Errorf("en-têtes %v, %v attendus", h, tt.result)
+			}
+		})
+	}
+}
+
+func TestHeaderValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+		ok   bool
+	}{
+		{"valide", Header{{Name: ":path", Value: "/"}, {Name: "accept", Value: "text/html"}}, true},
+		{"nom en majuscules", Header{{Name: "Accept", Value: "text/html"}}, false},
+		{"espace dans le nom", Header{{Name: "x a", Value: "1"}}, false},
+		{"espace autour de la valeur", Header{{Name: "accept", Value: " text/html"}}, false},
+		{"retour à la ligne dans la valeur", Header{{Name: "x-a", Value: "a\r\nb"}}, false},
+		{"pseudo-en-tête vide", Header{{Name: ":", Value: "1"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.h.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s : erreur %v", tt.name, err)
+		}
+	}
+}
+
+func TestHeaderCheckConnectionFields(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+		ok   bool
+	}{
+		{"sans en-tête de connexion", Header{{Name: ":path", Value: "/"}, {Name: "accept", Value: "text/html"}}, true},
+		{"te: trailers", Header{{Name: "te", Value: "trailers"}}, true},
+		{"te: gzip", Header{{Name: "te", Value: "gzip"}}, false},
+		{"connection", Header{{Name: "connection", Value: "keep-alive"}}, false},
+		{"keep-alive", Header{{Name: "keep-alive", Value: "timeout=5"}}, false},
+		{"proxy-connection", Header{{Name: "proxy-connection", Value: "close"}}, false},
+		{"transfer-encoding", Header{{Name: "transfer-encoding", Value: "chunked"}}, false},
+		{"upgrade", Header{{Name: "upgrade", Value: "websocket"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.h.checkConnectionFields(); (err == nil) != tt.ok {
+			t.Errorf("%s : erreur %v", tt.name, err)
+		}
+	}
+}
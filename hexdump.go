@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Affichage octet par octet des messages (option -hex), à la manière de https://quic.xargs.org/
+const hexBytesPerLine = 16
+
+// Au-delà, les octets d'un champ (données d'une frame DATA par exemple) ne sont pas tous affichés
+const hexMaxFieldBytes = 64
+
+// Portion d'un message brut et sa signification
+type hexField struct {
+	Label string
+	Bytes []byte
+}
+
+/**
+* Affiche les champs avec leur position dans le message
+*
+* ```
+* | 0000  00 00 06                                         Length (6)
+* | 0003  04                                               Type (SETTINGS)
+* ```
+**/
+func printHexDump(fields []hexField, in bool) {
+	color := dirColor(in)
+	offset := 0
+	for _, f := range fields {
+		b := f.Bytes
+		if len(b) > hexMaxFieldBytes {
+			b = b[:hexMaxFieldBytes]
+		}
+		for i := 0; i < len(b); i += hexBytesPerLine {
+			label := ""
+			if i == 0 {
+				label = f.Label
+			}
+			color.Printf("| %04x  ", offset+i)
+			tracef("%-48s %s\n", fmt.Sprintf("% x", b[i:min(i+hexBytesPerLine, len(b))]), label)
+		}
+		if len(f.Bytes) > len(b) {
+			color.Printf("| ....  ")
+			tracef("(%v octets de plus)\n", len(f.Bytes)-len(b))
+		}
+		offset += len(f.Bytes)
+	}
+}
+
+// Découpe un bloc d'en-têtes compressé champ par champ grâce à la taille de chaque
+// représentation, les octets restants au début forment le préfixe du bloc
+func headerBlockFields(block []byte, fields []HeaderField, prefixLabel string, blockLabel string) []hexField {
+	size := 0
+	for _, h := range fields {
+		if h.Encoding == nil {
+			return []hexField{{blockLabel, block}}
+		}
+		size += h.Encoding.Size
+	}
+	if len(fields) == 0 || size > len(block) {
+		return []hexField{{blockLabel, block}}
+	}
+
+	prefix := len(block) - size
+	out := []hexField{{prefixLabel, block[:prefix]}}
+	block = block[prefix:]
+	for _, h := range fields {
+		value := h.Value
+		if len(value) > 20 {
+			value = value[:20] + "..."
+		}
+		label := fmt.Sprintf("%s: %s (%s)", h.Name, value, hpackReprNames[h.Encoding.Repr])
+		out = append(out, hexField{label, block[:h.Encoding.Size]})
+		block = block[h.Encoding.Size:]
+	}
+	return out
+}
+
+// Noms des flags présents dans une frame HTTP2
+func (f Frame) flagNames() string {
+	var names []string
+	add := func(flag byte, name string) {
+		if f.Has(flag) {
+			names = append(names, name)
+		}
+	}
+	switch f.Type {
+	case frameTypeData:
+		add(flagEndStream, "END_STREAM")
+		add(flagPadded, "PADDED")
+	case frameTypeHeaders:
+		add(flagEndStream, "END_STREAM")
+		add(flagEndHeaders, "END_HEADERS")
+		add(flagPadded, "PADDED")
+		add(flagPriority, "PRIORITY")
+	case frameTypeSettings, frameTypePing:
+		add(flagAck, "ACK")
+	case frameTypePushPromise:
+		add(flagEndHeaders, "END_HEADERS")
+		add(flagPadded, "PADDED")
+	case frameTypeContinuation:
+		add(flagEndHeaders, "END_HEADERS")
+	}
+	return strings.Join(names, "|")
+}
+
+// Champs d'une frame HTTP2, fields contient les en-têtes décodés du bloc HPACK
+func (f Frame) hexFields(fields []HeaderField) []hexField {
+	// Les frames envoyées n'ont pas encore de payload
+	payload := f.Payload
+	if payload == nil {
+		payload = f.encodePayload()
+	}
+	l := len(payload)
+	out := []hexField{
+		{fmt.Sprintf("Length (%v)", l), []byte{byte(l >> 16), byte(l >> 8), byte(l)}},
+		{fmt.Sprintf("Type (%s)", f.Type), []byte{byte(f.Type)}},
+		{fmt.Sprintf("Flags (%s)", f.flagNames()), []byte{f.Flags}},
+		{fmt.Sprintf("Stream ID (%v)", f.StreamID), binary.BigEndian.AppendUint32(nil, f.StreamID)},
+	}
+
+	p := payload
+	var padding []byte
+	if f.Has(flagPadded) && (f.Type == frameTypeData || f.Type == frameTypeHeaders || f.Type == frameTypePushPromise) && len(p) > 0 {
+		out = append(out, hexField{fmt.Sprintf("Pad Length (%v)", p[0]), p[:1]})
+		p, padding = p[1:len(p)-int(p[0])], p[len(p)-int(p[0]):]
+	}
+
+	priority := func() {
+		out = append(out,
+			hexField{fmt.Sprintf("Stream Dependency (%v, exclusive %v)", f.Priority.StreamDep, f.Priority.Exclusive), p[:4]},
+			hexField{fmt.Sprintf("Weight (%v)", f.Priority.Weight), p[4:5]},
+		)
+		p = p[5:]
+	}
+
+	switch f.Type {
+	case frameTypeData:
+		out = append(out, hexField{"Data", p})
+	case frameTypeHeaders:
+		if f.Has(flagPriority) {
+			priority()
+		}
+		out = append(out, headerBlockFields(p, fields, "Mise à jour de la table HPACK", "Bloc HPACK")...)
+	case frameTypePriority:
+		priority()
+	case frameTypeRSTStream, frameTypeWindowUpdate:
+		label := fmt.Sprintf("Error Code (%s)", f.ErrorCode)
+		if f.Type == frameTypeWindowUpdate {
+			label = fmt.Sprintf("Window Size Increment (%v)", f.WindowIncrement)
+		}
+		out = append(out, hexField{label, p})
+	case frameTypeSettings:
+		for i, s := range f.Settings {
+			name, ok := h2SettingNames[s.ID]
+			if !ok {
+				name = fmt.Sprintf("%#x", s.ID)
+			}
+			out = append(out,
+				hexField{"Identifier (" + name + ")", p[i*6 : i*6+2]},
+				hexField{fmt.Sprintf("Value (%v)", s.Value), p[i*6+2 : i*6+6]},
+			)
+		}
+	case frameTypePushPromise:
+		out = append(out,
+			hexField{fmt.Sprintf("Promised Stream ID (%v)", f.PromisedStreamID), p[:4]},
+			hexField{"Bloc HPACK", p[4:]},
+		)
+	case frameTypePing:
+		out = append(out, hexField{"Opaque Data", p})
+	case frameTypeGoAway:
+		out = append(out,
+			hexField{fmt.Sprintf("Last-Stream-ID (%v)", f.LastStreamID), p[:4]},
+			hexField{fmt.Sprintf("Error Code (%s)", f.ErrorCode), p[4:8]},
+			hexField{"Additional Debug Data", p[8:]},
+		)
+	case frameTypeContinuation:
+		out = append(out, headerBlockFields(p, fields, "Mise à jour de la table HPACK", "Fragment HPACK")...)
+	default:
+		out = append(out, hexField{"Payload", p})
+	}
+	return append(out, hexField{"Padding", padding})
+}
+
+// Champs d'une frame HTTP3, le type et la longueur sont des varints (1, 2, 4 ou 8 octets)
+// Les varints reçus sont réencodés sous leur forme la plus courte
+func h3HexFields(f interface{}) []hexField {
+	var t uint64
+	var payload []hexField
+	switch f := f.(type) {
+	case HeadersFrame:
+		t = headerFrameType
+		payload = headerBlockFields(f.block, f.Headers, "Required Insert Count / Base", "Bloc QPACK")
+	case DataFrame:
+		t = dataFrameType
+		payload = []hexField{{"Data", f.Data}}
+	case SettingsFrame:
+		t = settingsFrameType
+		for _, s := range f.Settings {
+			name, ok := settingNames[s.Identifier]
+			if !ok {
+				name = fmt.Sprintf("%#x", s.Identifier)
+			}
+			payload = append(payload,
+				hexField{"Identifier (" + name + ")", quicvarint.Append(nil, s.Identifier)},
+				hexField{fmt.Sprintf("Value (%v)", s.Value), quicvarint.Append(nil, s.Value)},
+			)
+		}
+	case GoAwayFrame:
+		t = goAwayFrameType
+		payload = []hexField{{fmt.Sprintf("Stream ID (%v)", f.ID), quicvarint.Append(nil, f.ID)}}
+	default:
+		return nil
+	}
+
+	l := 0
+	for _, p := range payload {
+		l += len(p.Bytes)
+	}
+	return append([]hexField{
+		{fmt.Sprintf("Type (%s)", frameName(f)), quicvarint.Append(nil, t)},
+		{fmt.Sprintf("Length (%v)", l), quicvarint.Append(nil, uint64(l))},
+	}, payload...)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Les champs mis bout à bout doivent redonner le message tel qu'il passe sur le réseau
+func joinHexFields(fields []hexField) []byte {
+	var b []byte
+	for _, f := range fields {
+		b = append(b, f.Bytes...)
+	}
+	return b
+}
+
+func hexLabels(fields []hexField) string {
+	var labels []string
+	for _, f := range fields {
+		labels = append(labels, f.Label)
+	}
+	return strings.Join(labels, "\n")
+}
+
+func TestH2HexFields(t *testing.T) {
+	fields := fieldsOf(":status", "200", "content-type", "text/html", "x-custom", "valeur")
+	block := NewHPACKEncoder().Encode(fields)
+	tests := []struct {
+		name   string
+		frame  Frame
+		labels []string
+	}{
+		{"SETTINGS", Frame{Type: frameTypeSettings, Settings: []H2Setting{{ID: h2SettingMaxConcurrentStreams, Value: 100}}},
+			[]string{"Length (6)", "Type (SETTINGS)", "Identifier (MAX_CONCURRENT_STREAMS)", "Value (100)"}},
+		{"DATA avec padding", Frame{Type: frameTypeData, Flags: flagEndStream | flagPadded, StreamID: 1, PadLength: 3, Data: []byte("bonjour")},
+			[]string{"Flags (END_STREAM|PADDED)", "Stream ID (1)", "Pad Length (3)", "Data", "Padding"}},
+		{"HEADERS avec priorité", Frame{Type: frameTypeHeaders, Flags: flagEndHeaders | flagPriority | flagPadded, StreamID: 3, PadLength: 2,
+			Priority: Priority{Exclusive: true, StreamDep: 1, Weight: 15}, BlockFragment: block},
+			[]string{"Flags (END_HEADERS|PADDED|PRIORITY)", "Stream Dependency (1, exclusive true)", "Weight (15)", ":status: 200", "content-type: text/html", "x-custom: valeur"}},
+		{"WINDOW_UPDATE", Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: 1000}, []string{"Window Size Increment (1000)"}},
+		{"RST_STREAM", Frame{Type: frameTypeRSTStream, StreamID: 1, ErrorCode: H2ErrCodeCancel}, []string{"Error Code (CANCEL)"}},
+		{"PING", Frame{Type: frameTypePing, Flags: flagAck, PingData: [8]byte{1, 2, 3}}, []string{"Flags (ACK)", "Opaque Data"}},
+		{"GOAWAY", Frame{Type: frameTypeGoAway, LastStreamID: 5, ErrorCode: H2ErrCodeProtocolError, DebugData: []byte("raison")},
+			[]string{"Last-Stream-ID (5)", "Error Code (PROTOCOL_ERROR)", "Additional Debug Data"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wire bytes.Buffer
+			if err := tt.frame.Write(&wire); err != nil {
+				t.Fatal(err)
+			}
+			// Frame envoyée (payload encodé pour l'affichage) puis la même frame relue
+			read, err := NewFrame(bytes.NewReader(wire.Bytes()), maxFrameSizeLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []Frame{tt.frame, read} {
+				hex := f.hexFields(fields)
+				if b := joinHexFields(hex); !bytes.Equal(b, wire.Bytes()) {
+					t.Fatalf("octets % x, % x attendus", b, wire.Bytes())
+				}
+				labels := hexLabels(hex)
+				for _, label := range tt.labels {
+					if !strings.Contains(labels, label) {
+						t.Errorf("libellé %q absent de\n%s", label, labels)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestH3HexFields(t *testing.T) {
+	headers := HeadersFrame{Headers: fieldsOf(":status", "200", "content-type", "text/html")}
+	headers.block = NewQPACKEncoder().Encode(headers.Headers)
+	tests := []struct {
+		name   string
+		frame  interface{}
+		labels []string
+	}{
+		{"HEADERS", headers, []string{"Type (HEADERS)", "Required Insert Count / Base", ":status: 200", "content-type: text/html"}},
+		{"DATA", DataFrame{Data: bytes.Repeat([]byte("a"), 100)}, []string{"Type (DATA)", "Length (100)", "Data"}},
+		{"SETTINGS", SettingsFrame{Settings: []Setting{{settingQPACKMaxTableCapacity, 4096}, {0x21, 1}}}, []string{"Identifier (QPACK_MAX_TABLE_CAPACITY)", "Value (4096)", "Identifier (0x21)"}},
+		{"GOAWAY", GoAwayFrame{ID: 64}, []string{"Type (GOAWAY)", "Stream ID (64)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wire bytes.Buffer
+			var err error
+			switch f := tt.frame.(type) {
+			case HeadersFrame:
+				err = f.writeBlock(&wire)
+			case DataFrame:
+				err = f.Write(&wire)
+			case SettingsFrame:
+				err = f.Write(&wire)
+			case GoAwayFrame:
+				err = f.Write(&wire)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			hex := h3HexFields(tt.frame)
+			if b := joinHexFields(hex); !bytes.Equal(b, wire.Bytes()) {
+				t.Fatalf("octets % x, % x attendus", b, wire.Bytes())
+			}
+			labels := hexLabels(hex)
+			for _, label := range tt.labels {
+				if !strings.Contains(labels, label) {
+					t.Errorf("libellé %q absent de\n%s", label, labels)
+				}
+			}
+		})
+	}
+}
+
+// La requête HTTP1 est découpée ligne par ligne, octets de fin de ligne compris
+func TestHTTP1HexDump(t *testing.T) {
+	raw := "POST /form HTTP/1.1\r\nHost: localhost\r\nX-Long: a\r\n b\r\nContent-Length: 5\r\n\r\nhello"
+	r, err := readRawRequest([]string{raw}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := joinHexFields(r.dump); string(b) != raw {
+		t.Fatalf("octets %q, %q attendus", b, raw)
+	}
+	labels := hexLabels(r.dump)
+	for _, label := range []string{"Ligne de requête", "En-tête Host", "Suite de l'en-tête X-Long", "Fin des en-têtes", "Corps"} {
+		if !strings.Contains(labels, label) {
+			t.Errorf("libellé %q absent de\n%s", label, labels)
+		}
+	}
+}
+
+func TestPrintHexDump(t *testing.T) {
+	buf := captureTrace(t)
+	printHexDump([]hexField{
+		{"Length (3)", []byte{0, 0, 3}},
+		{"Data", bytes.Repeat([]byte{0xab}, hexMaxFieldBytes+10)},
+		{"Suite", []byte{1}},
+	}, true)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	// 1 ligne pour la longueur, 4 lignes de 16 octets, la ligne des octets masqués, puis la suite
+	if len(lines) != 7 {
+		t.Fatalf("%v lignes :\n%s", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "| 0000  00 00 03 ") || !strings.HasSuffix(lines[0], "Length (3)") {
+		t.Errorf("ligne %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[2], "| 0013  ab ab") || strings.Contains(lines[2], "Data") {
+		t.Errorf("ligne %q", lines[2])
+	}
+	if !strings.Contains(lines[5], "(10 octets de plus)") {
+		t.Errorf("ligne %q", lines[5])
+	}
+	// Les octets non affichés comptent dans la position des champs suivants
+	if !strings.HasPrefix(lines[6], "| 004d  01 ") {
+		t.Errorf("ligne %q", lines[6])
+	}
+}
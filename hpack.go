@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// https://httpwg.org/specs/rfc7541.html
+
+// Options de la compression des en-têtes HTTP2
+// Exemple : go run . http2 -hpack-verbose
+var hpackOptions struct {
+	xnet    bool
+	verbose bool
+}
+
+func registerHPACKFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&hpackOptions.xnet, "hpack-xnet", false, "utilise golang.org/x/net/http2/hpack au lieu de l'implémentation HPACK du projet")
+	fs.BoolVar(&hpackOptions.verbose, "hpack-verbose", false, "détaille l'encodage de chaque en-tête (représentation, index, Huffman)")
+}
+
+// Chaque entrée de la table dynamique compte pour nom + valeur + 32 octets
+const hpackEntryOverhead = 32
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Un en-tête sensible (cookie, authorization) n'est jamais indexé
+	Sensitive bool
+	// Manière dont l'en-tête a été encodé, renseigné par notre implémentation
+	Encoding *FieldEncoding
+}
+
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + hpackEntryOverhead
+}
+
+// Représentations d'un en-tête dans un bloc HPACK (RFC 7541 section 6)
+type hpackRepr uint8
+
+const (
+	hpackIndexed hpackRepr = iota
+	hpackIncremental
+	hpackWithoutIndexing
+	hpackNeverIndexed
+)
+
+var hpackReprNames = map[hpackRepr]string{
+	hpackIndexed:         "indexé",
+	hpackIncremental:     "littéral ajouté à la table",
+	hpackWithoutIndexing: "littéral non indexé",
+	hpackNeverIndexed:    "littéral jamais indexé",
+}
+
+type FieldEncoding struct {
+	Repr hpackRepr
+	// Index de l'en-tête (indexé) ou du nom (littéral), 0 si le nom est écrit en entier
+	Index uint64
+	// Table référencée par Index en QPACK ("statique" ou "dynamique"),
+	// HPACK n'utilise qu'un seul espace d'index
+	Table       string
+	NameHuffman bool
+	ValHuffman  bool
+	// Nombre d'octets occupés dans le bloc
+	Size int
+}
+
+// Octets économisés par rapport à l'en-tête écrit en clair "nom: valeur\r\n"
+func (e FieldEncoding) Saved(f HeaderField) int {
+	return len(f.Name) + len(f.Value) + 4 - e.Size
+}
+
+func (e FieldEncoding) String() string {
+	s := hpackReprNames[e.Repr]
+	ref := fmt.Sprintf("#%v", e.Index)
+	if e.Table != "" {
+		ref = e.Table + " " + ref
+	}
+	switch {
+	case e.Repr == hpackIndexed:
+		s += " " + ref
+	case e.Index > 0 || e.Table != "":
+		s += ", nom " + ref
+	}
+	if e.NameHuffman || e.ValHuffman {
+		s += ", huffman"
+	}
+	return s + fmt.Sprintf(", %v octets", e.Size)
+}
+
+// Table statique (RFC 7541 annexe A), les index commencent à 1
+var hpackStaticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// Table dynamique, l'entrée la plus récente est en tête et porte l'index 62
+type hpackTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *hpackTable) add(f HeaderField) {
+	// Une entrée plus grande que la table la vide entièrement
+	if f.size() > t.maxSize {
+		t.entries = nil
+		t.size = 0
+		return
+	}
+	t.evict(t.maxSize - f.size())
+	t.entries = append([]HeaderField{{Name: f.Name, Value: f.Value}}, t.entries...)
+	t.size += f.size()
+}
+
+// Retire les entrées les plus anciennes jusqu'à ce que la table tienne dans max
+func (t *hpackTable) evict(max int) {
+	for t.size > max {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.size()
+	}
+}
+
+func (t *hpackTable) setMaxSize(max int) {
+	t.maxSize = max
+	t.evict(max)
+}
+
+func (t *hpackTable) get(i uint64) (HeaderField, bool) {
+	switch {
+	case i == 0:
+		return HeaderField{}, false
+	case i <= uint64(len(hpackStaticTable)):
+		return hpackStaticTable[i-1], true
+	case i-uint64(len(hpackStaticTable)) <= uint64(len(t.entries)):
+		return t.entries[i-uint64(len(hpackStaticTable))-1], true
+	}
+	return HeaderField{}, false
+}
+
+// Cherche un en-tête dans les tables, renvoie l'index et si la valeur correspond aussi
+func (t *hpackTable) search(f HeaderField) (uint64, bool) {
+	var nameIndex uint64
+	all := append(hpackStaticTable[:len(hpackStaticTable):len(hpackStaticTable)], t.entries...)
+	for i, e := range all {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if nameIndex == 0 {
+			nameIndex = uint64(i + 1)
+		}
+	}
+	return nameIndex, false
+}
+
+/**
+* Entier avec un préfixe de n bits (RFC 7541 section 5.1)
+*
+* ```
+*   0   1   2   3   4   5   6   7
+* +---+---+---+---+---+---+---+---+
+* | ? | ? | ? | 1   1   1   1   1 |
+* +---+---+---+-------------------+
+* | 1 |    Value-(2^N-1) LSB      |
+* +---+---------------------------+
+*                ...
+* +---+---------------------------+
+* | 0 |    Value-(2^N-1) MSB      |
+* +---+---------------------------+
+* ```
+**/
+func appendHPACKInt(b []byte, first byte, n uint, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(b, first|byte(v))
+	}
+	b = append(b, first|byte(max))
+	v -= max
+	for v >= 128 {
+		b = append(b, byte(v&0x7f)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func readHPACKInt(p []byte, n uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, p, fmt.Errorf("entier tronqué")
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(p[0]) & max
+	p = p[1:]
+	if v < max {
+		return v, p, nil
+	}
+	for m := uint(0); len(p) > 0; m += 7 {
+		if m > 56 {
+			return 0, p, fmt.Errorf("entier trop grand")
+		}
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+	return 0, p, fmt.Errorf("entier tronqué")
+}
+
+// Chaîne littérale : bit H (Huffman) suivi de la longueur sur 7 bits puis des octets
+func appendHPACKString(b []byte, s string) ([]byte, bool) {
+	if l := huffmanEncodedLen(s); l < len(s) {
+		b = appendHPACKInt(b, 0x80, 7, uint64(l))
+		return huffmanEncode(b, s), true
+	}
+	b = appendHPACKInt(b, 0, 7, uint64(len(s)))
+	return append(b, s...), false
+}
+
+func readHPACKString(p []byte) (string, bool, []byte, error) {
+	if len(p) == 0 {
+		return "", false, p, fmt.Errorf("chaîne tronquée")
+	}
+	huffman := p[0]&0x80 != 0
+	l, p, err := readHPACKInt(p, 7)
+	if err != nil {
+		return "", false, p, err
+	}
+	if uint64(len(p)) < l {
+		return "", false, p, fmt.Errorf("chaîne tronquée")
+	}
+	s := p[:l]
+	p = p[l:]
+	if !huffman {
+		return string(s), false, p, nil
+	}
+	decoded, err := huffmanDecode(s)
+	return decoded, true, p, err
+}
+
+type HPACKDecoder struct {
+	table hpackTable
+	// Taille maximale annoncée dans nos SETTINGS, le pair ne peut pas la dépasser
+	maxSizeLimit int
+}
+
+func NewHPACKDecoder(maxSize int) *HPACKDecoder {
+	return &HPACKDecoder{table: hpackTable{maxSize: maxSize}, maxSizeLimit: maxSize}
+}
+
+// Décode un bloc d'en-têtes complet (HEADERS + CONTINUATION)
+func (d *HPACKDecoder) DecodeFull(p []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	start := true
+	for len(p) > 0 {
+		before := len(p)
+		var f HeaderField
+		var err error
+		b := p[0]
+		switch {
+		case b&0x80 != 0:
+			// 1xxxxxxx : champ indexé
+			var i uint64
+			i, p, err = readHPACKInt(p, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.get(i); !ok {
+				return nil, fmt.Errorf("index %v invalide", i)
+			}
+			f.Encoding = &FieldEncoding{Repr: hpackIndexed, Index: i}
+		case b&0xe0 == 0x20:
+			// 001xxxxx : mise à jour de la taille de la table dynamique
+			if !start {
+				return nil, fmt.Errorf("mise à jour de la taille de la table après un en-tête")
+			}
+			var size uint64
+			size, p, err = readHPACKInt(p, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxSizeLimit) {
+				return nil, fmt.Errorf("taille de table %v supérieure à %v", size, d.maxSizeLimit)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default:
+			// 01xxxxxx, 0001xxxx et 0000xxxx : littéral, avec un nom indexé ou non
+			repr, n := hpackWithoutIndexing, uint(4)
+			switch {
+			case b&0xc0 == 0x40:
+				repr, n = hpackIncremental, 6
+			case b&0xf0 == 0x10:
+				repr = hpackNeverIndexed
+			}
+			f, p, err = d.readLiteral(p, n)
+			if err != nil {
+				return nil, err
+			}
+			f.Encoding.Repr = repr
+			f.Sensitive = repr == hpackNeverIndexed
+			if repr == hpackIncremental {
+				d.table.add(f)
+			}
+		}
+		start = false
+		f.Encoding.Size = before - len(p)
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func (d *HPACKDecoder) readLiteral(p []byte, n uint) (HeaderField, []byte, error) {
+	f := HeaderField{Encoding: &FieldEncoding{}}
+	i, p, err := readHPACKInt(p, n)
+	if err != nil {
+		return f, p, err
+	}
+	if i > 0 {
+		name, ok := d.table.get(i)
+		if !ok {
+			return f, p, fmt.Errorf("index %v invalide", i)
+		}
+		f.Name = name.Name
+		f.Encoding.Index = i
+	} else {
+		f.Name, f.Encoding.NameHuffman, p, err = readHPACKString(p)
+		if err != nil {
+			return f, p, err
+		}
+	}
+	f.Value, f.Encoding.ValHuffman, p, err = readHPACKString(p)
+	return f, p, err
+}
+
+type HPACKEncoder struct {
+	table hpackTable
+	// Taille de table à annoncer au début du prochain bloc
+	pendingSize int
+	sizeUpdate  bool
+}
+
+func NewHPACKEncoder() *HPACKEncoder {
+	return &HPACKEncoder{table: hpackTable{maxSize: defaultHeaderTableSize}}
+}
+
+// Le décodeur du pair n'accepte pas de table plus grande que son HEADER_TABLE_SIZE
+func (e *HPACKEncoder) SetMaxDynamicTableSizeLimit(max uint32) {
+	size := min(int(max), defaultHeaderTableSize)
+	if size == e.table.maxSize {
+		return
+	}
+	e.table.setMaxSize(size)
+	e.pendingSize = size
+	e.sizeUpdate = true
+}
+
+// Encode les en-têtes, la manière dont chacun a été encodé est renseignée dans Encoding
+func (e *HPACKEncoder) Encode(fields []HeaderField) []byte {
+	var b []byte
+	if e.sizeUpdate {
+		b = appendHPACKInt(b, 0x20, 5, uint64(e.pendingSize))
+		e.sizeUpdate = false
+	}
+	for i, f := range fields {
+		before := len(b)
+		enc := &FieldEncoding{}
+		index, match := e.table.search(f)
+		switch {
+		case match && !f.Sensitive:
+			enc.Repr, enc.Index = hpackIndexed, index
+			b = appendHPACKInt(b, 0x80, 7, index)
+		case f.Sensitive:
+			enc.Repr = hpackNeverIndexed
+			b = e.appendLiteral(b, 0x10, 4, index, f, enc)
+		default:
+			enc.Repr = hpackIncremental
+			b = e.appendLiteral(b, 0x40, 6, index, f, enc)
+			e.table.add(f)
+		}
+		enc.Size = len(b) - before
+		fields[i].Encoding = enc
+	}
+	return b
+}
+
+func (e *HPACKEncoder) appendLiteral(b []byte, first byte, n uint, nameIndex uint64, f HeaderField, enc *FieldEncoding) []byte {
+	b = appendHPACKInt(b, first, n, nameIndex)
+	enc.Index = nameIndex
+	if nameIndex == 0 {
+		b, enc.NameHuffman = appendHPACKString(b, f.Name)
+	}
+	b, enc.ValHuffman = appendHPACKString(b, f.Value)
+	return b
+}
+
+// Compression des en-têtes d'une connexion, notre implémentation ou celle de golang.org/x/net
+type headerDecoder interface {
+	DecodeFull(p []byte) ([]HeaderField, error)
+}
+
+type headerEncoder interface {
+	Encode(fields []HeaderField) []byte
+	SetMaxDynamicTableSizeLimit(max uint32)
+}
+
+func newHeaderCodec() (headerDecoder, headerEncoder) {
+	if hpackOptions.xnet {
+		e := &xnetEncoder{}
+		e.Encoder = hpack.NewEncoder(&e.buf)
+		return xnetDecoder{hpack.NewDecoder(defaultHeaderTableSize, nil)}, e
+	}
+	return NewHPACKDecoder(defaultHeaderTableSize), NewHPACKEncoder()
+}
+
+type xnetDecoder struct {
+	*hpack.Decoder
+}
+
+func (d xnetDecoder) DecodeFull(p []byte) ([]HeaderField, error) {
+	hfs, err := d.Decoder.DecodeFull(p)
+	fields := make([]HeaderField, 0, len(hfs))
+	for _, h := range hfs {
+		fields = append(fields, HeaderField{Name: h.Name, Value: h.Value, Sensitive: h.Sensitive})
+	}
+	return fields, err
+}
+
+type xnetEncoder struct {
+	*hpack.Encoder
+	buf bytes.Buffer
+}
+
+func (e *xnetEncoder) Encode(fields []HeaderField) []byte {
+	e.buf.Reset()
+	for _, f := range fields {
+		e.WriteField(hpack.HeaderField{Name: f.Name, Value: f.Value, Sensitive: f.Sensitive})
+	}
+	return bytes.Clone(e.buf.Bytes())
+}
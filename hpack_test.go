@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Noms et valeurs seulement, sans la manière dont les en-têtes ont été encodés
+func plainFields(fields []HeaderField) []HeaderField {
+	plain := make([]HeaderField, len(fields))
+	for i, f := range fields {
+		plain[i] = HeaderField{Name: f.Name, Value: f.Value}
+	}
+	return plain
+}
+
+func fieldsOf(pairs ...string) []HeaderField {
+	var fields []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		fields = append(fields, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return fields
+}
+
+// Un bloc d'en-têtes de l'annexe C, décodé à la suite des précédents sur la même connexion
+type hpackVector struct {
+	block  string
+	fields []HeaderField
+	// Taille de la table dynamique après le bloc
+	size int
+	// Bloc produit par notre encodeur quand il diffère de l'exemple
+	encoded string
+}
+
+var (
+	hpackRequest1 = fieldsOf(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com")
+	hpackRequest2 = fieldsOf(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache")
+	hpackRequest3 = fieldsOf(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value")
+
+	hpackResponse1 = fieldsOf(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com")
+	hpackResponse2 = fieldsOf(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com")
+	hpackResponse3 = fieldsOf(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+		"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1")
+)
+
+// RFC 7541 annexes C.3 à C.6 : requêtes (table de 4096 octets) puis réponses (table de 256 octets),
+// sans puis avec Huffman
+var hpackVectors = []struct {
+	name      string
+	tableSize int
+	huffman   bool
+	blocks    []hpackVector
+}{
+	{"C.3 requêtes sans Huffman", 4096, false, []hpackVector{
+		{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", hpackRequest1, 57, ""},
+		{"8286 84be 5808 6e6f 2d63 6163 6865", hpackRequest2, 110, ""},
+		{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", hpackRequest3, 164, ""},
+	}},
+	{"C.4 requêtes avec Huffman", 4096, true, []hpackVector{
+		{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", hpackRequest1, 57, ""},
+		{"8286 84be 5886 a8eb 1064 9cbf", hpackRequest2, 110, ""},
+		{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", hpackRequest3, 164, ""},
+	}},
+	{"C.5 réponses sans Huffman", 256, false, []hpackVector{
+		{"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", hpackResponse1, 222, ""},
+		{"4803 3330 37c1 c0bf", hpackResponse2, 222, ""},
+		{"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31", hpackResponse3, 215, ""},
+	}},
+	{"C.6 réponses avec Huffman", 256, true, []hpackVector{
+		{"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3", hpackResponse1, 222, ""},
+		// "307" fait 3 octets avec ou sans Huffman, l'encodeur garde alors le littéral
+		{"4883 640e ffc1 c0bf", hpackResponse2, 222, "4803 3330 37c1 c0bf"},
+		{"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07", hpackResponse3, 215, ""},
+	}},
+}
+
+func TestHPACKDecoderVectors(t *testing.T) {
+	for _, tt := range hpackVectors {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewHPACKDecoder(tt.tableSize)
+			for i, v := range tt.blocks {
+				fields, err := d.DecodeFull(unhex(t, v.block))
+				if err != nil {
+					t.Fatalf("bloc %v : %v", i+1, err)
+				}
+				if !slices.Equal(plainFields(fields), v.fields) {
+					t.Errorf("bloc %v : %v\n%v attendus", i+1, plainFields(fields), v.fields)
+				}
+				if d.table.size != v.size {
+					t.Errorf("bloc %v : table de %v octets, %v attendus", i+1, d.table.size, v.size)
+				}
+			}
+		})
+	}
+}
+
+// Notre encodeur indexe tous les en-têtes et choisit Huffman quand c'est plus court,
+// comme les exemples avec Huffman de l'annexe C
+func TestHPACKEncoderVectors(t *testing.T) {
+	for _, tt := range hpackVectors {
+		if !tt.huffman {
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewHPACKEncoder()
+			e.table.maxSize = tt.tableSize
+			for i, v := range tt.blocks {
+				block := e.Encode(slices.Clone(v.fields))
+				want := unhex(t, v.block)
+				if v.encoded != "" {
+					want = unhex(t, v.encoded)
+				}
+				if !slices.Equal(block, want) {
+					t.Errorf("bloc %v : %x\n%x attendu", i+1, block, want)
+				}
+				if e.table.size != v.size {
+					t.Errorf("bloc %v : table de %v octets, %v attendus", i+1, e.table.size, v.size)
+				}
+			}
+		})
+	}
+}
+
+// RFC 7541 annexe C.2 : une représentation de chaque sorte
+func TestHPACKRepresentations(t *testing.T) {
+	tests := []struct {
+		name      string
+		block     string
+		field     HeaderField
+		repr      hpackRepr
+		tableSize int
+	}{
+		{"C.2.1 littéral ajouté à la table", "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			HeaderField{Name: "custom-key", Value: "custom-header"}, hpackIncremental, 55},
+		{"C.2.2 littéral non indexé", "040c 2f73 616d 706c 652f 7061 7468",
+			HeaderField{Name: ":path", Value: "/sample/path"}, hpackWithoutIndexing, 0},
+		{"C.2.3 littéral jamais indexé", "1008 7061 7373 776f 7264 0673 6563 7265 74",
+			HeaderField{Name: "password", Value: "secret", Sensitive: true}, hpackNeverIndexed, 0},
+		{"C.2.4 indexé", "82", HeaderField{Name: ":method", Value: "GET"}, hpackIndexed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewHPACKDecoder(defaultHeaderTableSize)
+			fields, err := d.DecodeFull(unhex(t, tt.block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fields) != 1 || fields[0].Encoding.Repr != tt.repr {
+				t.Fatalf("en-têtes %v", fields)
+			}
+			f := fields[0]
+			f.Encoding = nil
+			if f != tt.field {
+				t.Errorf("en-tête %+v, %+v attendu", f, tt.field)
+			}
+			if d.table.size != tt.tableSize {
+				t.Errorf("table de %v octets, %v attendus", d.table.size, tt.tableSize)
+			}
+		})
+	}
+}
+
+// RFC 7541 annexe C.1 : entiers avec un préfixe de 5 et 8 bits
+func TestHPACKInt(t *testing.T) {
+	tests := []struct {
+		value uint64
+		n     uint
+		raw   []byte
+	}{
+		{10, 5, []byte{0x0a}},
+		{1337, 5, []byte{0x1f, 0x9a, 0x0a}},
+		{42, 8, []byte{0x2a}},
+		{31, 5, []byte{0x1f, 0x00}},
+		{1<<32 - 1, 7, []byte{0x7f, 0x80, 0xff, 0xff, 0xff, 0x0f}},
+	}
+	for _, tt := range tests {
+		if b := appendHPACKInt(nil, 0, tt.n, tt.value); !slices.Equal(b, tt.raw) {
+			t.Errorf("appendHPACKInt(%v, %v) = %x, %x attendu", tt.value, tt.n, b, tt.raw)
+		}
+		v, rest, err := readHPACKInt(tt.raw, tt.n)
+		if err != nil || v != tt.value || len(rest) != 0 {
+			t.Errorf("readHPACKInt(%x) = %v, %x, %v", tt.raw, v, rest, err)
+		}
+	}
+	for _, raw := range [][]byte{{}, {0x1f}, {0x1f, 0x80}, {0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}} {
+		if _, _, err := readHPACKInt(raw, 5); err == nil {
+			t.Errorf("readHPACKInt(%x) sans erreur", raw)
+		}
+	}
+}
+
+func TestHPACKDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+	}{
+		{"index 0", "80"},
+		{"index hors des tables", "be"},
+		{"nom indexé hors des tables", "7e 0161"},
+		{"chaîne tronquée", "400a 6375 7374"},
+		{"mise à jour de la taille après un en-tête", "82 3f e1 1f"},
+		{"table plus grande que la limite", "3f e2 1f"},
+		{"Huffman invalide", "4081 ff 0161"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewHPACKDecoder(defaultHeaderTableSize).DecodeFull(unhex(t, tt.block)); err == nil {
+				t.Error("bloc décodé sans erreur")
+			}
+		})
+	}
+}
+
+// Les blocs de notre encodeur sont lus par x/net, et inversement, sur plusieurs requêtes
+// d'une même connexion pour que les tables dynamiques évoluent ensemble
+func TestHPACKRoundTrip(t *testing.T) {
+	requests := [][]HeaderField{
+		hpackRequest1,
+		hpackRequest3,
+		append(fieldsOf(":status", "200", "content-type", "text/html; charset=utf-8", "x-long", strings.Repeat("é", 300)),
+			HeaderField{Name: "authorization", Value: "Bearer secret", Sensitive: true}),
+		hpackResponse3,
+		fieldsOf("x-empty", "", "x-bytes", "\x00\x7f\xff"),
+	}
+	for i := range 20 {
+		requests = append(requests, fieldsOf(fmt.Sprintf("x-header-%v", i), strings.Repeat("v", i*20)))
+	}
+
+	e := NewHPACKEncoder()
+	e.SetMaxDynamicTableSizeLimit(512)
+	xd := hpack.NewDecoder(512, nil)
+	var xbuf strings.Builder
+	xe := hpack.NewEncoder(&xbuf)
+	d := NewHPACKDecoder(defaultHeaderTableSize)
+	for i, fields := range requests {
+		block := e.Encode(slices.Clone(fields))
+		decoded, err := xd.DecodeFull(block)
+		if err != nil {
+			t.Fatalf("requête %v lue par x/net : %v", i, err)
+		}
+		for j, f := range decoded {
+			if f.Name != fields[j].Name || f.Value != fields[j].Value || f.Sensitive != fields[j].Sensitive {
+				t.Errorf("requête %v lue par x/net : %+v, %+v attendu", i, f, fields[j])
+			}
+		}
+
+		xbuf.Reset()
+		for _, f := range fields {
+			xe.WriteField(hpack.HeaderField{Name: f.Name, Value: f.Value, Sensitive: f.Sensitive})
+		}
+		ours, err := d.DecodeFull([]byte(xbuf.String()))
+		if err != nil {
+			t.Fatalf("requête %v de x/net : %v", i, err)
+		}
+		for j, f := range ours {
+			f.Encoding = nil
+			if f != fields[j] {
+				t.Errorf("requête %v de x/net : %+v, %+v attendu", i, f, fields[j])
+			}
+		}
+	}
+	if e.table.size > 512 {
+		t.Errorf("table de l'encodeur de %v octets, limite 512", e.table.size)
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"strconv"
+	"net/http"
+	"net/url"
 
 	"net"
 	"strings"
@@ -20,15 +22,53 @@ type Request struct {
 	Path     string
 	Method   string
 	Protocol string
-	Headers  map[string]string
-	Body     string
+	// En-têtes dans leur ordre d'arrivée, pseudo-en-têtes compris en HTTP2 et HTTP3
+	Headers Header
+	Body    string
+	// Cible relative au serveur (/docs/?sort=size), * ou hôte:port selon sa forme
+	URI   string
+	Form  string
+	Query url.Values
+
+	// Corps HTTP1 encore sur la connexion et message brut pour l'affichage hexadécimal
+	body io.Reader
+	dump []hexField
 }
 
 // Les requêtes HTTP1 ne contiennent qu'une requête par connection
 // La requête est présentée sous forme de texte contenant l'ensemble des informations
 func handleHTTP1(conn net.Conn) {
 	defer conn.Close()
-	r, err := NewHTTP1Request(conn)
+	t := newTraceConn(HTTP1, conn.RemoteAddr().String())
+	state := tlsState(conn)
+	t.open(state)
+	defer t.close()
+	alpn, serverName := "", ""
+	if state != nil {
+		alpn, serverName = state.NegotiatedProtocol, state.ServerName
+	}
+	defer recordConnection(HTTP1, alpn)()
+	br := bufio.NewReader(conn)
+	start := time.Now()
+	r, err := NewHTTP1Request(conn, br, t)
+	var vh *virtualHost
+	var ok bool
+	if err == nil {
+		vh, ok = selectVHost(serverName, r.Header("Host"))
+		// Le proxy transmet le corps au fil de l'eau, sinon il est lu en entier avant de répondre
+		err = readHTTP1Body(r, t, ok && vh.proxy != nil)
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		if r == nil {
+			r = &Request{Protocol: "HTTP/1.1"}
+		}
+		printRequestError(t, noStream, reqErr)
+		f := statusFile(reqErr.Status, r.Path)
+		respondHTTP1(f, conn, t)
+		newAccessEntry(r, r.Protocol, t.Remote, start).log(f.Status, int64(len(f.Body)))
+		return
+	}
 	if err != nil {
 		// Silence les erreurs de certificat
 		if strings.Contains(err.Error(), "unknown certificate") {
@@ -37,8 +77,35 @@ func handleHTTP1(conn net.Conn) {
 		log.Printf("Error handling request %v", err.Error())
 		return
 	}
-	respondHTTP1(r, conn)
-	fmt.Printf("x\n\n")
+	entry := newAccessEntry(r, r.Protocol, t.Remote, start)
+	if !ok {
+		f := misdirectedFile(r.Header("Host"))
+		respondHTTP1(f, conn, t)
+		entry.log(f.Status, int64(len(f.Body)))
+		return
+	}
+	if r.Form == authorityForm {
+		f := connectFile(r.URI)
+		respondHTTP1(f, conn, t)
+		entry.log(f.Status, int64(len(f.Body)))
+		return
+	}
+	if strings.EqualFold(r.Header("Upgrade"), "websocket") {
+		entry.log(upgradeWebSocket(r, conn, br, t), 0)
+		return
+	}
+	if "/"+r.Path == eventsPath {
+		respondEventsHTTP1(r, conn, t)
+		entry.log(http.StatusOK, 0)
+		return
+	}
+	if vh.proxy != nil {
+		entry.log(proxyHTTP1(vh.proxy, r, conn, t))
+		return
+	}
+	f := lookupStatic(vh.root, r)
+	respondHTTP1(f, conn, t)
+	entry.log(f.Status, int64(len(f.Body)))
 }
 
 /**
@@ -57,126 +124,267 @@ func handleHTTP1(conn net.Conn) {
 * firstname=John
 * ```
 **/
-func NewHTTP1Request(c net.Conn) (*Request, error) {
-	// Pour éviter le blocage, on ne lit plus au bout de 2 secondes
-	c.SetReadDeadline(time.Now().Add(2 * time.Second))
-
-	r := bufio.NewReader(c)
+func NewHTTP1Request(c net.Conn, r *bufio.Reader, t *traceConn) (*Request, error) {
+	// Pour éviter le blocage, la ligne de requête et les en-têtes doivent arriver avant -header-timeout
+	c.SetReadDeadline(time.Now().Add(limitOptions.headerTimeout))
 
 	// On lit la première ligne
-	method, path, protocol, err := readRequestLine(r)
+	method, path, protocol, raw, err := readRequestLine(r)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("⦿\n")
-	printLine(fmt.Sprintf("%s %s %s", method, path, protocol), true)
+	printLine(t, fmt.Sprintf("%s %s %s", method, path, protocol), true)
+	dump := []hexField{{"Ligne de requête", []byte(raw)}}
 
 	req := &Request{
 		Method:   method,
 		Path:     resolvePath(path),
 		Protocol: protocol,
-		Headers:  make(map[string]string),
+		URI:      path,
 	}
 
-	// On lit les en têtes
+	// On lit les en têtes, leur nombre et leur taille totale sont limités
+	headerBytes := 0
 	for {
-		name, value := readHeaderLine(r)
-		printHeader(name, value, true)
-		if name == "" {
+		raw, err := readLimitedLine(r, limitOptions.maxHeaderBytes-headerBytes)
+		if err != nil {
+			return req, readError(err, http.StatusRequestHeaderFieldsTooLarge, "les en-têtes")
+		}
+		headerBytes += len(raw)
+		if err := checkCRLF(raw); err != nil {
+			return req, newRequestError(http.StatusBadRequest, "%v", err)
+		}
+		if raw == "\r\n" {
+			printLine(t, "", true)
+			dump = append(dump, hexField{"Fin des en-têtes", []byte(raw)})
 			break
 		}
-		req.Headers[name] = value
-	}
-
-	// On lit le body
-	lengthHeader, ok := req.Headers["Content-Length"]
-	if ok {
-		contentLength, err := strconv.Atoi(lengthHeader)
-		if contentLength > 0 && err == nil {
-			body, err := r.Peek(contentLength)
-			if err == nil {
-				req.Body = string(body)
-				printLine(req.Body, true)
-			}
+		n := len(req.Headers)
+		if err := req.Headers.parseLine(raw); err != nil {
+			return req, newRequestError(http.StatusBadRequest, "%v", err)
 		}
+		if len(req.Headers) > limitOptions.maxHeaders {
+			return req, newRequestError(http.StatusRequestHeaderFieldsTooLarge, "plus de %v en-têtes", limitOptions.maxHeaders)
+		}
+		h := req.Headers[len(req.Headers)-1]
+		if len(req.Headers) == n {
+			printLine(t, "  "+strings.TrimSpace(raw), true)
+			dump = append(dump, hexField{"Suite de l'en-tête " + h.Name, []byte(raw)})
+			continue
+		}
+		printHeader(t, h.Name, h.Value, true)
+		dump = append(dump, hexField{"En-tête " + h.Name, []byte(raw)})
+	}
+
+	if err := req.setTarget(path); err != nil {
+		return req, err
 	}
 
-	// On lit les en-têtes
+	// Le corps reste sur la connexion, il est lu (ou transmis) par readHTTP1Body
+	contentLength, err := requestFraming(req)
+	if err != nil {
+		return req, err
+	}
+	if contentLength > limitOptions.maxBody {
+		return req, newRequestError(http.StatusRequestEntityTooLarge, "corps de %v octets, %v au maximum", contentLength, limitOptions.maxBody)
+	}
+	switch {
+	case contentLength < 0:
+		req.body = newBodyReader(newChunkedReader(r), c)
+	case contentLength > 0:
+		req.body = newBodyReader(&exactReader{r: r, remaining: contentLength}, c)
+	}
+	req.dump = dump
 	return req, nil
 }
 
-func readRequestLine(r *bufio.Reader) (string, string, string, error) {
-	l, err := r.ReadString('\n')
-	if err != nil {
-		return "", "", "", fmt.Errorf("impossible de lire la première ligne, %s\n", err.Error())
+/**
+* Lit le corps de la requête avec les limites de -max-body, -body-timeout et -min-rate,
+* puis affiche le message complet. Avec stream, le corps reste sur la connexion
+* (r.body) pour être transmis au serveur amont pendant sa lecture
+**/
+func readHTTP1Body(r *Request, t *traceConn, stream bool) error {
+	if r.body != nil && !stream {
+		body, err := io.ReadAll(r.body)
+		if err != nil {
+			return err
+		}
+		r.Body, r.body = string(body), nil
+		printLine(t, traceData(body), true)
+		r.dump = append(r.dump, hexField{"Corps", body[:min(len(body), traceMaxDataBytes)]})
 	}
-	l = strings.TrimSpace(l)
-	parts := strings.Split(l, " ")
-	if len(parts) != 3 {
-		return "", "", "", fmt.Errorf(
-			"impossible de lire la première ligne, 3 parties attendues, %v\n", l)
+	if traceOptions.hex {
+		t.lock(noStream)
+		printHexDump(r.dump, true)
+		t.unlock()
 	}
-	return parts[0], parts[1], parts[2], nil
+	line := strings.TrimSuffix(string(r.dump[0].Bytes), "\r\n")
+	t.message(true, line, r.Headers, r.dump, []byte(r.Body))
+	return nil
+}
+
+// Valeur d'un en-tête, sans tenir compte de la casse de son nom
+func (r *Request) Header(name string) string {
+	return r.Headers.Get(name)
 }
 
-func readHeaderLine(r *bufio.Reader) (string, string) {
-	l, err := r.ReadString('\n')
+// Renvoie aussi la ligne brute (fin de ligne comprise) pour l'affichage hexadécimal
+func readRequestLine(r *bufio.Reader) (string, string, string, string, error) {
+	raw, err := readLimitedLine(r, limitOptions.maxRequestLine)
 	if err != nil {
-		return "", ""
+		return "", "", "", raw, readError(err, http.StatusRequestURITooLong, "la ligne de requête")
+	}
+	if err := checkCRLF(raw); err != nil {
+		return "", "", "", raw, newRequestError(http.StatusBadRequest, "%v", err)
 	}
-	l = strings.TrimSpace(l)
-	parts := strings.Split(l, ":")
-	if len(parts) >= 2 {
-		return parts[0],
-			strings.TrimSpace(strings.Join(parts[1:], ":"))
+	l := strings.TrimSuffix(raw, "\r\n")
+	parts := strings.Split(l, " ")
+	if len(parts) != 3 {
+		return "", "", "", raw, newRequestError(http.StatusBadRequest,
+			"impossible de lire la première ligne, 3 parties attendues, %q", l)
 	}
-	return "", ""
+	return parts[0], parts[1], parts[2], raw, nil
 }
 
-func printLine(s string, in bool) {
+// Une connexion HTTP1 ne transporte qu'un message à la fois, les lignes n'ont pas de stream
+func printLine(t *traceConn, s string, in bool) {
+	t.lock(noStream)
+	defer t.unlock()
 	dirColor(in).Printf("| %s\n", s)
 }
 
-func printHeader(name string, value string, in bool) {
+func printHeader(t *traceConn, name string, value string, in bool) {
 	if name == "" {
-		printLine(name, in)
+		printLine(t, name, in)
 		return
 	}
-	if len(name)+len(value) > 50 {
-		value = value[0:(50-len(name))] + "..."
-	}
-	fmt.Printf(
+	t.lock(noStream)
+	defer t.unlock()
+	tracef(
 		"%s: %s\n",
 		dirColor(in).Sprintf("| "+name),
-		value,
+		truncateValue(name, value),
 	)
 }
 
+// Coupe la valeur pour que l'en-tête tienne sur 50 caractères,
+// un nom plus long garde seulement "..." comme valeur
+func truncateValue(name string, value string) string {
+	if len(name)+len(value) <= 50 {
+		return value
+	}
+	return value[:max(50-len(name), 0)] + "..."
+}
+
 // Trouve la couleur à utiliser (bleu pour la lecture, vert pour l'écriture)
 func dirColor(in bool) *color.Color {
+	if traceOutput.reversed {
+		in = !in
+	}
 	if in == false {
 		return green
 	}
 	return blue
 }
 
-// Trouve le fichier à charger en fonction du chemin demandé
-func resolvePath(path string) string {
-	if strings.HasSuffix(path, "/") {
-		path = path + "index.html"
+/**
+* Passe la connexion en WebSocket (RFC 6455 section 4.2)
+*
+* ```
+* HTTP/1.1 101 Switching Protocols
+* Upgrade: websocket
+* Connection: Upgrade
+* Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=
+* ```
+**/
+func upgradeWebSocket(r *Request, conn net.Conn, br *bufio.Reader, t *traceConn) int {
+	key := r.Header("Sec-WebSocket-Key")
+	code := 0
+	switch {
+	case r.Path != strings.Trim(webSocketPath, "/"):
+		code = http.StatusNotFound
+	case r.Method != "GET" || !strings.Contains(strings.ToLower(r.Header("Connection")), "upgrade") || !validWebSocketKey(key):
+		code = http.StatusBadRequest
+	case r.Header("Sec-WebSocket-Version") != "13":
+		code = http.StatusUpgradeRequired
+	}
+	if code != 0 {
+		status := fmt.Sprintf("%v %s", code, http.StatusText(code))
+		conn.Write([]byte("HTTP/1.1 " + status + "\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\n\r\n"))
+		printLine(t, "HTTP/1.1 "+status, false)
+		printLine(t, "", false)
+		t.message(false, "HTTP/1.1 "+status, []HeaderField{{Name: "Sec-WebSocket-Version", Value: "13"}, {Name: "Content-Length", Value: "0"}}, nil, nil)
+		return code
+	}
+
+	accept := webSocketAccept(key)
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"))
+	printLine(t, "HTTP/1.1 101 Switching Protocols", false)
+	printHeader(t, "Upgrade", "websocket", false)
+	printHeader(t, "Connection", "Upgrade", false)
+	printHeader(t, "Sec-WebSocket-Accept", accept, false)
+	printLine(t, "", false)
+	t.message(false, "HTTP/1.1 101 Switching Protocols", []HeaderField{
+		{Name: "Upgrade", Value: "websocket"},
+		{Name: "Connection", Value: "Upgrade"},
+		{Name: "Sec-WebSocket-Accept", Value: accept},
+	}, nil, nil)
+
+	// La connexion reste ouverte, on supprime la limite de temps de lecture
+	conn.SetReadDeadline(time.Time{})
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{br, conn}
+	if err := serveWebSocket(rw, t, noStream); err != nil && err != io.EOF {
+		log.Printf("Erreur WebSocket %v", err)
 	}
-	return strings.Trim(path, "/")
+	return http.StatusSwitchingProtocols
 }
 
-func respondHTTP1(r *Request, w io.Writer) {
-	w.Write([]byte("HTTP/1.1 200 OK\n"))
-	format := fmt.Sprintf("text/%s", getFileExtension(r.Path))
-	w.Write([]byte("Content-Type: " + format + "\n"))
+// Le flux d'évènements n'a pas de taille connue à l'avance, le corps est envoyé par chunks
+func respondEventsHTTP1(r *Request, w io.Writer, t *traceConn) {
+	w.Write([]byte("HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/event-stream\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n"))
+	printLine(t, "HTTP/1.1 200 OK", false)
+	printHeader(t, "Content-Type", "text/event-stream", false)
+	printHeader(t, "Cache-Control", "no-cache", false)
+	printHeader(t, "Transfer-Encoding", "chunked", false)
+	printLine(t, "", false)
+	t.message(false, "HTTP/1.1 200 OK", []HeaderField{
+		{Name: "Content-Type", Value: "text/event-stream"},
+		{Name: "Cache-Control", Value: "no-cache"},
+		{Name: "Transfer-Encoding", Value: "chunked"},
+	}, nil, nil)
+
+	cw := chunkedWriter{w, t}
+	if err := serveEvents(cw, r.Header("Last-Event-ID"), t, noStream); err != nil {
+		return
+	}
+	cw.Close()
+}
+
+func respondHTTP1(f staticFile, w io.Writer, t *traceConn) {
+	status := fmt.Sprintf("HTTP/1.1 %v %s", f.Status, http.StatusText(f.Status))
+	w.Write([]byte(status + "\n"))
+	headers := f.headers().Canonical()
+	for _, h := range headers {
+		w.Write([]byte(h.Name + ": " + h.Value + "\n"))
+	}
 	w.Write([]byte("\n"))
-	readFileInto("public/"+r.Path, w)
+	w.Write(f.Body)
 
-	printLine("HTTP/1.1 200 OK", false)
-	printHeader("Content-Type", format, false)
-	printLine("", false)
-	printLine("...", false)
+	printLine(t, status, false)
+	for _, h := range headers {
+		printHeader(t, h.Name, h.Value, false)
+	}
+	printLine(t, "", false)
+	printLine(t, "...", false)
+	printCompression(t, noStream, f)
+	t.message(false, status, headers, nil, nil)
 }
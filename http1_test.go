@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Le serveur n'est pas un proxy, un CONNECT classique reçoit 405 avec les méthodes permises
+func TestHTTP1Connect(t *testing.T) {
+	client, server := net.Pipe()
+	go handleHTTP1(server)
+	defer client.Close()
+	go io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("statut %v et Allow %q, 405 et GET, HEAD, OPTIONS attendus", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
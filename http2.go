@@ -2,266 +2,850 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
-
-	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
+	"time"
 )
 
 const HTTP2 = "h2"
 
-var decoder = hpack.NewDecoder(2048, nil)
+// Préface envoyée par le client avant sa première frame
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Taille de la table dynamique HPACK tant que le pair n'a pas annoncé HEADER_TABLE_SIZE
+const defaultHeaderTableSize = 4096
+
+// Connexion HTTP2, plusieurs streams (WebSocket, évènements) pouvant écrire
+// en parallèle les écritures sont protégées par un mutex
+type h2Conn struct {
+	w  io.Writer
+	mu sync.Mutex
+	// Streams restés ouverts après la requête (WebSocket, évènements)
+	streams map[uint32]*h2Stream
+
+	// La compression des en-têtes a un état propre à chaque connexion et à chaque sens
+	decoder headerDecoder
+	encoder headerEncoder
+
+	// Taille maximale des frames envoyées, annoncée par le client
+	maxFrameSize uint32
+	lastStreamID uint32
+	// Nom demandé lors du handshake (SNI), comparé à :authority pour choisir le virtual host
+	serverName string
+
+	// Contrôle de flux (RFC 9113 section 5.2) : une frame DATA n'est envoyée que s'il reste
+	// de la place dans la fenêtre de la connexion et dans celle de son stream
+	sendWindow    int64
+	streamWindows map[uint32]int64
+	// SETTINGS_INITIAL_WINDOW_SIZE du pair, fenêtre de départ de chaque stream
+	initialWindow int64
+	// Signalé quand une fenêtre grandit, qu'un stream est annulé ou que la connexion se termine
+	windowUpdated *sync.Cond
+	closed        bool
+
+	trace *traceConn
+}
+
+func newH2Conn(w io.Writer, remote string) *h2Conn {
+	c := &h2Conn{
+		w:             w,
+		streams:       make(map[uint32]*h2Stream),
+		maxFrameSize:  defaultMaxFrameSize,
+		sendWindow:    defaultInitialWindowSize,
+		streamWindows: make(map[uint32]int64),
+		initialWindow: defaultInitialWindowSize,
+		trace:         newTraceConn(HTTP2, remote),
+	}
+	c.windowUpdated = sync.NewCond(&c.mu)
+	return c
+}
 
 func handleHTTP2(conn net.Conn) {
 	defer conn.Close()
-	fmt.Printf("⦿\n")
-	defer fmt.Printf("x\n")
+	c := newH2Conn(conn, conn.RemoteAddr().String())
+	state := tlsState(conn)
+	alpn := ""
+	if state != nil {
+		c.serverName = state.ServerName
+		alpn = state.NegotiatedProtocol
+	}
+	c.trace.open(state)
+	defer c.trace.close()
+	defer recordConnection(HTTP2, alpn)()
 
 	// On lit la préface
-	preface, err := readBytes(conn, 24)
+	preface, err := readBytes(conn, len(h2Preface))
 	if err != nil {
 		log.Printf("impossible de lire la préface %v", err.Error())
 		return
 	}
+	c.trace.lock(noStream)
 	dirColor(true).Printf("+- Preface : %q\n|\n", string(preface))
+	c.trace.unlock()
+	c.decoder, c.encoder = newHeaderCodec()
+
+	// Le serveur commence par ses propres SETTINGS
+	err = c.writeFrame(Frame{
+		Type: frameTypeSettings,
+		Settings: []H2Setting{
+			{ID: h2SettingEnableConnectProtocol, Value: 1},
+			{ID: h2SettingMaxHeaderListSize, Value: uint32(limitOptions.maxHeaderBytes)},
+		},
+	})
+	if err != nil {
+		log.Printf("Impossible d'envoyer les Settings")
+		return
+	}
+	defer func() {
+		c.closeWindows()
+		c.mu.Lock()
+		streams := make([]*h2Stream, 0, len(c.streams))
+		for _, s := range c.streams {
+			streams = append(streams, s)
+		}
+		c.mu.Unlock()
+		for _, s := range streams {
+			s.cancel(io.EOF)
+		}
+	}()
 
-	// Permet de dupliquer le writer pour pouvoir écouter les frames renvoyées au client
-	pr, pw := io.Pipe()
-	multiWriter := io.MultiWriter(pw, conn)
-	framer := http2.NewFramer(multiWriter, conn)
-
-	go frameListener(pr, false)
+	err = c.serve(conn)
+	var h2Err *h2Error
+	if errors.As(err, &h2Err) {
+		c.goAway(h2Err)
+		return
+	}
+	if err == io.EOF {
+		c.trace.lock(noStream)
+		printKeyValue("EOF", true, true)
+		c.trace.unlock()
+		return
+	}
+	if err != nil {
+		log.Printf("Impossible de lire la frame %s", err.Error())
+	}
+}
 
-	// Ecoute les frames entrantes
+// Ecoute les frames entrantes jusqu'à la fin de la connexion
+func (c *h2Conn) serve(r io.Reader) error {
 	requests := make(map[uint32]*Request)
-	for {
-		frame, err := framer.ReadFrame()
-		if err == io.EOF {
-			printKeyValue("EOF", true, true)
-			return
+	entries := make(map[uint32]*accessEntry)
+	defer func() {
+		for _, entry := range entries {
+			entry.abort()
 		}
+	}()
+	// HEADERS dont le bloc d'en-têtes continue dans des frames CONTINUATION
+	var pending *Frame
+	var block []byte
+
+	for {
+		f, err := NewFrame(r, defaultMaxFrameSize)
 		if err != nil {
-			log.Printf("Impossible de lire la frame %s", err.Error())
-			return
+			return err
 		}
-		printFrame(frame, true)
-		switch f := frame.(type) {
-		case *http2.SettingsFrame:
-			err := framer.WriteSettingsAck()
-			if err != nil {
+		if pending != nil && (f.Type != frameTypeContinuation || f.StreamID != pending.StreamID) {
+			return newH2Error(H2ErrCodeProtocolError, "CONTINUATION attendue sur le stream #%v, reçu %s", pending.StreamID, f.Type)
+		}
+
+		switch f.Type {
+		case frameTypeSettings:
+			c.printFrame(f, true)
+			if f.Has(flagAck) {
+				continue
+			}
+			if err := c.applySettings(f.Settings); err != nil {
+				return err
+			}
+			if err := c.writeFrame(Frame{Type: frameTypeSettings, Flags: flagAck}); err != nil {
 				log.Printf("Impossible d'envoyer l'acceptation des Settings")
-				return
+				return err
+			}
+		case frameTypeHeaders, frameTypeContinuation:
+			if f.Type == frameTypeContinuation && pending == nil {
+				return newH2Error(H2ErrCodeProtocolError, "CONTINUATION sans HEADERS")
 			}
-		case *http2.WindowUpdateFrame:
-		case *http2.HeadersFrame:
-			if !f.Flags.Has(http2.FlagHeadersEndHeaders) {
+			if f.Type == frameTypeHeaders {
+				pending = &f
+				block = nil
+				if f.StreamID > c.lastStreamID {
+					c.lastStreamID = f.StreamID
+					c.openWindow(f.StreamID)
+				}
+			}
+			// Le bloc est gardé jusqu'à END_HEADERS, un flot de CONTINUATION ne doit pas le faire
+			// grossir sans fin. Il ne peut pas être ignoré sans désynchroniser la table HPACK
+			if len(block)+len(f.BlockFragment) > limitOptions.maxHeaderBytes {
+				c.printFrame(f, true)
+				return newH2Error(H2ErrCodeEnhanceYourCalm, "bloc d'en-têtes de plus de %v octets", limitOptions.maxHeaderBytes)
+			}
+			block = append(block, f.BlockFragment...)
+			if !f.Has(flagEndHeaders) {
+				c.printFrame(f, true)
 				continue
 			}
 
-			r, err := NewHTTP2Request(f)
+			fields, err := c.decoder.DecodeFull(block)
 			if err != nil {
-				log.Printf("Impossible d'interpréter les en têtes")
-				return
+				return newH2Error(H2ErrCodeCompressionError, "impossible de décoder les en-têtes, %s", err.Error())
+			}
+			recordHeaders(HTTP2, fields, len(block), true)
+			c.printFrame(f, true, fields...)
+			headers := *pending
+			pending = nil
+
+			// Une requête mal formée n'annule que son stream (RFC 9113 section 8.1.1),
+			// une cible invalide reçoit une réponse comme en HTTP1
+			// Les réponses sont envoyées à côté de cette boucle, qui doit continuer à lire
+			// les WINDOW_UPDATE pour que leurs frames DATA puissent partir
+			r, err := NewHTTP2Request(fields)
+			// Un petit bloc peut référencer de longues entrées de la table HPACK
+			if size := headerListSize(fields); err == nil && size > limitOptions.maxHeaderBytes {
+				err = newRequestError(http.StatusRequestHeaderFieldsTooLarge, "en-têtes de %v octets, limite %v", size, limitOptions.maxHeaderBytes)
+			}
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				printRequestError(c.trace, uint64(headers.StreamID), reqErr)
+				f := statusFile(reqErr.Status, r.Path)
+				entry := newAccessEntry(r, "HTTP/2.0", c.trace.Remote, time.Now())
+				go c.respondFile(f, headers.StreamID, entry)
+				continue
+			}
+			if err != nil {
+				c.resetStream(headers.StreamID, newH2Error(H2ErrCodeProtocolError, "%s", err.Error()))
+				continue
+			}
+
+			entry := newAccessEntry(r, "HTTP/2.0", c.trace.Remote, time.Now())
+			vh, ok := selectVHost(c.serverName, r.Header(":authority"))
+			if !ok {
+				go c.respondFile(misdirectedFile(r.Header(":authority")), headers.StreamID, entry)
+				continue
+			}
+
+			if r.Form == authorityForm {
+				go c.respondFile(connectFile(r.URI), headers.StreamID, entry)
+				continue
+			}
+			// Extended CONNECT : le stream reste ouvert et transporte une connexion WebSocket
+			if r.Method == "CONNECT" {
+				c.connectWebSocket(r, headers.StreamID, entry)
+				continue
+			}
+
+			if vh.proxy != nil && "/"+r.Path != eventsPath {
+				c.proxy(vh.proxy, r, headers.StreamID, headers.Has(flagEndStream), entry)
+				continue
 			}
 
 			// On peut commencer à répondre
-			requests[f.StreamID] = r
+			requests[headers.StreamID] = r
+			entries[headers.StreamID] = entry
 
-			if f.Flags.Has(http2.FlagHeadersEndStream) {
-				respondHTTP2(r, f.StreamID, framer)
-				delete(requests, f.StreamID)
+			if headers.Has(flagEndStream) {
+				go c.respond(r, headers.StreamID, entry)
+				delete(requests, headers.StreamID)
+				delete(entries, headers.StreamID)
 			}
 
-		case *http2.DataFrame:
-			if f.Flags.Has(http2.FlagDataEndStream) {
-				respondHTTP2(requests[f.StreamID], f.StreamID, framer)
+		case frameTypeData:
+			c.printFrame(f, true)
+			// La fenêtre de la connexion est rendue aussitôt : chaque stream ne garde en
+			// attente que sa propre fenêtre, un handler lent ne bloque pas les autres streams
+			if f.Length > 0 {
+				c.writeFrame(Frame{Type: frameTypeWindowUpdate, WindowIncrement: f.Length})
+			}
+			if s := c.stream(f.StreamID); s != nil {
+				if err := s.receive(f); err != nil {
+					c.resetStream(f.StreamID, err)
+				}
+				continue
+			}
+			// Le corps d'une requête servie depuis les fichiers est ignoré
+			if f.Length > 0 {
+				c.writeFrame(Frame{Type: frameTypeWindowUpdate, StreamID: f.StreamID, WindowIncrement: f.Length})
+			}
+			if r, ok := requests[f.StreamID]; ok && f.Has(flagEndStream) {
+				go c.respond(r, f.StreamID, entries[f.StreamID])
 				delete(requests, f.StreamID)
+				delete(entries, f.StreamID)
 			}
-		case *http2.GoAwayFrame:
-			return
+		case frameTypeRSTStream:
+			c.printFrame(f, true)
+			entries[f.StreamID].abort()
+			delete(requests, f.StreamID)
+			delete(entries, f.StreamID)
+			c.dropWindow(f.StreamID)
+			if s := c.stream(f.StreamID); s != nil {
+				s.cancel(fmt.Errorf("stream #%v annulé par le client", f.StreamID))
+			}
+		case frameTypeWindowUpdate:
+			c.printFrame(f, true)
+			if err := c.windowUpdate(f); err != nil {
+				if f.StreamID == 0 {
+					return err
+				}
+				entries[f.StreamID].abort()
+				delete(requests, f.StreamID)
+				delete(entries, f.StreamID)
+				c.resetStream(f.StreamID, err)
+			}
+		case frameTypePing:
+			c.printFrame(f, true)
+			if !f.Has(flagAck) {
+				c.writeFrame(Frame{Type: frameTypePing, Flags: flagAck, PingData: f.PingData})
+			}
+		case frameTypePushPromise:
+			c.printFrame(f, true)
+			return newH2Error(H2ErrCodeProtocolError, "un client ne peut pas envoyer de PUSH_PROMISE")
+		case frameTypeGoAway:
+			// Les réponses en cours se terminent, le client ferme la connexion ensuite
+			c.printFrame(f, true)
 		default:
-			fmt.Printf("Unknown type %T\n", f)
+			c.printFrame(f, true)
 		}
+	}
+}
+
+// Prend en compte les paramètres du client pour les frames envoyées
+func (c *h2Conn) applySettings(settings []H2Setting) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case h2SettingMaxFrameSize:
+			c.maxFrameSize = s.Value
+		case h2SettingHeaderTableSize:
+			c.encoder.SetMaxDynamicTableSizeLimit(s.Value)
+		case h2SettingInitialWindowSize:
+			// La différence s'applique aussi aux streams ouverts, leur fenêtre peut devenir négative
+			delta := int64(s.Value) - c.initialWindow
+			c.initialWindow = int64(s.Value)
+			for id, window := range c.streamWindows {
+				if window+delta > maxWindowSize {
+					return newH2Error(H2ErrCodeFlowControlError, "fenêtre du stream #%v supérieure à 2^31-1", id)
+				}
+				c.streamWindows[id] = window + delta
+			}
+			c.windowUpdated.Broadcast()
+		}
+	}
+	return nil
+}
 
+/**
+* Agrandit la fenêtre d'envoi de la connexion (stream 0) ou d'un stream. L'erreur concerne
+* la connexion pour le stream 0, seulement le stream sinon
+*
+* ```
+* WINDOW_UPDATE #0 +0          → GOAWAY PROTOCOL_ERROR
+* WINDOW_UPDATE #3 +0          → RST_STREAM #3 PROTOCOL_ERROR
+* WINDOW_UPDATE #3 +2147483647 → RST_STREAM #3 FLOW_CONTROL_ERROR
+* ```
+**/
+func (c *h2Conn) windowUpdate(f Frame) *h2Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	increment := int64(f.WindowIncrement)
+	if increment == 0 {
+		return newH2Error(H2ErrCodeProtocolError, "WINDOW_UPDATE avec un incrément nul")
 	}
+	if f.StreamID == 0 {
+		if c.sendWindow+increment > maxWindowSize {
+			return newH2Error(H2ErrCodeFlowControlError, "fenêtre de la connexion supérieure à 2^31-1")
+		}
+		c.sendWindow += increment
+		c.windowUpdated.Broadcast()
+		return nil
+	}
+	// Un stream déjà terminé peut encore recevoir des WINDOW_UPDATE, elles sont ignorées
+	// La fenêtre d'un stream existe dès ses HEADERS, avant que la réponse ne commence
+	window, ok := c.streamWindows[f.StreamID]
+	if !ok {
+		return nil
+	}
+	if window+increment > maxWindowSize {
+		return newH2Error(H2ErrCodeFlowControlError, "fenêtre du stream #%v supérieure à 2^31-1", f.StreamID)
+	}
+	c.streamWindows[f.StreamID] = window + increment
+	c.windowUpdated.Broadcast()
+	return nil
+}
 
+// Attend de pouvoir envoyer au moins un octet sur le stream, renvoie la taille de la
+// prochaine frame DATA (0 pour une frame vide) et la retire des fenêtres, c.mu est tenu
+func (c *h2Conn) reserveWindow(streamID uint32, size int) (int, error) {
+	for {
+		window, ok := c.streamWindows[streamID]
+		switch {
+		case c.closed:
+			return 0, errors.New("connexion fermée")
+		case !ok:
+			return 0, fmt.Errorf("stream #%v fermé", streamID)
+		case size == 0:
+			return 0, nil
+		}
+		if n := min(int64(size), int64(c.maxFrameSize), window, c.sendWindow); n > 0 {
+			c.sendWindow -= n
+			c.streamWindows[streamID] -= n
+			return int(n), nil
+		}
+		c.windowUpdated.Wait()
+	}
 }
 
-func frameListener(r io.Reader, in bool) {
-	framer := http2.NewFramer(nil, r)
+// Ouvre la fenêtre d'envoi d'un nouveau stream, retirée quand il se termine
+// (END_STREAM envoyé ou RST_STREAM)
+func (c *h2Conn) openWindow(streamID uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.streamWindows[streamID]; !ok {
+		c.streamWindows[streamID] = c.initialWindow
+	}
+}
 
+// Le stream est terminé, les écritures en attente de sa fenêtre échouent
+func (c *h2Conn) dropWindow(streamID uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streamWindows, streamID)
+	c.windowUpdated.Broadcast()
+}
+
+// La connexion est terminée, plus aucune frame DATA ne sera envoyée
+func (c *h2Conn) closeWindows() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.windowUpdated.Broadcast()
+}
+
+// Annule un stream suite à une erreur qui ne concerne que lui (RFC 9113 section 5.4.2)
+func (c *h2Conn) resetStream(streamID uint32, err *h2Error) {
+	printH2Error(c.trace, uint64(streamID), err.Code, err.Msg, false)
+	c.writeFrame(Frame{Type: frameTypeRSTStream, StreamID: streamID, ErrorCode: err.Code})
+	c.dropWindow(streamID)
+	if s := c.stream(streamID); s != nil {
+		s.cancel(err)
+	}
+}
+
+// Ferme la connexion suite à une erreur en indiquant le dernier stream traité
+func (c *h2Conn) goAway(err *h2Error) {
+	printH2Error(c.trace, noStream, err.Code, err.Msg, false)
+	c.writeFrame(Frame{
+		Type:         frameTypeGoAway,
+		LastStreamID: c.lastStreamID,
+		ErrorCode:    err.Code,
+		DebugData:    []byte(err.Msg),
+	})
+}
+
+func (c *h2Conn) writeFrame(f Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeFrameLocked(f)
+}
+
+func (c *h2Conn) writeFrameLocked(f Frame, fields ...HeaderField) error {
+	c.printFrame(f, false, fields...)
+	return f.Write(c.w)
+}
+
+// Envoie les en-têtes encodés avec l'état HPACK de la connexion,
+// un bloc trop grand pour une frame est découpé en frames CONTINUATION
+func (c *h2Conn) writeHeaders(streamID uint32, endStream bool, fields []HeaderField) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if endStream {
+		delete(c.streamWindows, streamID)
+	}
+	block := c.encoder.Encode(fields)
+	recordHeaders(HTTP2, fields, len(block), false)
+
+	f := Frame{Type: frameTypeHeaders, StreamID: streamID}
+	if endStream {
+		f.Flags |= flagEndStream
+	}
+	for {
+		n := min(len(block), int(c.maxFrameSize))
+		f.BlockFragment, block = block[:n], block[n:]
+		if len(block) == 0 {
+			f.Flags |= flagEndHeaders
+			return c.writeFrameLocked(f, fields...)
+		}
+		if err := c.writeFrameLocked(f); err != nil {
+			return err
+		}
+		f = Frame{Type: frameTypeContinuation, StreamID: streamID}
+	}
+}
+
+// Envoie les données en les découpant selon la taille maximale des frames du client,
+// en attendant si besoin que ses fenêtres de contrôle de flux s'agrandissent
+func (c *h2Conn) writeData(streamID uint32, endStream bool, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for {
-		frame, err := framer.ReadFrame()
+		n, err := c.reserveWindow(streamID, len(data))
 		if err != nil {
-			return
+			return err
+		}
+		f := Frame{Type: frameTypeData, StreamID: streamID, Data: data[:n]}
+		data = data[n:]
+		if endStream && len(data) == 0 {
+			f.Flags |= flagEndStream
+			delete(c.streamWindows, streamID)
+		}
+		if err := c.writeFrameLocked(f); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
 		}
-		printFrame(frame, in)
 	}
 }
 
-var printMu sync.Mutex
+func (c *h2Conn) respond(r *Request, streamID uint32, entry *accessEntry) {
+	if "/"+r.Path == eventsPath {
+		go c.streamEvents(r, streamID, entry)
+		return
+	}
+	vh, _ := selectVHost(c.serverName, r.Header(":authority"))
+	c.respondFile(lookupStatic(vh.root, r), streamID, entry)
+}
 
-// Ecoute les frame et affiche dans le terminal
-func printFrame(f http2.Frame, in bool) {
-	printMu.Lock()
-	defer printMu.Unlock()
-	switch f := f.(type) {
-	case *http2.SettingsFrame:
-		printSettingFrame(f, in)
-	case *http2.WindowUpdateFrame:
-		printUpdateFrame(f, in)
-	case *http2.HeadersFrame:
-		printHeadersFrame(f, in)
-	case *http2.DataFrame:
-		printDataFrame(f, in)
+func (c *h2Conn) respondFile(f staticFile, streamID uint32, entry *accessEntry) {
+	respondHTTP2(f, streamID, c)
+	entry.log(f.Status, int64(len(f.Body)))
+}
+
+// WebSocket sur HTTP2 (RFC 8441), la requête CONNECT contient :protocol = websocket
+// et les frames WebSocket sont transportées dans les frames DATA du stream
+// Un autre :protocol n'est pas implémenté (501), le CONNECT classique est refusé avant
+func (c *h2Conn) connectWebSocket(r *Request, streamID uint32, entry *accessEntry) {
+	status := "200"
+	switch {
+	case r.Header(":protocol") != "websocket":
+		status = "501"
+	case "/"+r.Path != webSocketPath:
+		status = "404"
+	case r.Header("sec-websocket-version") != "13":
+		status = "400"
 	}
+	c.writeHeaders(streamID, status != "200", []HeaderField{{Name: ":status", Value: status}})
+	code, _ := strconv.Atoi(status)
+	if status != "200" {
+		entry.log(code, 0)
+		return
+	}
+
+	s := c.openStream(streamID)
+	go func() {
+		if err := serveWebSocket(s, c.trace, uint64(streamID)); err != nil && err != io.EOF {
+			log.Printf("Erreur WebSocket %v", err)
+		}
+		s.Close()
+		entry.log(code, 0)
+	}()
 }
 
-func printSettingFrame(f *http2.SettingsFrame, in bool) {
-	color := dirColor(in)
-	defer color.Printf("|\n")
-	color.Printf("+- SETTINGS\n")
-	printFlag("ACK", f.IsAck(), in)
-	f.ForeachSetting(func(s http2.Setting) error {
-		printKeyValue(s.ID.String(), s.Val, in)
-		return nil
+// Envoie le flux d'évènements dans une succession de frames DATA sur le même stream
+func (c *h2Conn) streamEvents(r *Request, streamID uint32, entry *accessEntry) {
+	s := c.openStream(streamID)
+	err := c.writeHeaders(streamID, false, []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/event-stream"},
+		{Name: "cache-control", Value: "no-cache"},
 	})
+	if err != nil {
+		return
+	}
+	defer entry.log(http.StatusOK, 0)
+	if err := serveEvents(s, r.Header("last-event-id"), c.trace, uint64(streamID)); err != nil {
+		s.cancel(err)
+		return
+	}
+	s.Close()
 }
 
-func printUpdateFrame(f *http2.WindowUpdateFrame, in bool) {
-	color := dirColor(in)
-	defer color.Printf("|\n")
-	color.Printf("+- WINDOW_UPDATE")
-	fmt.Printf(" #%v", f.StreamID)
-	fmt.Println()
+// Stream HTTP2 utilisé comme un flux bidirectionnel
+type h2Stream struct {
+	conn *h2Conn
+	id   uint32
+	// Corps de la requête reçu dans les frames DATA et pas encore lu par le handler,
+	// il ne dépasse jamais la fenêtre de réception annoncée au client
+	body bytes.Buffer
+	// io.EOF après END_STREAM, l'erreur d'annulation si le stream est annulé
+	bodyErr error
+	// Place restante dans la fenêtre de réception, rendue au client à mesure de la lecture
+	recvWindow int64
+	// Signalé sur c.mu quand des données arrivent ou que le corps se termine
+	received *sync.Cond
+	// Fermé quand le stream est annulé (RST_STREAM ou fin de la connexion)
+	reset chan struct{}
 }
 
-func printSettingACK() {
-	color := dirColor(false)
-	defer color.Printf("|\n")
-	color.Printf("+- SETTINGS\n")
-	color.Printf("| 🏁 ACK:")
-	fmt.Printf("%v\n", true)
+// Enregistre un stream qui reste ouvert après la réception des en-têtes
+func (c *h2Conn) openStream(id uint32) *h2Stream {
+	s := &h2Stream{conn: c, id: id, recvWindow: defaultInitialWindowSize, reset: make(chan struct{})}
+	s.received = sync.NewCond(&c.mu)
+	c.mu.Lock()
+	c.streams[id] = s
+	c.mu.Unlock()
+	return s
+}
+
+func (c *h2Conn) stream(id uint32) *h2Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+/**
+* Ajoute une frame DATA au corps sans bloquer la boucle de lecture de la connexion,
+* qui doit continuer à recevoir les WINDOW_UPDATE. Le client ne peut pas dépasser la
+* fenêtre du stream, le corps en attente de lecture est donc limité à cette fenêtre
+*
+* ```
+* DATA #1 (65535 octets) → fenêtre 0, le client attend que le handler lise
+* lecture de 16384 octets → WINDOW_UPDATE #1 +16384
+* ```
+**/
+func (s *h2Stream) receive(f Frame) *h2Error {
+	c := s.conn
+	c.mu.Lock()
+	if int64(f.Length) > s.recvWindow {
+		c.mu.Unlock()
+		return newH2Error(H2ErrCodeFlowControlError, "%v octets reçus sur le stream #%v, fenêtre de %v", f.Length, s.id, s.recvWindow)
+	}
+	s.recvWindow -= int64(f.Length)
+	// Le padding n'est pas lu par le handler, ni le corps d'un stream qu'il a cessé de lire
+	returned := f.Length - uint32(len(f.Data))
+	if s.bodyErr == nil {
+		s.body.Write(f.Data)
+	} else {
+		returned = f.Length
+	}
+	if f.Has(flagEndStream) {
+		s.endBody(io.EOF)
+		returned = 0
+	}
+	s.recvWindow += int64(returned)
+	s.received.Broadcast()
+	c.mu.Unlock()
+	if returned > 0 {
+		c.writeFrame(Frame{Type: frameTypeWindowUpdate, StreamID: s.id, WindowIncrement: returned})
+	}
+	return nil
+}
+
+// Termine le corps, une erreur autre que io.EOF abandonne les données pas encore lues,
+// c.mu est tenu
+func (s *h2Stream) endBody(err error) {
+	if err != io.EOF {
+		s.body.Reset()
+	} else if s.bodyErr != nil {
+		return
+	}
+	s.bodyErr = err
+	s.received.Broadcast()
+}
+
+// Lit le corps reçu, la place libérée dans la fenêtre est rendue au client
+func (s *h2Stream) Read(p []byte) (int, error) {
+	c := s.conn
+	c.mu.Lock()
+	for s.body.Len() == 0 && s.bodyErr == nil {
+		s.received.Wait()
+	}
+	if s.body.Len() == 0 {
+		defer c.mu.Unlock()
+		return 0, s.bodyErr
+	}
+	n, _ := s.body.Read(p)
+	// Après END_STREAM le client n'enverra plus rien, inutile d'agrandir la fenêtre
+	update := s.bodyErr == nil
+	if update {
+		s.recvWindow += int64(n)
+	}
+	c.mu.Unlock()
+	if update {
+		c.writeFrame(Frame{Type: frameTypeWindowUpdate, StreamID: s.id, WindowIncrement: uint32(n)})
+	}
+	return n, nil
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	select {
+	case <-s.reset:
+		return 0, fmt.Errorf("stream #%v annulé", s.id)
+	default:
+	}
+	if err := s.conn.writeData(s.id, false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Ferme le stream côté serveur avec une frame DATA vide portant END_STREAM
+func (s *h2Stream) Close() error {
+	s.conn.mu.Lock()
+	s.endBody(io.ErrClosedPipe)
+	delete(s.conn.streams, s.id)
+	s.conn.mu.Unlock()
+	select {
+	case <-s.reset:
+		return nil
+	default:
+	}
+	return s.conn.writeData(s.id, true, nil)
+}
+
+// Annule le stream, les lectures et écritures suivantes échouent
+func (s *h2Stream) cancel(err error) {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	select {
+	case <-s.reset:
+		return
+	default:
+	}
+	close(s.reset)
+	s.endBody(err)
+	delete(s.conn.streams, s.id)
+	delete(s.conn.streamWindows, s.id)
+	s.conn.windowUpdated.Broadcast()
 }
 
-func printHeadersFrame(f *http2.HeadersFrame, in bool) {
+// Affiche la frame et la transmet au tableau de bord
+func (c *h2Conn) printFrame(f Frame, in bool, fields ...HeaderField) {
+	printFrame(c.trace, f, in, fields...)
+	c.trace.frame(f, in, fields)
+	recordFrame(HTTP2, f.Type.String(), in)
+}
+
+// Affiche une frame dans le terminal, les en-têtes décodés sont passés
+// séparément car le décodage HPACK dépend de l'état de la connexion
+func printFrame(t *traceConn, f Frame, in bool, fields ...HeaderField) {
+	t.lock(uint64(f.StreamID))
+	defer t.unlock()
 	color := dirColor(in)
 	defer color.Printf("|\n")
-	color.Printf("+- HEADERS")
-	fmt.Printf(" #%v", f.StreamID)
-	fmt.Println()
-
-	printFlag("END_STREAM", f.Flags.Has(http2.FlagHeadersEndStream), in)
-	printFlag("END_HEADERS", f.Flags.Has(http2.FlagHeadersEndHeaders), in)
-	printFlag("PADDED", f.Flags.Has(http2.FlagHeadersPadded), in)
-	printFlag("PRIORITY", f.Flags.Has(http2.FlagHeadersPriority), in)
+	color.Printf("+- %s", f.Type)
+	if f.StreamID != 0 {
+		tracef(" #%v", f.StreamID)
+	}
+	tracef("\n")
+
+	switch f.Type {
+	case frameTypeSettings:
+		printFlag("ACK", f.Has(flagAck), in)
+		for _, s := range f.Settings {
+			name, ok := h2SettingNames[s.ID]
+			if !ok {
+				name = fmt.Sprintf("UNKNOWN_SETTING_%v", s.ID)
+			}
+			printKeyValue(name, s.Value, in)
+		}
+	case frameTypeWindowUpdate:
+		printKeyValue("Increment", f.WindowIncrement, in)
+	case frameTypeHeaders:
+		printFlag("END_STREAM", f.Has(flagEndStream), in)
+		printFlag("END_HEADERS", f.Has(flagEndHeaders), in)
+		printFlag("PADDED", f.Has(flagPadded), in)
+		printFlag("PRIORITY", f.Has(flagPriority), in)
+		if f.Has(flagPriority) {
+			printPriority(f.Priority, in)
+		}
+	case frameTypeContinuation:
+		printFlag("END_HEADERS", f.Has(flagEndHeaders), in)
+	case frameTypeData:
+		printFlag("END_STREAM", f.Has(flagEndStream), in)
+		printFlag("PADDED", f.Has(flagPadded), in)
+		printKeyValue("Data", fmt.Sprintf("%q", f.Data), in)
+	case frameTypePriority:
+		printPriority(f.Priority, in)
+	case frameTypeRSTStream:
+		printKeyValue("Error", f.ErrorCode.String(), in)
+	case frameTypePushPromise:
+		printFlag("END_HEADERS", f.Has(flagEndHeaders), in)
+		printKeyValue("Promised stream", f.PromisedStreamID, in)
+	case frameTypePing:
+		printFlag("ACK", f.Has(flagAck), in)
+		printKeyValue("Data", fmt.Sprintf("%x", f.PingData), in)
+	case frameTypeGoAway:
+		printKeyValue("Last stream", f.LastStreamID, in)
+		printKeyValue("Error", f.ErrorCode.String(), in)
+		if len(f.DebugData) > 0 {
+			printKeyValue("Debug", string(f.DebugData), in)
+		}
+	default:
+		printKeyValue("Length", f.Length, in)
+	}
 
-	hf, _ := decoder.DecodeFull(f.HeaderBlockFragment())
-	for _, h := range hf {
+	for _, h := range fields {
 		printKeyValue(h.Name, h.Value, in)
+		if hpackOptions.verbose && h.Encoding != nil {
+			printFieldEncoding(h, in)
+		}
+	}
+	if traceOptions.hex {
+		printHexDump(f.hexFields(fields), in)
 	}
 }
 
-func printDataFrame(f *http2.DataFrame, in bool) {
+// Affiche la représentation HPACK d'un en-tête sous sa valeur
+func printFieldEncoding(h HeaderField, in bool) {
 	color := dirColor(in)
-	defer color.Printf("|\n")
-	color.Printf("+- DATA")
-	fmt.Printf(" #%v", f.StreamID)
-	fmt.Println()
+	color.Printf("|   ↳ %s", h.Encoding)
+	tracef(" (%v octets économisés)\n", h.Encoding.Saved(h))
+}
 
-	printFlag("END_STREAM", f.Flags.Has(http2.FlagDataEndStream), in)
-	printFlag("PADDED", f.Flags.Has(http2.FlagDataPadded), in)
-	printKeyValue("Data", fmt.Sprintf("%q", f.Data()), in)
+func printPriority(p Priority, in bool) {
+	printKeyValue("Exclusive", p.Exclusive, in)
+	printKeyValue("Stream dependency", p.StreamDep, in)
+	printKeyValue("Weight", p.Weight, in)
+}
+
+// Affiche une erreur HTTP2 (code et raison) en rouge dans la trace
+func printH2Error(t *traceConn, stream uint64, code H2ErrCode, msg string, in bool) {
+	t.lock(stream)
+	defer t.unlock()
+	prefix := "->"
+	if in {
+		prefix = "<-"
+	}
+	red.Printf("+- %s %s (%#x)\n", prefix, code, uint32(code))
+	if msg != "" {
+		red.Printf("| %s\n", msg)
+	}
+	red.Printf("|\n")
 }
 
 func printKeyValue(key string, value interface{}, in bool) {
 	color := dirColor(in)
 	color.Printf("| %s:", key)
 	valueStr, ok := value.(string)
-	if ok && len(key)+len(valueStr) > 50 {
-		value = valueStr[0:(50-len(key))] + "..."
+	if ok {
+		value = truncateValue(key, valueStr)
 	}
-	fmt.Printf(" %v", value)
-	fmt.Println()
+	tracef(" %v", value)
+	tracef("\n")
 }
 
 func printFlag(key string, value interface{}, in bool) {
 	color := dirColor(in)
 	color.Printf("| 🏁 %s:", key)
-	fmt.Printf(" %v", value)
-	fmt.Println()
-}
-
-// Les requêtes HTTP2 fonctionnent avec un système de frames
-func handleHTTP22(conn net.Conn) {
-	defer conn.Close()
-	_, err := readBytes(conn, 24)
-
-	if err != nil {
-		log.Printf("Cannot read preface %v\n", err)
-	}
-	fmt.Printf("\n\nx-- Preface -->")
-
-	framer := http2.NewFramer(conn, conn)
-
-	/*
-		// Send initial settings to the client
-		if err := framer.WriteSettings(
-			http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100},
-			http2.Setting{ID: http2.SettingInitialWindowSize, Val: 65535},
-		); err != nil {
-			log.Printf("Failed to send settings frame: %v\n", err)
-			return
-		}
-	*/
-
-	for {
-		frame, err := framer.ReadFrame()
-		if err != nil {
-			log.Printf("Cannot read frame %s", err.Error())
-		}
-		switch f := frame.(type) {
-		case *http2.SettingsFrame:
-			if err := framer.WriteSettingsAck(); err != nil {
-				log.Printf("Failed to write settings ACK: %v\n", err)
-				return
-			}
-			UNUSED(f)
-		case *http2.WindowUpdateFrame:
-			fmt.Printf("-- Window Update -->")
-			UNUSED(f)
-		case *http2.HeadersFrame:
-			streamID := f.StreamID
-			r, _ := NewHTTP2Request(f)
-			fmt.Printf("-- HeadersFrame %v %v %v -->", streamID, r.Path, f.Flags.Has(http2.FlagHeadersEndStream))
-			// On répond
-			if r.Path == "" {
-				// Comprendre pourquoi on a des en tête vide :(
-				framer.WriteHeaders(http2.HeadersFrameParam{
-					StreamID:   streamID,
-					EndHeaders: true,
-					EndStream:  true,
-				})
-			} else {
-				respondHTTP2(r, streamID, framer)
-			}
-		case *http2.RSTStreamFrame:
-			log.Printf("Stream %v terminated", f.StreamID)
-		case *http2.GoAwayFrame:
-			log.Printf("GoAway", f.StreamID)
-			return
-		default:
-			log.Printf("Received frame of type %T", f)
-			return
-		}
-	}
-
+	tracef(" %v", value)
+	tracef("\n")
 }
 
 // Lit un certain nombre d'octet dans un reader
@@ -280,54 +864,44 @@ func readBytes(r io.Reader, n int) ([]byte, error) {
 	return buffer, nil
 }
 
-func NewHTTP2Request(f *http2.HeadersFrame) (*Request, error) {
-	hf, _ := decoder.DecodeFull(f.HeaderBlockFragment())
-	path := ""
-	headers := make(map[string]string)
-	for _, h := range hf {
-		if h.Name == ":path" {
-			path = h.Value
-		}
-		headers[strings.ToLower(h.Name)] = strings.TrimSpace(h.Value)
-	}
-	if strings.HasSuffix(path, "/") {
-		path = path + "index.html"
+// Taille des en-têtes au sens de SETTINGS_MAX_HEADER_LIST_SIZE (RFC 9113 section 6.5.2)
+func headerListSize(fields []HeaderField) int {
+	size := 0
+	for _, f := range fields {
+		size += f.size()
 	}
-	path = strings.Trim(path, "/")
+	return size
+}
 
-	return &Request{
-		Path:     path,
-		Method:   "GET",
+func NewHTTP2Request(fields []HeaderField) (*Request, error) {
+	headers := Header(fields)
+	if err := headers.validate(); err != nil {
+		return nil, err
+	}
+	if err := headers.checkConnectionFields(); err != nil {
+		return nil, err
+	}
+	method := headers.Get(":method")
+	if method == "" {
+		method = "GET"
+	}
+	r := &Request{
+		Method:   method,
 		Protocol: "h2",
 		Headers:  headers,
-	}, nil
+	}
+	target := headers.Get(":path")
+	if method == "CONNECT" && !headers.Has(":protocol") {
+		target = headers.Get(":authority")
+	}
+	return r, r.setTarget(target)
 }
 
-func respondHTTP2(r *Request, streamID uint32, framer *http2.Framer) {
+func respondHTTP2(f staticFile, streamID uint32, c *h2Conn) {
 	// Headers frame
-	buff := bytes.NewBuffer([]byte{})
-	encoder := hpack.NewEncoder(buff)
-	encoder.WriteField(hpack.HeaderField{
-		Name:  ":status",
-		Value: "200",
-	})
-	encoder.WriteField(hpack.HeaderField{
-		Name:  "content-type",
-		Value: "text/" + getFileExtension(r.Path),
-	})
-	framer.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      streamID,
-		BlockFragment: buff.Bytes(),
-		EndHeaders:    true,
-	})
+	c.writeHeaders(streamID, false, append([]HeaderField{{Name: ":status", Value: strconv.Itoa(f.Status)}}, f.headers()...))
+	printCompression(c.trace, uint64(streamID), f)
 
 	// Data frame
-	content, err := os.ReadFile("public/" + r.Path)
-	if err != nil {
-		framer.WriteData(streamID, true, []byte{})
-		log.Printf("Cannot read file %s", r.Path)
-		return
-	}
-
-	framer.WriteData(streamID, true, content)
+	c.writeData(streamID, true, f.Body)
 }
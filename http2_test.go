@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Client HTTP2 minimal qui parle à handleHTTP2 sur une connexion en mémoire
+type h2TestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan Frame
+	// SETTINGS envoyés par le serveur au début de la connexion
+	settings []H2Setting
+	decoder  *HPACKDecoder
+}
+
+func newH2TestClient(t *testing.T, settings ...H2Setting) *h2TestClient {
+	client, server := net.Pipe()
+	go handleHTTP2(server)
+	c := &h2TestClient{t: t, conn: client, frames: make(chan Frame, 100), decoder: NewHPACKDecoder(defaultHeaderTableSize)}
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer close(c.frames)
+		for {
+			f, err := NewFrame(client, maxFrameSizeLimit)
+			if err != nil {
+				return
+			}
+			c.frames <- f
+		}
+	}()
+	client.Write([]byte(h2Preface))
+	c.write(Frame{Type: frameTypeSettings, Settings: settings})
+	c.settings = c.expect(frameTypeSettings).Settings
+	c.expect(frameTypeSettings)
+	return c
+}
+
+// Statut de la réponse du stream
+func (c *h2TestClient) status(streamID uint32) string {
+	return c.response(streamID).Get(":status")
+}
+
+// En-têtes de la réponse du stream, les frames qui précèdent ses HEADERS sont ignorées
+// Les HEADERS reçus doivent tous être lus ainsi pour que la table HPACK suive
+func (c *h2TestClient) response(streamID uint32) Header {
+	for {
+		f := c.next(time.Second)
+		if f == nil {
+			c.t.Fatalf("pas de réponse sur le stream #%v", streamID)
+		}
+		if f.Type != frameTypeHeaders {
+			continue
+		}
+		fields, err := c.decoder.DecodeFull(f.BlockFragment)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if f.StreamID == streamID {
+			return Header(fields)
+		}
+	}
+}
+
+// Une écriture que le serveur ne lit pas échoue au lieu de bloquer le test
+func (c *h2TestClient) write(f Frame) {
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if err := f.Write(c.conn); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *h2TestClient) headers(streamID uint32, endStream bool, fields []HeaderField) {
+	f := Frame{Type: frameTypeHeaders, Flags: flagEndHeaders, StreamID: streamID, BlockFragment: NewHPACKEncoder().Encode(fields)}
+	if endStream {
+		f.Flags |= flagEndStream
+	}
+	c.write(f)
+}
+
+func (c *h2TestClient) get(streamID uint32, path string) {
+	c.headers(streamID, true, fieldsOf(":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", path))
+}
+
+// Prochaine frame reçue, nil si rien n'arrive pendant wait
+func (c *h2TestClient) next(wait time.Duration) *Frame {
+	select {
+	case f, ok := <-c.frames:
+		if !ok {
+			return nil
+		}
+		return &f
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func (c *h2TestClient) expect(typ FrameType) Frame {
+	f := c.next(time.Second)
+	if f == nil {
+		c.t.Fatalf("frame %s attendue, rien reçu", typ)
+	}
+	if f.Type != typ {
+		c.t.Fatalf("frame %s attendue, %s reçue", typ, f.Type)
+	}
+	return *f
+}
+
+// Lit les frames DATA du stream jusqu'à ce que plus rien n'arrive, renvoie la taille reçue
+func (c *h2TestClient) readData(streamID uint32) (int, bool) {
+	n := 0
+	for {
+		f := c.next(100 * time.Millisecond)
+		if f == nil {
+			return n, false
+		}
+		if f.Type != frameTypeData || f.StreamID != streamID {
+			continue
+		}
+		n += len(f.Data)
+		if f.Has(flagEndStream) {
+			return n, true
+		}
+	}
+}
+
+func TestH2StreamFlowControl(t *testing.T) {
+	c := newH2TestClient(t, H2Setting{ID: h2SettingInitialWindowSize, Value: 100})
+	c.get(1, "/index.html")
+	c.expect(frameTypeHeaders)
+	n, end := c.readData(1)
+	if n != 100 || end {
+		t.Fatalf("%v octets reçus (fin %v), la fenêtre du stream n'en permet que 100", n, end)
+	}
+
+	// Une fenêtre négative après une baisse de INITIAL_WINDOW_SIZE attend d'être renflouée
+	c.write(Frame{Type: frameTypeSettings, Settings: []H2Setting{{ID: h2SettingInitialWindowSize, Value: 50}}})
+	c.expect(frameTypeSettings)
+	c.write(Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: 50})
+	if n, _ := c.readData(1); n != 0 {
+		t.Fatalf("%v octets reçus avec une fenêtre nulle", n)
+	}
+	c.write(Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: 1000})
+	n, end = c.readData(1)
+	if n != 584-100 || !end {
+		t.Fatalf("%v octets reçus (fin %v), %v attendus", n, end, 584-100)
+	}
+}
+
+// Une WINDOW_UPDATE envoyée juste après la requête arrive avant que la réponse ne commence
+func TestH2WindowUpdateBeforeResponse(t *testing.T) {
+	c := newH2TestClient(t, H2Setting{ID: h2SettingInitialWindowSize, Value: 100})
+	c.get(1, "/index.html")
+	c.write(Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: 1000})
+	if status := c.status(1); status != "200" {
+		t.Fatalf("statut %v, 200 attendu", status)
+	}
+	if n, end := c.readData(1); n != 584 || !end {
+		t.Fatalf("%v octets reçus (fin %v), 584 attendus", n, end)
+	}
+}
+
+func TestH2WindowUpdateErrors(t *testing.T) {
+	t.Run("incrément nul sur un stream", func(t *testing.T) {
+		c := newH2TestClient(t)
+		c.write(Frame{Type: frameTypeWindowUpdate, StreamID: 3})
+		f := c.expect(frameTypeRSTStream)
+		if f.StreamID != 3 || f.ErrorCode != H2ErrCodeProtocolError {
+			t.Fatalf("RST_STREAM #%v %s, #3 PROTOCOL_ERROR attendu", f.StreamID, f.ErrorCode)
+		}
+		// La connexion reste ouverte
+		c.write(Frame{Type: frameTypePing})
+		if f := c.expect(frameTypePing); !f.Has(flagAck) {
+			t.Fatal("PING sans ACK")
+		}
+	})
+	t.Run("incrément nul sur la connexion", func(t *testing.T) {
+		c := newH2TestClient(t)
+		c.write(Frame{Type: frameTypeWindowUpdate})
+		if f := c.expect(frameTypeGoAway); f.ErrorCode != H2ErrCodeProtocolError {
+			t.Fatalf("GOAWAY %s, PROTOCOL_ERROR attendu", f.ErrorCode)
+		}
+	})
+	t.Run("fenêtre de la connexion trop grande", func(t *testing.T) {
+		c := newH2TestClient(t)
+		c.write(Frame{Type: frameTypeWindowUpdate, WindowIncrement: maxWindowSize})
+		if f := c.expect(frameTypeGoAway); f.ErrorCode != H2ErrCodeFlowControlError {
+			t.Fatalf("GOAWAY %s, FLOW_CONTROL_ERROR attendu", f.ErrorCode)
+		}
+	})
+}
+
+func TestH2ConnectionWindow(t *testing.T) {
+	c := newH2Conn(io.Discard, "test")
+	c.decoder, c.encoder = newHeaderCodec()
+	c.sendWindow = 10
+	c.openWindow(1)
+	c.openWindow(3)
+	c.writeHeaders(1, false, []HeaderField{{Name: ":status", Value: "200"}})
+	c.writeHeaders(3, false, []HeaderField{{Name: ":status", Value: "200"}})
+
+	done := make(chan error)
+	go func() { done <- c.writeData(1, true, make([]byte, 30)) }()
+	time.Sleep(50 * time.Millisecond)
+	c.mu.Lock()
+	window, stream := c.sendWindow, c.streamWindows[1]
+	c.mu.Unlock()
+	if window != 0 || stream != defaultInitialWindowSize-10 {
+		t.Fatalf("fenêtres %v et %v, 0 et %v attendues", window, stream, defaultInitialWindowSize-10)
+	}
+
+	// La fenêtre de la connexion est partagée entre les streams
+	if err := c.windowUpdate(Frame{Type: frameTypeWindowUpdate, WindowIncrement: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeData(3, false, make([]byte, 80)); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- c.writeData(3, false, make([]byte, 1)) }()
+
+	// Une écriture en attente échoue quand le stream est annulé
+	time.Sleep(50 * time.Millisecond)
+	c.dropWindow(3)
+	if err := <-done; err == nil {
+		t.Fatal("écriture sur un stream annulé")
+	}
+}
+
+func TestH2WindowUpdateOverflow(t *testing.T) {
+	c := newH2Conn(io.Discard, "test")
+	c.decoder, c.encoder = newHeaderCodec()
+	c.openWindow(1)
+	err := c.windowUpdate(Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: maxWindowSize})
+	var h2Err *h2Error
+	if !errors.As(err, &h2Err) || h2Err.Code != H2ErrCodeFlowControlError {
+		t.Fatalf("erreur %v, FLOW_CONTROL_ERROR attendue", err)
+	}
+	// Un stream terminé ignore les WINDOW_UPDATE
+	if err := c.windowUpdate(Frame{Type: frameTypeWindowUpdate, StreamID: 5, WindowIncrement: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Une hausse de INITIAL_WINDOW_SIZE ne peut pas faire dépasser 2^31-1 à un stream ouvert
+	c.streamWindows[1] = maxWindowSize - 10
+	settingsErr := c.applySettings([]H2Setting{{ID: h2SettingInitialWindowSize, Value: defaultInitialWindowSize + 11}})
+	if !errors.As(settingsErr, &h2Err) || h2Err.Code != H2ErrCodeFlowControlError {
+		t.Fatalf("erreur %v, FLOW_CONTROL_ERROR attendue", settingsErr)
+	}
+}
+
+// Le handler WebSocket écrit sa réponse pendant que le client envoie la suite : la boucle de
+// lecture ne doit jamais attendre le handler, sinon les WINDOW_UPDATE ne sont plus lus
+func TestH2WebSocketLargerThanWindow(t *testing.T) {
+	c := newH2TestClient(t)
+	c.headers(1, false, fieldsOf(":method", "CONNECT", ":protocol", "websocket", ":scheme", "https",
+		":authority", "localhost", ":path", webSocketPath, "sec-websocket-version", "13"))
+	if f := c.expect(frameTypeHeaders); f.Has(flagEndStream) {
+		t.Fatal("Extended CONNECT refusé")
+	}
+
+	const size = 100_000
+	var out bytes.Buffer
+	for i := range 2 {
+		message := bytes.Repeat([]byte{byte(i)}, size)
+		WSFrame{Fin: true, Opcode: wsOpBinary, Masked: true, MaskKey: [4]byte{1, 2, 3, 4}, Payload: message}.Write(&out)
+	}
+	// Chaque message revient non masqué avec une longueur sur 64 bits
+	want := 2 * (size + 10)
+
+	// Le client respecte la fenêtre par défaut du serveur et rend la sienne à la réception
+	connWindow, streamWindow := int64(defaultInitialWindowSize), int64(defaultInitialWindowSize)
+	received := 0
+	for received < want {
+		for out.Len() > 0 && min(connWindow, streamWindow) > 0 {
+			chunk := out.Next(int(min(defaultMaxFrameSize, connWindow, streamWindow)))
+			c.write(Frame{Type: frameTypeData, StreamID: 1, Data: chunk})
+			connWindow -= int64(len(chunk))
+			streamWindow -= int64(len(chunk))
+		}
+		f := c.next(2 * time.Second)
+		if f == nil {
+			t.Fatalf("bloqué après %v octets reçus sur %v, %v octets pas encore envoyés", received, want, out.Len())
+		}
+		switch {
+		case f.Type == frameTypeWindowUpdate && f.StreamID == 0:
+			connWindow += int64(f.WindowIncrement)
+		case f.Type == frameTypeWindowUpdate:
+			streamWindow += int64(f.WindowIncrement)
+		case f.Type == frameTypeData:
+			received += len(f.Data)
+			c.write(Frame{Type: frameTypeWindowUpdate, WindowIncrement: f.Length})
+			c.write(Frame{Type: frameTypeWindowUpdate, StreamID: 1, WindowIncrement: f.Length})
+		case f.Type == frameTypeRSTStream || f.Type == frameTypeGoAway:
+			t.Fatalf("%s %s", f.Type, f.ErrorCode)
+		}
+	}
+}
+
+func TestH2StreamReceiveWindow(t *testing.T) {
+	c := newH2Conn(io.Discard, "test")
+	s := c.openStream(1)
+	if err := s.receive(Frame{Type: frameTypeData, StreamID: 1, Length: defaultInitialWindowSize, Data: make([]byte, defaultInitialWindowSize)}); err != nil {
+		t.Fatal(err)
+	}
+	err := s.receive(Frame{Type: frameTypeData, StreamID: 1, Length: 1, Data: []byte{1}})
+	if err == nil || err.Code != H2ErrCodeFlowControlError {
+		t.Fatalf("erreur %v, FLOW_CONTROL_ERROR attendue", err)
+	}
+
+	// La lecture libère la fenêtre, le padding est rendu dès la réception
+	if n, err := s.Read(make([]byte, 1000)); n != 1000 || err != nil {
+		t.Fatalf("lecture de %v octets, %v", n, err)
+	}
+	if err := s.receive(Frame{Type: frameTypeData, StreamID: 1, Flags: flagPadded, Length: 211, PadLength: 200, Data: []byte("0123456789")}); err != nil {
+		t.Fatal(err)
+	}
+	if s.recvWindow != 990 {
+		t.Errorf("fenêtre de %v octets, 990 attendus", s.recvWindow)
+	}
+
+	// Les données reçues avant END_STREAM sont lues avant io.EOF
+	s.receive(Frame{Type: frameTypeData, StreamID: 1, Flags: flagEndStream})
+	body, readErr := io.ReadAll(s)
+	if readErr != nil || len(body) != defaultInitialWindowSize-1000+10 || string(body[len(body)-10:]) != "0123456789" {
+		t.Fatalf("corps de %v octets, %v", len(body), readErr)
+	}
+
+	// Une annulation abandonne le corps en attente
+	s = c.openStream(3)
+	s.receive(Frame{Type: frameTypeData, StreamID: 3, Length: 5, Data: []byte("hello")})
+	s.cancel(errors.New("annulé"))
+	if n, err := s.Read(make([]byte, 10)); n != 0 || err == nil {
+		t.Fatalf("lecture de %v octets après l'annulation", n)
+	}
+}
+
+func TestH2HeaderBlockLimit(t *testing.T) {
+	setOption(t, &limitOptions.maxHeaderBytes, 1000)
+	t.Run("limite annoncée", func(t *testing.T) {
+		c := newH2TestClient(t)
+		if !slices.Contains(c.settings, H2Setting{ID: h2SettingMaxHeaderListSize, Value: 1000}) {
+			t.Errorf("SETTINGS %v sans MAX_HEADER_LIST_SIZE", c.settings)
+		}
+	})
+	t.Run("flot de CONTINUATION", func(t *testing.T) {
+		c := newH2TestClient(t)
+		c.write(Frame{Type: frameTypeHeaders, StreamID: 1, BlockFragment: make([]byte, 600)})
+		c.write(Frame{Type: frameTypeContinuation, StreamID: 1, BlockFragment: make([]byte, 600)})
+		if f := c.expect(frameTypeGoAway); f.ErrorCode != H2ErrCodeEnhanceYourCalm {
+			t.Fatalf("GOAWAY %s, ENHANCE_YOUR_CALM attendu", f.ErrorCode)
+		}
+	})
+	t.Run("liste d'en-têtes trop grande", func(t *testing.T) {
+		c := newH2TestClient(t)
+		c.headers(1, true, fieldsOf(":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/",
+			"x-long", strings.Repeat("a", 1000)))
+		if status := c.status(1); status != "431" {
+			t.Fatalf("statut %v, 431 attendu", status)
+		}
+		// La connexion reste utilisable
+		c.get(3, "/index.html")
+		if status := c.status(3); status != "200" {
+			t.Fatalf("statut %v, 200 attendu", status)
+		}
+	})
+}
+
+// Le CONNECT classique est refusé comme en HTTP1, seul l'Extended CONNECT ouvre un stream
+func TestH2PlainConnect(t *testing.T) {
+	c := newH2TestClient(t)
+	c.headers(1, true, fieldsOf(":method", "CONNECT", ":authority", "example.com:443"))
+	if h := c.response(1); h.Get(":status") != "405" || h.Get("allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("statut %v et Allow %q, 405 et GET, HEAD, OPTIONS attendus", h.Get(":status"), h.Get("allow"))
+	}
+}
+
+// Un en-tête spécifique à la connexion rend la requête mal formée, seul son stream est annulé
+func TestH2ConnectionSpecificFields(t *testing.T) {
+	c := newH2TestClient(t)
+	request := fieldsOf(":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/index.html")
+	c.headers(1, true, append(slices.Clone(request), fieldsOf("connection", "keep-alive")...))
+	if f := c.expect(frameTypeRSTStream); f.StreamID != 1 || f.ErrorCode != H2ErrCodeProtocolError {
+		t.Fatalf("RST_STREAM #%v %s, #1 PROTOCOL_ERROR attendu", f.StreamID, f.ErrorCode)
+	}
+	c.headers(3, true, append(slices.Clone(request), fieldsOf("te", "trailers")...))
+	if status := c.status(3); status != "200" {
+		t.Fatalf("statut %v, 200 attendu avec te: trailers", status)
+	}
+}
+
+// Le flux d'évènements garde le stream ouvert, chaque évènement part dans une frame DATA
+func TestH2Events(t *testing.T) {
+	c := newH2TestClient(t)
+	c.get(1, eventsPath)
+	if h := c.response(1); h.Get(":status") != "200" || h.Get("content-type") != "text/event-stream" {
+		t.Fatalf("réponse %v", h)
+	}
+	f := c.expect(frameTypeData)
+	if f.Has(flagEndStream) || !bytes.HasPrefix(f.Data, []byte("id: 1\nevent: tick\nretry: ")) {
+		t.Fatalf("frame DATA %q (fin %v)", f.Data, f.Has(flagEndStream))
+	}
+}
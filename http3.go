@@ -4,15 +4,16 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/quic-go/qpack"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/quicvarint"
 )
@@ -27,10 +28,37 @@ const (
 )
 
 const (
-	dataFrameType   = 0x00
-	headerFrameType = 0x01
+	dataFrameType     = 0x00
+	headerFrameType   = 0x01
+	settingsFrameType = 0x04
+	goAwayFrameType   = 0x07
 )
 
+// Identifiants des paramètres SETTINGS
+const (
+	settingQPACKMaxTableCapacity = 0x01
+	settingMaxFieldSectionSize   = 0x06
+	settingQPACKBlockedStreams   = 0x07
+	settingEnableConnectProtocol = 0x08
+	settingH3Datagram            = 0x33
+	settingEnableWebTransport    = 0x2b603742
+)
+
+var settingNames = map[uint64]string{
+	settingQPACKMaxTableCapacity: "QPACK_MAX_TABLE_CAPACITY",
+	settingMaxFieldSectionSize:   "MAX_FIELD_SECTION_SIZE",
+	settingQPACKBlockedStreams:   "QPACK_BLOCKED_STREAMS",
+	settingEnableConnectProtocol: "ENABLE_CONNECT_PROTOCOL",
+	settingH3Datagram:            "H3_DATAGRAM",
+	settingEnableWebTransport:    "ENABLE_WEBTRANSPORT",
+}
+
+// Types de frames HTTP/2 qui n'ont pas d'équivalent en HTTP/3
+var reservedFrameTypes = map[uint64]bool{0x02: true, 0x06: true, 0x08: true, 0x09: true}
+
+// Taille maximale acceptée pour une frame autre que DATA
+const maxH3FramePayload = 1 << 20
+
 type ErrCode quic.ApplicationErrorCode
 
 const (
@@ -52,8 +80,66 @@ const (
 	ErrCodeConnectError         ErrCode = 0x10f
 	ErrCodeVersionFallback      ErrCode = 0x110
 	ErrCodeDatagramError        ErrCode = 0x33
+
+	ErrCodeQPACKDecompressionFailed ErrCode = 0x200
+	ErrCodeQPACKEncoderStreamError  ErrCode = 0x201
+	ErrCodeQPACKDecoderStreamError  ErrCode = 0x202
 )
 
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNoError:                  "H3_NO_ERROR",
+	ErrCodeGeneralProtocolError:     "H3_GENERAL_PROTOCOL_ERROR",
+	ErrCodeInternalError:            "H3_INTERNAL_ERROR",
+	ErrCodeStreamCreationError:      "H3_STREAM_CREATION_ERROR",
+	ErrCodeClosedCriticalStream:     "H3_CLOSED_CRITICAL_STREAM",
+	ErrCodeFrameUnexpected:          "H3_FRAME_UNEXPECTED",
+	ErrCodeFrameError:               "H3_FRAME_ERROR",
+	ErrCodeExcessiveLoad:            "H3_EXCESSIVE_LOAD",
+	ErrCodeIDError:                  "H3_ID_ERROR",
+	ErrCodeSettingsError:            "H3_SETTINGS_ERROR",
+	ErrCodeMissingSettings:          "H3_MISSING_SETTINGS",
+	ErrCodeRequestRejected:          "H3_REQUEST_REJECTED",
+	ErrCodeRequestCanceled:          "H3_REQUEST_CANCELLED",
+	ErrCodeRequestIncomplete:        "H3_REQUEST_INCOMPLETE",
+	ErrCodeMessageError:             "H3_MESSAGE_ERROR",
+	ErrCodeConnectError:             "H3_CONNECT_ERROR",
+	ErrCodeVersionFallback:          "H3_VERSION_FALLBACK",
+	ErrCodeDatagramError:            "H3_DATAGRAM_ERROR",
+	ErrCodeQPACKDecompressionFailed: "QPACK_DECOMPRESSION_FAILED",
+	ErrCodeQPACKEncoderStreamError:  "QPACK_ENCODER_STREAM_ERROR",
+	ErrCodeQPACKDecoderStreamError:  "QPACK_DECODER_STREAM_ERROR",
+}
+
+func (e ErrCode) String() string {
+	if name, ok := errCodeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("H3_UNKNOWN_%#x", uint64(e))
+}
+
+// Indique si l'erreur ne concerne que le stream (sinon toute la connexion est fermée)
+func (e ErrCode) isStreamError() bool {
+	switch e {
+	case ErrCodeRequestRejected, ErrCodeRequestCanceled, ErrCodeRequestIncomplete, ErrCodeMessageError:
+		return true
+	}
+	return false
+}
+
+// Violation du protocole HTTP/3 associée au code d'erreur à renvoyer au client
+type h3Error struct {
+	Code ErrCode
+	Msg  string
+}
+
+func newH3Error(code ErrCode, format string, a ...interface{}) *h3Error {
+	return &h3Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *h3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Msg)
+}
+
 // Crée un serveur HTTP2 qui informe du support de l'HTTP3
 func broadcastHTTP3(config *tls.Config) {
 	h1and2 := http.Server{
@@ -71,46 +157,235 @@ func broadcastHTTP3(config *tls.Config) {
 	}
 }
 
+// État d'une connexion HTTP3, partagé entre les différents streams
+type h3Conn struct {
+	quic.EarlyConnection
+	// Flux unidirectionnel de contrôle ouvert par le serveur
+	control quic.SendStream
+
+	mu sync.Mutex
+	// Prochain identifiant de stream bidirectionnel attendu
+	nextStreamID quic.StreamID
+	// Identifiant envoyé dans le GOAWAY, les streams suivants sont refusés
+	goAwayID   quic.StreamID
+	goingAway  bool
+	peerGoAway *uint64
+	// Flux unidirectionnels critiques (contrôle, QPACK) déjà ouverts par le client
+	peerStreams map[uint64]bool
+	// Paramètres envoyés par le client dans sa frame SETTINGS
+	peerSettings map[uint64]uint64
+	// Sessions WebTransport ouvertes, indexées par l'identifiant du stream CONNECT
+	sessions map[quic.StreamID]*wtSession
+
+	// Compression des en-têtes, chaque sens a sa propre table dynamique
+	encoder       *QPACKEncoder
+	decoder       *QPACKDecoder
+	encoderStream quic.SendStream
+
+	trace *traceConn
+}
+
+// Connexions HTTP3 actives, utilisées pour l'arrêt propre du serveur
+var h3Conns = make(map[*h3Conn]bool)
+var h3ConnsMu sync.Mutex
+
+// Accepte les connexions QUIC jusqu'à l'annulation du contexte ou la fermeture de l'écoute
+func serveHTTP3(ctx context.Context, ln *quic.EarlyListener) {
+	for {
+		conn, err := ln.Accept(ctx)
+		if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("impossible d'accepter la connexion, %v", err)
+			continue
+		}
+		go handleHTTP3(conn)
+	}
+}
+
 // Gère une requête HTTP3
 // Détail de l'échange QUIC : https://quic.xargs.org/
 // Detail du protocol : https://http3-explained.haxx.se/en
 // Pour tester : curl --http3 -v --insecure https://localhost
-func handleHTTP3(conn quic.Connection) error {
-	fmt.Printf("⦿\n")
-	defer fmt.Printf("x\n")
+func handleHTTP3(conn quic.EarlyConnection) error {
+	c := &h3Conn{
+		EarlyConnection: conn,
+		sessions:        make(map[quic.StreamID]*wtSession),
+		peerStreams:     make(map[uint64]bool),
+		encoder:         NewQPACKEncoder(),
+		trace:           newTraceConn(HTTP3, conn.RemoteAddr().String()),
+	}
+	c.encoder.trace = c.trace
+	c.trace.open(nil)
+	defer c.trace.close()
+	defer recordConnection(HTTP3, conn.ConnectionState().TLS.NegotiatedProtocol)()
+	go printQUICConnection(c.trace, conn)
+
 	// On envoit la frame de "SETTINGS"
-	str, err := conn.OpenUniStreamSync(context.Background())
-	if err != nil {
-		return fmt.Errorf("impossible d'ouvrir un stream unifirectionnel %w", err)
+	if err := c.openControlStream(serverSettings()); err != nil {
+		return err
 	}
-	b := make([]byte, 0, 64)
-	b = quicvarint.Append(b, streamTypeControlStream)
-	b = quicvarint.Append(b, 0x4)
-	b = quicvarint.Append(b, 0)
-	str.Write(b)
+	if err := c.openQPACKStreams(); err != nil {
+		return err
+	}
+
+	h3ConnsMu.Lock()
+	h3Conns[c] = true
+	h3ConnsMu.Unlock()
+	defer func() {
+		h3ConnsMu.Lock()
+		delete(h3Conns, c)
+		h3ConnsMu.Unlock()
+	}()
 
 	// On gère le flux unidirectionnel pour recevoir les settings
-	go listenUniStream(conn)
+	go c.listenUniStreams()
 
 	// Flux principal (bidirectionnel) qui contiendra requête et réponse
-	var wg sync.WaitGroup
 	for {
 		str, err := conn.AcceptStream(context.Background())
 		if err != nil {
-			log.Printf("cannot accept bi stream %v", err)
+			printH3ConnClosed(c.trace, err)
 			break
 		}
-		go handleRequest(conn, str)
+		if !c.acceptRequest(str.StreamID()) {
+			c.resetStream(str, newH3Error(ErrCodeRequestRejected,
+				"stream #%v reçu après le GOAWAY (limite #%v)", str.StreamID(), c.goAwayID))
+			continue
+		}
+		go c.handleRequest(str, !handshakeComplete(conn))
+	}
+	return nil
+}
+
+// Ouvre un flux unidirectionnel, le type du flux est le premier varint envoyé
+func (c *h3Conn) openUniStream(streamType uint64) (quic.SendStream, error) {
+	str, err := c.OpenUniStreamSync(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("impossible d'ouvrir un stream unifirectionnel %w", err)
+	}
+	if _, err := str.Write(quicvarint.Append(nil, streamType)); err != nil {
+		return nil, err
+	}
+	return str, nil
+}
+
+// Ouvre notre flux de contrôle, il commence par la frame SETTINGS
+func (c *h3Conn) openControlStream(settings SettingsFrame) error {
+	str, err := c.openUniStream(streamTypeControlStream)
+	if err != nil {
+		return err
+	}
+	c.control = str
+	c.printFrame(str.StreamID(), settings, false)
+	if err := settings.Write(str); err != nil {
+		return fmt.Errorf("impossible d'envoyer les SETTINGS %w", err)
+	}
+	return nil
+}
+
+// Flux QPACK : instructions de notre encodeur et acquittements de notre décodeur
+func (c *h3Conn) openQPACKStreams() error {
+	var err error
+	if c.encoderStream, err = c.openUniStream(streamTypeQPACKEncoderStream); err != nil {
+		return err
 	}
-	wg.Wait()
+	decoderStream, err := c.openUniStream(streamTypeQPACKDecoderStream)
+	if err != nil {
+		return err
+	}
+	c.decoder = NewQPACKDecoder(decoderStream, c.Context().Done())
+	c.decoder.trace = c.trace
 	return nil
 }
 
-func listenUniStream(conn quic.Connection) {
+// Enregistre un flux critique ouvert par le client, false si ce type est déjà ouvert
+func (c *h3Conn) registerPeerStream(streamType uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerStreams[streamType] {
+		return false
+	}
+	c.peerStreams[streamType] = true
+	return true
+}
+
+// Enregistre un nouveau stream de requête, false si il dépasse la limite du GOAWAY
+func (c *h3Conn) acceptRequest(id quic.StreamID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.goingAway && id >= c.goAwayID {
+		return false
+	}
+	if id >= c.nextStreamID {
+		c.nextStreamID = id + 4
+	}
+	return true
+}
+
+// Envoie une frame GOAWAY sur le flux de contrôle, les requêtes en cours se terminent
+// mais les nouveaux streams seront refusés avec H3_REQUEST_REJECTED
+func (c *h3Conn) goAway() {
+	c.mu.Lock()
+	if c.goingAway {
+		c.mu.Unlock()
+		return
+	}
+	c.goingAway = true
+	c.goAwayID = c.nextStreamID
+	f := GoAwayFrame{ID: uint64(c.goAwayID)}
+	c.mu.Unlock()
+
+	c.printFrame(c.control.StreamID(), f, false)
+	if err := f.Write(c.control); err != nil {
+		log.Printf("impossible d'envoyer le GOAWAY %v", err)
+	}
+}
+
+// Ferme la connexion avec le code d'erreur correspondant à la violation du protocole
+func (c *h3Conn) closeWithError(err *h3Error) {
+	if err == nil || c.Context().Err() != nil {
+		return
+	}
+	printH3Error(c.trace, noStream, err.Code, err.Msg, false)
+	c.CloseWithError(quic.ApplicationErrorCode(err.Code), err.Msg)
+}
+
+// Annule le stream dans les deux sens avec le code d'erreur fourni
+func (c *h3Conn) resetStream(str quic.Stream, err *h3Error) {
+	printH3Error(c.trace, uint64(str.StreamID()), err.Code, err.Msg, false)
+	str.CancelRead(quic.StreamErrorCode(err.Code))
+	str.CancelWrite(quic.StreamErrorCode(err.Code))
+}
+
+// Arrête proprement les connexions HTTP3 : envoi d'un GOAWAY puis attente de la
+// fermeture par le client, au-delà du délai la connexion est fermée par le serveur
+func shutdownHTTP3(timeout time.Duration) {
+	h3ConnsMu.Lock()
+	conns := make([]*h3Conn, 0, len(h3Conns))
+	for c := range h3Conns {
+		conns = append(conns, c)
+	}
+	h3ConnsMu.Unlock()
+
+	for _, c := range conns {
+		c.goAway()
+	}
+	deadline := time.After(timeout)
+	for _, c := range conns {
+		select {
+		case <-c.Context().Done():
+		case <-deadline:
+		}
+		c.CloseWithError(quic.ApplicationErrorCode(ErrCodeNoError), "arrêt du serveur")
+	}
+}
+
+func (c *h3Conn) listenUniStreams() {
 	for {
-		str, err := conn.AcceptUniStream(context.Background())
+		str, err := c.AcceptUniStream(context.Background())
 		if err != nil {
-			log.Printf("cannot accept uni stream %v", err.Error())
 			return
 		}
 
@@ -120,126 +395,487 @@ func listenUniStream(conn quic.Connection) {
 				log.Printf("cannot read stream type %v", err.Error())
 				return
 			}
-			fp := NewFrameParser(str, nil)
 			switch streamType {
 			case streamTypeControlStream:
-				f, err := fp.NextFrame()
-				if err != nil {
-					log.Printf("cannot parse next frame %v\n", err.Error())
+				c.handleControlStream(str)
+			case streamTypePushStream:
+				c.closeWithError(newH3Error(ErrCodeStreamCreationError,
+					"un client ne peut pas ouvrir de push stream"))
+			case streamTypeQPACKEncoderStream:
+				if c.registerPeerStream(streamType) {
+					c.closeWithError(qpackStreamError(c.decoder.readEncoderStream(str), ErrCodeQPACKEncoderStreamError))
+				} else {
+					c.closeWithError(newH3Error(ErrCodeStreamCreationError, "second flux encodeur QPACK ouvert par le client"))
 				}
-				switch f.(type) {
-				case SettingsFrame:
-					printH3Frame(f, true)
-				default:
-					log.Printf("control stream expected, got %+v\n", f)
+			case streamTypeQPACKDecoderStream:
+				if c.registerPeerStream(streamType) {
+					c.closeWithError(qpackStreamError(c.encoder.readDecoderStream(str), ErrCodeQPACKDecoderStreamError))
+				} else {
+					c.closeWithError(newH3Error(ErrCodeStreamCreationError, "second flux décodeur QPACK ouvert par le client"))
 				}
-			// On ne gère que le flux de contrôle
+			case wtUniStreamType:
+				c.serveWebTransportUniStream(str)
 			default:
-				return
+				str.CancelRead(quic.StreamErrorCode(ErrCodeStreamCreationError))
 			}
 		}(str)
 	}
 }
 
-func handleRequest(conn quic.Connection, str quic.Stream) {
-	fmt.Printf("+==============\n")
-	fmt.Printf("+= Stream #%v =\n", str.StreamID())
-	fmt.Printf("+==============\n")
-	defer fmt.Printf("+==============\n")
-	decoder := qpack.NewDecoder(func(hf qpack.HeaderField) {})
-	fp := NewFrameParser(str, decoder)
+// Le flux de contrôle commence par SETTINGS et reste ouvert toute la connexion
+func (c *h3Conn) handleControlStream(str quic.ReceiveStream) {
+	if !c.registerPeerStream(streamTypeControlStream) {
+		c.closeWithError(newH3Error(ErrCodeStreamCreationError, "second flux de contrôle ouvert par le client"))
+		return
+	}
+
+	fp := NewFrameParser(str, nil)
 	f, err := fp.NextFrame()
 	if err != nil {
-		log.Printf("Cannot read header frame %w", err)
+		c.closeWithError(controlStreamError(err))
 		return
 	}
-	hf, ok := f.(HeadersFrame)
+	settings, ok := f.(SettingsFrame)
 	if !ok {
-		conn.CloseWithError(quic.ApplicationErrorCode(ErrCodeFrameUnexpected), "expected first frame to be a HEADERS frame")
+		c.closeWithError(newH3Error(ErrCodeMissingSettings,
+			"la première frame du flux de contrôle doit être SETTINGS, reçu %s", frameName(f)))
+		return
+	}
+	c.printFrame(str.StreamID(), f, true)
+	if err := c.applyPeerSettings(settings); err != nil {
+		c.closeWithError(err)
 		return
 	}
-	printH3Frame(hf, true)
 
-	if hf.Header(":method", "GET") != "GET" {
-		f, err = fp.NextFrame()
+	for {
+		f, err := fp.NextFrame()
 		if err != nil {
-			log.Printf("Cannot read data frame %w", err)
+			c.closeWithError(controlStreamError(err))
+			return
+		}
+		c.printFrame(str.StreamID(), f, true)
+		switch f := f.(type) {
+		case GoAwayFrame:
+			c.mu.Lock()
+			increased := c.peerGoAway != nil && f.ID > *c.peerGoAway
+			c.peerGoAway = &f.ID
+			c.mu.Unlock()
+			if increased {
+				c.closeWithError(newH3Error(ErrCodeIDError, "l'identifiant du GOAWAY ne peut pas augmenter"))
+				return
+			}
+		default:
+			c.closeWithError(newH3Error(ErrCodeFrameUnexpected,
+				"frame %s interdite sur le flux de contrôle", frameName(f)))
 			return
 		}
-		printH3Frame(f, true)
-	}
-	hf, df := framesFromRequest(hf)
-	printH3Frame(hf, false)
-	hf.Write(str)
-	printH3Frame(df, false)
-	df.Write(str)
-	str.Close()
-}
-
-// Génère les frames à renvoyer en fonction de la requêt
-func framesFromRequest(f HeadersFrame) (HeadersFrame, DataFrame) {
-	path := f.Header(":path", "/")
-	if strings.HasSuffix(path, "/") {
-		path = path + "index.html"
-	}
-	path = strings.Trim(path, "/")
-	content, _ := os.ReadFile("public/" + path)
-	return HeadersFrame{
-			Headers: []qpack.HeaderField{
-				{Name: ":status", Value: "200"},
-				{Name: "content-type", Value: "text/" + getFileExtension(path)},
-			},
-		}, DataFrame{
-			Data: content,
+	}
+}
+
+// Paramètres annoncés par le serveur sur son flux de contrôle
+func serverSettings() SettingsFrame {
+	return SettingsFrame{Settings: []Setting{
+		{settingQPACKMaxTableCapacity, qpackMaxTableCapacity},
+		{settingQPACKBlockedStreams, qpackBlockedStreams},
+		{settingEnableConnectProtocol, 1},
+		{settingH3Datagram, 1},
+		{settingEnableWebTransport, 1},
+	}}
+}
+
+// Enregistre les paramètres du client, les datagrammes ne sont utilisables que
+// si H3_DATAGRAM est annoncé et que QUIC a négocié l'extension datagramme
+func (c *h3Conn) applyPeerSettings(f SettingsFrame) *h3Error {
+	settings := make(map[uint64]uint64)
+	for _, s := range f.Settings {
+		settings[s.Identifier] = s.Value
+	}
+	switch settings[settingH3Datagram] {
+	case 0:
+	case 1:
+		if !c.ConnectionState().SupportsDatagrams {
+			return newH3Error(ErrCodeSettingsError, "H3_DATAGRAM annoncé sans support des datagrammes QUIC")
+		}
+	default:
+		return newH3Error(ErrCodeSettingsError, "valeur invalide pour H3_DATAGRAM")
+	}
+
+	c.mu.Lock()
+	c.peerSettings = settings
+	c.mu.Unlock()
+	if settings[settingH3Datagram] == 1 {
+		go c.receiveDatagrams()
+	}
+	// Sans capacité annoncée, les réponses n'utilisent que la table statique
+	if capacity := settings[settingQPACKMaxTableCapacity]; capacity > 0 {
+		if err := c.encoder.enableDynamicTable(c.encoderStream, capacity); err != nil {
+			return newH3Error(ErrCodeClosedCriticalStream, "impossible d'écrire sur le flux encodeur")
+		}
+	}
+	return nil
+}
+
+// Convertit une erreur de lecture d'un flux QPACK en erreur de connexion,
+// les instructions malformées sont signalées avec le code propre au flux
+func qpackStreamError(err error, code ErrCode) *h3Error {
+	var h3Err *h3Error
+	var streamErr *quic.StreamError
+	switch {
+	case errors.As(err, &h3Err):
+		return h3Err
+	case err == io.EOF, errors.As(err, &streamErr):
+		return newH3Error(ErrCodeClosedCriticalStream, "un flux QPACK a été fermé")
+	}
+	// Si la connexion est déjà fermée l'erreur sera ignorée
+	return newH3Error(code, "%s", err.Error())
+}
+
+// Convertit une erreur de lecture du flux de contrôle en erreur de connexion
+func controlStreamError(err error) *h3Error {
+	var h3Err *h3Error
+	var streamErr *quic.StreamError
+	switch {
+	case errors.As(err, &h3Err):
+		return h3Err
+	case err == io.EOF, errors.As(err, &streamErr):
+		return newH3Error(ErrCodeClosedCriticalStream, "le flux de contrôle a été fermé")
+	}
+	// La connexion est déjà fermée
+	return nil
+}
+
+func (c *h3Conn) handleRequest(str quic.Stream, early bool) {
+	err := c.serveStream(str, early)
+	var h3Err *h3Error
+	var streamErr *quic.StreamError
+	switch {
+	case err == nil:
+	case errors.As(err, &h3Err) && h3Err.Code.isStreamError():
+		c.resetStream(str, h3Err)
+	case errors.As(err, &h3Err):
+		c.closeWithError(h3Err)
+	case errors.As(err, &streamErr) && streamErr.Remote:
+		// Le client a annulé la requête (RESET_STREAM ou STOP_SENDING)
+		printH3Error(c.trace, uint64(str.StreamID()), ErrCode(streamErr.ErrorCode), "annulé par le client", true)
+		str.CancelRead(quic.StreamErrorCode(ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(ErrCodeRequestCanceled))
+	default:
+		log.Printf("erreur sur le stream #%v %v", str.StreamID(), err)
+	}
+}
+
+// Un stream bidirectionnel contient soit une requête, soit un flux WebTransport
+// qui commence par un type spécifique à la place du type de la première frame
+func (c *h3Conn) serveStream(str quic.Stream, early bool) error {
+	t, err := quicvarint.Read(quicvarint.NewReader(str))
+	if err == io.EOF {
+		return newH3Error(ErrCodeRequestIncomplete, "stream fermé avant la frame HEADERS")
+	}
+	if err != nil {
+		return frameReadError("impossible de lire le type de la frame", err)
+	}
+	if t == wtBidiStreamType {
+		return c.serveWebTransportStream(str)
+	}
+
+	// On remet le type déjà lu devant le reste du stream
+	r := io.MultiReader(bytes.NewReader(quicvarint.Append(nil, t)), str)
+	return c.serveRequest(str, r, early)
+}
+
+func (c *h3Conn) serveRequest(str quic.Stream, r io.Reader, early bool) error {
+	start := time.Now()
+	fp := NewFrameParser(r, qpackStreamDecoder{c.decoder, uint64(str.StreamID())})
+	f, err := fp.NextFrame()
+	if err == io.EOF {
+		return newH3Error(ErrCodeRequestIncomplete, "stream fermé avant la frame HEADERS")
+	}
+	if err != nil {
+		return err
+	}
+	hf, ok := f.(HeadersFrame)
+	if !ok {
+		return newH3Error(ErrCodeFrameUnexpected,
+			"la première frame doit être HEADERS, reçu %s", frameName(f))
+	}
+	c.printFrame(str.StreamID(), hf, true)
+	if err := validateH3Request(hf); err != nil {
+		return err
+	}
+	req, err := NewHTTP2Request(hf.Headers)
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		printRequestError(c.trace, uint64(str.StreamID()), reqErr)
+		str.CancelRead(quic.StreamErrorCode(ErrCodeNoError))
+		return c.respondFile(str, statusFile(reqErr.Status, req.Path), newAccessEntry(req, "HTTP/3.0", c.trace.Remote, start))
+	}
+	if err != nil {
+		return newH3Error(ErrCodeMessageError, "%v", err)
+	}
+	entry := newAccessEntry(req, "HTTP/3.0", c.trace.Remote, start)
+	defer entry.abort()
+	// Requête reçue en 0-RTT avant la fin du handshake (RFC 8470)
+	if early && !isIdempotent(hf.Header(":method", "GET")) {
+		entry.log(http.StatusTooEarly, 0)
+		return c.respondTooEarly(str)
+	}
+	authority := hf.Header(":authority", "")
+	vh, ok := selectVHost(c.ConnectionState().TLS.ServerName, authority)
+	if !ok {
+		// La réponse est envoyée sans attendre le corps de la requête (RFC 9114 section 4.1)
+		str.CancelRead(quic.StreamErrorCode(ErrCodeNoError))
+		return c.respondFile(str, misdirectedFile(authority), entry)
+	}
+	if hf.Header(":method", "GET") == "CONNECT" {
+		return c.serveConnect(str, hf, fp, entry)
+	}
+	if vh.proxy != nil && "/"+req.Path != eventsPath {
+		return c.proxy(vh.proxy, str, hf, fp, entry)
+	}
+
+	// Le corps de la requête est envoyé sous forme de frames DATA jusqu'à la fin du stream
+	if hf.Header(":method", "GET") != "GET" {
+		for {
+			f, err = fp.NextFrame()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			switch f.(type) {
+			case DataFrame, HeadersFrame:
+				c.printFrame(str.StreamID(), f, true)
+			default:
+				return newH3Error(ErrCodeFrameUnexpected,
+					"frame %s interdite sur un stream de requête", frameName(f))
+			}
+		}
+	}
+
+	if "/"+req.Path == eventsPath {
+		defer entry.log(http.StatusOK, 0)
+		return c.serveEvents(str, hf)
+	}
+
+	return c.respondFile(str, lookupStatic(vh.root, req), entry)
+}
+
+// Le flux d'évènements est envoyé sous forme de frames DATA successives sur le stream de la requête
+func (c *h3Conn) serveEvents(str quic.Stream, req HeadersFrame) error {
+	hf := HeadersFrame{
+		Headers: Header{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "text/event-stream"},
+			{Name: "cache-control", Value: "no-cache"},
+		},
+	}
+	if err := c.writeHeaders(str, hf); err != nil {
+		return err
+	}
+	if err := serveEvents(h3DataWriter{c, str}, req.Header("last-event-id", ""), c.trace, uint64(str.StreamID())); err != nil {
+		return err
+	}
+	return str.Close()
+}
+
+// La requête pourrait être rejouée, le client doit la renvoyer une fois le handshake terminé
+func (c *h3Conn) respondTooEarly(str quic.Stream) error {
+	hf := HeadersFrame{Headers: Header{{Name: ":status", Value: "425"}}}
+	if err := c.writeHeaders(str, hf); err != nil {
+		return err
+	}
+	return str.Close()
+}
+
+// Les en-têtes sont affichés après l'encodage pour connaître leur représentation QPACK
+func (c *h3Conn) writeHeaders(str quic.Stream, f HeadersFrame) error {
+	f.block = c.encoder.Encode(f.Headers)
+	c.printFrame(str.StreamID(), f, false)
+	return f.writeBlock(str)
+}
+
+// Vérifie que les en-têtes forment une requête valide (RFC 9114 section 4.3)
+func validateH3Request(f HeadersFrame) *h3Error {
+	if err := f.Headers.validate(); err != nil {
+		return newH3Error(ErrCodeMessageError, "%v", err)
+	}
+	if err := f.Headers.checkConnectionFields(); err != nil {
+		return newH3Error(ErrCodeMessageError, "%v", err)
+	}
+	pseudo := true
+	seen := make(map[string]bool)
+	for _, h := range f.Headers {
+		if strings.HasPrefix(h.Name, ":") {
+			if !pseudo {
+				return newH3Error(ErrCodeMessageError, "le pseudo en-tête %s doit précéder les en-têtes", h.Name)
+			}
+			if seen[h.Name] {
+				return newH3Error(ErrCodeMessageError, "pseudo en-tête %s dupliqué", h.Name)
+			}
+			seen[h.Name] = true
+			continue
+		}
+		pseudo = false
+	}
+	// Le CONNECT classique ne contient que l'autorité, l'Extended CONNECT
+	// (RFC 9220) ajoute :protocol et utilise les mêmes pseudo en-têtes qu'une requête
+	required := []string{":method", ":scheme", ":path"}
+	if seen[":protocol"] {
+		if f.Header(":method", "") != "CONNECT" {
+			return newH3Error(ErrCodeMessageError, ":protocol n'est autorisé qu'avec CONNECT")
 		}
+		required = append(required, ":authority")
+	} else if f.Header(":method", "") == "CONNECT" {
+		required = []string{":method", ":authority"}
+	}
+	for _, name := range required {
+		if !seen[name] {
+			return newH3Error(ErrCodeMessageError, "pseudo en-tête %s manquant", name)
+		}
+	}
+	return nil
+}
+
+// Envoie la réponse en une frame HEADERS et une frame DATA
+func (c *h3Conn) respondFile(str quic.Stream, file staticFile, entry *accessEntry) error {
+	defer entry.log(file.Status, int64(len(file.Body)))
+	hf := HeadersFrame{
+		Headers: append(Header{{Name: ":status", Value: strconv.Itoa(file.Status)}}, file.headers()...),
+	}
+	if err := c.writeHeaders(str, hf); err != nil {
+		return err
+	}
+	printCompression(c.trace, uint64(str.StreamID()), file)
+	df := DataFrame{Data: file.Body}
+	c.printFrame(str.StreamID(), df, false)
+	if err := df.Write(str); err != nil {
+		return err
+	}
+	return str.Close()
+}
+
+// Affiche la frame et la transmet au tableau de bord avec le stream QUIC qui la transporte
+func (c *h3Conn) printFrame(id quic.StreamID, f interface{}, in bool) {
+	printH3Frame(c.trace, uint64(id), f, in)
+	c.trace.h3Frame(uint64(id), f, in)
+	recordFrame(HTTP3, frameName(f), in)
+	if hf, ok := f.(HeadersFrame); ok && hf.block != nil {
+		recordHeaders(HTTP3, hf.Headers, len(hf.block), in)
+	}
 }
 
-func printH3Frame(f interface{}, in bool) {
-	printMu.Lock()
-	defer printMu.Unlock()
+func printH3Frame(t *traceConn, stream uint64, f interface{}, in bool) {
+	t.lock(stream)
+	defer t.unlock()
+	defer dirColor(in).Printf("|\n")
 	switch f := f.(type) {
 	case SettingsFrame:
-		printH3SettingFrame(in)
+		printH3SettingFrame(f, in)
 	case HeadersFrame:
 		printH3HeadersFrame(f, in)
 	case DataFrame:
 		printH3DataFrame(f, in)
+	case GoAwayFrame:
+		printH3GoAwayFrame(f, in)
 	default:
-		fmt.Println("Cannot print unknown frame %t", f)
+		tracef("Cannot print unknown frame %T\n", f)
+	}
+	if traceOptions.hex {
+		printHexDump(h3HexFields(f), in)
 	}
 }
 
-func printH3SettingFrame(in bool) {
+func printH3SettingFrame(f SettingsFrame, in bool) {
 	color := dirColor(in)
-	defer color.Printf("|\n")
 	color.Printf("+- SETTINGS\n")
+	for _, s := range f.Settings {
+		name, ok := settingNames[s.Identifier]
+		if !ok {
+			name = fmt.Sprintf("%#x", s.Identifier)
+		}
+		printKeyValue(name, s.Value, in)
+	}
 }
 
 func printH3HeadersFrame(f HeadersFrame, in bool) {
 	color := dirColor(in)
-	defer color.Printf("|\n")
 	color.Printf("+- HEADERS")
-	fmt.Println()
+	tracef("\n")
 
 	for _, h := range f.Headers {
 		printKeyValue(h.Name, h.Value, in)
+		if h.Encoding != nil {
+			printFieldEncoding(h, in)
+		}
 	}
 }
 
 func printH3DataFrame(f DataFrame, in bool) {
 	color := dirColor(in)
-	defer color.Printf("|\n")
 	color.Printf("+- Data")
-	fmt.Println()
+	tracef("\n")
 	color.Printf("| ...\n")
 }
 
+func printH3GoAwayFrame(f GoAwayFrame, in bool) {
+	color := dirColor(in)
+	color.Printf("+- GOAWAY")
+	tracef(" #%v", f.ID)
+	tracef("\n")
+}
+
+// Affiche une erreur HTTP3 (code et raison) en rouge dans la trace
+func printH3Error(t *traceConn, stream uint64, code ErrCode, msg string, in bool) {
+	t.lock(stream)
+	defer t.unlock()
+	prefix := "->"
+	if in {
+		prefix = "<-"
+	}
+	red.Printf("+- %s %s (%#x)\n", prefix, code, uint64(code))
+	if msg != "" {
+		red.Printf("| %s\n", msg)
+	}
+	red.Printf("|\n")
+}
+
+// Affiche la raison de la fermeture d'une connexion
+func printH3ConnClosed(t *traceConn, err error) {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		if ErrCode(appErr.ErrorCode) != ErrCodeNoError {
+			printH3Error(t, noStream, ErrCode(appErr.ErrorCode), appErr.ErrorMessage, appErr.Remote)
+		}
+		return
+	}
+	var idleErr *quic.IdleTimeoutError
+	if errors.As(err, &idleErr) {
+		return
+	}
+	log.Printf("connexion fermée %v", err)
+}
+
+func frameName(f HTTP3Frame) string {
+	switch f.(type) {
+	case DataFrame:
+		return "DATA"
+	case HeadersFrame:
+		return "HEADERS"
+	case SettingsFrame:
+		return "SETTINGS"
+	case GoAwayFrame:
+		return "GOAWAY"
+	}
+	return fmt.Sprintf("%T", f)
+}
+
 type framerParser struct {
 	str     io.Reader
-	decoder *qpack.Decoder
+	decoder headerDecoder
 }
 
-func NewFrameParser(str io.Reader, decoder *qpack.Decoder) *framerParser {
+func NewFrameParser(str io.Reader, decoder headerDecoder) *framerParser {
 	return &framerParser{
 		str:     str,
 		decoder: decoder,
@@ -254,50 +890,77 @@ func (fp *framerParser) NextFrame() (HTTP3Frame, error) {
 			return nil, err
 		}
 		if err != nil {
-			return nil, fmt.Errorf("impossible de lire le type de la frame, %s", err.Error())
+			return nil, frameReadError("impossible de lire le type de la frame", err)
 		}
 
 		l, err := quicvarint.Read(qr)
-		if err == io.EOF {
-			return nil, err
-		}
 		if err != nil {
-			return nil, fmt.Errorf("impossible de lire la longueur de la frame, %s", err.Error())
+			return nil, frameReadError("impossible de lire la longueur de la frame", err)
+		}
+
+		if reservedFrameTypes[t] {
+			return nil, newH3Error(ErrCodeFrameUnexpected, "frame HTTP/2 réservée %#x", t)
+		}
+		if t != dataFrameType && l > maxH3FramePayload {
+			return nil, newH3Error(ErrCodeExcessiveLoad, "frame %#x trop volumineuse (%v octets)", t, l)
+		}
+
+		switch t {
+		case dataFrameType, headerFrameType, settingsFrameType, goAwayFrameType:
+		default:
+			// Type de frame inconnu, on ignore son contenu
+			if _, err := io.CopyN(io.Discard, qr, int64(l)); err != nil {
+				return nil, frameReadError("frame inconnue tronquée", err)
+			}
+			continue
+		}
+
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(qr, buf); err != nil {
+			return nil, frameReadError("frame tronquée", err)
 		}
 
 		switch t {
 		case dataFrameType:
-			buf := make([]byte, l)
-			qr.Read(buf)
 			return DataFrame{
 				Data: buf,
 			}, nil
 		case headerFrameType:
-			buf := make([]byte, l)
-			qr.Read(buf)
+			if fp.decoder == nil {
+				return nil, newH3Error(ErrCodeFrameUnexpected, "frame HEADERS hors d'un stream de requête")
+			}
 			fields, err := fp.decoder.DecodeFull(buf)
 			if err != nil {
-				return nil, fmt.Errorf("impossible de décoder les en tête, %s", err.Error())
+				return nil, newH3Error(ErrCodeQPACKDecompressionFailed, "impossible de décoder les en tête, %s", err.Error())
 			}
 			return HeadersFrame{
 				Headers: fields,
+				block:   buf,
 			}, nil
-		case 0x04:
-			buf := make([]byte, l)
-			qr.Read(buf)
-			return NewSettingsFrame(buf), nil
-		}
-		if _, err := io.CopyN(io.Discard, qr, int64(l)); err != nil {
-			return nil, err
+		case settingsFrameType:
+			return NewSettingsFrame(buf)
+		default:
+			return NewGoAwayFrame(buf)
 		}
 	}
 }
 
+// Une fin de stream au milieu d'une frame est une erreur de format,
+// les autres erreurs (stream annulé, connexion fermée) sont renvoyées telles quelles
+func frameReadError(msg string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return newH3Error(ErrCodeFrameError, "%s", msg)
+	}
+	return err
+}
+
 type HTTP3Frame interface {
 }
 
 type HeadersFrame struct {
-	Headers []qpack.HeaderField
+	Headers Header
+	// Bloc QPACK tel qu'envoyé ou reçu
+	block []byte
 }
 
 type DataFrame struct {
@@ -313,57 +976,100 @@ type Setting struct {
 	Value      uint64
 }
 
-func NewSettingsFrame(buf []byte) SettingsFrame {
+// Le GOAWAY contient l'identifiant du dernier stream (ou push) qui sera traité
+type GoAwayFrame struct {
+	ID uint64
+}
+
+func NewSettingsFrame(buf []byte) (SettingsFrame, error) {
 	r := bytes.NewReader(buf)
 	f := SettingsFrame{}
-	for {
+	seen := make(map[uint64]bool)
+	for r.Len() > 0 {
 		id, err := quicvarint.Read(r)
-		if err != io.EOF {
-			break
+		if err != nil {
+			return f, newH3Error(ErrCodeFrameError, "identifiant de paramètre tronqué")
 		}
 		v, err := quicvarint.Read(r)
-		if err != io.EOF {
-			break
+		if err != nil {
+			return f, newH3Error(ErrCodeFrameError, "valeur de paramètre tronquée")
 		}
+		// Les identifiants 0x02 à 0x05 sont des paramètres HTTP/2 interdits en HTTP/3
+		if id >= 0x02 && id <= 0x05 {
+			return f, newH3Error(ErrCodeSettingsError, "paramètre HTTP/2 %#x interdit", id)
+		}
+		if seen[id] {
+			return f, newH3Error(ErrCodeSettingsError, "paramètre %#x dupliqué", id)
+		}
+		seen[id] = true
 		f.Settings = append(f.Settings, Setting{id, v})
 	}
-	return f
+	return f, nil
 }
 
-func (f HeadersFrame) Write(w io.Writer) {
-	var headers bytes.Buffer
-	enc := qpack.NewEncoder(&headers)
-
-	for _, field := range f.Headers {
-		err := enc.WriteField(field)
-		if err != nil {
-			log.Printf("impossible d'écrire l'en tête dans l'encodeur %v", err)
-		}
+func NewGoAwayFrame(buf []byte) (GoAwayFrame, error) {
+	r := bytes.NewReader(buf)
+	id, err := quicvarint.Read(r)
+	if err != nil || r.Len() > 0 {
+		return GoAwayFrame{}, newH3Error(ErrCodeFrameError, "frame GOAWAY malformée")
 	}
+	return GoAwayFrame{ID: id}, nil
+}
+
+// Encode les en-têtes avec la seule table statique
+func (f HeadersFrame) Write(w io.Writer) error {
+	return f.WriteWith(w, NewQPACKEncoder())
+}
+
+// Encode les en-têtes avec l'encodeur QPACK d'une connexion
+func (f HeadersFrame) WriteWith(w io.Writer, enc *QPACKEncoder) error {
+	f.block = enc.Encode(f.Headers)
+	return f.writeBlock(w)
+}
 
-	buf := make([]byte, 0, 16+headers.Len())
+func (f HeadersFrame) writeBlock(w io.Writer) error {
+	buf := make([]byte, 0, 16+len(f.block))
 	buf = quicvarint.Append(buf, headerFrameType)
-	buf = quicvarint.Append(buf, uint64(headers.Len()))
-	buf = append(buf, headers.Bytes()...)
-	n, err := w.Write(buf)
-	if err != nil {
-		log.Printf("impossible d'écrire l'en tête %v %v\n", n, err)
-	}
+	buf = quicvarint.Append(buf, uint64(len(f.block)))
+	buf = append(buf, f.block...)
+	_, err := w.Write(buf)
+	return err
 }
 
 func (f HeadersFrame) Header(name string, base string) string {
-	for _, field := range f.Headers {
-		if field.Name == name {
-			return field.Value
-		}
+	if !f.Headers.Has(name) {
+		return base
 	}
-	return base
+	return f.Headers.Get(name)
 }
 
-func (f DataFrame) Write(w io.Writer) {
+func (f DataFrame) Write(w io.Writer) error {
 	out := make([]byte, 0)
 	out = quicvarint.Append(out, dataFrameType)
 	out = quicvarint.Append(out, uint64(len(f.Data)))
-	w.Write(out)
-	w.Write(f.Data)
+	if _, err := w.Write(out); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Data)
+	return err
+}
+
+func (f SettingsFrame) Write(w io.Writer) error {
+	var payload []byte
+	for _, s := range f.Settings {
+		payload = quicvarint.Append(payload, s.Identifier)
+		payload = quicvarint.Append(payload, s.Value)
+	}
+	buf := quicvarint.Append(nil, settingsFrameType)
+	buf = quicvarint.Append(buf, uint64(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+func (f GoAwayFrame) Write(w io.Writer) error {
+	payload := quicvarint.Append(nil, f.ID)
+	buf := quicvarint.Append(nil, goAwayFrameType)
+	buf = quicvarint.Append(buf, uint64(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
 }
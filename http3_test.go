@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Stream QUIC en mémoire, seules les méthodes utilisées par les requêtes sont implémentées
+type h3TestStream struct {
+	quic.Stream
+	id       quic.StreamID
+	request  io.Reader
+	response bytes.Buffer
+	closed   bool
+	// Codes des annulations envoyées au client, nil si le sens n'est pas annulé
+	readCanceled  *quic.StreamErrorCode
+	writeCanceled *quic.StreamErrorCode
+}
+
+func (s *h3TestStream) StreamID() quic.StreamID               { return s.id }
+func (s *h3TestStream) Read(p []byte) (int, error)            { return s.request.Read(p) }
+func (s *h3TestStream) Write(p []byte) (int, error)           { return s.response.Write(p) }
+func (s *h3TestStream) Close() error                          { s.closed = true; return nil }
+func (s *h3TestStream) CancelRead(code quic.StreamErrorCode)  { s.readCanceled = &code }
+func (s *h3TestStream) CancelWrite(code quic.StreamErrorCode) { s.writeCanceled = &code }
+
+// Connexion sans QUIC, suffisante pour les requêtes qui n'atteignent pas le virtual host
+func newH3TestConn(t *testing.T) *h3Conn {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	return &h3Conn{
+		encoder:  NewQPACKEncoder(),
+		decoder:  NewQPACKDecoder(io.Discard, done),
+		sessions: make(map[quic.StreamID]*wtSession),
+		trace:    newTraceConn(HTTP3, "test"),
+	}
+}
+
+// Première frame de la réponse, qui doit être HEADERS
+func readH3Response(t *testing.T, str *h3TestStream) HeadersFrame {
+	done := make(chan struct{})
+	defer close(done)
+	fp := NewFrameParser(&str.response, qpackStreamDecoder{NewQPACKDecoder(io.Discard, done), 0})
+	f, err := fp.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf, ok := f.(HeadersFrame)
+	if !ok {
+		t.Fatalf("frame %s, HEADERS attendue", frameName(f))
+	}
+	return hf
+}
+
+// Le CONNECT classique est refusé comme en HTTP1 et HTTP2
+func TestH3PlainConnect(t *testing.T) {
+	c := newH3TestConn(t)
+	str := &h3TestStream{}
+	hf := HeadersFrame{Headers: Header{{Name: ":method", Value: "CONNECT"}, {Name: ":authority", Value: "example.com:443"}}}
+	if err := c.serveConnect(str, hf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	res := readH3Response(t, str)
+	if res.Header(":status", "") != "405" || res.Header("allow", "") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("statut %v et Allow %q, 405 et GET, HEAD, OPTIONS attendus", res.Header(":status", ""), res.Header("allow", ""))
+	}
+	if !str.closed {
+		t.Errorf("stream non fermé après la réponse")
+	}
+}
+
+// Frame HTTP3 brute : type et longueur en varint puis le contenu
+func rawH3Frame(typ uint64, payload []byte) []byte {
+	b := quicvarint.Append(nil, typ)
+	b = quicvarint.Append(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+func TestH3FrameParserErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		code ErrCode
+	}{
+		{"frame HTTP/2 réservée", rawH3Frame(0x02, nil), ErrCodeFrameUnexpected},
+		{"frame trop volumineuse", quicvarint.Append(quicvarint.Append(nil, settingsFrameType), maxH3FramePayload+1), ErrCodeExcessiveLoad},
+		{"frame tronquée", rawH3Frame(dataFrameType, []byte("abc"))[:4], ErrCodeFrameError},
+		{"longueur tronquée", quicvarint.Append(nil, dataFrameType), ErrCodeFrameError},
+		{"HEADERS hors d'un stream de requête", rawH3Frame(headerFrameType, []byte{0, 0}), ErrCodeFrameUnexpected},
+		{"paramètre HTTP/2", rawH3Frame(settingsFrameType, []byte{0x04, 0x01}), ErrCodeSettingsError},
+		{"paramètre dupliqué", rawH3Frame(settingsFrameType, []byte{0x06, 0x01, 0x06, 0x02}), ErrCodeSettingsError},
+		{"GOAWAY malformé", rawH3Frame(goAwayFrameType, []byte{0x04, 0x00}), ErrCodeFrameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFrameParser(bytes.NewReader(tt.raw), nil).NextFrame()
+			var h3Err *h3Error
+			if !errors.As(err, &h3Err) || h3Err.Code != tt.code {
+				t.Fatalf("erreur %v, %s attendu", err, tt.code)
+			}
+		})
+	}
+
+	// Les frames de type inconnu sont ignorées
+	raw := append(rawH3Frame(0x21, []byte("grease")), rawH3Frame(dataFrameType, []byte("ok"))...)
+	f, err := NewFrameParser(bytes.NewReader(raw), nil).NextFrame()
+	if df, ok := f.(DataFrame); err != nil || !ok || string(df.Data) != "ok" {
+		t.Fatalf("frame %#v, erreur %v", f, err)
+	}
+}
+
+func TestH3ErrorMapping(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code ErrCode
+	}{
+		{"flux fermé", io.EOF, ErrCodeClosedCriticalStream},
+		{"flux annulé", &quic.StreamError{ErrorCode: 0x10c, Remote: true}, ErrCodeClosedCriticalStream},
+		{"violation transmise", newH3Error(ErrCodeFrameUnexpected, "DATA"), ErrCodeFrameUnexpected},
+	}
+	for _, tt := range tests {
+		if err := controlStreamError(tt.err); err == nil || err.Code != tt.code {
+			t.Errorf("contrôle, %s : %v, %s attendu", tt.name, err, tt.code)
+		}
+		if err := qpackStreamError(tt.err, ErrCodeQPACKEncoderStreamError); err == nil || err.Code != tt.code {
+			t.Errorf("QPACK, %s : %v, %s attendu", tt.name, err, tt.code)
+		}
+	}
+	// Une instruction QPACK invalide prend le code du flux, une connexion fermée est ignorée
+	if err := qpackStreamError(errors.New("instruction invalide"), ErrCodeQPACKEncoderStreamError); err == nil || err.Code != ErrCodeQPACKEncoderStreamError {
+		t.Errorf("QPACK : %v", err)
+	}
+	if err := controlStreamError(errors.New("connexion fermée")); err != nil {
+		t.Errorf("contrôle : %v", err)
+	}
+	for _, code := range []ErrCode{ErrCodeRequestRejected, ErrCodeRequestCanceled, ErrCodeRequestIncomplete, ErrCodeMessageError} {
+		if !code.isStreamError() {
+			t.Errorf("%s devrait n'annuler que le stream", code)
+		}
+	}
+	if ErrCodeFrameUnexpected.isStreamError() || ErrCodeClosedCriticalStream.isStreamError() {
+		t.Errorf("une erreur de connexion n'annule que le stream")
+	}
+}
+
+// Après le GOAWAY les streams déjà ouverts continuent, les suivants sont refusés
+func TestH3GoAway(t *testing.T) {
+	c := newH3TestConn(t)
+	control := &h3TestStream{id: 3}
+	c.control = control
+	for _, id := range []quic.StreamID{0, 4} {
+		if !c.acceptRequest(id) {
+			t.Fatalf("stream #%v refusé avant le GOAWAY", id)
+		}
+	}
+	c.goAway()
+	c.goAway()
+	f, err := NewFrameParser(&control.response, nil).NextFrame()
+	if g, ok := f.(GoAwayFrame); err != nil || !ok || g.ID != 8 {
+		t.Fatalf("frame %#v, GOAWAY 8 attendu (%v)", f, err)
+	}
+	if control.response.Len() > 0 {
+		t.Errorf("GOAWAY envoyé plusieurs fois")
+	}
+	if !c.acceptRequest(4) || c.acceptRequest(8) || c.acceptRequest(12) {
+		t.Errorf("limite du GOAWAY non respectée")
+	}
+}
+
+func TestH3RequestStreamErrors(t *testing.T) {
+	request := func(fields ...string) io.Reader {
+		var b bytes.Buffer
+		HeadersFrame{Headers: fieldsOf(fields...)}.Write(&b)
+		return &b
+	}
+	tests := []struct {
+		name    string
+		request io.Reader
+		code    ErrCode
+	}{
+		{"annulée par le client", iotest.ErrReader(&quic.StreamError{ErrorCode: 0x10c, Remote: true}), ErrCodeRequestCanceled},
+		{"stream vide", bytes.NewReader(nil), ErrCodeRequestIncomplete},
+		{"pseudo en-tête manquant", request(":method", "GET", ":scheme", "https"), ErrCodeMessageError},
+		{"en-tête en majuscules", request(":method", "GET", ":scheme", "https", ":path", "/", "Accept", "*/*"), ErrCodeMessageError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newH3TestConn(t)
+			str := &h3TestStream{request: tt.request}
+			c.handleRequest(str, false)
+			if str.readCanceled == nil || str.writeCanceled == nil {
+				t.Fatal("stream non annulé")
+			}
+			if ErrCode(*str.readCanceled) != tt.code || ErrCode(*str.writeCanceled) != tt.code {
+				t.Fatalf("stream annulé avec %s et %s, %s attendu", ErrCode(*str.readCanceled), ErrCode(*str.writeCanceled), tt.code)
+			}
+		})
+	}
+}
+
+// Connexion QUIC qui rejoue des datagrammes reçus et garde ceux envoyés
+type h3TestDatagrams struct {
+	quic.EarlyConnection
+	received [][]byte
+	sent     [][]byte
+}
+
+func (d *h3TestDatagrams) ReceiveDatagram(context.Context) ([]byte, error) {
+	if len(d.received) == 0 {
+		return nil, io.EOF
+	}
+	b := d.received[0]
+	d.received = d.received[1:]
+	return b, nil
+}
+
+func (d *h3TestDatagrams) SendDatagram(b []byte) error {
+	d.sent = append(d.sent, b)
+	return nil
+}
+
+func TestParseCapsule(t *testing.T) {
+	datagram := Capsule{Type: capsuleDatagram, Value: []byte("ping")}
+	closeSession := Capsule{Type: capsuleCloseWTSession, Value: []byte{0, 0, 0, 0}}
+	b := closeSession.Append(datagram.Append(nil))
+
+	c, n, ok := parseCapsule(b)
+	if !ok || c.Type != capsuleDatagram || string(c.Value) != "ping" {
+		t.Fatalf("capsule %#v", c)
+	}
+	c, m, ok := parseCapsule(b[n:])
+	if !ok || c.Type != capsuleCloseWTSession || n+m != len(b) {
+		t.Fatalf("capsule %#v", c)
+	}
+	// Une capsule incomplète attend la suite du stream
+	for i := range n {
+		if _, _, ok := parseCapsule(b[:i]); ok {
+			t.Fatalf("capsule lue dans %v octets sur %v", i, n)
+		}
+	}
+}
+
+func TestH3WebTransportConnect(t *testing.T) {
+	connect := func(protocol, path string) HeadersFrame {
+		return HeadersFrame{Headers: fieldsOf(":method", "CONNECT", ":protocol", protocol, ":scheme", "https", ":authority", "localhost", ":path", path)}
+	}
+	tests := []struct {
+		name    string
+		request HeadersFrame
+		status  string
+	}{
+		{"protocole inconnu", connect("websocket", webTransportEchoPath), "501"},
+		{"chemin inconnu", connect("webtransport", "/autre"), "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			str := &h3TestStream{}
+			if err := newH3TestConn(t).serveConnect(str, tt.request, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if status := readH3Response(t, str).Header(":status", ""); status != tt.status || !str.closed {
+				t.Fatalf("statut %v (fermé %v), %v attendu", status, str.closed, tt.status)
+			}
+		})
+	}
+
+	// Une session d'écho : la capsule DRAIN est ignorée, la capsule DATAGRAM est renvoyée
+	// même découpée entre deux frames
+	t.Run("session", func(t *testing.T) {
+		c := newH3TestConn(t)
+		datagram := Capsule{Type: capsuleDatagram, Value: []byte("ping")}.Append(nil)
+		var request bytes.Buffer
+		DataFrame{Data: append(Capsule{Type: capsuleDrainWTSession}.Append(nil), datagram[:2]...)}.Write(&request)
+		DataFrame{Data: datagram[2:]}.Write(&request)
+		DataFrame{Data: Capsule{Type: capsuleCloseWTSession, Value: []byte{0, 0, 0, 0}}.Append(nil)}.Write(&request)
+
+		str := &h3TestStream{id: 4}
+		fp := NewFrameParser(&request, nil)
+		if err := c.serveConnect(str, connect("webtransport", webTransportEchoPath), fp, nil); err != nil {
+			t.Fatal(err)
+		}
+		res := readH3Response(t, str)
+		if res.Header(":status", "") != "200" || res.Header("sec-webtransport-http3-draft", "") != webTransportDraftValue {
+			t.Fatalf("réponse %v", res.Headers)
+		}
+		f, err := NewFrameParser(&str.response, nil).NextFrame()
+		if df, ok := f.(DataFrame); err != nil || !ok || !bytes.Equal(df.Data, datagram) {
+			t.Fatalf("frame %#v, capsule DATAGRAM attendue (%v)", f, err)
+		}
+		if !str.closed || len(c.sessions) != 0 {
+			t.Errorf("session non terminée par CLOSE_WEBTRANSPORT_SESSION")
+		}
+	})
+}
+
+// Les datagrammes HTTP sont renvoyés à leur session, ceux d'une session inconnue sont ignorés
+func TestH3Datagrams(t *testing.T) {
+	c := newH3TestConn(t)
+	conn := &h3TestDatagrams{received: [][]byte{
+		append(quicvarint.Append(nil, 1), "ping"...),
+		append(quicvarint.Append(nil, 2), "perdu"...),
+	}}
+	c.EarlyConnection = conn
+	c.sessions[4] = &wtSession{conn: c, str: &h3TestStream{id: 4}}
+	c.receiveDatagrams()
+	if len(conn.sent) != 1 || string(conn.sent[0]) != "\x01ping" {
+		t.Fatalf("datagrammes envoyés %q", conn.sent)
+	}
+
+	if err := c.applyPeerSettings(SettingsFrame{Settings: []Setting{{settingH3Datagram, 2}}}); err == nil || err.Code != ErrCodeSettingsError {
+		t.Errorf("erreur %v pour H3_DATAGRAM=2", err)
+	}
+}
+
+// Un flux bidirectionnel WebTransport renvoie ce qu'il reçoit, s'il appartient à une session
+func TestH3WebTransportStream(t *testing.T) {
+	c := newH3TestConn(t)
+	c.sessions[4] = &wtSession{conn: c, str: &h3TestStream{id: 4}}
+
+	str := &h3TestStream{id: 1, request: bytes.NewReader(append(quicvarint.Append(nil, 4), "bonjour"...))}
+	if err := c.serveWebTransportStream(str); err != nil {
+		t.Fatal(err)
+	}
+	if str.response.String() != "bonjour" || !str.closed {
+		t.Fatalf("écho %q (fermé %v)", str.response.String(), str.closed)
+	}
+
+	str = &h3TestStream{id: 5, request: bytes.NewReader(append(quicvarint.Append(nil, 8), "bonjour"...))}
+	if err := c.serveWebTransportStream(str); err == nil || str.readCanceled == nil || ErrCode(*str.readCanceled) != ErrCodeStreamCreationError {
+		t.Fatalf("flux d'une session inconnue accepté (%v)", err)
+	}
+}
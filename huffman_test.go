@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Chaînes des exemples de l'annexe C de la RFC 7541
+func TestHuffmanVectors(t *testing.T) {
+	tests := []struct {
+		s       string
+		encoded string
+	}{
+		{"www.example.com", "f1e3c2e5f23a6ba0ab90f4ff"},
+		{"no-cache", "a8eb10649cbf"},
+		{"custom-key", "25a849e95ba97d7f"},
+		{"custom-value", "25a849e95bb8e8b4bf"},
+		{"302", "6402"},
+		{"private", "aec3771a4b"},
+		{"Mon, 21 Oct 2013 20:13:21 GMT", "d07abe941054d444a8200595040b8166e082a62d1bff"},
+		{"https://www.example.com", "9d29ad171863c78f0b97c8e9ae82ae43d3"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		encoded := hex.EncodeToString(huffmanEncode(nil, tt.s))
+		if encoded != tt.encoded {
+			t.Errorf("huffmanEncode(%q) = %v, %v attendu", tt.s, encoded, tt.encoded)
+		}
+		if l := huffmanEncodedLen(tt.s); l != len(tt.encoded)/2 {
+			t.Errorf("huffmanEncodedLen(%q) = %v, %v attendu", tt.s, l, len(tt.encoded)/2)
+		}
+		raw, _ := hex.DecodeString(tt.encoded)
+		if s, err := huffmanDecode(raw); err != nil || s != tt.s {
+			t.Errorf("huffmanDecode(%v) = %q, %v", tt.encoded, s, err)
+		}
+	}
+}
+
+// Tous les octets, y compris ceux dont le code dépasse 20 bits
+func TestHuffmanRoundTrip(t *testing.T) {
+	var b strings.Builder
+	for i := range 256 {
+		b.WriteByte(byte(i))
+	}
+	all := b.String()
+	for _, s := range []string{all, strings.Repeat("a", 1000), "é€\x00\xff" + all[200:]} {
+		decoded, err := huffmanDecode(huffmanEncode(nil, s))
+		if err != nil || decoded != s {
+			t.Errorf("aller-retour de %q : %q, %v", s, decoded, err)
+		}
+	}
+}
+
+func TestHuffmanDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"padding de 8 bits", []byte{0xff}},
+		{"padding après un caractère", []byte{0x1f, 0xff}},
+		{"padding sans uns", []byte{0x18}},
+		{"EOS", []byte{0xff, 0xff, 0xff, 0xff}},
+		{"EOS après un caractère", []byte{0x1f, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		if s, err := huffmanDecode(tt.encoded); err == nil {
+			t.Errorf("%s : %q décodé sans erreur", tt.name, s)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dégradation du réseau simulée par le serveur sur ses connexions TCP et sur la connexion
+// UDP de QUIC, dans les deux sens, pour observer le blocage en tête de file de TCP
+// Exemple : go run . http2 -delay 50ms -jitter 10ms -loss 0.05
+var impairOptions impairment
+
+func registerImpairFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&impairOptions.delay, "delay", 0, "délai ajouté dans chaque sens (la latence aller-retour est doublée)")
+	fs.DurationVar(&impairOptions.jitter, "jitter", 0, "variation aléatoire du délai (plus ou moins)")
+	fs.IntVar(&impairOptions.bandwidth, "bandwidth", 0, "débit maximum de chaque sens en Kbit/s, illimité si 0")
+	fs.Float64Var(&impairOptions.loss, "loss", 0, "probabilité de perdre un paquet (0 à 1)")
+	fs.Float64Var(&impairOptions.reorder, "reorder", 0, "probabilité qu'un datagramme UDP double les précédents (0 à 1)")
+}
+
+type impairment struct {
+	delay     time.Duration
+	jitter    time.Duration
+	bandwidth int
+	loss      float64
+	reorder   float64
+}
+
+func (im impairment) active() bool {
+	return im.delay > 0 || im.jitter > 0 || im.bandwidth > 0 || im.loss > 0 || im.reorder > 0
+}
+
+func (im impairment) String() string {
+	var s []string
+	if im.delay > 0 {
+		s = append(s, fmt.Sprintf("délai %v", im.delay))
+	}
+	if im.jitter > 0 {
+		s = append(s, fmt.Sprintf("gigue ±%v", im.jitter))
+	}
+	if im.bandwidth > 0 {
+		s = append(s, fmt.Sprintf("%v Kbit/s", im.bandwidth))
+	}
+	if im.loss > 0 {
+		s = append(s, fmt.Sprintf("perte %.1f%%", im.loss*100))
+	}
+	if im.reorder > 0 {
+		s = append(s, fmt.Sprintf("désordre %.1f%%", im.reorder*100))
+	}
+	return strings.Join(s, ", ")
+}
+
+func (im impairment) lost() bool {
+	return im.loss > 0 && rand.Float64() < im.loss
+}
+
+func (im impairment) reordered() bool {
+	return im.reorder > 0 && rand.Float64() < im.reorder
+}
+
+// Délai d'un paquet, entre delay - jitter et delay + jitter
+func (im impairment) latency() time.Duration {
+	d := im.delay
+	if im.jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(2*im.jitter)+1)) - im.jitter
+	}
+	return max(d, 0)
+}
+
+// Délai minimal avant qu'un segment TCP perdu soit retransmis (RTO de Linux)
+const tcpMinRetransmitTimeout = 200 * time.Millisecond
+
+// Un sens de la connexion, les paquets se partagent le débit disponible
+type impairedPath struct {
+	im impairment
+
+	mu sync.Mutex
+	// Fin de la transmission du dernier paquet
+	free time.Time
+	// Arrivée du dernier segment TCP
+	last time.Time
+}
+
+// Instant où les n octets ont fini d'être transmis sur le lien
+func (p *impairedPath) transmit(n int) time.Time {
+	now := time.Now()
+	if p.im.bandwidth <= 0 {
+		return now
+	}
+	if p.free.Before(now) {
+		p.free = now
+	}
+	p.free = p.free.Add(time.Duration(n) * 8 * time.Millisecond / time.Duration(p.im.bandwidth))
+	return p.free
+}
+
+// Arrivée d'un segment TCP, un segment perdu est retransmis après le RTO et, TCP livrant
+// les données dans l'ordre, retient ceux qui le suivent (le désordre n'a donc pas d'effet)
+func (p *impairedPath) segment(n int) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at := p.transmit(n).Add(p.im.latency())
+	if p.im.lost() {
+		at = at.Add(max(tcpMinRetransmitTimeout, 4*p.im.delay))
+	}
+	if at.Before(p.last) {
+		at = p.last
+	}
+	p.last = at
+	return at
+}
+
+// Arrivée d'un datagramme UDP, ok vaut false s'il est perdu
+// Un datagramme en désordre n'attend pas le délai et double ceux envoyés avant lui
+func (p *impairedPath) datagram(n int) (at time.Time, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at = p.transmit(n)
+	if p.im.lost() {
+		return at, false
+	}
+	if !p.im.reordered() {
+		at = at.Add(p.im.latency())
+	}
+	return at, true
+}
+
+// File d'attente qui délivre chaque paquet à l'instant prévu, dans l'ordre d'arrivée
+type delayLine struct {
+	packets chan delayedPacket
+	done    chan struct{}
+}
+
+type delayedPacket struct {
+	at   time.Time
+	send func()
+}
+
+func newDelayLine() *delayLine {
+	l := &delayLine{
+		packets: make(chan delayedPacket, 1024),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *delayLine) run() {
+	defer close(l.done)
+	for p := range l.packets {
+		time.Sleep(time.Until(p.at))
+		p.send()
+	}
+}
+
+func (l *delayLine) push(at time.Time, send func()) {
+	l.packets <- delayedPacket{at, send}
+}
+
+// Attend la livraison des paquets déjà en file
+func (l *delayLine) close() {
+	close(l.packets)
+	<-l.done
+}
+
+// Paquet reçu, en attente de lecture
+type impairedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// Échéance de lecture, la modifier réveille la lecture en attente
+// (quic.Transport fixe une échéance immédiate pour interrompre sa lecture)
+type readDeadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func newReadDeadline() *readDeadline {
+	return &readDeadline{changed: make(chan struct{})}
+}
+
+func (d *readDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Attend le prochain paquet, ok vaut false une fois ended fermé et les paquets lus
+func (d *readDeadline) wait(ch <-chan impairedPacket, ended <-chan struct{}) (p impairedPacket, ok bool, err error) {
+	for {
+		d.mu.Lock()
+		t, changed := d.t, d.changed
+		d.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !t.IsZero() {
+			if !time.Now().Before(t) {
+				return p, false, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(time.Until(t))
+			timeout = timer.C
+		}
+		retry := false
+		select {
+		case p = <-ch:
+			ok = true
+		case <-ended:
+			// Les paquets déjà reçus sont lus avant la fin
+			select {
+			case p = <-ch:
+				ok = true
+			default:
+			}
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			retry = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !retry {
+			return p, ok, err
+		}
+	}
+}
+
+/**
+* Connexion TCP dégradée dans les deux sens
+* TCP garantit l'ordre : un segment perdu est retransmis après le RTO et bloque
+* ceux qui le suivent (blocage en tête de file)
+*
+* ```
+* écrit    t=0ms   t=1ms           t=2ms
+* délai    50ms    50ms + perdu    50ms
+* reçu     t=50ms  t=251ms (RTO)   t=251ms (bloqué)
+* ```
+**/
+type impairedConn struct {
+	net.Conn
+	out, in *impairedPath
+
+	mu     sync.Mutex
+	send   *delayLine
+	closed bool
+	// Erreur rencontrée lors d'un envoi différé, renvoyée à l'écriture suivante
+	errMu sync.Mutex
+	err   error
+
+	// Données reçues, délivrées par recv à l'instant prévu
+	recv     *delayLine
+	incoming chan impairedPacket
+	pending  []byte
+	ended    chan struct{}
+	readErr  error
+	deadline *readDeadline
+	done     chan struct{}
+}
+
+func newImpairedConn(conn net.Conn, im impairment) *impairedConn {
+	c := &impairedConn{
+		Conn:     conn,
+		out:      &impairedPath{im: im},
+		in:       &impairedPath{im: im},
+		send:     newDelayLine(),
+		recv:     newDelayLine(),
+		incoming: make(chan impairedPacket, 64),
+		ended:    make(chan struct{}),
+		deadline: newReadDeadline(),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *impairedConn) readLoop() {
+	defer c.recv.close()
+	for {
+		buf := make([]byte, 16*1024)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			data := buf[:n]
+			c.recv.push(c.in.segment(n), func() {
+				select {
+				case c.incoming <- impairedPacket{data: data}:
+				case <-c.done:
+				}
+			})
+		}
+		if err != nil {
+			c.recv.push(time.Time{}, func() {
+				c.readErr = err
+				close(c.ended)
+			})
+			return
+		}
+	}
+}
+
+func (c *impairedConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		p, ok, err := c.deadline.wait(c.incoming, c.ended)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, c.readErr
+		}
+		c.pending = p.data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *impairedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if err := c.sendError(); err != nil {
+		return 0, err
+	}
+	data := append([]byte(nil), b...)
+	c.send.push(c.out.segment(len(b)), func() {
+		if _, err := c.Conn.Write(data); err != nil {
+			c.errMu.Lock()
+			c.err = err
+			c.errMu.Unlock()
+		}
+	})
+	return len(b), nil
+}
+
+func (c *impairedConn) sendError() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Les écritures étant différées, l'échéance ne s'applique qu'aux lectures
+// (tls.Conn fixe une échéance immédiate après l'alerte de fermeture)
+func (c *impairedConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *impairedConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *impairedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Les données en attente sont envoyées avant la fermeture
+func (c *impairedConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.send.close()
+	close(c.done)
+	return c.Conn.Close()
+}
+
+// Accepte des connexions dégradées
+type impairedListener struct {
+	net.Listener
+	im impairment
+}
+
+func (l impairedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newImpairedConn(conn, l.im), nil
+}
+
+// Connexion UDP dégradée dans les deux sens (utilisée par QUIC), un datagramme perdu
+// n'arrive jamais, c'est à QUIC de détecter la perte et de renvoyer les données
+// Chaque datagramme a son propre délai, la gigue peut donc aussi les mettre en désordre
+type impairedPacketConn struct {
+	net.PacketConn
+	out, in *impairedPath
+
+	incoming chan impairedPacket
+	ended    chan struct{}
+	readErr  error
+	deadline *readDeadline
+}
+
+func newImpairedPacketConn(conn net.PacketConn, im impairment) *impairedPacketConn {
+	// quic-go ne peut pas agrandir les tampons d'une connexion enveloppée
+	os.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
+	c := &impairedPacketConn{
+		PacketConn: conn,
+		out:        &impairedPath{im: im},
+		in:         &impairedPath{im: im},
+		// Comme dans le tampon du système, les datagrammes qui ne rentrent pas sont perdus
+		incoming: make(chan impairedPacket, 1024),
+		ended:    make(chan struct{}),
+		deadline: newReadDeadline(),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *impairedPacketConn) readLoop() {
+	for {
+		buf := make([]byte, 64*1024)
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			c.readErr = err
+			close(c.ended)
+			return
+		}
+		at, ok := c.in.datagram(n)
+		if !ok {
+			continue
+		}
+		p := impairedPacket{data: buf[:n], addr: addr}
+		time.AfterFunc(time.Until(at), func() {
+			select {
+			case c.incoming <- p:
+			default:
+			}
+		})
+	}
+}
+
+func (c *impairedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p, ok, err := c.deadline.wait(c.incoming, c.ended)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok {
+		return 0, nil, c.readErr
+	}
+	return copy(b, p.data), p.addr, nil
+}
+
+func (c *impairedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	at, ok := c.out.datagram(len(b))
+	if !ok {
+		return len(b), nil
+	}
+	data := append([]byte(nil), b...)
+	time.AfterFunc(time.Until(at), func() {
+		c.PacketConn.WriteTo(data, addr)
+	})
+	return len(b), nil
+}
+
+func (c *impairedPacketConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *impairedPacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *impairedPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestImpairmentString(t *testing.T) {
+	tests := []struct {
+		im   impairment
+		want string
+	}{
+		{impairment{}, ""},
+		{impairment{delay: 50 * time.Millisecond, jitter: 10 * time.Millisecond}, "délai 50ms, gigue ±10ms"},
+		{impairment{bandwidth: 1000, loss: 0.05, reorder: 0.1}, "1000 Kbit/s, perte 5.0%, désordre 10.0%"},
+	}
+	for _, tt := range tests {
+		if s := tt.im.String(); s != tt.want {
+			t.Errorf("%q, %q attendu", s, tt.want)
+		}
+		if tt.im.active() != (tt.want != "") {
+			t.Errorf("%q : active() = %v", tt.want, tt.im.active())
+		}
+	}
+}
+
+func TestImpairmentLatency(t *testing.T) {
+	im := impairment{delay: 10 * time.Millisecond, jitter: 5 * time.Millisecond}
+	for range 100 {
+		if d := im.latency(); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("délai %v hors de 10ms ±5ms", d)
+		}
+	}
+	// Une gigue plus grande que le délai ne donne pas de délai négatif
+	im = impairment{delay: time.Millisecond, jitter: 10 * time.Millisecond}
+	for range 100 {
+		if d := im.latency(); d < 0 {
+			t.Fatalf("délai %v", d)
+		}
+	}
+}
+
+// Un paquet de n octets occupe le lien n * 8 / bandwidth millisecondes
+func TestImpairedPathBandwidth(t *testing.T) {
+	p := &impairedPath{im: impairment{bandwidth: 8}}
+	now := time.Now()
+	first, second := p.transmit(100), p.transmit(100)
+	if d := first.Sub(now); d < 100*time.Millisecond || d > 150*time.Millisecond {
+		t.Errorf("premier paquet transmis après %v, 100ms attendues", d)
+	}
+	if d := second.Sub(first); d != 100*time.Millisecond {
+		t.Errorf("second paquet transmis %v après le premier, 100ms attendues", d)
+	}
+}
+
+// Un segment perdu est retransmis après le RTO et retient ceux qui le suivent
+func TestImpairedPathSegment(t *testing.T) {
+	p := &impairedPath{im: impairment{delay: 10 * time.Millisecond, loss: 1}}
+	now := time.Now()
+	lost := p.segment(10)
+	if d := lost.Sub(now); d < 10*time.Millisecond+tcpMinRetransmitTimeout {
+		t.Errorf("segment perdu reçu après %v", d)
+	}
+	p.im.loss = 0
+	if next := p.segment(10); !next.Equal(lost) {
+		t.Errorf("segment suivant reçu %v avant le segment perdu", lost.Sub(next))
+	}
+}
+
+func TestImpairedPathDatagram(t *testing.T) {
+	p := &impairedPath{im: impairment{delay: 50 * time.Millisecond, loss: 1}}
+	if _, ok := p.datagram(10); ok {
+		t.Error("datagramme perdu reçu")
+	}
+	p.im.loss = 0
+	now := time.Now()
+	if at, ok := p.datagram(10); !ok || at.Sub(now) < 50*time.Millisecond {
+		t.Errorf("datagramme reçu après %v", at.Sub(now))
+	}
+	// Un datagramme en désordre n'attend pas le délai
+	p.im.reorder = 1
+	now = time.Now()
+	if at, ok := p.datagram(10); !ok || at.Sub(now) >= 50*time.Millisecond {
+		t.Errorf("datagramme en désordre reçu après %v", at.Sub(now))
+	}
+}
+
+func TestImpairedConn(t *testing.T) {
+	delay := 20 * time.Millisecond
+	client, server := net.Pipe()
+	conn := newImpairedConn(server, impairment{delay: delay})
+	defer client.Close()
+
+	// Les données sont retardées dans les deux sens
+	start := time.Now()
+	go client.Write([]byte("requête"))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "requête" {
+		t.Fatalf("lu %q (%v)", buf[:n], err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("requête reçue après %v", d)
+	}
+	start = time.Now()
+	if _, err := conn.Write([]byte("réponse")); err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(buf)
+	if err != nil || string(buf[:n]) != "réponse" {
+		t.Fatalf("lu %q (%v)", buf[:n], err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("réponse reçue après %v", d)
+	}
+
+	// Une échéance modifiée réveille la lecture en attente
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.SetReadDeadline(time.Now())
+	}()
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("erreur %v, échéance dépassée attendue", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Les données en attente sont envoyées avant la fermeture
+	conn.Write([]byte("fin"))
+	go conn.Close()
+	n, err = client.Read(buf)
+	if err != nil || string(buf[:n]) != "fin" {
+		t.Fatalf("lu %q (%v)", buf[:n], err)
+	}
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Fatalf("erreur %v, EOF attendu", err)
+	}
+}
+
+func TestImpairedPacketConn(t *testing.T) {
+	delay := 20 * time.Millisecond
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	peer, udp := listen(), listen()
+	conn := newImpairedPacketConn(udp, impairment{delay: delay})
+
+	start := time.Now()
+	if _, err := peer.WriteTo([]byte("ping"), udp.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("lu %q de %v (%v)", buf[:n], addr, err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("datagramme reçu après %v", d)
+	}
+	start = time.Now()
+	conn.WriteTo([]byte("pong"), peer.LocalAddr())
+	n, _, err = peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("lu %q (%v)", buf[:n], err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("datagramme envoyé après %v", d)
+	}
+
+	// Un datagramme perdu n'arrive jamais, c'est à QUIC de le renvoyer
+	conn.out.mu.Lock()
+	conn.out.im.loss = 1
+	conn.out.mu.Unlock()
+	conn.WriteTo([]byte("perdu"), peer.LocalAddr())
+	peer.SetReadDeadline(time.Now().Add(3 * delay))
+	if _, _, err := peer.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("erreur %v, échéance dépassée attendue", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(delay))
+	if _, _, err := conn.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("erreur %v, échéance dépassée attendue", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Limites des requêtes HTTP1 et des connexions TCP, pour qu'un client lent ou malveillant
+// (slowloris) ne puisse pas occuper le serveur indéfiniment
+// Exemple : go run . http1 -header-timeout 2s -min-rate 1024 -max-conns-per-ip 4
+var limitOptions struct {
+	maxRequestLine int
+	maxHeaders     int
+	maxHeaderBytes int
+	maxBody        int64
+	headerTimeout  time.Duration
+	bodyTimeout    time.Duration
+	minRate        int
+	maxConnsPerIP  int
+}
+
+func registerLimitFlags(fs *flag.FlagSet) {
+	fs.IntVar(&limitOptions.maxRequestLine, "max-request-line", 8<<10, "taille maximale de la ligne de requête HTTP1 (414 au-delà)")
+	fs.IntVar(&limitOptions.maxHeaders, "max-headers", 100, "nombre maximum d'en-têtes d'une requête HTTP1 (431 au-delà)")
+	fs.IntVar(&limitOptions.maxHeaderBytes, "max-header-bytes", 64<<10, "taille maximale des en-têtes d'une requête HTTP1 ou HTTP2 (431 au-delà)")
+	fs.Int64Var(&limitOptions.maxBody, "max-body", 10<<20, "taille maximale du corps d'une requête HTTP1 (413 au-delà)")
+	fs.DurationVar(&limitOptions.headerTimeout, "header-timeout", 5*time.Second, "délai pour recevoir la ligne de requête et les en-têtes HTTP1 (408 au-delà)")
+	fs.DurationVar(&limitOptions.bodyTimeout, "body-timeout", 30*time.Second, "délai pour recevoir le corps d'une requête HTTP1")
+	fs.IntVar(&limitOptions.minRate, "min-rate", 512, "débit minimum (octets/s) du corps d'une requête HTTP1 après une seconde, 0 pour ne pas le vérifier")
+	fs.IntVar(&limitOptions.maxConnsPerIP, "max-conns-per-ip", 32, "nombre maximum de connexions TCP simultanées par adresse IP, 0 pour ne pas limiter")
+}
+
+// Requête refusée avant d'être traitée, le statut est envoyé au client avant de fermer la connexion
+type requestError struct {
+	Status int
+	Msg    string
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("%v %s, %s", e.Status, http.StatusText(e.Status), e.Msg)
+}
+
+func newRequestError(status int, format string, args ...any) *requestError {
+	return &requestError{Status: status, Msg: fmt.Sprintf(format, args...)}
+}
+
+var errLineTooLong = errors.New("ligne trop longue")
+
+/**
+* Lit une ligne (fin de ligne comprise) sans dépasser max octets,
+* contrairement à ReadString qui accumule tout ce que le client envoie
+**/
+func readLimitedLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			return string(line), errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Statut renvoyé quand la lecture de l'en-tête de la requête échoue
+func readError(err error, status int, what string) error {
+	if errors.Is(err, errLineTooLong) {
+		return newRequestError(status, "limite de taille dépassée (%s)", what)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return newRequestError(http.StatusRequestTimeout, "délai de %s dépassé (%s)", limitOptions.headerTimeout, what)
+	}
+	return fmt.Errorf("impossible de lire %s, %w", what, err)
+}
+
+/**
+* Corps d'une requête HTTP1 lu avec une durée maximale et un débit minimum :
+* l'échéance de lecture recule à mesure que les octets arrivent
+*
+* ```
+* échéance = début + 1s + octets reçus / débit minimum (sans dépasser début + -body-timeout)
+* ```
+**/
+type bodyReader struct {
+	r     io.Reader
+	conn  net.Conn
+	start time.Time
+	n     int64
+	// Octets restant à lire avant de dépasser -max-body
+	remaining int64
+}
+
+const minRateGrace = time.Second
+
+func newBodyReader(r io.Reader, conn net.Conn) *bodyReader {
+	return &bodyReader{r: r, conn: conn, start: time.Now(), remaining: limitOptions.maxBody}
+}
+
+// Échéance de lecture une fois received octets du corps reçus
+func bodyDeadline(start time.Time, received int64) time.Time {
+	deadline := start.Add(limitOptions.bodyTimeout)
+	if limitOptions.minRate > 0 {
+		rateDeadline := start.Add(minRateGrace + time.Duration(received)*time.Second/time.Duration(limitOptions.minRate))
+		if rateDeadline.Before(deadline) {
+			return rateDeadline
+		}
+	}
+	return deadline
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	b.conn.SetReadDeadline(bodyDeadline(b.start, b.n))
+	if b.remaining <= 0 {
+		// Un octet de plus indique que le corps dépasse la limite
+		var one [1]byte
+		if n, _ := b.r.Read(one[:]); n > 0 {
+			return 0, newRequestError(http.StatusRequestEntityTooLarge, "le corps dépasse %v octets", limitOptions.maxBody)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	b.remaining -= int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = newRequestError(http.StatusRequestTimeout, "corps trop lent, %v octets reçus en %s", b.n, time.Since(b.start).Round(time.Millisecond))
+	}
+	return n, err
+}
+
+var (
+	connsPerIP   = make(map[string]int)
+	connsPerIPMu sync.Mutex
+)
+
+// Réserve une place pour une connexion de cette adresse, false si l'adresse en a déjà trop
+func acquireConnSlot(remote string) (func(), bool) {
+	if limitOptions.maxConnsPerIP <= 0 {
+		return func() {}, true
+	}
+	ip, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ip = remote
+	}
+	connsPerIPMu.Lock()
+	defer connsPerIPMu.Unlock()
+	if connsPerIP[ip] >= limitOptions.maxConnsPerIP {
+		return nil, false
+	}
+	connsPerIP[ip]++
+	return func() {
+		connsPerIPMu.Lock()
+		defer connsPerIPMu.Unlock()
+		if connsPerIP[ip]--; connsPerIP[ip] == 0 {
+			delete(connsPerIP, ip)
+		}
+	}, true
+}
+
+func printRequestError(t *traceConn, stream uint64, err *requestError) {
+	t.lock(stream)
+	defer t.unlock()
+	red.Printf("x Requête refusée : %s\n", err)
+}
+
+func printConnRefused(remote string) {
+	var t *traceConn
+	t.lock(noStream)
+	defer t.unlock()
+	red.Printf("x Connexion de %s refusée : plus de %v connexions ouvertes depuis cette adresse\n", remote, limitOptions.maxConnsPerIP)
+}
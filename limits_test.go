@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Change une option le temps d'un test
+func setOption[T any](t *testing.T, option *T, value T) {
+	old := *option
+	*option = value
+	t.Cleanup(func() { *option = old })
+}
+
+/**
+* Envoie un message HTTP1 en plusieurs morceaux sur une connexion en mémoire et le lit
+* comme handleHTTP1, le corps compris
+**/
+func readRawRequest(parts []string, pause time.Duration) (*Request, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		for i, part := range parts {
+			if i > 0 {
+				time.Sleep(pause)
+			}
+			if _, err := client.Write([]byte(part)); err != nil {
+				return
+			}
+		}
+		// Le serveur peut avoir répondu sans tout lire
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		client.Read(make([]byte, 1))
+	}()
+	r, err := NewHTTP1Request(server, bufio.NewReader(server), nil)
+	if err != nil {
+		return r, err
+	}
+	return r, readHTTP1Body(r, nil, false)
+}
+
+// Statut de la réponse envoyée pour une requête refusée, 200 si elle est acceptée
+func requestStatus(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.Status
+	}
+	if err != nil {
+		return 0
+	}
+	return http.StatusOK
+}
+
+func TestRequestLimits(t *testing.T) {
+	setOption(t, &limitOptions.maxBody, 100)
+	setOption(t, &limitOptions.maxHeaders, 5)
+	setOption(t, &limitOptions.maxRequestLine, 64)
+
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"requête valide", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello", http.StatusOK},
+		{"ligne de requête trop longue", "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", http.StatusRequestURITooLong},
+		{"trop d'en-têtes", "GET / HTTP/1.1\r\n" + strings.Repeat("X-A: 1\r\n", 6) + "\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"en-têtes trop grands", "GET / HTTP/1.1\r\nX-A: " + strings.Repeat("a", 64<<10) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"Content-Length trop grand", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 101\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"corps en chunks trop grand", "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"40\r\n" + strings.Repeat("a", 64) + "\r\n40\r\n" + strings.Repeat("a", 64) + "\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"corps en chunks à la limite", "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"64\r\n" + strings.Repeat("a", 100) + "\r\n0\r\n\r\n", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRawRequest([]string{tt.request}, 0)
+			if status := requestStatus(err); status != tt.status {
+				t.Errorf("statut %v, %v attendu (%v)", status, tt.status, err)
+			}
+		})
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	body := strings.Repeat("abcdefgh", 1024)
+	r, err := readRawRequest([]string{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8192\r\n\r\n", body[:4096], body[4096:]}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Body != body {
+		t.Errorf("corps de %v octets, %v attendus", len(r.Body), len(body))
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	setOption(t, &limitOptions.headerTimeout, 100*time.Millisecond)
+	setOption(t, &limitOptions.minRate, 100)
+
+	tests := []struct {
+		name  string
+		parts []string
+		pause time.Duration
+	}{
+		{"en-têtes trop lents", []string{"GET / HTTP/1.1\r\n", "Host: localhost\r\n\r\n"}, 200 * time.Millisecond},
+		// Après une seconde, le client doit avoir envoyé 100 octets par seconde écoulée
+		{"corps sous le débit minimum", []string{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 50\r\n\r\na", "b", "c"}, 700 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRawRequest(tt.parts, tt.pause)
+			if status := requestStatus(err); status != http.StatusRequestTimeout {
+				t.Errorf("statut %v, 408 attendu (%v)", status, err)
+			}
+		})
+	}
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/quic-go/quic-go"
 )
@@ -14,25 +20,77 @@ import (
 func main() {
 	// On récupère l'argument
 	if len(os.Args) < 2 {
-		log.Fatalf("Vous devez fournir le mode (http1, http2, ou http3)")
+		log.Println("Vous devez fournir le mode (http1, http2, http3, client ou bench)")
 		fmt.Println("Utilisation:", os.Args[0], "<mode>")
 		fmt.Println("Exemple:")
 		fmt.Println("  go run . http1")
 		fmt.Println("  go run . http2")
 		fmt.Println("  go run . http3")
+		fmt.Println("  go run . client -proto http3 -k https://localhost")
+		fmt.Println("  go run . bench -delay 25ms -loss 0.02")
 		os.Exit(1)
 	}
 	mode := os.Args[1]
 	validModes := map[string]bool{
-		"http1": true,
-		"http2": true,
-		"http3": true,
+		"http1":  true,
+		"http2":  true,
+		"http3":  true,
+		"client": true,
+		"bench":  true,
 	}
 	if !validModes[mode] {
-		log.Fatalf("Erreur: Mode invalide '%s'. http1, http2, http3 accepté\n", mode)
+		log.Fatalf("Erreur: Mode invalide '%s'. http1, http2, http3, client, bench accepté\n", mode)
+	}
+	flags := flag.NewFlagSet(mode, flag.ExitOnError)
+	registerQUICFlags(flags)
+	registerHPACKFlags(flags)
+	registerTraceFlags(flags)
+	registerUIFlags(flags)
+	registerTLSFlags(flags)
+	if mode != "client" {
+		registerImpairFlags(flags)
+	}
+	if mode == "client" {
+		registerClientFlags(flags)
+	}
+	if mode == "bench" {
+		registerBenchFlags(flags)
+	}
+	if mode == "http1" || mode == "http2" || mode == "http3" {
+		registerProxyFlags(flags)
+		registerCompressFlags(flags)
+		registerStaticFlags(flags)
+		registerVHostFlags(flags)
+		registerAccessLogFlags(flags)
+		registerMetricsFlags(flags)
+		registerLimitFlags(flags)
+	}
+	flags.Parse(os.Args[2:])
+	if traceOptions.quiet {
+		traceOutput.w = io.Discard
+	}
+
+	if mode == "client" {
+		runClient(flags.Args())
+		return
+	}
+	if mode == "bench" {
+		runBench(flags.Args())
+		return
 	}
 
 	fmt.Println("🖥️ Serveur démarré sur https://localhost")
+	if uiOptions.addr != "" {
+		go serveDashboard(uiOptions.addr)
+	}
+	if metricsOptions.addr != "" {
+		go serveMetrics(metricsOptions.addr)
+	}
+	if impairOptions.active() {
+		fmt.Printf("🐌 Réseau dégradé : %s\n", impairOptions)
+	}
+	setupProxy()
+	setupAccessLog()
 
 	if mode == "http3" {
 		config := loadTLSConfig(HTTP3)
@@ -43,21 +101,23 @@ func main() {
 		tr := quic.Transport{
 			Conn: udpConn,
 		}
-		quicConf := &quic.Config{
-			Versions: []quic.Version{quic.Version2, quic.Version1},
+		if impairOptions.active() {
+			tr.Conn = newImpairedPacketConn(udpConn, impairOptions)
+		}
+		ln, err := tr.ListenEarly(config, quicConfig())
+		if err != nil {
+			log.Fatalf("impossible d'écouter les connexions QUIC, %v", err)
 		}
-
-		ln, err := tr.Listen(config, quicConf)
 		go broadcastHTTP3(config)
 
-		for {
-			conn, err := ln.Accept(context.Background())
-			if err != nil {
-				log.Printf("impossible d'accepter la connexion, %v", err)
-				continue
-			}
-			go handleHTTP3(conn)
-		}
+		// Ctrl+C déclenche un arrêt propre (GOAWAY) des connexions en cours
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		serveHTTP3(ctx, ln)
+		fmt.Println("🛑 Arrêt du serveur")
+		shutdownHTTP3(5 * time.Second)
+		ln.Close()
 	} else {
 
 		// On écoute les connexions TCP
@@ -66,51 +126,67 @@ func main() {
 			log.Fatalf("Failed to create listener: %v\n", err)
 		}
 		defer listener.Close()
+		if impairOptions.active() {
+			listener = impairedListener{listener, impairOptions}
+		}
 
-		for {
-			protocol := HTTP1
-			if mode == "http2" {
-				protocol = HTTP2
-			}
-			// On accepte la connexion
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("Failed to accept connection: %v\n", err)
-				continue
-			}
-
-			// Gestion du TLS
-			tlsConn := tls.Server(conn, loadTLSConfig(protocol))
-			err = tlsConn.Handshake()
-			if err != nil {
-				// Ignore error since we use local certificate
-			}
-
-			protocol = tlsConn.ConnectionState().NegotiatedProtocol
-
-			switch protocol {
-			case HTTP1:
-				go handleHTTP1(tlsConn)
-			case HTTP2:
-				go handleHTTP2(tlsConn)
-			}
+		protocol := HTTP1
+		if mode == "http2" {
+			protocol = HTTP2
 		}
+		serveTCP(listener, protocol)
 	}
 
 }
 
-func loadTLSConfig(protocol string) *tls.Config {
-	// On charge les certificats
-	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
-	if err != nil {
-		log.Fatalf("Failed to load certificate: %v", err)
+// Accepte les connexions TCP jusqu'à la fermeture de l'écoute
+func serveTCP(listener net.Listener, protocol string) {
+	for {
+		// On accepte la connexion
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept connection: %v\n", err)
+			continue
+		}
+		release, ok := acquireConnSlot(conn.RemoteAddr().String())
+		if !ok {
+			printConnRefused(conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer release()
+			handleTLS(conn, protocol)
+		}()
 	}
+}
 
-	// Configuration TLS
-	return &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		NextProtos:         []string{protocol},
-		InsecureSkipVerify: true,
+// Le handshake TLS choisit (ALPN) le gestionnaire de la connexion
+func handleTLS(conn net.Conn, protocol string) {
+	metered := &meteredConn{Conn: conn}
+	tlsConn := tls.Server(metered, loadTLSConfig(protocol))
+	// Un client qui n'achève pas le handshake ne garde pas la connexion ouverte
+	conn.SetDeadline(time.Now().Add(limitOptions.headerTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		printTLSError(conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	p := tlsConn.ConnectionState().NegotiatedProtocol
+	metered.setProtocol(p)
+	switch p {
+	case HTTP1:
+		handleHTTP1(tlsConn)
+	case HTTP2:
+		handleHTTP2(tlsConn)
+	default:
+		printTLSError(conn.RemoteAddr().String(), fmt.Errorf("protocole %q non pris en charge", p))
+		tlsConn.Close()
 	}
 }
 
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// Les options gardent leurs valeurs par défaut et la trace n'est pas affichée
+func TestMain(m *testing.M) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	registerLimitFlags(flags)
+	registerCompressFlags(flags)
+	registerStaticFlags(flags)
+	flags.Parse(nil)
+	traceOutput.w = io.Discard
+	os.Exit(m.Run())
+}
+
+// Relance le test dans un processus à part et renvoie true, renvoie false dans ce processus
+// Pour les tests qui lancent des serveurs sans les arrêter ou qui dépendent de valeurs
+// calculées une seule fois (sync.OnceValue)
+func runInSubprocess(t *testing.T) bool {
+	if os.Getenv("GOHTTP_SUBPROCESS") != "" {
+		return false
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "GOHTTP_SUBPROCESS=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	return true
+}
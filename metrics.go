@@ -0,0 +1,367 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Métriques au format Prometheus, servies en HTTP/1.1 sur un port d'administration séparé
+// Exemple : go run . http2 -metrics localhost:9100 puis curl localhost:9100/metrics
+var metricsOptions struct {
+	addr string
+}
+
+func registerMetricsFlags(fs *flag.FlagSet) {
+	fs.StringVar(&metricsOptions.addr, "metrics", "", "adresse du endpoint /metrics au format Prometheus (ex: localhost:9100), désactivé si vide")
+}
+
+var (
+	connectionsTotal = newMetric("gohttp_connections_total", "counter",
+		"Connexions acceptées", "protocol", "alpn")
+	connectionsActive = newMetric("gohttp_connections_active", "gauge",
+		"Connexions ouvertes", "protocol")
+	streamsActive = newMetric("gohttp_streams_active", "gauge",
+		"Requêtes (streams) en cours de traitement", "protocol")
+	requestsTotal = newMetric("gohttp_requests_total", "counter",
+		"Requêtes traitées par statut", "protocol", "status")
+	requestDuration = newHistogram("gohttp_request_duration_seconds",
+		"Durée de traitement des requêtes",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "protocol")
+	bytesReceived = newMetric("gohttp_bytes_received_total", "counter",
+		"Octets reçus (TLS compris, paquets QUIC en HTTP3)", "protocol")
+	bytesSent = newMetric("gohttp_bytes_sent_total", "counter",
+		"Octets envoyés (TLS compris, paquets QUIC en HTTP3)", "protocol")
+	framesTotal = newMetric("gohttp_frames_total", "counter",
+		"Frames HTTP2 et HTTP3 par type et par sens", "protocol", "type", "direction")
+	headerBytes = newMetric("gohttp_header_bytes_total", "counter",
+		"Taille des en-têtes avant (plain) et après (encoded) compression HPACK / QPACK", "protocol", "direction", "encoding")
+	headerRatio = newRatio("gohttp_header_compression_ratio",
+		"Taille des en-têtes compressés rapportée à leur taille en clair", headerBytes, "encoding", "encoded", "plain")
+	quicRTT = newHistogram("gohttp_quic_rtt_seconds",
+		"RTT lissé des connexions QUIC à leur fermeture",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "")
+	quicPacketsSent = newMetric("gohttp_quic_packets_sent_total", "counter",
+		"Paquets QUIC envoyés")
+	quicPacketsLost = newMetric("gohttp_quic_packets_lost_total", "counter",
+		"Paquets QUIC déclarés perdus")
+)
+
+// Valeurs d'une métrique indexées par les valeurs de ses labels
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+
+	mu sync.Mutex
+	// Indexées par les labels formatés, {protocol="http2",status="200"}
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+}
+
+var metricsRegistry []interface{ write(w io.Writer) }
+
+func newMetric(name string, kind string, help string, labels ...string) *metric {
+	m := &metric{name: name, kind: kind, help: help, labels: labels, series: make(map[string]*metricSeries)}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	key := formatLabels(m.labels, labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		m.series[key] = s
+	}
+	s.value += v
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	// Une métrique sans label est exportée dès le démarrage
+	if len(m.labels) == 0 && len(m.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+	}
+	for _, key := range sortedKeys(m.series) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatValue(m.series[key].value))
+	}
+}
+
+// Jauge calculée à l'export en divisant deux séries d'un compteur,
+// distinguées par la valeur d'un de ses labels
+type ratio struct {
+	name        string
+	help        string
+	source      *metric
+	label       string
+	numerator   string
+	denominator string
+}
+
+func newRatio(name string, help string, source *metric, label string, numerator string, denominator string) *ratio {
+	r := &ratio{name: name, help: help, source: source, label: label, numerator: numerator, denominator: denominator}
+	metricsRegistry = append(metricsRegistry, r)
+	return r
+}
+
+func (r *ratio) write(w io.Writer) {
+	// Les labels du ratio sont ceux du compteur sans le label qui distingue les deux séries
+	var names []string
+	index := -1
+	for i, name := range r.source.labels {
+		if name == r.label {
+			index = i
+		} else {
+			names = append(names, name)
+		}
+	}
+	numerators := make(map[string]float64)
+	denominators := make(map[string]float64)
+	r.source.mu.Lock()
+	for _, s := range r.source.series {
+		values := slices.Delete(slices.Clone(s.labelValues), index, index+1)
+		id := formatLabels(names, values)
+		switch s.labelValues[index] {
+		case r.numerator:
+			numerators[id] += s.value
+		case r.denominator:
+			denominators[id] += s.value
+		}
+	}
+	r.source.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", r.name, r.help, r.name)
+	for _, id := range sortedKeys(denominators) {
+		if denominators[id] > 0 {
+			fmt.Fprintf(w, "%s%s %s\n", r.name, id, formatValue(numerators[id]/denominators[id]))
+		}
+	}
+}
+
+// Histogramme cumulatif : chaque bucket compte les observations inférieures ou égales à sa borne
+type histogram struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// label vaut "" pour un histogramme sans label
+func newHistogram(name string, help string, buckets []float64, label string) *histogram {
+	h := &histogram{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogram) observe(v float64, labelValue string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+/**
+* ```
+* gohttp_request_duration_seconds_bucket{protocol="http2",le="0.005"} 12
+* gohttp_request_duration_seconds_bucket{protocol="http2",le="+Inf"} 14
+* gohttp_request_duration_seconds_sum{protocol="http2"} 0.094
+* gohttp_request_duration_seconds_count{protocol="http2"} 14
+* ```
+**/
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var names []string
+	if h.label != "" {
+		names = []string{h.label}
+	}
+	for _, value := range sortedKeys(h.series) {
+		s := h.series[value]
+		var values []string
+		if h.label != "" {
+			values = []string{value}
+		}
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %v\n", h.name, formatLabels(append(names, "le"), append(values, formatValue(le))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %v\n", h.name, formatLabels(append(names, "le"), append(values, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(names, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %v\n", h.name, formatLabels(names, values), s.count)
+	}
+}
+
+// {protocol="h2",status="200"}, vide pour une métrique sans label
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Nom du protocole dans les labels, à partir de l'ALPN ou de la version d'une requête
+func metricProtocol(protocol string) string {
+	switch {
+	case protocol == HTTP1 || strings.HasPrefix(protocol, "HTTP/1"):
+		return "http1"
+	case protocol == HTTP2 || strings.HasPrefix(protocol, "HTTP/2"):
+		return "http2"
+	case protocol == HTTP3 || strings.HasPrefix(protocol, "HTTP/3"):
+		return "http3"
+	}
+	return protocol
+}
+
+// Compte une connexion ouverte, la fonction renvoyée est appelée à sa fermeture
+func recordConnection(protocol string, alpn string) func() {
+	protocol = metricProtocol(protocol)
+	connectionsTotal.inc(protocol, alpn)
+	connectionsActive.inc(protocol)
+	return func() {
+		connectionsActive.add(-1, protocol)
+	}
+}
+
+func recordFrame(protocol string, frameType string, in bool) {
+	direction := "out"
+	if in {
+		direction = "in"
+	}
+	framesTotal.inc(metricProtocol(protocol), frameType, direction)
+}
+
+// Taille des en-têtes en clair (comptés comme en HTTP1, "nom: valeur\r\n") et une fois compressés
+func recordHeaders(protocol string, fields []HeaderField, encoded int, in bool) {
+	plain := 0
+	for _, f := range fields {
+		plain += len(f.Name) + len(f.Value) + 4
+	}
+	direction := "out"
+	if in {
+		direction = "in"
+	}
+	protocol = metricProtocol(protocol)
+	headerBytes.add(float64(plain), protocol, direction, "plain")
+	headerBytes.add(float64(encoded), protocol, direction, "encoded")
+}
+
+// Connexion TCP dont les octets lus et écrits sont comptés, le protocole n'est connu
+// qu'à la fin du handshake (ALPN) donc les octets du handshake sont comptés à ce moment
+type meteredConn struct {
+	net.Conn
+	protocol string
+	received int
+	sent     int
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.protocol == "" {
+		c.received += n
+	} else {
+		bytesReceived.add(float64(n), c.protocol)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.protocol == "" {
+		c.sent += n
+	} else {
+		bytesSent.add(float64(n), c.protocol)
+	}
+	return n, err
+}
+
+// Appelé avant que la connexion ne soit partagée entre plusieurs goroutines,
+// les connexions sans protocole pris en charge ne sont pas comptées
+func (c *meteredConn) setProtocol(alpn string) {
+	c.protocol = metricProtocol(alpn)
+	if c.protocol == "" {
+		return
+	}
+	bytesReceived.add(float64(c.received), c.protocol)
+	bytesSent.add(float64(c.sent), c.protocol)
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	fmt.Printf("📈 Métriques sur http://%s/metrics\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("impossible de lancer le endpoint des métriques %v", err)
+	}
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
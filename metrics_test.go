@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Valeur d'une série, les métriques étant globales les tests comparent avant et après
+func metricValue(m *metric, labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[formatLabels(m.labels, labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func histogramCount(h *histogram, labelValue string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[labelValue]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		names  []string
+		values []string
+		want   string
+	}{
+		{nil, nil, ""},
+		{[]string{"protocol", "status"}, []string{"http2", "200"}, `{protocol="http2",status="200"}`},
+		{[]string{"alpn"}, []string{`a"b`}, `{alpn="a\"b"}`},
+		{[]string{"protocol", "le"}, []string{"http1"}, `{protocol="http1",le=""}`},
+	}
+	for _, tt := range tests {
+		if s := formatLabels(tt.names, tt.values); s != tt.want {
+			t.Errorf("formatLabels(%v, %v) = %s, %s attendu", tt.names, tt.values, s, tt.want)
+		}
+	}
+	for v, want := range map[float64]string{0: "0", 3: "3", 0.25: "0.25", math.Inf(1): "+Inf"} {
+		if s := formatValue(v); s != want {
+			t.Errorf("formatValue(%v) = %s, %s attendu", v, s, want)
+		}
+	}
+}
+
+func TestMetricProtocol(t *testing.T) {
+	tests := map[string]string{
+		HTTP1: "http1", "HTTP/1.0": "http1", "HTTP/1.1": "http1",
+		HTTP2: "http2", "HTTP/2.0": "http2",
+		HTTP3: "http3", "HTTP/3": "http3",
+		"": "", "spdy/3": "spdy/3",
+	}
+	for protocol, want := range tests {
+		if p := metricProtocol(protocol); p != want {
+			t.Errorf("metricProtocol(%q) = %q, %q attendu", protocol, p, want)
+		}
+	}
+}
+
+func TestMetricWrite(t *testing.T) {
+	m := &metric{name: "test_requests_total", kind: "counter", help: "Requêtes", labels: []string{"protocol", "status"}, series: make(map[string]*metricSeries)}
+	m.inc("http2", "404")
+	m.add(2, "http1", "200")
+	m.inc("http1", "200")
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := "# HELP test_requests_total Requêtes\n# TYPE test_requests_total counter\n" +
+		"test_requests_total{protocol=\"http1\",status=\"200\"} 3\n" +
+		"test_requests_total{protocol=\"http2\",status=\"404\"} 1\n"
+	if buf.String() != want {
+		t.Errorf("export\n%s\nattendu\n%s", buf.String(), want)
+	}
+
+	// Une métrique sans label vaut 0 avant sa première mesure
+	buf.Reset()
+	(&metric{name: "test_lost_total", kind: "counter", help: "Pertes", series: make(map[string]*metricSeries)}).write(&buf)
+	if !strings.HasSuffix(buf.String(), "\ntest_lost_total 0\n") {
+		t.Errorf("export %q", buf.String())
+	}
+}
+
+// Les buckets sont cumulatifs
+func TestHistogramWrite(t *testing.T) {
+	h := &histogram{name: "test_duration_seconds", help: "Durée", label: "protocol", buckets: []float64{0.25, 1}, series: make(map[string]*histogramSeries)}
+	for _, v := range []float64{0.25, 0.5, 2} {
+		h.observe(v, "http3")
+	}
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := "# HELP test_duration_seconds Durée\n# TYPE test_duration_seconds histogram\n" +
+		"test_duration_seconds_bucket{protocol=\"http3\",le=\"0.25\"} 1\n" +
+		"test_duration_seconds_bucket{protocol=\"http3\",le=\"1\"} 2\n" +
+		"test_duration_seconds_bucket{protocol=\"http3\",le=\"+Inf\"} 3\n" +
+		"test_duration_seconds_sum{protocol=\"http3\"} 2.75\n" +
+		"test_duration_seconds_count{protocol=\"http3\"} 3\n"
+	if buf.String() != want {
+		t.Errorf("export\n%s\nattendu\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	h = &histogram{name: "test_rtt_seconds", help: "RTT", buckets: []float64{0.01}, series: make(map[string]*histogramSeries)}
+	h.observe(0.005, "")
+	h.write(&buf)
+	if !strings.Contains(buf.String(), "\ntest_rtt_seconds_bucket{le=\"0.01\"} 1\n") || !strings.Contains(buf.String(), "\ntest_rtt_seconds_count 1\n") {
+		t.Errorf("export\n%s", buf.String())
+	}
+}
+
+func TestRatioWrite(t *testing.T) {
+	source := &metric{name: "test_header_bytes_total", labels: []string{"protocol", "direction", "encoding"}, series: make(map[string]*metricSeries)}
+	source.add(400, "http2", "in", "plain")
+	source.add(100, "http2", "in", "encoded")
+	// Sans taille en clair le rapport n'est pas exporté
+	source.add(50, "http3", "out", "encoded")
+	r := &ratio{name: "test_ratio", help: "Rapport", source: source, label: "encoding", numerator: "encoded", denominator: "plain"}
+	var buf bytes.Buffer
+	r.write(&buf)
+	want := "# HELP test_ratio Rapport\n# TYPE test_ratio gauge\ntest_ratio{protocol=\"http2\",direction=\"in\"} 0.25\n"
+	if buf.String() != want {
+		t.Errorf("export\n%s\nattendu\n%s", buf.String(), want)
+	}
+}
+
+// Les labels inconnus des autres tests isolent les séries mesurées
+func TestRecordConnection(t *testing.T) {
+	total, active := metricValue(connectionsTotal, "test/1", "test/1"), metricValue(connectionsActive, "test/1")
+	done := recordConnection("test/1", "test/1")
+	if v := metricValue(connectionsTotal, "test/1", "test/1") - total; v != 1 {
+		t.Errorf("%v connexions acceptées", v)
+	}
+	if v := metricValue(connectionsActive, "test/1") - active; v != 1 {
+		t.Errorf("%v connexions ouvertes", v)
+	}
+	done()
+	if v := metricValue(connectionsActive, "test/1") - active; v != 0 {
+		t.Errorf("%v connexions ouvertes après la fermeture", v)
+	}
+}
+
+// Les octets du handshake sont comptés une fois le protocole connu
+func TestMeteredConn(t *testing.T) {
+	received, sent := metricValue(bytesReceived, "test/2"), metricValue(bytesSent, "test/2")
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &meteredConn{Conn: server}
+	go client.Write([]byte("abc"))
+	io.ReadFull(conn, make([]byte, 3))
+	go io.ReadFull(client, make([]byte, 7))
+	conn.Write([]byte("hello"))
+	if v := metricValue(bytesReceived, "test/2") - received; v != 0 {
+		t.Fatalf("%v octets comptés avant l'ALPN", v)
+	}
+	conn.setProtocol("test/2")
+	conn.Write([]byte("!!"))
+	if r, s := metricValue(bytesReceived, "test/2")-received, metricValue(bytesSent, "test/2")-sent; r != 3 || s != 7 {
+		t.Errorf("%v octets reçus et %v envoyés, 3 et 7 attendus", r, s)
+	}
+}
+
+func TestMeterQUIC(t *testing.T) {
+	sent, lost := metricValue(quicPacketsSent), metricValue(quicPacketsLost)
+	sentBytes, rtts := metricValue(bytesSent, "http3"), histogramCount(quicRTT, "")
+	closed := false
+	tracer := &logging.ConnectionTracer{Close: func() { closed = true }}
+	stats := &quicStats{rtt: 20 * time.Millisecond}
+	meterQUIC(tracer, stats)
+	tracer.SentLongHeaderPacket(nil, 1200, logging.ECNUnsupported, nil, nil)
+	tracer.SentShortHeaderPacket(nil, 100, logging.ECNUnsupported, nil, nil)
+	tracer.LostPacket(logging.Encryption1RTT, 1, logging.PacketLossTimeThreshold)
+	tracer.Close()
+	if v := metricValue(quicPacketsSent) - sent; v != 2 {
+		t.Errorf("%v paquets envoyés", v)
+	}
+	if v := metricValue(quicPacketsLost) - lost; v != 1 {
+		t.Errorf("%v paquets perdus", v)
+	}
+	if v := metricValue(bytesSent, "http3") - sentBytes; v != 1300 {
+		t.Errorf("%v octets envoyés", v)
+	}
+	// Le RTT est mesuré à la fermeture, le Close d'origine est toujours appelé
+	if v := histogramCount(quicRTT, "") - rtts; v != 1 || !closed {
+		t.Errorf("%v RTT mesurés, Close appelé %v", v, closed)
+	}
+}
+
+// Une requête HTTP2 compte ses frames, ses en-têtes et son statut
+func TestH2Metrics(t *testing.T) {
+	headersIn, headersOut := metricValue(framesTotal, "http2", "HEADERS", "in"), metricValue(framesTotal, "http2", "HEADERS", "out")
+	plain, encoded := metricValue(headerBytes, "http2", "in", "plain"), metricValue(headerBytes, "http2", "in", "encoded")
+	requests := metricValue(requestsTotal, "http2", "200")
+
+	c := newH2TestClient(t)
+	c.get(1, "/index.html")
+	if status := c.status(1); status != "200" {
+		t.Fatalf("statut %v", status)
+	}
+	if v := metricValue(framesTotal, "http2", "HEADERS", "in") - headersIn; v != 1 {
+		t.Errorf("%v HEADERS reçus", v)
+	}
+	if v := metricValue(framesTotal, "http2", "HEADERS", "out") - headersOut; v != 1 {
+		t.Errorf("%v HEADERS envoyés", v)
+	}
+	if p, e := metricValue(headerBytes, "http2", "in", "plain")-plain, metricValue(headerBytes, "http2", "in", "encoded")-encoded; p == 0 || e == 0 || e >= p {
+		t.Errorf("en-têtes de %v octets, %v compressés", p, e)
+	}
+	// La requête est comptée une fois la réponse envoyée
+	deadline := time.Now().Add(time.Second)
+	for metricValue(requestsTotal, "http2", "200") == requests && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if v := metricValue(requestsTotal, "http2", "200") - requests; v != 1 {
+		t.Errorf("%v requêtes comptées", v)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("type %q", ct)
+	}
+	body := w.Body.String()
+	for _, name := range []string{"gohttp_connections_total", "gohttp_request_duration_seconds", "gohttp_header_compression_ratio", "gohttp_quic_packets_lost_total"} {
+		if !strings.Contains(body, "# TYPE "+name+" ") {
+			t.Errorf("métrique %s absente", name)
+		}
+	}
+	if !strings.Contains(body, "\ngohttp_quic_packets_lost_total ") {
+		t.Errorf("pertes QUIC non exportées\n%s", body)
+	}
+}
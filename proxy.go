@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Mode proxy : les requêtes sont transmises à un serveur HTTP/1.1 au lieu d'être servies
+// depuis public/, pour tester une application existante en HTTP/2 ou HTTP/3
+// Exemple : go run . http3 -proxy http://localhost:3000 (ou -proxy unix:/tmp/app.sock)
+var proxyOptions struct {
+	upstream string
+	timeout  time.Duration
+}
+
+func registerProxyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&proxyOptions.upstream, "proxy", "", "serveur HTTP/1.1 qui reçoit les requêtes (http://hôte:port ou unix:/chemin/socket)")
+	fs.DurationVar(&proxyOptions.timeout, "proxy-timeout", 30*time.Second, "délai maximum pour obtenir les en-têtes de la réponse du serveur amont")
+}
+
+// Le serveur amont de -proxy est celui du virtual host par défaut
+func setupProxy() {
+	if proxyOptions.upstream == "" {
+		return
+	}
+	p, err := newUpstreamProxy(proxyOptions.upstream)
+	if err != nil {
+		log.Fatalf("Proxy invalide : %v", err)
+	}
+	defaultVHost.proxy = p
+	fmt.Printf("🔀 Requêtes transmises à %s\n", p.name)
+}
+
+// Connexions inactives conservées pour les requêtes suivantes
+const proxyMaxIdleConns = 16
+
+// En-têtes propres à une connexion, ils ne sont pas transmis (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type upstreamProxy struct {
+	network string
+	addr    string
+	name    string
+	idle    chan *upstreamConn
+}
+
+func newUpstreamProxy(upstream string) (*upstreamProxy, error) {
+	p := &upstreamProxy{name: upstream, idle: make(chan *upstreamConn, proxyMaxIdleConns)}
+	if path, ok := strings.CutPrefix(upstream, "unix:"); ok {
+		p.network, p.addr = "unix", path
+		return p, nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("%q, http://hôte:port ou unix:/chemin/socket attendu", upstream)
+	}
+	p.network, p.addr = "tcp", u.Host
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	return p, nil
+}
+
+type upstreamConn struct {
+	net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// Chaque écriture vers le serveur amont doit aboutir dans le délai -proxy-timeout :
+// un client lent n'est pas pénalisé, un serveur amont qui ne lit plus le corps l'est
+type deadlineWriter struct {
+	net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.SetWriteDeadline(time.Now().Add(proxyOptions.timeout))
+	return w.Conn.Write(p)
+}
+
+// Réutilise une connexion inactive si possible
+func (p *upstreamProxy) get() (c *upstreamConn, reused bool, err error) {
+	select {
+	case c := <-p.idle:
+		return c, true, nil
+	default:
+	}
+	conn, err := net.DialTimeout(p.network, p.addr, proxyOptions.timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	return &upstreamConn{Conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(deadlineWriter{conn})}, false, nil
+}
+
+func (p *upstreamProxy) put(c *upstreamConn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Requête transmise au serveur amont, le corps est lu au fur et à mesure de l'envoi
+type proxyRequest struct {
+	Method  string
+	URI     string
+	Headers Header
+	Body    io.Reader
+	// -1 si la taille du corps n'est pas connue (il est alors envoyé en chunks)
+	ContentLength int64
+}
+
+type proxyResponse struct {
+	Status  int
+	Headers Header
+	Body    io.ReadCloser
+}
+
+/**
+* Prépare la requête pour le serveur amont : les pseudo-en-têtes et les en-têtes propres
+* à la connexion du client sont retirés et le client est identifié par Forwarded
+*
+* ```
+* GET /api HTTP/1.1
+* Host: localhost
+* Forwarded: for=127.0.0.1;host=localhost;proto=https
+* X-Forwarded-For: 127.0.0.1
+* X-Forwarded-Host: localhost
+* X-Forwarded-Proto: https
+* ```
+**/
+func newProxyRequest(r *Request, remote string) *proxyRequest {
+	pr := &proxyRequest{Method: r.Method, URI: r.URI, ContentLength: -1}
+	if pr.URI == "" {
+		pr.URI = "/"
+	}
+	if n, err := strconv.ParseInt(r.Header("Content-Length"), 10, 64); err == nil && n >= 0 {
+		pr.ContentLength = n
+	}
+	authority := r.Header(":authority")
+	if authority == "" {
+		authority = r.Header("Host")
+	}
+	pr.Headers.Add("Host", authority)
+
+	hop := connectionHeaders(r.Headers)
+	var cookies, forwarded, forwardedFor []string
+	for _, h := range r.Headers {
+		name := strings.ToLower(h.Name)
+		switch {
+		case strings.HasPrefix(name, ":"), hop[name], name == "host", name == "content-length",
+			name == "x-forwarded-host", name == "x-forwarded-proto":
+		// HTTP2 et HTTP3 peuvent découper les cookies, HTTP1 les attend sur une seule ligne
+		case name == "cookie":
+			cookies = append(cookies, h.Value)
+		case name == "forwarded":
+			forwarded = append(forwarded, h.Value)
+		case name == "x-forwarded-for":
+			forwardedFor = append(forwardedFor, h.Value)
+		default:
+			pr.Headers = append(pr.Headers, h)
+		}
+	}
+	if len(cookies) > 0 {
+		pr.Headers.Add("Cookie", strings.Join(cookies, "; "))
+	}
+
+	ip, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ip = remote
+	}
+	node := ip
+	if strings.Contains(ip, ":") {
+		node = `"[` + ip + `]"`
+	}
+	forwarded = append(forwarded, fmt.Sprintf("for=%s;host=%s;proto=https", node, quoteForwarded(authority)))
+	forwardedFor = append(forwardedFor, ip)
+	pr.Headers = append(pr.Headers,
+		HeaderField{Name: "Forwarded", Value: strings.Join(forwarded, ", ")},
+		HeaderField{Name: "X-Forwarded-For", Value: strings.Join(forwardedFor, ", ")},
+		HeaderField{Name: "X-Forwarded-Host", Value: authority},
+		HeaderField{Name: "X-Forwarded-Proto", Value: "https"},
+	)
+	return pr
+}
+
+// Une valeur de Forwarded contenant autre chose qu'un token doit être entre guillemets
+func quoteForwarded(v string) string {
+	if validFieldName(v) {
+		return v
+	}
+	return strconv.Quote(v)
+}
+
+// Noms (en minuscules) des en-têtes à ne pas transmettre, y compris ceux listés par Connection
+func connectionHeaders(h Header) map[string]bool {
+	hop := make(map[string]bool)
+	for _, name := range hopByHopHeaders {
+		hop[strings.ToLower(name)] = true
+	}
+	for _, token := range strings.Split(h.Get("Connection"), ",") {
+		hop[strings.ToLower(strings.TrimSpace(token))] = true
+	}
+	return hop
+}
+
+// Le corps est attendu s'il a une taille, ou si elle est inconnue pour une méthode qui en a un
+func (r *proxyRequest) expectsBody() bool {
+	return r.ContentLength > 0 || r.ContentLength < 0 && r.Method != "GET" && r.Method != "HEAD"
+}
+
+// Transmet la requête au serveur amont, une erreur devient une réponse 502 (ou 504 si le
+// serveur amont n'a pas répondu à temps)
+func (p *upstreamProxy) forward(t *traceConn, stream uint64, r *proxyRequest) *proxyResponse {
+	start := time.Now()
+	t.lock(stream)
+	dirColor(false).Printf("+- PROXY → %s\n", p.name)
+	tracef("| %s %s\n|\n", r.Method, r.URI)
+	t.unlock()
+
+	resp, err := p.roundTrip(r)
+	if err != nil {
+		status := http.StatusBadGateway
+		var ne net.Error
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			// Le corps envoyé par le client dépasse les limites (-max-body, -min-rate)
+			status = reqErr.Status
+		} else if errors.As(err, &ne) && ne.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+		t.lock(stream)
+		red.Printf("+- PROXY %v %s\n", status, http.StatusText(status))
+		red.Printf("| %v\n|\n", err)
+		t.unlock()
+		return &proxyResponse{
+			Status:  status,
+			Headers: Header{{Name: "Content-Type", Value: "text/plain; charset=utf-8"}},
+			Body:    io.NopCloser(strings.NewReader(fmt.Sprintf("%s : %v\n", http.StatusText(status), err))),
+		}
+	}
+	t.lock(stream)
+	dirColor(true).Printf("+- PROXY ← %v %s (%s)\n|\n", resp.Status, http.StatusText(resp.Status), formatDuration(time.Since(start)))
+	t.unlock()
+	return resp
+}
+
+func (p *upstreamProxy) roundTrip(r *proxyRequest) (*proxyResponse, error) {
+	for {
+		c, reused, err := p.get()
+		if err != nil {
+			return nil, fmt.Errorf("impossible de joindre %s, %w", p.name, err)
+		}
+		resp, err := p.exchange(c, r)
+		if err == nil {
+			return resp, nil
+		}
+		c.Close()
+		// Une connexion inactive a pu être fermée par le serveur amont, la requête est
+		// renvoyée sur une autre connexion tant qu'aucun corps n'a été consommé
+		var ne net.Error
+		if reused && r.Body == nil && !(errors.As(err, &ne) && ne.Timeout()) {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// Envoie la requête et lit les en-têtes de la réponse, le corps est lu par le client
+func (p *upstreamProxy) exchange(c *upstreamConn, r *proxyRequest) (*proxyResponse, error) {
+	// Le corps suit le rythme du client, limité par -body-timeout et -min-rate : le délai
+	// -proxy-timeout ne couvre que chaque écriture, puis l'attente de la réponse
+	if err := writeUpstreamRequest(c.bw, r); err != nil {
+		return nil, fmt.Errorf("impossible d'envoyer la requête, %w", err)
+	}
+	c.SetReadDeadline(time.Now().Add(proxyOptions.timeout))
+	status, fields, err := readUpstreamResponse(c.br)
+	if err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+
+	body := &upstreamBody{proxy: p, conn: c, reusable: true}
+	hop := connectionHeaders(fields)
+	resp := &proxyResponse{Status: status, Body: body}
+	for _, h := range fields {
+		name := strings.ToLower(h.Name)
+		if name == "connection" && strings.EqualFold(h.Value, "close") {
+			body.reusable = false
+		}
+		if !hop[name] {
+			resp.Headers = append(resp.Headers, h)
+		}
+	}
+	length, err := strconv.ParseInt(fields.Get("Content-Length"), 10, 64)
+	switch {
+	case r.Method == "HEAD" || status == http.StatusNoContent || status == http.StatusNotModified:
+		body.r = bytes.NewReader(nil)
+	case strings.EqualFold(fields.Get("Transfer-Encoding"), "chunked"):
+		body.r = httputil.NewChunkedReader(c.br)
+		body.chunked = true
+	case err == nil:
+		body.r = io.LimitReader(c.br, length)
+	default:
+		// Sans taille ni chunks, le corps se termine avec la connexion
+		body.r = c.br
+		body.reusable = false
+	}
+	return resp, nil
+}
+
+func writeUpstreamRequest(w *bufio.Writer, r *proxyRequest) error {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", r.Method, r.URI)
+	for _, h := range r.Headers {
+		fmt.Fprintf(w, "%s: %s\r\n", h.Name, h.Value)
+	}
+	switch {
+	case r.Body == nil:
+		if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+			w.WriteString("Content-Length: 0\r\n")
+		}
+	case r.ContentLength >= 0:
+		fmt.Fprintf(w, "Content-Length: %v\r\n", r.ContentLength)
+	default:
+		w.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	w.WriteString("\r\n")
+
+	if r.Body != nil {
+		if r.ContentLength >= 0 {
+			if _, err := io.CopyN(w, r.Body, r.ContentLength); err != nil {
+				return err
+			}
+		} else {
+			cw := httputil.NewChunkedWriter(w)
+			if _, err := io.Copy(cw, r.Body); err != nil {
+				return err
+			}
+			cw.Close()
+			w.WriteString("\r\n")
+		}
+	}
+	return w.Flush()
+}
+
+// Lit la ligne de statut et les en-têtes, les réponses intermédiaires (1xx) sont ignorées
+func readUpstreamResponse(br *bufio.Reader) (int, Header, error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, nil, fmt.Errorf("impossible de lire la ligne de statut, %w", err)
+		}
+		proto, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+		code, _, _ := strings.Cut(rest, " ")
+		status, err := strconv.Atoi(code)
+		if !strings.HasPrefix(proto, "HTTP/1.") || err != nil || len(code) != 3 {
+			return 0, nil, fmt.Errorf("ligne de statut invalide %q", strings.TrimSpace(line))
+		}
+		var fields Header
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return 0, nil, fmt.Errorf("impossible de lire les en-têtes, %w", err)
+			}
+			if strings.TrimRight(line, "\r\n") == "" {
+				break
+			}
+			if err := fields.parseLine(line); err != nil {
+				return 0, nil, err
+			}
+		}
+		if status == http.StatusSwitchingProtocols {
+			return 0, nil, errors.New("changement de protocole non pris en charge")
+		}
+		if status >= 200 {
+			return status, fields, nil
+		}
+	}
+}
+
+// Corps de la réponse, la connexion retourne dans le pool une fois le corps lu en entier
+type upstreamBody struct {
+	proxy    *upstreamProxy
+	conn     *upstreamConn
+	r        io.Reader
+	chunked  bool
+	reusable bool
+	done     bool
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		// Les trailers éventuels et la ligne vide terminent un corps en chunks
+		if b.chunked {
+			for {
+				line, err := b.conn.br.ReadString('\n')
+				if err != nil {
+					b.reusable = false
+					break
+				}
+				if strings.TrimSpace(line) == "" {
+					break
+				}
+			}
+		}
+		b.release(true)
+	}
+	return n, err
+}
+
+// Un corps abandonné avant la fin laisse la connexion dans un état inconnu, elle est fermée
+func (b *upstreamBody) Close() error {
+	b.release(false)
+	return nil
+}
+
+func (b *upstreamBody) release(complete bool) {
+	if b.done {
+		return
+	}
+	b.done = true
+	if complete && b.reusable {
+		b.proxy.put(b.conn)
+		return
+	}
+	b.conn.Close()
+}
+
+// Noms des en-têtes en minuscules pour HTTP2 et HTTP3, le statut est un pseudo-en-tête
+func proxyResponseFields(resp *proxyResponse) []HeaderField {
+	return append([]HeaderField{{Name: ":status", Value: strconv.Itoa(resp.Status)}}, resp.Headers.Fields()...)
+}
+
+// Une connexion HTTP1 ne sert qu'une requête, la réponse se termine avec la connexion
+// Renvoie le statut et la taille du corps transmis pour le journal d'accès
+func proxyHTTP1(p *upstreamProxy, r *Request, conn net.Conn, t *traceConn) (int, int64) {
+	// Le corps peut être long à envoyer, il n'est limité que par -body-timeout et -min-rate
+	pr := newProxyRequest(r, conn.RemoteAddr().String())
+	pr.Body = r.body
+
+	resp := p.forward(t, noStream, pr)
+	defer resp.Body.Close()
+	status := fmt.Sprintf("HTTP/1.1 %v %s", resp.Status, http.StatusText(resp.Status))
+	headers := append(resp.Headers, HeaderField{Name: "Connection", Value: "close"})
+	bw := bufio.NewWriter(conn)
+	bw.WriteString(status + "\r\n")
+	printLine(t, status, false)
+	for _, h := range headers {
+		fmt.Fprintf(bw, "%s: %s\r\n", h.Name, h.Value)
+		printHeader(t, h.Name, h.Value, false)
+	}
+	bw.WriteString("\r\n")
+	printLine(t, "", false)
+	t.message(false, status, headers, nil, nil)
+	var size int64
+	if r.Method != "HEAD" {
+		size, _ = io.Copy(bw, resp.Body)
+	}
+	bw.Flush()
+	return resp.Status, size
+}
+
+// Le stream reste enregistré pour que les frames DATA alimentent le corps de la requête
+func (c *h2Conn) proxy(p *upstreamProxy, r *Request, streamID uint32, endStream bool, entry *accessEntry) {
+	s := c.openStream(streamID)
+	pr := newProxyRequest(r, c.trace.Remote)
+	// Les frames DATA attendent d'être lues, le corps est donc transmis même s'il est vide
+	if endStream {
+		c.mu.Lock()
+		s.endBody(io.EOF)
+		c.mu.Unlock()
+	} else {
+		pr.Body = s
+	}
+	go func() {
+		resp := p.forward(c.trace, uint64(streamID), pr)
+		defer resp.Body.Close()
+		if err := c.writeHeaders(streamID, false, proxyResponseFields(resp)); err != nil {
+			entry.log(resp.Status, 0)
+			s.cancel(err)
+			return
+		}
+		size, err := io.Copy(s, resp.Body)
+		entry.log(resp.Status, size)
+		if err != nil {
+			s.cancel(err)
+			return
+		}
+		s.Close()
+	}()
+}
+
+// Le corps de la requête est lu dans les frames DATA au fur et à mesure de l'envoi
+func (c *h3Conn) proxy(p *upstreamProxy, str quic.Stream, hf HeadersFrame, fp *framerParser, entry *accessEntry) error {
+	r, err := NewHTTP2Request(hf.Headers)
+	if err != nil {
+		return err
+	}
+	r.Protocol = HTTP3
+	pr := newProxyRequest(r, c.trace.Remote)
+	body := &h3BodyReader{c: c, str: str, fp: fp}
+	if pr.expectsBody() {
+		pr.Body = body
+	}
+
+	resp := p.forward(c.trace, uint64(str.StreamID()), pr)
+	defer resp.Body.Close()
+	if err := c.writeHeaders(str, HeadersFrame{Headers: proxyResponseFields(resp)}); err != nil {
+		entry.log(resp.Status, 0)
+		return err
+	}
+	size, err := io.Copy(h3DataWriter{c, str}, resp.Body)
+	entry.log(resp.Status, size)
+	if err != nil {
+		return err
+	}
+	// Une erreur de trame dans un corps non transmis doit tout de même être signalée
+	if body.err == nil {
+		io.Copy(io.Discard, body)
+	}
+	if body.err != nil && body.err != io.EOF {
+		return body.err
+	}
+	return str.Close()
+}
+
+type h3BodyReader struct {
+	c       *h3Conn
+	str     quic.Stream
+	fp      *framerParser
+	pending []byte
+	err     error
+}
+
+func (b *h3BodyReader) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		f, err := b.fp.NextFrame()
+		if err != nil {
+			b.err = err
+			continue
+		}
+		switch f := f.(type) {
+		case DataFrame:
+			b.c.printFrame(b.str.StreamID(), f, true)
+			b.pending = f.Data
+		case HeadersFrame:
+			// Les trailers ne sont pas transmis au serveur amont
+			b.c.printFrame(b.str.StreamID(), f, true)
+		default:
+			b.err = newH3Error(ErrCodeFrameUnexpected,
+				"frame %s interdite sur un stream de requête", frameName(f))
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Serveur amont qui lit la requête en entier, puis répond après respondAfter
+// (jamais si respondAfter est négatif)
+func newTestUpstream(t *testing.T, respondAfter time.Duration) *upstreamProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				body, _ := io.ReadAll(req.Body)
+				if respondAfter < 0 {
+					// Jusqu'à ce que le proxy abandonne la connexion
+					io.Copy(io.Discard, br)
+					return
+				}
+				time.Sleep(respondAfter)
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+			}()
+		}
+	}()
+	p, err := newUpstreamProxy("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestProxyTimeout(t *testing.T) {
+	setOption(t, &proxyOptions.timeout, 100*time.Millisecond)
+
+	tests := []struct {
+		name string
+		// Temps mis par le client pour envoyer son corps
+		upload       time.Duration
+		respondAfter time.Duration
+		status       int
+	}{
+		{"envoi lent du corps", 300 * time.Millisecond, 0, http.StatusOK},
+		{"réponse dans le délai", 0, 50 * time.Millisecond, http.StatusOK},
+		{"réponse trop lente", 0, 300 * time.Millisecond, http.StatusGatewayTimeout},
+		{"pas de réponse après un envoi lent", 300 * time.Millisecond, -1, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestUpstream(t, tt.respondAfter)
+			pr, pw := io.Pipe()
+			go func() {
+				time.Sleep(tt.upload)
+				io.WriteString(pw, "corps")
+				pw.Close()
+			}()
+			resp := p.forward(nil, noStream, &proxyRequest{Method: "POST", URI: "/", Headers: Header{{Name: "Host", Value: "localhost"}}, Body: pr, ContentLength: 5})
+			defer resp.Body.Close()
+			if resp.Status != tt.status {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("statut %v, %v attendu (%s)", resp.Status, tt.status, body)
+			}
+			if tt.status == http.StatusOK {
+				if body, _ := io.ReadAll(resp.Body); string(body) != "corps" {
+					t.Errorf("corps %q", body)
+				}
+			}
+		})
+	}
+}
+
+// Corps de taille quelconque qui n'occupe pas de mémoire
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Un serveur amont qui ne lit plus le corps ne bloque pas l'envoi au-delà de -proxy-timeout
+func TestProxyStalledUpload(t *testing.T) {
+	setOption(t, &proxyOptions.timeout, 100*time.Millisecond)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// La connexion reste ouverte sans être lue jusqu'à la fin du test
+		t.Cleanup(func() { conn.Close() })
+	}()
+	p, err := newUpstreamProxy("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(64 << 20)
+	resp := p.forward(nil, noStream, &proxyRequest{Method: "POST", URI: "/", Headers: Header{{Name: "Host", Value: "localhost"}}, Body: io.LimitReader(zeroReader{}, size), ContentLength: size})
+	defer resp.Body.Close()
+	if resp.Status != http.StatusGatewayTimeout {
+		t.Fatalf("statut %v, 504 attendu", resp.Status)
+	}
+}
+
+func TestNewProxyRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *Request
+		remote  string
+		headers Header
+	}{
+		{
+			"HTTP1",
+			&Request{Method: "GET", URI: "/api?a=1", Headers: Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "Accept", Value: "*/*"},
+			}},
+			"127.0.0.1:52000",
+			Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "Accept", Value: "*/*"},
+				{Name: "Forwarded", Value: "for=127.0.0.1;host=localhost;proto=https"},
+				{Name: "X-Forwarded-For", Value: "127.0.0.1"},
+				{Name: "X-Forwarded-Host", Value: "localhost"},
+				{Name: "X-Forwarded-Proto", Value: "https"},
+			},
+		},
+		{
+			"en-têtes propres à la connexion",
+			&Request{Method: "POST", URI: "/", Headers: Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "Connection", Value: "keep-alive, X-Trace"},
+				{Name: "Keep-Alive", Value: "timeout=5"},
+				{Name: "X-Trace", Value: "1"},
+				{Name: "Transfer-Encoding", Value: "chunked"},
+				{Name: "TE", Value: "trailers"},
+				{Name: "Upgrade", Value: "h2c"},
+				{Name: "Proxy-Connection", Value: "keep-alive"},
+				{Name: "Content-Length", Value: "5"},
+				{Name: "X-Custom", Value: "gardé"},
+			}},
+			"127.0.0.1:52000",
+			Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "X-Custom", Value: "gardé"},
+				{Name: "Forwarded", Value: "for=127.0.0.1;host=localhost;proto=https"},
+				{Name: "X-Forwarded-For", Value: "127.0.0.1"},
+				{Name: "X-Forwarded-Host", Value: "localhost"},
+				{Name: "X-Forwarded-Proto", Value: "https"},
+			},
+		},
+		{
+			"HTTP2 avec cookies découpés",
+			&Request{Method: "GET", URI: "/", Headers: Header{
+				{Name: ":method", Value: "GET"},
+				{Name: ":authority", Value: "demo.test:8443"},
+				{Name: "cookie", Value: "a=1"},
+				{Name: "cookie", Value: "b=2"},
+			}},
+			"[::1]:52000",
+			Header{
+				{Name: "Host", Value: "demo.test:8443"},
+				{Name: "Cookie", Value: "a=1; b=2"},
+				{Name: "Forwarded", Value: `for="[::1]";host="demo.test:8443";proto=https`},
+				{Name: "X-Forwarded-For", Value: "::1"},
+				{Name: "X-Forwarded-Host", Value: "demo.test:8443"},
+				{Name: "X-Forwarded-Proto", Value: "https"},
+			},
+		},
+		{
+			"proxys précédents",
+			&Request{Method: "GET", URI: "/", Headers: Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "Forwarded", Value: "for=10.0.0.1"},
+				{Name: "X-Forwarded-For", Value: "10.0.0.1"},
+				{Name: "X-Forwarded-Host", Value: "ignoré"},
+				{Name: "X-Forwarded-Proto", Value: "http"},
+			}},
+			"127.0.0.1:52000",
+			Header{
+				{Name: "Host", Value: "localhost"},
+				{Name: "Forwarded", Value: "for=10.0.0.1, for=127.0.0.1;host=localhost;proto=https"},
+				{Name: "X-Forwarded-For", Value: "10.0.0.1, 127.0.0.1"},
+				{Name: "X-Forwarded-Host", Value: "localhost"},
+				{Name: "X-Forwarded-Proto", Value: "https"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := newProxyRequest(tt.request, tt.remote)
+			if !slices.Equal(pr.Headers, tt.headers) {
+				t.Errorf("en-têtes\n%v\n%v attendus", pr.Headers, tt.headers)
+			}
+		})
+	}
+}
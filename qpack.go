@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9204.html
+
+// Capacité de la table dynamique que le client peut utiliser pour ses requêtes
+const qpackMaxTableCapacity = 4096
+
+// Nombre de streams pouvant attendre des insertions dans la table dynamique
+const qpackBlockedStreams = 16
+
+// Table statique (RFC 9204 annexe A), les index commencent à 0
+var qpackStaticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":path", Value: "/"},
+	{Name: "age", Value: "0"},
+	{Name: "content-disposition"},
+	{Name: "content-length", Value: "0"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "referer"},
+	{Name: "set-cookie"},
+	{Name: ":method", Value: "CONNECT"},
+	{Name: ":method", Value: "DELETE"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "HEAD"},
+	{Name: ":method", Value: "OPTIONS"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":method", Value: "PUT"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "103"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "503"},
+	{Name: "accept", Value: "*/*"},
+	{Name: "accept", Value: "application/dns-message"},
+	{Name: "accept-encoding", Value: "gzip, deflate, br"},
+	{Name: "accept-ranges", Value: "bytes"},
+	{Name: "access-control-allow-headers", Value: "cache-control"},
+	{Name: "access-control-allow-headers", Value: "content-type"},
+	{Name: "access-control-allow-origin", Value: "*"},
+	{Name: "cache-control", Value: "max-age=0"},
+	{Name: "cache-control", Value: "max-age=2592000"},
+	{Name: "cache-control", Value: "max-age=604800"},
+	{Name: "cache-control", Value: "no-cache"},
+	{Name: "cache-control", Value: "no-store"},
+	{Name: "cache-control", Value: "public, max-age=31536000"},
+	{Name: "content-encoding", Value: "br"},
+	{Name: "content-encoding", Value: "gzip"},
+	{Name: "content-type", Value: "application/dns-message"},
+	{Name: "content-type", Value: "application/javascript"},
+	{Name: "content-type", Value: "application/json"},
+	{Name: "content-type", Value: "application/x-www-form-urlencoded"},
+	{Name: "content-type", Value: "image/gif"},
+	{Name: "content-type", Value: "image/jpeg"},
+	{Name: "content-type", Value: "image/png"},
+	{Name: "content-type", Value: "text/css"},
+	{Name: "content-type", Value: "text/html; charset=utf-8"},
+	{Name: "content-type", Value: "text/plain"},
+	{Name: "content-type", Value: "text/plain;charset=utf-8"},
+	{Name: "range", Value: "bytes=0-"},
+	{Name: "strict-transport-security", Value: "max-age=31536000"},
+	{Name: "strict-transport-security", Value: "max-age=31536000; includesubdomains"},
+	{Name: "strict-transport-security", Value: "max-age=31536000; includesubdomains; preload"},
+	{Name: "vary", Value: "accept-encoding"},
+	{Name: "vary", Value: "origin"},
+	{Name: "x-content-type-options", Value: "nosniff"},
+	{Name: "x-xss-protection", Value: "1; mode=block"},
+	{Name: ":status", Value: "100"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "302"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "403"},
+	{Name: ":status", Value: "421"},
+	{Name: ":status", Value: "425"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-language"},
+	{Name: "access-control-allow-credentials", Value: "FALSE"},
+	{Name: "access-control-allow-credentials", Value: "TRUE"},
+	{Name: "access-control-allow-headers", Value: "*"},
+	{Name: "access-control-allow-methods", Value: "get"},
+	{Name: "access-control-allow-methods", Value: "get, post, options"},
+	{Name: "access-control-allow-methods", Value: "options"},
+	{Name: "access-control-expose-headers", Value: "content-length"},
+	{Name: "access-control-request-headers", Value: "content-type"},
+	{Name: "access-control-request-method", Value: "get"},
+	{Name: "access-control-request-method", Value: "post"},
+	{Name: "alt-svc", Value: "clear"},
+	{Name: "authorization"},
+	{Name: "content-security-policy", Value: "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{Name: "early-data", Value: "1"},
+	{Name: "expect-ct"},
+	{Name: "forwarded"},
+	{Name: "if-range"},
+	{Name: "origin"},
+	{Name: "purpose", Value: "prefetch"},
+	{Name: "server"},
+	{Name: "timing-allow-origin", Value: "*"},
+	{Name: "upgrade-insecure-requests", Value: "1"},
+	{Name: "user-agent"},
+	{Name: "x-forwarded-for"},
+	{Name: "x-frame-options", Value: "deny"},
+	{Name: "x-frame-options", Value: "sameorigin"},
+}
+
+// Cherche un en-tête dans une table, renvoie l'index du nom (-1 si absent)
+// et si la valeur correspond aussi
+func searchFields(table []HeaderField, f HeaderField) (int, bool) {
+	index := -1
+	for i, e := range table {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return i, true
+		}
+		if index < 0 {
+			index = i
+		}
+	}
+	return index, false
+}
+
+// Table dynamique QPACK, une entrée est repérée par son index absolu
+// (0 pour la première insertion) qui ne change pas avec les évictions
+type qpackTable struct {
+	// De la plus ancienne à la plus récente
+	entries  []HeaderField
+	dropped  uint64
+	size     int
+	capacity int
+}
+
+// Nombre total d'insertions depuis le début de la connexion
+func (t *qpackTable) insertCount() uint64 {
+	return t.dropped + uint64(len(t.entries))
+}
+
+func (t *qpackTable) get(abs uint64) (HeaderField, bool) {
+	if abs < t.dropped || abs >= t.insertCount() {
+		return HeaderField{}, false
+	}
+	return t.entries[abs-t.dropped], true
+}
+
+// Ajoute une entrée en évinçant les plus anciennes, false si elle est plus grande que la table
+func (t *qpackTable) insert(f HeaderField) bool {
+	if f.size() > t.capacity {
+		return false
+	}
+	t.evict(t.capacity - f.size())
+	t.entries = append(t.entries, HeaderField{Name: f.Name, Value: f.Value})
+	t.size += f.size()
+	return true
+}
+
+func (t *qpackTable) evict(max int) {
+	for t.size > max {
+		t.size -= t.entries[0].size()
+		t.entries = t.entries[1:]
+		t.dropped++
+	}
+}
+
+func (t *qpackTable) setCapacity(capacity int) {
+	t.capacity = capacity
+	t.evict(capacity)
+}
+
+// Lit un entier dont le préfixe de n bits est dans le premier octet, déjà lu
+func readQPACKInt(r io.ByteReader, first byte, n uint) (uint64, error) {
+	max := uint64(1)<<n - 1
+	v := uint64(first) & max
+	if v < max {
+		return v, nil
+	}
+	for m := uint(0); ; m += 7 {
+		if m > 56 {
+			return 0, fmt.Errorf("entier trop grand")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+// Chaîne dont la longueur a un préfixe de n bits, le bit Huffman est juste avant le préfixe
+func readQPACKString(r io.ByteReader, first byte, n uint) (string, bool, error) {
+	huffman := first&(1<<n) != 0
+	l, err := readQPACKInt(r, first, n)
+	if err != nil {
+		return "", false, err
+	}
+	if l > maxH3FramePayload {
+		return "", false, fmt.Errorf("chaîne de %v octets", l)
+	}
+	s := make([]byte, l)
+	for i := range s {
+		if s[i], err = r.ReadByte(); err != nil {
+			return "", false, err
+		}
+	}
+	if !huffman {
+		return string(s), false, nil
+	}
+	decoded, err := huffmanDecode(s)
+	return decoded, true, err
+}
+
+// Valeur d'un en-tête, toujours avec un préfixe de 7 bits
+func readQPACKValue(r io.ByteReader) (string, bool, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", false, err
+	}
+	return readQPACKString(r, b, 7)
+}
+
+func appendQPACKString(b []byte, first byte, n uint, s string) ([]byte, bool) {
+	if l := huffmanEncodedLen(s); l < len(s) {
+		b = appendHPACKInt(b, first|1<<n, n, uint64(l))
+		return huffmanEncode(b, s), true
+	}
+	b = appendHPACKInt(b, first, n, uint64(len(s)))
+	return append(b, s...), false
+}
+
+// Required Insert Count est encodé modulo 2 * MaxEntries (RFC 9204 section 4.5.1.1)
+func encodeRequiredInsertCount(ric uint64, maxEntries uint64) uint64 {
+	if ric == 0 {
+		return 0
+	}
+	return ric%(2*maxEntries) + 1
+}
+
+func decodeRequiredInsertCount(encoded uint64, maxEntries uint64, totalInserts uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+	fullRange := 2 * maxEntries
+	if encoded > fullRange {
+		return 0, fmt.Errorf("required insert count %v invalide", encoded)
+	}
+	maxValue := totalInserts + maxEntries
+	ric := maxValue/fullRange*fullRange + encoded - 1
+	if ric > maxValue {
+		if ric <= fullRange {
+			return 0, fmt.Errorf("required insert count %v invalide", encoded)
+		}
+		ric -= fullRange
+	}
+	if ric == 0 {
+		return 0, fmt.Errorf("required insert count %v invalide", encoded)
+	}
+	return ric, nil
+}
+
+// Décodeur des requêtes d'une connexion, la table dynamique est alimentée par
+// le flux encodeur du client et partagée par tous les streams de requête
+type QPACKDecoder struct {
+	mu    sync.Mutex
+	table qpackTable
+	// Fermé puis remplacé à chaque insertion pour réveiller les streams bloqués
+	inserted chan struct{}
+	blocked  int
+	// Insertions déjà signalées au client (acquittements et incréments)
+	acknowledged uint64
+	// Notre flux décodeur, transporte les acquittements vers l'encodeur du client
+	stream io.Writer
+	done   <-chan struct{}
+	trace  *traceConn
+}
+
+func NewQPACKDecoder(stream io.Writer, done <-chan struct{}) *QPACKDecoder {
+	return &QPACKDecoder{
+		inserted: make(chan struct{}),
+		stream:   stream,
+		done:     done,
+	}
+}
+
+/**
+* Instructions du flux encodeur (RFC 9204 section 4.3)
+*
+* ```
+* 001xxxxx  Set Dynamic Table Capacity
+* 1Txxxxxx  Insert with Name Reference (T = table statique)
+* 01Hxxxxx  Insert with Literal Name
+* 000xxxxx  Duplicate
+* ```
+**/
+func (d *QPACKDecoder) readEncoderStream(str io.Reader) error {
+	r := bufio.NewReader(str)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if err := d.readEncoderInstruction(r, b); err != nil {
+			return err
+		}
+		// Les insertions reçues ensemble sont confirmées en une fois
+		if r.Buffered() == 0 {
+			d.acknowledgeInserts()
+		}
+	}
+}
+
+func (d *QPACKDecoder) readEncoderInstruction(r *bufio.Reader, b byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case b&0x80 != 0:
+		index, err := readQPACKInt(r, b, 6)
+		if err != nil {
+			return err
+		}
+		name, ok := d.nameReference(b&0x40 != 0, index, d.table.insertCount())
+		if !ok {
+			return newH3Error(ErrCodeQPACKEncoderStreamError, "référence %v invalide", index)
+		}
+		value, _, err := readQPACKValue(r)
+		if err != nil {
+			return err
+		}
+		return d.insert(HeaderField{Name: name, Value: value})
+	case b&0xc0 == 0x40:
+		name, _, err := readQPACKString(r, b, 5)
+		if err != nil {
+			return err
+		}
+		value, _, err := readQPACKValue(r)
+		if err != nil {
+			return err
+		}
+		return d.insert(HeaderField{Name: name, Value: value})
+	case b&0xe0 == 0x20:
+		capacity, err := readQPACKInt(r, b, 5)
+		if err != nil {
+			return err
+		}
+		if capacity > qpackMaxTableCapacity {
+			return newH3Error(ErrCodeQPACKEncoderStreamError, "capacité %v supérieure à %v", capacity, qpackMaxTableCapacity)
+		}
+		printQPACKInstruction(d.trace, "SET_CAPACITY", true, "Capacity", capacity)
+		d.table.setCapacity(int(capacity))
+		return nil
+	default:
+		index, err := readQPACKInt(r, b, 5)
+		if err != nil {
+			return err
+		}
+		f, ok := d.table.get(d.table.insertCount() - 1 - index)
+		if !ok {
+			return newH3Error(ErrCodeQPACKEncoderStreamError, "duplication de l'entrée %v invalide", index)
+		}
+		return d.insert(f)
+	}
+}
+
+// Nom d'une entrée de la table statique ou de la table dynamique (index relatif à base)
+func (d *QPACKDecoder) nameReference(static bool, index uint64, base uint64) (string, bool) {
+	if static {
+		if index >= uint64(len(qpackStaticTable)) {
+			return "", false
+		}
+		return qpackStaticTable[index].Name, true
+	}
+	if index >= base {
+		return "", false
+	}
+	f, ok := d.table.get(base - 1 - index)
+	return f.Name, ok
+}
+
+func (d *QPACKDecoder) insert(f HeaderField) error {
+	abs := d.table.insertCount()
+	if !d.table.insert(f) {
+		return newH3Error(ErrCodeQPACKEncoderStreamError, "entrée %s plus grande que la table", f.Name)
+	}
+	printQPACKInstruction(d.trace, "INSERT", true, f.Name, f.Value, "Index", abs)
+	close(d.inserted)
+	d.inserted = make(chan struct{})
+	return nil
+}
+
+/**
+* Instructions du flux décodeur (RFC 9204 section 4.4)
+*
+* ```
+* 1xxxxxxx  Section Acknowledgment (identifiant du stream)
+* 01xxxxxx  Stream Cancellation
+* 00xxxxxx  Insert Count Increment
+* ```
+**/
+func (d *QPACKDecoder) acknowledgeInserts() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	increment := d.table.insertCount() - d.acknowledged
+	if increment == 0 {
+		return
+	}
+	d.acknowledged += increment
+	printQPACKInstruction(d.trace, "INSERT_COUNT_INCREMENT", false, "Increment", increment)
+	d.stream.Write(appendHPACKInt(nil, 0x00, 6, increment))
+}
+
+func (d *QPACKDecoder) acknowledgeSection(streamID uint64, ric uint64) {
+	d.acknowledged = max(d.acknowledged, ric)
+	printQPACKInstruction(d.trace, "SECTION_ACK", false, "Stream", streamID)
+	d.stream.Write(appendHPACKInt(nil, 0x80, 7, streamID))
+}
+
+// Décode le bloc d'en-têtes d'un stream, attend si il référence des entrées pas encore reçues
+func (d *QPACKDecoder) Decode(streamID uint64, p []byte) ([]HeaderField, error) {
+	r := bytes.NewReader(p)
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := readQPACKInt(r, b, 8)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = r.ReadByte(); err != nil {
+		return nil, err
+	}
+	delta, err := readQPACKInt(r, b, 7)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ric, err := decodeRequiredInsertCount(encoded, qpackMaxTableCapacity/32, d.table.insertCount())
+	if err != nil {
+		return nil, err
+	}
+	base := ric + delta
+	if b&0x80 != 0 {
+		if delta >= ric {
+			return nil, fmt.Errorf("base négative")
+		}
+		base = ric - delta - 1
+	}
+	if err := d.waitInserts(ric); err != nil {
+		return nil, err
+	}
+
+	var fields []HeaderField
+	for r.Len() > 0 {
+		before := r.Len()
+		f, err := d.readField(r, base, ric)
+		if err != nil {
+			return nil, err
+		}
+		f.Encoding.Size = before - r.Len()
+		fields = append(fields, f)
+	}
+	if ric > 0 {
+		d.acknowledgeSection(streamID, ric)
+	}
+	return fields, nil
+}
+
+// Le stream est bloqué tant que la table ne contient pas ric entrées
+func (d *QPACKDecoder) waitInserts(ric uint64) error {
+	if ric <= d.table.insertCount() {
+		return nil
+	}
+	if d.blocked >= qpackBlockedStreams {
+		return fmt.Errorf("plus de %v streams bloqués", qpackBlockedStreams)
+	}
+	d.blocked++
+	defer func() { d.blocked-- }()
+	for ric > d.table.insertCount() {
+		inserted := d.inserted
+		d.mu.Unlock()
+		select {
+		case <-inserted:
+		case <-d.done:
+			d.mu.Lock()
+			return fmt.Errorf("connexion fermée")
+		}
+		d.mu.Lock()
+	}
+	return nil
+}
+
+/**
+* Représentations d'un en-tête (RFC 9204 section 4.5)
+*
+* ```
+* 1Txxxxxx  Indexed Field Line (T = table statique)
+* 0001xxxx  Indexed Field Line with Post-Base Index
+* 01NTxxxx  Literal Field Line with Name Reference (N = jamais indexé)
+* 0000Nxxx  Literal Field Line with Post-Base Name Reference
+* 001NHxxx  Literal Field Line with Literal Name
+* ```
+**/
+func (d *QPACKDecoder) readField(r *bytes.Reader, base uint64, ric uint64) (HeaderField, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return HeaderField{}, err
+	}
+	enc := &FieldEncoding{Repr: hpackWithoutIndexing}
+	f := HeaderField{Encoding: enc}
+
+	// Index absolu d'une entrée dynamique, elle doit faire partie des ric premières insertions
+	dynamic := func(abs uint64) (HeaderField, error) {
+		enc.Table, enc.Index = "dynamique", abs
+		e, ok := d.table.get(abs)
+		if !ok || abs >= ric {
+			return e, fmt.Errorf("entrée dynamique %v invalide", abs)
+		}
+		return e, nil
+	}
+
+	switch {
+	case b&0x80 != 0:
+		index, err := readQPACKInt(r, b, 6)
+		if err != nil {
+			return f, err
+		}
+		enc.Repr = hpackIndexed
+		if b&0x40 != 0 {
+			if index >= uint64(len(qpackStaticTable)) {
+				return f, fmt.Errorf("index statique %v invalide", index)
+			}
+			enc.Table, enc.Index = "statique", index
+			e := qpackStaticTable[index]
+			f.Name, f.Value = e.Name, e.Value
+			return f, nil
+		}
+		if index >= base {
+			return f, fmt.Errorf("index relatif %v invalide", index)
+		}
+		e, err := dynamic(base - 1 - index)
+		f.Name, f.Value = e.Name, e.Value
+		return f, err
+	case b&0xf0 == 0x10:
+		index, err := readQPACKInt(r, b, 4)
+		if err != nil {
+			return f, err
+		}
+		enc.Repr = hpackIndexed
+		e, err := dynamic(base + index)
+		f.Name, f.Value = e.Name, e.Value
+		return f, err
+	case b&0xc0 == 0x40:
+		index, err := readQPACKInt(r, b, 4)
+		if err != nil {
+			return f, err
+		}
+		f.Sensitive = b&0x20 != 0
+		if b&0x10 != 0 {
+			if index >= uint64(len(qpackStaticTable)) {
+				return f, fmt.Errorf("index statique %v invalide", index)
+			}
+			enc.Table, enc.Index = "statique", index
+			f.Name = qpackStaticTable[index].Name
+		} else {
+			if index >= base {
+				return f, fmt.Errorf("index relatif %v invalide", index)
+			}
+			e, err := dynamic(base - 1 - index)
+			if err != nil {
+				return f, err
+			}
+			f.Name = e.Name
+		}
+	case b&0xf0 == 0x00:
+		index, err := readQPACKInt(r, b, 3)
+		if err != nil {
+			return f, err
+		}
+		f.Sensitive = b&0x08 != 0
+		e, err := dynamic(base + index)
+		if err != nil {
+			return f, err
+		}
+		f.Name = e.Name
+	default:
+		f.Sensitive = b&0x10 != 0
+		if f.Name, enc.NameHuffman, err = readQPACKString(r, b, 3); err != nil {
+			return f, err
+		}
+	}
+	if f.Sensitive {
+		enc.Repr = hpackNeverIndexed
+	}
+	f.Value, enc.ValHuffman, err = readQPACKValue(r)
+	return f, err
+}
+
+// Décodeur des blocs d'en-têtes d'un stream de requête
+type qpackStreamDecoder struct {
+	decoder  *QPACKDecoder
+	streamID uint64
+}
+
+func (s qpackStreamDecoder) DecodeFull(p []byte) ([]HeaderField, error) {
+	return s.decoder.Decode(s.streamID, p)
+}
+
+// Encodeur des réponses d'une connexion, les entrées ajoutées à la table dynamique
+// ne sont référencées qu'une fois leur réception confirmée par le client,
+// aucun stream du client n'est donc jamais bloqué
+type QPACKEncoder struct {
+	mu    sync.Mutex
+	table qpackTable
+	// Insertions confirmées par le décodeur du client
+	knownReceived uint64
+	// Calculé à partir de QPACK_MAX_TABLE_CAPACITY annoncé par le client
+	maxEntries uint64
+	// Notre flux encodeur, nil tant que la table dynamique n'est pas utilisée
+	stream io.Writer
+	trace  *traceConn
+}
+
+func NewQPACKEncoder() *QPACKEncoder {
+	return &QPACKEncoder{}
+}
+
+// Active la table dynamique avec la capacité annoncée par le client
+func (e *QPACKEncoder) enableDynamicTable(stream io.Writer, peerCapacity uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	capacity := min(peerCapacity, qpackMaxTableCapacity)
+	e.stream = stream
+	e.maxEntries = peerCapacity / 32
+	e.table.setCapacity(int(capacity))
+	printQPACKInstruction(e.trace, "SET_CAPACITY", false, "Capacity", capacity)
+	_, err := stream.Write(appendHPACKInt(nil, 0x20, 5, capacity))
+	return err
+}
+
+// Cherche un en-tête parmi les entrées dynamiques confirmées
+func (e *QPACKEncoder) searchDynamic(f HeaderField) (uint64, bool, bool) {
+	var index uint64
+	found := false
+	for abs := e.knownReceived; abs > e.table.dropped; abs-- {
+		entry, _ := e.table.get(abs - 1)
+		if entry.Name != f.Name {
+			continue
+		}
+		if entry.Value == f.Value {
+			return abs - 1, true, true
+		}
+		if !found {
+			index, found = abs-1, true
+		}
+	}
+	return index, found, false
+}
+
+// Encode les en-têtes, la manière dont chacun a été encodé est renseignée dans Encoding
+func (e *QPACKEncoder) Encode(fields []HeaderField) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Toutes les références dynamiques sont antérieures à base
+	base := e.knownReceived
+	var ric uint64
+	var b []byte
+	for i, f := range fields {
+		before := len(b)
+		enc := &FieldEncoding{Repr: hpackWithoutIndexing}
+		var never byte
+		if f.Sensitive {
+			enc.Repr = hpackNeverIndexed
+			never = 0x20
+		}
+		static, staticMatch := searchFields(qpackStaticTable, f)
+		dyn, dynFound, dynMatch := e.searchDynamic(f)
+
+		switch {
+		case staticMatch && !f.Sensitive:
+			enc.Repr, enc.Table, enc.Index = hpackIndexed, "statique", uint64(static)
+			b = appendHPACKInt(b, 0xc0, 6, uint64(static))
+		case dynMatch && !f.Sensitive:
+			enc.Repr, enc.Table, enc.Index = hpackIndexed, "dynamique", dyn
+			b = appendHPACKInt(b, 0x80, 6, base-1-dyn)
+			ric = max(ric, dyn+1)
+		case static >= 0:
+			enc.Table, enc.Index = "statique", uint64(static)
+			b = appendHPACKInt(b, 0x50|never, 4, uint64(static))
+			b, enc.ValHuffman = appendQPACKString(b, 0, 7, f.Value)
+		case dynFound:
+			enc.Table, enc.Index = "dynamique", dyn
+			b = appendHPACKInt(b, 0x40|never, 4, base-1-dyn)
+			b, enc.ValHuffman = appendQPACKString(b, 0, 7, f.Value)
+			ric = max(ric, dyn+1)
+		default:
+			b, enc.NameHuffman = appendQPACKString(b, 0x20|never>>1, 3, f.Name)
+			b, enc.ValHuffman = appendQPACKString(b, 0, 7, f.Value)
+		}
+		enc.Size = len(b) - before
+		fields[i].Encoding = enc
+
+		if !f.Sensitive && !staticMatch && !dynMatch {
+			e.insert(f, static)
+		}
+	}
+
+	prefix := appendHPACKInt(nil, 0, 8, encodeRequiredInsertCount(ric, e.maxEntries))
+	if ric > 0 {
+		prefix = appendHPACKInt(prefix, 0, 7, base-ric)
+	} else {
+		prefix = append(prefix, 0)
+	}
+	return append(prefix, b...)
+}
+
+// Ajoute l'en-tête à la table dynamique pour les réponses suivantes,
+// seulement si il tient sans évincer d'entrée (elles peuvent encore être référencées)
+func (e *QPACKEncoder) insert(f HeaderField, static int) {
+	if e.stream == nil || e.table.size+f.size() > e.table.capacity {
+		return
+	}
+	for _, entry := range e.table.entries {
+		if entry.Name == f.Name && entry.Value == f.Value {
+			return
+		}
+	}
+	var b []byte
+	if static >= 0 {
+		b = appendHPACKInt(b, 0xc0, 6, uint64(static))
+	} else {
+		b, _ = appendQPACKString(b, 0x40, 5, f.Name)
+	}
+	b, _ = appendQPACKString(b, 0, 7, f.Value)
+	abs := e.table.insertCount()
+	e.table.insert(f)
+	printQPACKInstruction(e.trace, "INSERT", false, f.Name, f.Value, "Index", abs)
+	e.stream.Write(b)
+}
+
+// Lit les instructions envoyées par le décodeur du client
+func (e *QPACKEncoder) readDecoderStream(str io.Reader) error {
+	r := bufio.NewReader(str)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case b&0x80 != 0:
+			id, err := readQPACKInt(r, b, 7)
+			if err != nil {
+				return err
+			}
+			printQPACKInstruction(e.trace, "SECTION_ACK", true, "Stream", id)
+		case b&0xc0 == 0x40:
+			id, err := readQPACKInt(r, b, 6)
+			if err != nil {
+				return err
+			}
+			printQPACKInstruction(e.trace, "STREAM_CANCELLATION", true, "Stream", id)
+		default:
+			increment, err := readQPACKInt(r, b, 6)
+			if err != nil {
+				return err
+			}
+			printQPACKInstruction(e.trace, "INSERT_COUNT_INCREMENT", true, "Increment", increment)
+			e.mu.Lock()
+			known := e.knownReceived + increment
+			if increment == 0 || known > e.table.insertCount() {
+				e.mu.Unlock()
+				return newH3Error(ErrCodeQPACKDecoderStreamError, "incrément %v invalide", increment)
+			}
+			e.knownReceived = known
+			e.mu.Unlock()
+		}
+	}
+}
+
+// Affiche une instruction des flux encodeur / décodeur, suivie de paires clé / valeur
+// Les instructions concernent la table de la connexion et non un stream de requête
+func printQPACKInstruction(t *traceConn, name string, in bool, kv ...interface{}) {
+	t.lock(noStream)
+	defer t.unlock()
+	color := dirColor(in)
+	defer color.Printf("|\n")
+	color.Printf("+- QPACK %s\n", name)
+	for i := 0; i+1 < len(kv); i += 2 {
+		printKeyValue(fmt.Sprint(kv[i]), kv[i+1], in)
+	}
+}
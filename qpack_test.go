@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Instructions du flux encodeur écrites à la main (RFC 9204 section 4.3)
+func qpackSetCapacity(b []byte, capacity uint64) []byte {
+	return appendHPACKInt(b, 0x20, 5, capacity)
+}
+
+func qpackInsertLiteral(b []byte, name, value string) []byte {
+	b, _ = appendQPACKString(b, 0x40, 5, name)
+	b, _ = appendQPACKString(b, 0, 7, value)
+	return b
+}
+
+func qpackInsertNameRef(b []byte, static bool, index uint64, value string) []byte {
+	first := byte(0x80)
+	if static {
+		first |= 0x40
+	}
+	b = appendHPACKInt(b, first, 6, index)
+	b, _ = appendQPACKString(b, 0, 7, value)
+	return b
+}
+
+func qpackDuplicate(b []byte, index uint64) []byte {
+	return appendHPACKInt(b, 0x00, 5, index)
+}
+
+func TestQPACKTable(t *testing.T) {
+	table := qpackTable{capacity: 100}
+	// 34, 43 puis 34 octets : la troisième insertion évince la première
+	for _, f := range fieldsOf("a", "1", ":authority", "x", "b", "2") {
+		if !table.insert(f) {
+			t.Fatalf("insertion de %v refusée", f)
+		}
+	}
+	if table.insertCount() != 3 || table.dropped != 1 || table.size != 77 {
+		t.Fatalf("%v insertions, %v évincées, %v octets", table.insertCount(), table.dropped, table.size)
+	}
+	if _, ok := table.get(0); ok {
+		t.Error("entrée 0 évincée encore lisible")
+	}
+	if f, ok := table.get(2); !ok || f.Name != "b" {
+		t.Errorf("entrée 2 : %v", f)
+	}
+	if _, ok := table.get(3); ok {
+		t.Error("entrée 3 lisible avant son insertion")
+	}
+	if table.insert(HeaderField{Name: "c", Value: strings.Repeat("v", 100)}) {
+		t.Error("entrée plus grande que la table insérée")
+	}
+	table.setCapacity(40)
+	if table.insertCount() != 3 || table.dropped != 2 || table.size != 34 {
+		t.Errorf("après réduction : %v insertions, %v évincées, %v octets", table.insertCount(), table.dropped, table.size)
+	}
+}
+
+func TestQPACKRequiredInsertCount(t *testing.T) {
+	const maxEntries = 128
+	for _, total := range []uint64{1, 10, 255, 256, 257, 1000, 5000} {
+		// Le bloc référence au plus les maxEntries dernières insertions
+		for ric := total - min(total, maxEntries) + 1; ric <= total; ric++ {
+			encoded := encodeRequiredInsertCount(ric, maxEntries)
+			decoded, err := decodeRequiredInsertCount(encoded, maxEntries, total)
+			if err != nil || decoded != ric {
+				t.Fatalf("%v insertions : %v encodé %v puis décodé %v (%v)", total, ric, encoded, decoded, err)
+			}
+		}
+	}
+	if ric, err := decodeRequiredInsertCount(0, maxEntries, 10); ric != 0 || err != nil {
+		t.Errorf("0 décodé %v, %v", ric, err)
+	}
+	// Valeurs hors de la plage 2 * MaxEntries, ou qui donnent un nombre d'insertions nul
+	for _, encoded := range []uint64{2*maxEntries + 1, 1000} {
+		if _, err := decodeRequiredInsertCount(encoded, maxEntries, 10); err == nil {
+			t.Errorf("%v décodé sans erreur", encoded)
+		}
+	}
+	if _, err := decodeRequiredInsertCount(2*maxEntries, maxEntries, 0); err == nil {
+		t.Errorf("nombre d'insertions supérieur à la table accepté")
+	}
+}
+
+func TestQPACKEncoderStream(t *testing.T) {
+	var acks bytes.Buffer
+	d := NewQPACKDecoder(&acks, nil)
+	var b []byte
+	b = qpackSetCapacity(b, 100)
+	b = qpackInsertLiteral(b, "a", "1")
+	b = qpackInsertNameRef(b, true, 0, "x")
+	// Index relatif au nombre d'insertions : 1 désigne a: 1, qui est évincée par sa copie
+	b = qpackDuplicate(b, 1)
+	b = qpackInsertNameRef(b, false, 0, "2")
+	if err := d.readEncoderStream(bytes.NewReader(b)); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	want := fieldsOf("a", "1", "a", "2")
+	if entries := d.table.entries; !slices.Equal(entries, want) {
+		t.Errorf("table %v, %v attendue", entries, want)
+	}
+	if d.table.insertCount() != 4 || d.table.dropped != 2 {
+		t.Errorf("%v insertions dont %v évincées", d.table.insertCount(), d.table.dropped)
+	}
+	// Les insertions reçues ensemble sont acquittées par un seul Insert Count Increment
+	if !bytes.Equal(acks.Bytes(), []byte{0x04}) {
+		t.Errorf("flux décodeur %x, 04 attendu", acks.Bytes())
+	}
+
+	acks.Reset()
+	if err := d.readEncoderStream(bytes.NewReader(qpackSetCapacity(nil, 40))); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if d.table.dropped != 3 || acks.Len() != 0 {
+		t.Errorf("après réduction : %v évincées, flux décodeur %x", d.table.dropped, acks.Bytes())
+	}
+}
+
+func TestQPACKEncoderStreamErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []byte
+	}{
+		{"capacité trop grande", qpackSetCapacity(nil, qpackMaxTableCapacity+1)},
+		{"insertion sans capacité", qpackInsertLiteral(nil, "a", "1")},
+		{"entrée plus grande que la table", qpackInsertLiteral(qpackSetCapacity(nil, 40), "a", strings.Repeat("v", 10))},
+		{"index statique invalide", qpackInsertNameRef(qpackSetCapacity(nil, 100), true, uint64(len(qpackStaticTable)), "x")},
+		{"index dynamique invalide", qpackInsertNameRef(qpackSetCapacity(nil, 100), false, 0, "x")},
+		{"duplication invalide", qpackDuplicate(qpackInsertLiteral(qpackSetCapacity(nil, 100), "a", "1"), 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewQPACKDecoder(io.Discard, nil)
+			err := d.readEncoderStream(bytes.NewReader(tt.instructions))
+			var h3Err *h3Error
+			if !errors.As(err, &h3Err) || h3Err.Code != ErrCodeQPACKEncoderStreamError {
+				t.Errorf("erreur %v, QPACK_ENCODER_STREAM_ERROR attendue", err)
+			}
+		})
+	}
+}
+
+// Un encodeur et un décodeur reliés par leurs flux, comme les deux côtés d'une connexion HTTP3
+type qpackPair struct {
+	t             *testing.T
+	encoder       *QPACKEncoder
+	decoder       *QPACKDecoder
+	encoderStream bytes.Buffer
+	decoderStream bytes.Buffer
+	done          chan struct{}
+}
+
+func newQPACKPair(t *testing.T, capacity uint64) *qpackPair {
+	p := &qpackPair{t: t, encoder: NewQPACKEncoder(), done: make(chan struct{})}
+	t.Cleanup(func() { close(p.done) })
+	p.decoder = NewQPACKDecoder(&p.decoderStream, p.done)
+	if err := p.encoder.enableDynamicTable(&p.encoderStream, capacity); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Transmet les instructions en attente dans les deux sens
+func (p *qpackPair) sync() {
+	if err := p.decoder.readEncoderStream(&p.encoderStream); !errors.Is(err, io.EOF) {
+		p.t.Fatal(err)
+	}
+	if err := p.encoder.readDecoderStream(&p.decoderStream); !errors.Is(err, io.EOF) {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *qpackPair) roundTrip(streamID uint64, fields []HeaderField) {
+	block := p.encoder.Encode(slices.Clone(fields))
+	// Les entrées insérées pendant l'encodage ne sont pas référencées, le bloc se décode
+	// avant que le décodeur ait reçu les instructions
+	decoded, err := p.decoder.Decode(streamID, block)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	for i := range decoded {
+		decoded[i].Encoding = nil
+	}
+	if !slices.Equal(decoded, fields) {
+		p.t.Errorf("en-têtes %v, %v attendus", decoded, fields)
+	}
+}
+
+func TestQPACKRoundTrip(t *testing.T) {
+	p := newQPACKPair(t, 4096)
+	response := fieldsOf(":status", "200", "content-type", "application/xml", "x-custom", "valeur", "server", "gohttp")
+	first := p.encoder.Encode(slices.Clone(response))
+	if p.encoder.table.insertCount() != 3 {
+		t.Fatalf("%v insertions, 3 attendues", p.encoder.table.insertCount())
+	}
+	if _, err := p.decoder.Decode(0, first); err != nil {
+		t.Fatal(err)
+	}
+	p.sync()
+	if p.decoder.table.insertCount() != 3 || p.encoder.knownReceived != 3 {
+		t.Fatalf("%v insertions reçues, %v confirmées", p.decoder.table.insertCount(), p.encoder.knownReceived)
+	}
+
+	// Les entrées confirmées sont référencées et le bloc est acquitté par le décodeur
+	fields := slices.Clone(response)
+	block := p.encoder.Encode(fields)
+	for _, f := range fields[1:] {
+		if f.Encoding.Table != "dynamique" || f.Encoding.Repr != hpackIndexed {
+			t.Errorf("%s encodé %+v, entrée dynamique attendue", f.Name, *f.Encoding)
+		}
+	}
+	if len(block) >= len(first) {
+		t.Errorf("bloc de %v octets, plus court que %v attendu", len(block), len(first))
+	}
+	decoded, err := p.decoder.Decode(4, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(plainFields(decoded), response) {
+		t.Errorf("en-têtes %v, %v attendus", plainFields(decoded), response)
+	}
+	if !bytes.Equal(p.decoderStream.Bytes(), []byte{0x84}) {
+		t.Errorf("flux décodeur %x, Section Acknowledgment du stream 4 attendu", p.decoderStream.Bytes())
+	}
+	p.sync()
+
+	// Un en-tête sensible n'est jamais ajouté à la table
+	p.roundTrip(8, []HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}})
+	if p.encoder.table.insertCount() != 3 {
+		t.Errorf("en-tête sensible ajouté à la table")
+	}
+}
+
+// L'encodeur n'évince jamais d'entrée : une table pleine n'accepte plus d'insertion,
+// mais les en-têtes restent encodés correctement
+func TestQPACKRoundTripFullTable(t *testing.T) {
+	p := newQPACKPair(t, 100)
+	for i, value := range []string{"un", "deux", "trois", "quatre"} {
+		p.roundTrip(uint64(i*4), fieldsOf("x-a", value, ":status", "200"))
+		p.sync()
+	}
+	if p.encoder.table.insertCount() != 2 || p.encoder.table.dropped != 0 {
+		t.Errorf("%v insertions dont %v évincées, 2 et 0 attendues", p.encoder.table.insertCount(), p.encoder.table.dropped)
+	}
+	if p.decoder.table.insertCount() != 2 || p.encoder.knownReceived != 2 {
+		t.Errorf("%v insertions reçues, %v confirmées", p.decoder.table.insertCount(), p.encoder.knownReceived)
+	}
+	p.roundTrip(16, fieldsOf("x-a", "deux"))
+}
+
+// Le décodeur évince selon les instructions reçues : les blocs qui référencent
+// les entrées restantes se décodent, ceux qui référencent une entrée évincée échouent
+func TestQPACKDecodeAfterEviction(t *testing.T) {
+	d := NewQPACKDecoder(io.Discard, nil)
+	var b []byte
+	b = qpackSetCapacity(b, 80)
+	b = qpackInsertLiteral(b, "a", "1")
+	b = qpackInsertLiteral(b, "b", "2")
+	b = qpackInsertLiteral(b, "c", "3")
+	if err := d.readEncoderStream(bytes.NewReader(b)); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	// Required Insert Count 3, base 3 : les index relatifs 0 et 1 désignent c et b
+	prefix := []byte{byte(encodeRequiredInsertCount(3, qpackMaxTableCapacity/32)), 0}
+	fields, err := d.Decode(0, append(slices.Clone(prefix), 0x80, 0x81))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fieldsOf("c", "3", "b", "2"); !slices.Equal(plainFields(fields), want) {
+		t.Errorf("en-têtes %v, %v attendus", plainFields(fields), want)
+	}
+	if _, err := d.Decode(0, append(slices.Clone(prefix), 0x82)); err == nil {
+		t.Error("entrée évincée décodée sans erreur")
+	}
+}
+
+// Un bloc qui référence une entrée pas encore reçue attend l'instruction d'insertion
+func TestQPACKBlockedStream(t *testing.T) {
+	var acks bytes.Buffer
+	done := make(chan struct{})
+	d := NewQPACKDecoder(&acks, done)
+	if err := d.readEncoderStream(bytes.NewReader(qpackSetCapacity(nil, 100))); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	block := []byte{byte(encodeRequiredInsertCount(1, qpackMaxTableCapacity/32)), 0, 0x80}
+	result := make(chan error)
+	go func() {
+		fields, err := d.Decode(0, block)
+		if err == nil && (len(fields) != 1 || fields[0].Name != "a") {
+			t.Errorf("en-têtes %v", fields)
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		t.Fatalf("bloc décodé avant l'insertion (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := d.readEncoderStream(bytes.NewReader(qpackInsertLiteral(nil, "a", "1"))); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	// La fermeture de la connexion débloque le stream en erreur
+	go func() {
+		_, err := d.Decode(4, []byte{byte(encodeRequiredInsertCount(2, qpackMaxTableCapacity/32)), 0, 0x80})
+		result <- err
+	}()
+	close(done)
+	if err := <-result; err == nil {
+		t.Fatal("bloc décodé sans l'insertion")
+	}
+}
+
+func TestQPACKDecoderStreamErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []byte
+	}{
+		{"incrément nul", []byte{0x00}},
+		{"incrément supérieur aux insertions", []byte{0x02}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newQPACKPair(t, 4096)
+			p.encoder.Encode(fieldsOf("x-a", "1"))
+			err := p.encoder.readDecoderStream(bytes.NewReader(tt.instructions))
+			var h3Err *h3Error
+			if !errors.As(err, &h3Err) || h3Err.Code != ErrCodeQPACKDecoderStreamError {
+				t.Errorf("erreur %v, QPACK_DECODER_STREAM_ERROR attendue", err)
+			}
+		})
+	}
+	// Section Acknowledgment et Stream Cancellation sont acceptés
+	p := newQPACKPair(t, 4096)
+	if err := p.encoder.readDecoderStream(bytes.NewReader([]byte{0x84, 0x44})); !errors.Is(err, io.EOF) {
+		t.Errorf("erreur %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Options du transport QUIC, modifiables en ligne de commande
+// Exemple : go run . http3 -idle-timeout 10s -max-streams 10
+var quicOptions struct {
+	idleTimeout      time.Duration
+	keepAlive        time.Duration
+	maxStreams       int64
+	maxUniStreams    int64
+	streamWindow     uint64
+	connectionWindow uint64
+	allow0RTT        bool
+}
+
+func registerQUICFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&quicOptions.idleTimeout, "idle-timeout", 30*time.Second, "durée d'inactivité avant la fermeture d'une connexion QUIC")
+	fs.DurationVar(&quicOptions.keepAlive, "keep-alive", 0, "intervalle d'envoi des paquets keep-alive (0 pour désactiver)")
+	fs.Int64Var(&quicOptions.maxStreams, "max-streams", 100, "nombre de streams bidirectionnels simultanés par connexion")
+	fs.Int64Var(&quicOptions.maxUniStreams, "max-uni-streams", 100, "nombre de streams unidirectionnels simultanés par connexion")
+	fs.Uint64Var(&quicOptions.streamWindow, "stream-window", 512<<10, "fenêtre initiale de contrôle de flux d'un stream (octets)")
+	fs.Uint64Var(&quicOptions.connectionWindow, "connection-window", 512<<10, "fenêtre initiale de contrôle de flux de la connexion (octets)")
+	fs.BoolVar(&quicOptions.allow0RTT, "0rtt", true, "accepte les requêtes envoyées en 0-RTT")
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		Versions:                       []quic.Version{quic.Version2, quic.Version1},
+		EnableDatagrams:                true,
+		MaxIdleTimeout:                 quicOptions.idleTimeout,
+		KeepAlivePeriod:                quicOptions.keepAlive,
+		MaxIncomingStreams:             quicOptions.maxStreams,
+		MaxIncomingUniStreams:          quicOptions.maxUniStreams,
+		InitialStreamReceiveWindow:     quicOptions.streamWindow,
+		InitialConnectionReceiveWindow: quicOptions.connectionWindow,
+		Allow0RTT:                      quicOptions.allow0RTT,
+		Tracer:                         quicTracer,
+	}
+}
+
+// Statistiques d'une connexion QUIC, quic-go ne les expose qu'au travers du tracer
+type quicStats struct {
+	mu  sync.Mutex
+	rtt time.Duration
+}
+
+// Statistiques indexées par l'identifiant de traçage présent dans le contexte de la connexion
+var quicStatsByConn sync.Map
+
+func quicTracer(ctx context.Context, p logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+	stats := &quicStats{}
+	tracingID, _ := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	quicStatsByConn.Store(tracingID, stats)
+	tracer := &logging.ConnectionTracer{
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			stats.mu.Lock()
+			stats.rtt = rttStats.SmoothedRTT()
+			stats.mu.Unlock()
+		},
+		Close: func() {
+			quicStatsByConn.Delete(tracingID)
+		},
+	}
+	// Les connexions du mode client ne sont pas comptées dans les métriques du serveur
+	if p == logging.PerspectiveServer {
+		meterQUIC(tracer, stats)
+	}
+	return tracer
+}
+
+// Ajoute au tracer le comptage des octets, des paquets perdus et du RTT
+func meterQUIC(tracer *logging.ConnectionTracer, stats *quicStats) {
+	protocol := metricProtocol(HTTP3)
+	sent := func(size logging.ByteCount) {
+		quicPacketsSent.inc()
+		bytesSent.add(float64(size), protocol)
+	}
+	tracer.SentLongHeaderPacket = func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+		sent(size)
+	}
+	tracer.SentShortHeaderPacket = func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+		sent(size)
+	}
+	tracer.ReceivedLongHeaderPacket = func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+		bytesReceived.add(float64(size), protocol)
+	}
+	tracer.ReceivedShortHeaderPacket = func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+		bytesReceived.add(float64(size), protocol)
+	}
+	tracer.LostPacket = func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+		quicPacketsLost.inc()
+	}
+	closed := tracer.Close
+	tracer.Close = func() {
+		if rtt := stats.RTT(); rtt > 0 {
+			quicRTT.observe(rtt.Seconds(), "")
+		}
+		closed()
+	}
+}
+
+func connectionStats(conn quic.Connection) *quicStats {
+	tracingID, _ := conn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if s, ok := quicStatsByConn.Load(tracingID); ok {
+		return s.(*quicStats)
+	}
+	return &quicStats{}
+}
+
+func (s *quicStats) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
+}
+
+// Les requêtes reçues en 0-RTT peuvent être rejouées par un attaquant,
+// seules les méthodes idempotentes sont traitées avant la fin du handshake
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Indique si le handshake est terminé, les données reçues avant sont en 0-RTT
+func handshakeComplete(conn quic.EarlyConnection) bool {
+	select {
+	case <-conn.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
+// Affiche les paramètres de la connexion une fois le handshake terminé
+func printQUICConnection(t *traceConn, conn quic.EarlyConnection) {
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+	}
+	// La connexion peut aussi se terminer après un handshake réussi
+	select {
+	case <-conn.HandshakeComplete():
+	default:
+		printTLSError(t.Remote, context.Cause(conn.Context()))
+		return
+	}
+	state := conn.ConnectionState()
+	t.lock(noStream)
+	defer t.unlock()
+	color := dirColor(true)
+	defer color.Printf("|\n")
+	color.Printf("+- QUIC\n")
+	printKeyValue("Version", state.Version.String(), true)
+	printKeyValue("RTT", connectionStats(conn).RTT().String(), true)
+	printKeyValue("0-RTT", state.Used0RTT, true)
+	printKeyValue("Datagrams", state.SupportsDatagrams, true)
+	printTLSState(state.TLS, takeClientHello(t.Remote))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Connexion QUIC dont le handshake est terminé quand handshake est fermé
+type quicTestConn struct {
+	quic.EarlyConnection
+	handshake chan struct{}
+}
+
+func (c *quicTestConn) HandshakeComplete() <-chan struct{}    { return c.handshake }
+func (c *quicTestConn) ConnectionState() quic.ConnectionState { return quic.ConnectionState{} }
+
+func TestQUICConfig(t *testing.T) {
+	// Les options sont rétablies après le test
+	setOption(t, &quicOptions, quicOptions)
+	fs := flag.NewFlagSet("http3", flag.ContinueOnError)
+	registerQUICFlags(fs)
+	err := fs.Parse([]string{"-idle-timeout", "10s", "-keep-alive", "5s", "-max-streams", "10", "-max-uni-streams", "3",
+		"-stream-window", "1024", "-connection-window", "4096", "-0rtt=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := quicConfig()
+	if config.MaxIdleTimeout != 10*time.Second || config.KeepAlivePeriod != 5*time.Second {
+		t.Errorf("délais %v et %v", config.MaxIdleTimeout, config.KeepAlivePeriod)
+	}
+	if config.MaxIncomingStreams != 10 || config.MaxIncomingUniStreams != 3 {
+		t.Errorf("streams %v et %v", config.MaxIncomingStreams, config.MaxIncomingUniStreams)
+	}
+	if config.InitialStreamReceiveWindow != 1024 || config.InitialConnectionReceiveWindow != 4096 {
+		t.Errorf("fenêtres %v et %v", config.InitialStreamReceiveWindow, config.InitialConnectionReceiveWindow)
+	}
+	if config.Allow0RTT || !config.EnableDatagrams {
+		t.Errorf("0-RTT %v, datagrammes %v", config.Allow0RTT, config.EnableDatagrams)
+	}
+}
+
+func TestHandshakeComplete(t *testing.T) {
+	conn := &quicTestConn{handshake: make(chan struct{})}
+	if handshakeComplete(conn) {
+		t.Fatal("handshake terminé avant la fermeture du canal")
+	}
+	close(conn.handshake)
+	if !handshakeComplete(conn) {
+		t.Fatal("handshake non terminé")
+	}
+}
+
+// Seules les méthodes idempotentes sont traitées en 0-RTT, les autres reçoivent 425 Too Early
+func TestH3EarlyData(t *testing.T) {
+	tests := []struct {
+		method string
+		status string
+	}{
+		{"GET", "200"},
+		{"HEAD", "200"},
+		{"POST", "425"},
+		{"PATCH", "425"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			c := newH3TestConn(t)
+			c.EarlyConnection = &quicTestConn{handshake: make(chan struct{})}
+			var request bytes.Buffer
+			HeadersFrame{Headers: fieldsOf(":method", tt.method, ":scheme", "https", ":authority", "localhost", ":path", "/index.html")}.Write(&request)
+			str := &h3TestStream{request: &request}
+			c.handleRequest(str, true)
+			if status := readH3Response(t, str).Header(":status", ""); status != tt.status {
+				t.Fatalf("statut %v, %v attendu", status, tt.status)
+			}
+		})
+	}
+	for method, ok := range map[string]bool{"GET": true, "PUT": true, "DELETE": true, "OPTIONS": true, "POST": false, "CONNECT": false} {
+		if isIdempotent(method) != ok {
+			t.Errorf("isIdempotent(%s) = %v", method, !ok)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Fichiers servis pour un dossier, et liste de son contenu s'il n'en contient aucun
+// Exemple : go run . http2 -listing -index index.html,index.htm
+var staticOptions struct {
+	index   string
+	listing bool
+}
+
+func registerStaticFlags(fs *flag.FlagSet) {
+	fs.StringVar(&staticOptions.index, "index", "index.html,index.htm", "fichiers servis pour un dossier, séparés par des virgules")
+	fs.BoolVar(&staticOptions.listing, "listing", false, "liste le contenu des dossiers sans fichier index (HTML ou JSON)")
+}
+
+// Réponse préparée à partir du dossier d'un virtual host, éventuellement compressée
+type staticFile struct {
+	Status      int
+	Path        string
+	ContentType string
+	Body        []byte
+	// Redirection vers le dossier avec un / final
+	Location string
+	// Méthodes acceptées, pour OPTIONS
+	Allow string
+	// Vide si le contenu est envoyé sans compression
+	Encoding string
+	// Taille du contenu avant compression
+	Size          int
+	Precompressed bool
+	// La réponse dépend de Accept-Encoding, un cache doit en tenir compte
+	Vary bool
+}
+
+// En-têtes de la réponse, noms en minuscules comme en HTTP2 et HTTP3
+func (f staticFile) headers() Header {
+	var h Header
+	if f.ContentType != "" {
+		h.Add("content-type", f.ContentType)
+	}
+	if f.Allow != "" {
+		h.Add("allow", f.Allow)
+	}
+	if f.Location != "" {
+		h.Add("location", f.Location)
+	}
+	if f.Encoding != "" {
+		h.Add("content-encoding", f.Encoding)
+	}
+	if f.Vary {
+		h.Add("vary", "accept-encoding")
+	}
+	return h
+}
+
+func statusFile(status int, name string) staticFile {
+	body := []byte(http.StatusText(status) + "\n")
+	return staticFile{Status: status, Path: name, ContentType: "text/plain; charset=utf-8", Body: body, Size: len(body)}
+}
+
+func notFoundFile(name string) staticFile {
+	return statusFile(http.StatusNotFound, name)
+}
+
+// Chemin décodé relatif au dossier servi sans la query string, les segments .. ne peuvent pas en sortir
+func resolvePath(target string) string {
+	p, _, _ := strings.Cut(target, "?")
+	if decoded, err := url.PathUnescape(p); err == nil {
+		p = decoded
+	}
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// Réponse à OPTIONS *, qui interroge le serveur et non une ressource
+func optionsFile() staticFile {
+	return staticFile{Status: http.StatusNoContent, Path: "*", Allow: "GET, HEAD, OPTIONS"}
+}
+
+// Réponse à un CONNECT classique, le serveur n'est pas un proxy
+// et n'ouvre pas de tunnel vers l'autorité demandée
+func connectFile(authority string) staticFile {
+	f := statusFile(http.StatusMethodNotAllowed, authority)
+	f.Allow = optionsFile().Allow
+	return f
+}
+
+/**
+* Trouve la réponse à une requête sur le dossier root à partir de sa cible
+*
+* ```
+* /docs        → 301 Location: /docs/
+* /docs/       → /docs/index.html, /docs/index.htm ou liste du dossier
+* /docs/?sort=size&order=desc&format=json
+* ```
+**/
+func lookupStatic(root string, r *Request) staticFile {
+	if r.Form == asteriskForm {
+		return optionsFile()
+	}
+	rawPath, query, _ := strings.Cut(r.URI, "?")
+	name := r.Path
+	acceptEncoding := r.Header("Accept-Encoding")
+	info, err := os.Stat(path.Join(root, name))
+	if err != nil {
+		return notFoundFile(name)
+	}
+	if !info.IsDir() {
+		return loadStaticFile(root, name, acceptEncoding)
+	}
+
+	// Les liens relatifs d'une page de dossier ne fonctionnent qu'avec le / final
+	if !strings.HasSuffix(rawPath, "/") {
+		f := statusFile(http.StatusMovedPermanently, name)
+		f.Location = (&url.URL{Path: "/" + name + "/"}).EscapedPath()
+		if query != "" {
+			f.Location += "?" + query
+		}
+		return f
+	}
+	for _, index := range strings.Split(staticOptions.index, ",") {
+		index = path.Join(name, strings.TrimSpace(index))
+		if info, err := os.Stat(path.Join(root, index)); err == nil && !info.IsDir() {
+			return loadStaticFile(root, index, acceptEncoding)
+		}
+	}
+	if !staticOptions.listing {
+		return statusFile(http.StatusForbidden, name)
+	}
+	return listDirectory(root, name, r.Query, r.Header("Accept"), acceptEncoding)
+}
+
+type dirEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+/**
+* Liste le contenu d'un dossier en HTML, ou en JSON si le client le demande
+*
+* ```
+* GET /docs/?sort=modified&order=desc
+* Accept: application/json
+* ```
+**/
+func listDirectory(root string, name string, params url.Values, accept string, acceptEncoding string) staticFile {
+	files, err := os.ReadDir(path.Join(root, name))
+	if err != nil {
+		return statusFile(http.StatusInternalServerError, name)
+	}
+	var entries []dirEntry
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		e := dirEntry{Name: file.Name(), Dir: file.IsDir(), Modified: info.ModTime().UTC()}
+		if !e.Dir {
+			e.Size = info.Size()
+		}
+		entries = append(entries, e)
+	}
+
+	sortBy, order := params.Get("sort"), params.Get("order")
+	sortEntries(entries, sortBy, order == "desc")
+
+	f := staticFile{Status: http.StatusOK, Path: name}
+	if params.Get("format") == "json" || strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		f.ContentType = "application/json"
+		f.Body, _ = json.MarshalIndent(entries, "", "  ")
+	} else {
+		f.ContentType = "text/html; charset=utf-8"
+		f.Body = listingHTML(name, entries, sortBy, order)
+	}
+	f.Size = len(f.Body)
+	if compressOptions.enabled && f.Size >= compressOptions.minSize {
+		f.compress(parseAcceptEncoding(acceptEncoding))
+	}
+	return f
+}
+
+// Les dossiers restent en tête de liste quel que soit le tri
+func sortEntries(entries []dirEntry, sortBy string, desc bool) {
+	slices.SortStableFunc(entries, func(a, b dirEntry) int {
+		if a.Dir != b.Dir {
+			if a.Dir {
+				return -1
+			}
+			return 1
+		}
+		c := 0
+		switch sortBy {
+		case "size":
+			c = cmp.Compare(a.Size, b.Size)
+		case "modified":
+			c = a.Modified.Compare(b.Modified)
+		}
+		if c == 0 {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		if desc {
+			return -c
+		}
+		return c
+	})
+}
+
+func listingHTML(name string, entries []dirEntry, sortBy string, order string) []byte {
+	title := html.EscapeString("/" + name)
+	if name != "" {
+		title += "/"
+	}
+	// Un clic sur la colonne déjà triée inverse l'ordre
+	column := func(key string, label string) string {
+		next := "asc"
+		if key == sortBy && order != "desc" {
+			next = "desc"
+		}
+		return fmt.Sprintf(`<th><a href="?sort=%s&amp;order=%s">%s</a></th>`, key, next, label)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<html lang=\"fr\">\n<head><meta charset=\"utf-8\"><title>%s</title></head>\n<body>\n", title)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n<table>\n<tr>%s%s%s</tr>\n", title,
+		column("name", "Nom"), column("size", "Taille"), column("modified", "Modifié"))
+	if name != "" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, e := range entries {
+		// Le préfixe ./ garde le lien relatif, un fichier nommé "javascript:..." n'est pas un schéma
+		href := "./" + html.EscapeString(url.PathEscape(e.Name))
+		label, size := html.EscapeString(e.Name), formatBytes(e.Size)
+		if e.Dir {
+			href, label, size = href+"/", label+"/", "-"
+		}
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			href, label, size, e.Modified.Format("2006-01-02 15:04:05"))
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Dossier servi par les tests, les dates permettent de vérifier le tri
+func newStaticRoot(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"docs/index.html":      "<h1>docs</h1>",
+		"files/a.txt":          "aaaaaaaaaa",
+		"files/b.txt":          "bbb",
+		"files/.hidden":        "caché",
+		"files/sub/c.txt":      "c",
+		"files/javascript:x()": "lien",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(root, "files/a.txt"), now, now.Add(-time.Hour))
+	os.Chtimes(filepath.Join(root, "files/b.txt"), now, now.Add(-2*time.Hour))
+	os.Chtimes(filepath.Join(root, "files/javascript:x()"), now, now)
+	return root
+}
+
+func staticRequest(t *testing.T, target string, accept string) *Request {
+	r := &Request{Method: "GET", Headers: Header{{Name: "Accept", Value: accept}}}
+	if err := r.setTarget(target); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLookupStatic(t *testing.T) {
+	root := newStaticRoot(t)
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		listing  bool
+		status   int
+		location string
+		body     string
+		// Noms de la liste JSON, dans l'ordre
+		entries []string
+	}{
+		{"dossier sans / final", "/docs", "", false, http.StatusMovedPermanently, "/docs/", "", nil},
+		{"redirection avec la query string", "/docs?a=1", "", false, http.StatusMovedPermanently, "/docs/?a=1", "", nil},
+		{"fichier index", "/docs/", "", false, http.StatusOK, "", "<h1>docs</h1>", nil},
+		{"liste désactivée", "/files/", "", false, http.StatusForbidden, "", "", nil},
+		{"fichier absent", "/files/absent.txt", "", true, http.StatusNotFound, "", "", nil},
+		{"liste JSON", "/files/?format=json", "", true, http.StatusOK, "", "", []string{"sub", "a.txt", "b.txt", "javascript:x()"}},
+		{"liste JSON par Accept", "/files/", "application/json", true, http.StatusOK, "", "", []string{"sub", "a.txt", "b.txt", "javascript:x()"}},
+		{"tri par taille", "/files/?format=json&sort=size", "", true, http.StatusOK, "", "", []string{"sub", "b.txt", "javascript:x()", "a.txt"}},
+		{"tri par taille décroissante", "/files/?format=json&sort=size&order=desc", "", true, http.StatusOK, "", "", []string{"sub", "a.txt", "javascript:x()", "b.txt"}},
+		{"tri par date", "/files/?format=json&sort=modified", "", true, http.StatusOK, "", "", []string{"sub", "b.txt", "a.txt", "javascript:x()"}},
+		{"tri par nom décroissant", "/files/?format=json&order=desc", "", true, http.StatusOK, "", "", []string{"sub", "javascript:x()", "b.txt", "a.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOption(t, &staticOptions.listing, tt.listing)
+			f := lookupStatic(root, staticRequest(t, tt.target, tt.accept))
+			if f.Status != tt.status || f.Location != tt.location {
+				t.Fatalf("statut %v et Location %q, %v et %q attendus", f.Status, f.Location, tt.status, tt.location)
+			}
+			if tt.body != "" && string(f.Body) != tt.body {
+				t.Errorf("corps %q, %q attendu", f.Body, tt.body)
+			}
+			if tt.entries == nil {
+				return
+			}
+			if f.ContentType != "application/json" {
+				t.Fatalf("type %q, JSON attendu", f.ContentType)
+			}
+			var entries []dirEntry
+			if err := json.Unmarshal(f.Body, &entries); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			if !slices.Equal(names, tt.entries) {
+				t.Errorf("entrées %q, %q attendues", names, tt.entries)
+			}
+		})
+	}
+}
+
+// Les liens de la liste restent relatifs au dossier, quel que soit le nom du fichier
+func TestListingHTMLLinks(t *testing.T) {
+	setOption(t, &staticOptions.listing, true)
+	f := lookupStatic(newStaticRoot(t), staticRequest(t, "/files/", "text/html"))
+	body := string(f.Body)
+	for _, link := range []string{`href="../"`, `href="./sub/"`, `href="./a.txt"`, `href="./javascript:x%28%29"`} {
+		if !strings.Contains(body, link) {
+			t.Errorf("lien %s absent de la liste", link)
+		}
+	}
+	if strings.Contains(body, `href="javascript:`) || strings.Contains(body, ".hidden") {
+		t.Errorf("liste %s", body)
+	}
+}
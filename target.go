@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Formes de la cible d'une requête (RFC 9112 section 3.2)
+const (
+	originForm    = "origin"
+	absoluteForm  = "absolute"
+	authorityForm = "authority"
+	asteriskForm  = "asterisk"
+)
+
+/**
+* Interprète la cible de la requête et renseigne URI (toujours relative au serveur), Path et Query
+*
+* ```
+* GET /docs/a%20b.html?v=2 HTTP/1.1            → origin-form, Path = docs/a b.html, Query = v=2
+* GET https://localhost/docs/?sort=size HTTP/1.1 → absolute-form, Host = localhost
+* CONNECT localhost:443 HTTP/1.1                → authority-form
+* OPTIONS * HTTP/1.1                           → asterisk-form
+* ```
+*
+* En HTTP2 et HTTP3 la cible est découpée en pseudo-en-têtes, :path suit les mêmes règles
+**/
+func (r *Request) setTarget(target string) error {
+	switch {
+	case r.Method == "CONNECT":
+		// Seule l'autorité est envoyée, sauf pour l'Extended CONNECT (WebSocket, WebTransport)
+		if !strings.HasPrefix(target, "/") {
+			if !validAuthority(target) {
+				return newRequestError(http.StatusBadRequest, "cible CONNECT invalide %q, hôte:port attendu", target)
+			}
+			r.Form, r.URI = authorityForm, target
+			return nil
+		}
+		r.Form = originForm
+	case target == "*":
+		if r.Method != "OPTIONS" {
+			return newRequestError(http.StatusBadRequest, "la cible * n'est permise qu'avec OPTIONS")
+		}
+		r.Form, r.URI = asteriskForm, target
+		return nil
+	case !strings.HasPrefix(target, "/"):
+		// Le client s'adresse au serveur comme à un proxy, l'autorité de la cible remplace Host (RFC 9112 section 3.2.2)
+		u, err := url.Parse(target)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return newRequestError(http.StatusBadRequest, "cible invalide %q", target)
+		}
+		r.Headers.Set("Host", u.Host)
+		target = u.EscapedPath()
+		if target == "" {
+			target = "/"
+		}
+		if u.RawQuery != "" {
+			target += "?" + u.RawQuery
+		}
+		r.Form = absoluteForm
+	default:
+		r.Form = originForm
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	if _, err := url.PathUnescape(rawPath); err != nil {
+		return newRequestError(http.StatusBadRequest, "encodage invalide dans %q", rawPath)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, "query string invalide %q", rawQuery)
+	}
+	r.URI, r.Path, r.Query = target, resolvePath(target), query
+	return nil
+}
+
+// Hôte et port (1 à 65535) obligatoires, sans chemin ni identifiants
+func validAuthority(authority string) bool {
+	u, err := url.Parse("//" + authority)
+	if err != nil || u.Host != authority {
+		return false
+	}
+	// Contrairement à url.Parse, SplitHostPort refuse une adresse IPv6 sans crochets
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil || host == "" {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
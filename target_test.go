@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSetTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		form   string
+		uri    string
+		path   string
+		query  url.Values
+		host   string
+	}{
+		{"origin-form", "GET", "/docs/index.html", http.StatusOK, originForm, "/docs/index.html", "docs/index.html", url.Values{}, "localhost"},
+		{"origin-form avec query string", "GET", "/docs/?sort=size&order=desc&tag=a&tag=b", http.StatusOK, originForm,
+			"/docs/?sort=size&order=desc&tag=a&tag=b", "docs", url.Values{"sort": {"size"}, "order": {"desc"}, "tag": {"a", "b"}}, "localhost"},
+		{"origin-form encodé", "GET", "/a%20b.html?q=%C3%A9t%C3%A9", http.StatusOK, originForm, "/a%20b.html?q=%C3%A9t%C3%A9", "a b.html", url.Values{"q": {"été"}}, "localhost"},
+		{"origin-form hors du dossier", "GET", "/../../etc/passwd", http.StatusOK, originForm, "/../../etc/passwd", "etc/passwd", url.Values{}, "localhost"},
+		{"encodage invalide", "GET", "/a%zz.html", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"query string invalide", "GET", "/?q=%zz", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"absolute-form", "GET", "https://example.com:8443/docs/?v=2", http.StatusOK, absoluteForm, "/docs/?v=2", "docs", url.Values{"v": {"2"}}, "example.com:8443"},
+		{"absolute-form sans chemin", "GET", "http://example.com", http.StatusOK, absoluteForm, "/", "", url.Values{}, "example.com"},
+		{"absolute-form sans hôte", "GET", "https:///docs/", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"absolute-form avec un autre schéma", "GET", "ftp://example.com/", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"cible relative", "GET", "docs/index.html", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form", "CONNECT", "example.com:443", http.StatusOK, authorityForm, "example.com:443", "", nil, "localhost"},
+		{"authority-form IPv6", "CONNECT", "[::1]:8443", http.StatusOK, authorityForm, "[::1]:8443", "", nil, "localhost"},
+		{"authority-form IPv6 sans crochets", "CONNECT", "::1:8443", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form sans port", "CONNECT", "example.com", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form port vide", "CONNECT", "example.com:", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form port invalide", "CONNECT", "example.com:https", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form port hors limites", "CONNECT", "example.com:65536", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form port nul", "CONNECT", "example.com:0", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form avec identifiants", "CONNECT", "user@example.com:443", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"authority-form avec chemin", "CONNECT", "example.com:443/docs", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"Extended CONNECT", "CONNECT", "/chat?room=1", http.StatusOK, originForm, "/chat?room=1", "chat", url.Values{"room": {"1"}}, "localhost"},
+		{"asterisk-form", "OPTIONS", "*", http.StatusOK, asteriskForm, "*", "", nil, "localhost"},
+		{"* avec GET", "GET", "*", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"* avec POST", "POST", "*", http.StatusBadRequest, "", "", "", nil, "localhost"},
+		{"OPTIONS sur une ressource", "OPTIONS", "/index.html", http.StatusOK, originForm, "/index.html", "index.html", url.Values{}, "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Request{Method: tt.method, Headers: Header{{Name: "Host", Value: "localhost"}}}
+			err := r.setTarget(tt.target)
+			if status := requestStatus(err); status != tt.status {
+				t.Fatalf("statut %v, %v attendu (%v)", status, tt.status, err)
+			}
+			if r.Header("Host") != tt.host {
+				t.Errorf("Host %q, %q attendu", r.Header("Host"), tt.host)
+			}
+			if err != nil {
+				return
+			}
+			if r.Form != tt.form || r.URI != tt.uri || r.Path != tt.path {
+				t.Errorf("forme %q, URI %q, chemin %q, %q, %q, %q attendus", r.Form, r.URI, r.Path, tt.form, tt.uri, tt.path)
+			}
+			if !reflect.DeepEqual(r.Query, tt.query) {
+				t.Errorf("query %v, %v attendue", r.Query, tt.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Options TLS, les clés de session peuvent être enregistrées (format SSLKEYLOGFILE)
+// pour que Wireshark déchiffre une capture, en TCP comme en QUIC
+// Exemple : SSLKEYLOGFILE=keys.log go run . http3 ou go run . http2 -keylog keys.log
+var tlsOptions struct {
+	keyLog     string
+	clientCert bool
+}
+
+func registerTLSFlags(fs *flag.FlagSet) {
+	fs.StringVar(&tlsOptions.keyLog, "keylog", os.Getenv("SSLKEYLOGFILE"), "fichier où enregistrer les clés TLS (SSLKEYLOGFILE par défaut)")
+	fs.BoolVar(&tlsOptions.clientCert, "client-cert", false, "demande un certificat au client (le navigateur peut proposer d'en choisir un)")
+}
+
+// Fichier des clés, ouvert à la première connexion et partagé par toutes les connexions
+var keyLogWriter = sync.OnceValue(func() io.Writer {
+	if tlsOptions.keyLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(tlsOptions.keyLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalf("impossible d'ouvrir le fichier des clés TLS, %v", err)
+	}
+	fmt.Printf("🔑 Clés TLS enregistrées dans %s\n", tlsOptions.keyLog)
+	return f
+})
+
+// Configuration commune à toutes les connexions, la clé des tickets de session doit
+// être la même pour qu'un client puisse reprendre sa session sur une nouvelle connexion
+var serverTLSConfig = sync.OnceValue(func() *tls.Config {
+	// On charge les certificats
+	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
+	if err != nil {
+		log.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		KeyLogWriter:       keyLogWriter(),
+		GetConfigForClient: recordClientHello,
+		GetCertificate:     vhostCertificate,
+	}
+	if _, err := rand.Read(config.SessionTicketKey[:]); err != nil {
+		log.Fatalf("impossible de générer la clé des tickets de session, %v", err)
+	}
+	if tlsOptions.clientCert {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config
+})
+
+func loadTLSConfig(protocol string) *tls.Config {
+	config := serverTLSConfig().Clone()
+	config.NextProtos = []string{protocol}
+	return config
+}
+
+// Messages ClientHello en attente d'affichage, indexés par l'adresse du client
+// (quic-go renseigne aussi l'adresse dans ClientHelloInfo.Conn)
+var clientHellos sync.Map
+
+func recordClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if hello.Conn != nil {
+		clientHellos.Store(hello.Conn.RemoteAddr().String(), hello)
+	}
+	return nil, nil
+}
+
+func takeClientHello(remote string) *tls.ClientHelloInfo {
+	hello, ok := clientHellos.LoadAndDelete(remote)
+	if !ok {
+		return nil
+	}
+	return hello.(*tls.ClientHelloInfo)
+}
+
+// Paramètres TLS d'une connexion TCP, nil si la connexion n'est pas chiffrée
+func tlsState(conn net.Conn) *tls.ConnectionState {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+/**
+* Résumé du handshake, hello contient ce que le client a proposé (nil côté client)
+*
+* ```
+* | TLS: TLS 1.3
+* | Cipher: TLS_AES_128_GCM_SHA256
+* | ALPN: h2 (proposés : h2, http/1.1)
+* | SNI: localhost
+* | Certificat client: aucun
+* | Reprise de session: false
+* ```
+**/
+func printTLSState(state tls.ConnectionState, hello *tls.ClientHelloInfo) {
+	printKeyValue("TLS", tls.VersionName(state.Version), true)
+	printKeyValue("Cipher", tls.CipherSuiteName(state.CipherSuite), true)
+	alpn := state.NegotiatedProtocol
+	if hello != nil {
+		alpn = fmt.Sprintf("%s (proposés : %s)", alpn, strings.Join(hello.SupportedProtos, ", "))
+	}
+	dirColor(true).Printf("| ALPN:")
+	tracef(" %s\n", alpn)
+	printKeyValue("SNI", state.ServerName, true)
+	clientCert := "aucun"
+	if len(state.PeerCertificates) > 0 && hello != nil {
+		clientCert = state.PeerCertificates[0].Subject.String()
+	}
+	printKeyValue("Certificat client", clientCert, true)
+	printKeyValue("Reprise de session", state.DidResume, true)
+}
+
+// Handshake refusé, la connexion est fermée sans être confiée à un gestionnaire
+func printTLSError(remote string, err error) {
+	takeClientHello(remote)
+	var t *traceConn
+	t.lock(noStream)
+	defer t.unlock()
+	red.Printf("x Handshake TLS avec %s échoué : %v\n", remote, err)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	h1, h2 := loadTLSConfig(HTTP1), loadTLSConfig(HTTP2)
+	if len(h2.NextProtos) != 1 || h2.NextProtos[0] != HTTP2 || h2.InsecureSkipVerify {
+		t.Fatalf("ALPN %v, InsecureSkipVerify %v", h2.NextProtos, h2.InsecureSkipVerify)
+	}
+	// La clé des tickets est partagée pour que la session reprenne sur une nouvelle connexion
+	if h1.SessionTicketKey != h2.SessionTicketKey || h1.SessionTicketKey == [32]byte{} {
+		t.Fatal("clé des tickets de session différente ou vide")
+	}
+}
+
+// Lance handleTLS sur un pipe, la trace est lue une fois la connexion fermée
+func tlsTestHandshake(t *testing.T, protocol string, config *tls.Config, exchange func(conn *tls.Conn)) string {
+	buf := captureTrace(t)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleTLS(server, protocol)
+		close(done)
+	}()
+	conn := tls.Client(client, config)
+	exchange(conn)
+	conn.Close()
+	<-done
+	printMu.Lock()
+	defer printMu.Unlock()
+	return buf.String()
+}
+
+// Le résumé du handshake est affiché à l'ouverture de la connexion
+func TestTLSHandshakeSummary(t *testing.T) {
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost", NextProtos: []string{HTTP2, HTTP1}}
+	trace := tlsTestHandshake(t, HTTP1, config, func(conn *tls.Conn) {
+		go io.WriteString(conn, "GET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// Lit l'alerte de fermeture, sans quoi le serveur reste bloqué sur le pipe
+		io.Copy(io.Discard, br)
+	})
+	for _, line := range []string{
+		"| TLS: TLS 1.3",
+		"| Cipher: TLS_",
+		"| ALPN: http/1.1 (proposés : h2, http/1.1)",
+		"| SNI: localhost",
+		"| Certificat client: aucun",
+		"| Reprise de session: false",
+	} {
+		if !strings.Contains(trace, line) {
+			t.Errorf("ligne %q absente de la trace\n%s", line, trace)
+		}
+	}
+}
+
+// Un handshake refusé est signalé et la connexion n'est pas confiée à un gestionnaire
+func TestTLSHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange func(conn net.Conn)
+		reason   string
+	}{
+		{"requête en clair", func(conn net.Conn) {
+			go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			io.Copy(io.Discard, conn)
+		}, "first record does not look like a TLS handshake"},
+		{"sans ALPN", func(conn net.Conn) {
+			tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+			if err := tc.Handshake(); err != nil {
+				t.Error(err)
+			}
+			io.Copy(io.Discard, tc)
+		}, `protocole "" non pris en charge`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureTrace(t)
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				handleTLS(server, HTTP2)
+				close(done)
+			}()
+			tt.exchange(client)
+			client.Close()
+			<-done
+			printMu.Lock()
+			trace := buf.String()
+			printMu.Unlock()
+			if !strings.Contains(trace, "x Handshake TLS avec pipe échoué : ") || !strings.Contains(trace, tt.reason) {
+				t.Fatalf("trace %q, raison %q attendue", trace, tt.reason)
+			}
+			if strings.Contains(trace, "⦿ Connexion") {
+				t.Fatalf("connexion confiée à un gestionnaire\n%s", trace)
+			}
+		})
+	}
+}
+
+// Les clés de session sont enregistrées au format SSLKEYLOGFILE
+// (le fichier est ouvert une seule fois, le test est lancé dans un processus à part)
+func TestTLSKeyLog(t *testing.T) {
+	if runInSubprocess(t) {
+		return
+	}
+	path := filepath.Join(t.TempDir(), "keys.log")
+	setOption(t, &tlsOptions.keyLog, path)
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost", NextProtos: []string{HTTP1}}
+	tlsTestHandshake(t, HTTP1, config, func(conn *tls.Conn) {
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	keys, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range []string{"CLIENT_HANDSHAKE_TRAFFIC_SECRET ", "SERVER_TRAFFIC_SECRET_0 "} {
+		if !strings.Contains(string(keys), label) {
+			t.Errorf("clé %q absente de\n%s", label, keys)
+		}
+	}
+}
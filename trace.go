@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fatih/color"
+)
+
+// Options de la trace affichée dans le terminal
+// Exemple : go run . http2 -hex -conn-colors
+var traceOptions struct {
+	hex        bool
+	connColors bool
+	quiet      bool
+}
+
+func registerTraceFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&traceOptions.hex, "hex", false, "affiche chaque frame (et les requêtes HTTP1) octet par octet avec la signification de chaque champ")
+	fs.BoolVar(&traceOptions.connColors, "conn-colors", false, "colore le préfixe de chaque ligne selon la connexion")
+	fs.BoolVar(&traceOptions.quiet, "quiet", false, "n'affiche pas la trace des échanges (le journal d'accès reste écrit)")
+}
+
+// Ligne qui concerne la connexion entière et non un stream en particulier
+const noStream = ^uint64(0)
+
+// Connexion suivie dans la trace, plusieurs navigateurs peuvent échanger en même temps
+// et leurs lignes sont entrelacées, chaque ligne est donc préfixée par la connexion et le stream
+//
+// ```
+// [c1 s1] +- HEADERS #1
+// [c2]    ⦿ Connexion #2 127.0.0.1:52012
+// [c1 s1] | :method: GET
+// ```
+type traceConn struct {
+	ID       uint64
+	Protocol string
+	Remote   string
+	// Connexion ouverte par la commande client, les couleurs sont inversées
+	// pour que les requêtes restent en bleu et les réponses en vert
+	Client bool
+}
+
+var traceConnCount atomic.Uint64
+
+func newTraceConn(protocol string, remote string) *traceConn {
+	return &traceConn{
+		ID:       traceConnCount.Add(1),
+		Protocol: protocol,
+		Remote:   remote,
+	}
+}
+
+// Sortie du terminal, le préfixe est ajouté au début de chaque ligne
+// Les lignes d'un même bloc sont écrites en tenant printMu
+var traceOutput = &prefixWriter{w: color.Output, lineStart: true}
+var printMu sync.Mutex
+
+func init() {
+	color.Output = traceOutput
+}
+
+// Équivalent de fmt.Printf qui passe par la sortie préfixée
+func tracef(format string, a ...interface{}) {
+	fmt.Fprintf(traceOutput, format, a...)
+}
+
+// Verrouille la sortie pour afficher un bloc de lignes concernant un stream (ou noStream)
+func (t *traceConn) lock(stream uint64) {
+	printMu.Lock()
+	traceOutput.prefix = t.prefix(stream)
+	traceOutput.reversed = t != nil && t.Client
+}
+
+func (t *traceConn) unlock() {
+	traceOutput.prefix = ""
+	traceOutput.reversed = false
+	printMu.Unlock()
+}
+
+// Préfixe aligné pour que les lignes de la connexion restent lisibles
+func (t *traceConn) prefix(stream uint64) string {
+	if t == nil {
+		return ""
+	}
+	p := fmt.Sprintf("[c%v]", t.ID)
+	if stream != noStream {
+		p = fmt.Sprintf("[c%v s%v]", t.ID, stream)
+	}
+	p = fmt.Sprintf("%-10s ", p)
+	if traceOptions.connColors {
+		return connColors[(t.ID-1)%uint64(len(connColors))].Sprint(p)
+	}
+	return p
+}
+
+// Affiche l'ouverture de la connexion avec les paramètres TLS négociés
+// (state vaut nil en HTTP3, ils sont affichés une fois le handshake QUIC terminé)
+func (t *traceConn) open(state *tls.ConnectionState) {
+	t.lock(noStream)
+	tracef("⦿ Connexion #%v %s\n", t.ID, t.Remote)
+	if state != nil {
+		printTLSState(*state, takeClientHello(t.Remote))
+		dirColor(true).Printf("|\n")
+	}
+	t.unlock()
+	if traces.enabled() {
+		t.publish(TraceEvent{In: true, Type: "OPEN", Summary: t.Remote})
+	}
+}
+
+func (t *traceConn) close() {
+	t.lock(noStream)
+	tracef("x\n")
+	t.unlock()
+	if traces.enabled() {
+		t.publish(TraceEvent{Type: "CLOSE"})
+	}
+}
+
+// Ajoute un préfixe au début de chaque ligne écrite
+// Les séquences de couleur écrites en début de ligne sont placées après le préfixe
+// pour que le préfixe garde sa propre couleur
+type prefixWriter struct {
+	w         io.Writer
+	prefix    string
+	lineStart bool
+	pending   []byte
+	// Sens d'affichage inversé (voir traceConn.Client)
+	reversed bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if p.lineStart && isColorSequence(b) {
+			// Une couleur annulée avant d'avoir servi est simplement oubliée
+			if bytes.Equal(b, []byte(colorReset)) {
+				if len(p.pending) == 0 {
+					_, err := p.w.Write(b)
+					return n, err
+				}
+				p.pending = nil
+				return n, nil
+			}
+			p.pending = append(p.pending, b...)
+			return n, nil
+		}
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+		}
+		out := line
+		if p.lineStart {
+			out = append(append([]byte(p.prefix), p.pending...), line...)
+			p.pending = nil
+		}
+		if _, err := p.w.Write(out); err != nil {
+			return 0, err
+		}
+		p.lineStart = line[len(line)-1] == '\n'
+		b = b[len(line):]
+	}
+	return n, nil
+}
+
+const colorReset = "\x1b[0m"
+
+// Séquence ANSI seule, comme celles écrites par fatih/color avant et après le texte
+func isColorSequence(b []byte) bool {
+	return len(b) > 2 && b[0] == 0x1b && b[1] == '[' && b[len(b)-1] == 'm' && bytes.IndexByte(b, '\n') < 0
+}
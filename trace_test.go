@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Redirige la trace vers un buffer le temps du test
+func captureTrace(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	printMu.Lock()
+	w := traceOutput.w
+	traceOutput.w = &buf
+	printMu.Unlock()
+	t.Cleanup(func() {
+		printMu.Lock()
+		traceOutput.w = w
+		printMu.Unlock()
+	})
+	return &buf
+}
+
+func TestTruncateValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"Host", "localhost", "localhost"},
+		{"X-Long", strings.Repeat("a", 44), strings.Repeat("a", 44)},
+		{"X-Long", strings.Repeat("a", 45), strings.Repeat("a", 44) + "..."},
+		{strings.Repeat("x", 50), "", ""},
+		{strings.Repeat("x", 50), "valeur", "..."},
+		{strings.Repeat("x", 80), "valeur", "..."},
+	}
+	for _, tt := range tests {
+		if value := truncateValue(tt.name, tt.value); value != tt.want {
+			t.Errorf("truncateValue(%q, %q) = %q, %q attendu", tt.name, tt.value, value, tt.want)
+		}
+	}
+}
+
+// Un nom d'en-tête de plus de 50 caractères ne doit pas faire paniquer la trace
+func TestPrintLongHeaderName(t *testing.T) {
+	buf := captureTrace(t)
+	name := "X-" + strings.Repeat("long", 20)
+	printHeader(newTraceConn(HTTP1, "test"), name, "valeur", true)
+	printKeyValue(name, "valeur", true)
+	if n := strings.Count(buf.String(), name+": ..."); n != 2 {
+		t.Errorf("trace %q, deux lignes tronquées attendues", buf.String())
+	}
+}
+
+// Les lignes qui concernent la connexion n'ont pas de numéro de stream, comme en HTTP1 et HTTP3
+func TestH2TracePrefix(t *testing.T) {
+	setOption(t, &traceOptions.connColors, false)
+	buf := captureTrace(t)
+	newH2TestClient(t)
+	printMu.Lock()
+	trace := buf.String()
+	printMu.Unlock()
+	if !regexp.MustCompile(`(?m)^\[c\d+\] +\+- Preface`).MatchString(trace) {
+		t.Errorf("préface sans le préfixe de la connexion\n%s", trace)
+	}
+
+	buf = captureTrace(t)
+	conn := newTraceConn(HTTP2, "test")
+	printH2Error(conn, noStream, H2ErrCodeProtocolError, "connexion", false)
+	printH2Error(conn, 3, H2ErrCodeCancel, "stream", false)
+	for _, prefix := range []string{conn.prefix(noStream) + "+- -> PROTOCOL_ERROR", conn.prefix(3) + "+- -> CANCEL"} {
+		if !strings.Contains(buf.String(), prefix) {
+			t.Errorf("ligne %q absente\n%s", prefix, buf.String())
+		}
+	}
+}
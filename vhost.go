@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Virtual hosts : chaque nom d'hôte a son dossier (ou son serveur amont) et son certificat,
+// choisis à partir de Host (HTTP1), :authority (HTTP2 et HTTP3) et du SNI
+// Exemple : go run . http2 -vhost "*.demo.test=sites/demo,cert=demo.pem,key=demo-key.pem" -vhost api.test=http://localhost:3000
+var vhostOptions struct {
+	hosts vhostFlags
+}
+
+func registerVHostFlags(fs *flag.FlagSet) {
+	fs.Var(&vhostOptions.hosts, "vhost", "virtual host (\"hôte=dossier\" ou \"hôte=http://amont\", suivi de \",cert=fichier,key=fichier\"), peut être répété")
+}
+
+type virtualHost struct {
+	// Nom exact ou joker (*.example.com couvre tous les sous-domaines)
+	pattern string
+	root    string
+	// Serveur amont qui reçoit les requêtes à la place du dossier
+	proxy *upstreamProxy
+	// nil pour utiliser le certificat par défaut
+	cert *tls.Certificate
+}
+
+// Utilisé quand aucun virtual host ne correspond, il reprend les options globales (-proxy)
+var defaultVHost = &virtualHost{pattern: "*", root: "public"}
+
+type vhostFlags []*virtualHost
+
+func (v *vhostFlags) String() string {
+	var s []string
+	for _, vh := range *v {
+		s = append(s, vh.pattern)
+	}
+	return strings.Join(s, ", ")
+}
+
+/**
+* Lit la définition d'un virtual host
+*
+* ```
+* demo.test=sites/demo
+* *.demo.test=sites/demo,cert=demo.pem,key=demo-key.pem
+* api.test=unix:/tmp/api.sock
+* ```
+**/
+func (v *vhostFlags) Set(s string) error {
+	pattern, rest, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("%q, hôte=dossier attendu", s)
+	}
+	options := strings.Split(rest, ",")
+	vh := &virtualHost{pattern: strings.ToLower(pattern)}
+	if strings.HasPrefix(options[0], "http://") || strings.HasPrefix(options[0], "unix:") {
+		p, err := newUpstreamProxy(options[0])
+		if err != nil {
+			return err
+		}
+		vh.proxy = p
+	} else {
+		if info, err := os.Stat(options[0]); err != nil || !info.IsDir() {
+			return fmt.Errorf("%q n'est pas un dossier", options[0])
+		}
+		vh.root = options[0]
+	}
+
+	var certFile, keyFile string
+	for _, option := range options[1:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "cert":
+			certFile = value
+		case "key":
+			keyFile = value
+		default:
+			return fmt.Errorf("option %q inconnue, cert ou key attendue", name)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("certificat de %s, %w", pattern, err)
+		}
+		vh.cert = &cert
+	}
+	*v = append(*v, vh)
+	return nil
+}
+
+// Trouve le virtual host d'un nom d'hôte : le nom exact, sinon le joker le plus précis
+func matchVHost(host string) *virtualHost {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	var best *virtualHost
+	for _, vh := range vhostOptions.hosts {
+		if vh.pattern == host {
+			return vh
+		}
+		suffix, ok := strings.CutPrefix(vh.pattern, "*")
+		if ok && strings.HasSuffix(host, suffix) && (best == nil || len(vh.pattern) > len(best.pattern)) {
+			best = vh
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return defaultVHost
+}
+
+// Le virtual host est choisi par l'hôte de la requête, il doit être celui choisi par le SNI
+// lors du handshake, sinon le client doit envoyer la requête sur une autre connexion (421)
+func selectVHost(serverName string, authority string) (*virtualHost, bool) {
+	if authority == "" {
+		return matchVHost(serverName), true
+	}
+	vh := matchVHost(authority)
+	if serverName != "" && matchVHost(serverName) != vh {
+		return vh, false
+	}
+	return vh, true
+}
+
+// Certificat présenté selon le SNI, nil pour le certificat par défaut
+func vhostCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return matchVHost(hello.ServerName).cert, nil
+}
+
+// Réponse envoyée quand le SNI et l'hôte de la requête désignent deux virtual hosts différents
+func misdirectedFile(authority string) staticFile {
+	f := statusFile(http.StatusMisdirectedRequest, authority)
+	f.Body = []byte(fmt.Sprintf("Misdirected Request : %s n'est pas servi sur cette connexion\n", authority))
+	return f
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchVHost(t *testing.T) {
+	demo := &virtualHost{pattern: "demo.test", root: "sites/demo"}
+	wildcard := &virtualHost{pattern: "*.demo.test", root: "sites/wildcard"}
+	api := &virtualHost{pattern: "*.api.demo.test", root: "sites/api"}
+	admin := &virtualHost{pattern: "admin.api.demo.test", root: "sites/admin"}
+	hosts := vhostOptions.hosts
+	vhostOptions.hosts = vhostFlags{demo, wildcard, api, admin}
+	t.Cleanup(func() { vhostOptions.hosts = hosts })
+
+	tests := []struct {
+		host  string
+		vhost *virtualHost
+	}{
+		{"demo.test", demo},
+		{"DEMO.Test", demo},
+		{"demo.test.", demo},
+		{"demo.test:8443", demo},
+		{"www.demo.test", wildcard},
+		{"a.b.demo.test", wildcard},
+		{"www.demo.test:443", wildcard},
+		// Le joker le plus long l'emporte, quel que soit l'ordre des options
+		{"v1.api.demo.test", api},
+		{"api.demo.test", wildcard},
+		// Le nom exact passe avant les jokers
+		{"admin.api.demo.test", admin},
+		// Un joker ne couvre pas le domaine lui-même ni un domaine qui finit pareil
+		{"otherdemo.test", defaultVHost},
+		{"localhost", defaultVHost},
+		{"127.0.0.1:443", defaultVHost},
+		{"[::1]:443", defaultVHost},
+		{"", defaultVHost},
+	}
+	for _, tt := range tests {
+		if vh := matchVHost(tt.host); vh != tt.vhost {
+			t.Errorf("matchVHost(%q) = %s, %s attendu", tt.host, vh.pattern, tt.vhost.pattern)
+		}
+	}
+}
+
+func TestSelectVHost(t *testing.T) {
+	demo := &virtualHost{pattern: "demo.test", root: "sites/demo"}
+	wildcard := &virtualHost{pattern: "*.demo.test", root: "sites/wildcard"}
+	hosts := vhostOptions.hosts
+	vhostOptions.hosts = vhostFlags{demo, wildcard}
+	t.Cleanup(func() { vhostOptions.hosts = hosts })
+
+	tests := []struct {
+		name       string
+		serverName string
+		authority  string
+		vhost      *virtualHost
+		ok         bool
+	}{
+		{"SNI et hôte identiques", "demo.test", "demo.test", demo, true},
+		{"hôte avec un port", "demo.test", "demo.test:8443", demo, true},
+		{"deux noms du même joker", "a.demo.test", "b.demo.test", wildcard, true},
+		{"sans SNI", "", "www.demo.test", wildcard, true},
+		{"sans hôte", "demo.test", "", demo, true},
+		{"ni SNI ni hôte", "", "", defaultVHost, true},
+		{"SNI d'un autre virtual host", "demo.test", "www.demo.test", wildcard, false},
+		{"hôte inconnu", "demo.test", "localhost", defaultVHost, false},
+		{"SNI inconnu", "localhost", "demo.test", demo, false},
+		{"deux hôtes inconnus", "localhost", "example.com", defaultVHost, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vh, ok := selectVHost(tt.serverName, tt.authority)
+			if vh != tt.vhost || ok != tt.ok {
+				t.Errorf("%s, %v ; %s, %v attendus", vh.pattern, ok, tt.vhost.pattern, tt.ok)
+			}
+		})
+	}
+	if f := misdirectedFile("www.demo.test"); f.Status != http.StatusMisdirectedRequest {
+		t.Errorf("statut %v, 421 attendu", f.Status)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Chemin de l'endpoint d'écho WebSocket
+const webSocketPath = "/ws"
+
+// Valeur concaténée à la clé du client pour calculer Sec-WebSocket-Accept
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Taille maximale d'un message (toutes fragmentations confondues)
+const maxWSMessageSize = 1 << 20
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var wsOpNames = map[byte]string{
+	wsOpContinuation: "CONTINUATION",
+	wsOpText:         "TEXT",
+	wsOpBinary:       "BINARY",
+	wsOpClose:        "CLOSE",
+	wsOpPing:         "PING",
+	wsOpPong:         "PONG",
+}
+
+// Codes de fermeture (RFC 6455 section 7.4.1)
+const (
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseNoStatus        = 1005
+	wsCloseInvalidPayload  = 1007
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+	wsCloseInternalError   = 1011
+)
+
+// Erreur qui entraîne la fermeture de la connexion avec le code associé
+type wsCloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket %v: %s", e.Code, e.Reason)
+}
+
+/**
+* Frame WebSocket (RFC 6455 section 5.2)
+*
+* ```
+*  0                   1                   2                   3
+* +-+-+-+-+-------+-+-------------+-------------------------------+
+* |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+* |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+* |N|V|V|V|       |S|             |                               |
+* +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+* |                               |  Masking-key, if MASK set to 1 |
+* +-------------------------------+-------------------------------+
+* |                          Payload Data                         |
+* +---------------------------------------------------------------+
+* ```
+**/
+type WSFrame struct {
+	Fin     bool
+	Rsv     byte
+	Opcode  byte
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+func (f WSFrame) isControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// Calcule la valeur de Sec-WebSocket-Accept à partir de Sec-WebSocket-Key
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Vérifie que la clé envoyée par le client est 16 octets encodés en base64
+func validWebSocketKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 16
+}
+
+func ReadWSFrame(r io.Reader) (WSFrame, error) {
+	f := WSFrame{}
+	header, err := readBytes(r, 2)
+	if err != nil {
+		return f, err
+	}
+	f.Fin = readBit(header[0], 0)
+	f.Rsv = (header[0] >> 4) & 0x7
+	f.Opcode = header[0] & 0x0f
+	f.Masked = readBit(header[1], 0)
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		b, err := readBytes(r, 2)
+		if err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b, err := readBytes(r, 8)
+		if err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+
+	if f.Rsv != 0 {
+		return f, &wsCloseError{wsCloseProtocolError, "bits RSV non nuls sans extension négociée"}
+	}
+	if _, ok := wsOpNames[f.Opcode]; !ok {
+		return f, &wsCloseError{wsCloseProtocolError, fmt.Sprintf("opcode %#x inconnu", f.Opcode)}
+	}
+	if f.isControl() && (length > 125 || !f.Fin) {
+		return f, &wsCloseError{wsCloseProtocolError, "frame de contrôle fragmentée ou trop longue"}
+	}
+	if length > maxWSMessageSize {
+		return f, &wsCloseError{wsCloseTooBig, fmt.Sprintf("frame de %v octets", length)}
+	}
+	// Les frames envoyées par le client doivent être masquées
+	if !f.Masked {
+		return f, &wsCloseError{wsCloseProtocolError, "frame client non masquée"}
+	}
+
+	key, err := readBytes(r, 4)
+	if err != nil {
+		return f, err
+	}
+	copy(f.MaskKey[:], key)
+	f.Payload, err = readBytes(r, int(length))
+	if err != nil {
+		return f, err
+	}
+	maskWSPayload(f.Payload, f.MaskKey)
+	return f, nil
+}
+
+// Le masque est appliqué octet par octet avec un XOR, l'opération est symétrique
+func maskWSPayload(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+func (f WSFrame) Write(w io.Writer) error {
+	b := make([]byte, 0, 14+len(f.Payload))
+	first := f.Opcode
+	if f.Fin {
+		first |= 0x80
+	}
+	b = append(b, first)
+
+	var mask byte
+	if f.Masked {
+		mask = 0x80
+	}
+	switch l := len(f.Payload); {
+	case l < 126:
+		b = append(b, mask|byte(l))
+	case l <= 0xffff:
+		b = append(b, mask|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(l))
+	default:
+		b = append(b, mask|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(l))
+	}
+
+	payload := f.Payload
+	if f.Masked {
+		b = append(b, f.MaskKey[:]...)
+		payload = append([]byte{}, f.Payload...)
+		maskWSPayload(payload, f.MaskKey)
+	}
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+func closeWSFrame(code uint16, reason string) WSFrame {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	return WSFrame{Fin: true, Opcode: wsOpClose, Payload: append(payload, reason...)}
+}
+
+// Session d'écho : chaque message reçu est renvoyé au client
+// Le même code est utilisé pour HTTP/1.1 (Upgrade) et HTTP/2 (Extended CONNECT)
+func serveWebSocket(rw io.ReadWriter, t *traceConn, stream uint64) error {
+	send := func(f WSFrame) error {
+		printWSFrame(t, stream, f, false)
+		return f.Write(rw)
+	}
+
+	var message []byte
+	var messageOp byte
+	for {
+		f, err := ReadWSFrame(rw)
+		var closeErr *wsCloseError
+		if errors.As(err, &closeErr) {
+			printWSError(t, stream, closeErr)
+			return send(closeWSFrame(closeErr.Code, closeErr.Reason))
+		}
+		if err != nil {
+			return err
+		}
+		printWSFrame(t, stream, f, true)
+
+		switch f.Opcode {
+		case wsOpPing:
+			if err := send(WSFrame{Fin: true, Opcode: wsOpPong, Payload: f.Payload}); err != nil {
+				return err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			code, _, err := parseWSClose(f.Payload)
+			if err != nil {
+				printWSError(t, stream, err)
+				return send(closeWSFrame(err.Code, err.Reason))
+			}
+			// On répond avec le même code pour terminer la fermeture
+			if code == wsCloseNoStatus {
+				return send(WSFrame{Fin: true, Opcode: wsOpClose})
+			}
+			return send(closeWSFrame(code, ""))
+		case wsOpContinuation:
+			if messageOp == 0 {
+				return send(closeWSFrame(wsCloseProtocolError, "continuation sans message en cours"))
+			}
+		default:
+			if messageOp != 0 {
+				return send(closeWSFrame(wsCloseProtocolError, "nouveau message avant la fin du précédent"))
+			}
+			messageOp = f.Opcode
+		}
+
+		message = append(message, f.Payload...)
+		if len(message) > maxWSMessageSize {
+			return send(closeWSFrame(wsCloseTooBig, "message trop volumineux"))
+		}
+		if !f.Fin {
+			continue
+		}
+
+		if messageOp == wsOpText && !utf8.Valid(message) {
+			return send(closeWSFrame(wsCloseInvalidPayload, "texte UTF-8 invalide"))
+		}
+		if err := send(WSFrame{Fin: true, Opcode: messageOp, Payload: message}); err != nil {
+			return err
+		}
+		message = nil
+		messageOp = 0
+	}
+}
+
+// Une frame CLOSE contient éventuellement un code sur 2 octets suivi d'une raison en UTF-8
+func parseWSClose(payload []byte) (uint16, string, *wsCloseError) {
+	if len(payload) == 0 {
+		return wsCloseNoStatus, "", nil
+	}
+	if len(payload) == 1 {
+		return 0, "", &wsCloseError{wsCloseProtocolError, "code de fermeture tronqué"}
+	}
+	code := binary.BigEndian.Uint16(payload)
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return 0, "", &wsCloseError{wsCloseInvalidPayload, "raison de fermeture invalide"}
+	}
+	switch {
+	case code < 1000, code == wsCloseNoStatus, code == 1006, code == 1015, code >= 1016 && code < 3000, code >= 5000:
+		return 0, "", &wsCloseError{wsCloseProtocolError, fmt.Sprintf("code de fermeture %v invalide", code)}
+	}
+	return code, string(reason), nil
+}
+
+func printWSFrame(t *traceConn, stream uint64, f WSFrame, in bool) {
+	t.lock(stream)
+	defer t.unlock()
+	color := dirColor(in)
+	defer color.Printf("|\n")
+	color.Printf("+- WS %s", wsOpNames[f.Opcode])
+	tracef("\n")
+
+	printFlag("FIN", f.Fin, in)
+	printFlag("MASK", f.Masked, in)
+	if f.Masked {
+		printKeyValue("Masking key", fmt.Sprintf("%x", f.MaskKey), in)
+	}
+	printKeyValue("Length", len(f.Payload), in)
+	switch {
+	case f.Opcode == wsOpClose && len(f.Payload) >= 2:
+		printKeyValue("Code", binary.BigEndian.Uint16(f.Payload), in)
+		printKeyValue("Reason", string(f.Payload[2:]), in)
+	case f.Opcode == wsOpText:
+		printKeyValue("Data", string(f.Payload), in)
+	case len(f.Payload) > 0:
+		printKeyValue("Data", fmt.Sprintf("%q", f.Payload), in)
+	}
+}
+
+func printWSError(t *traceConn, stream uint64, err *wsCloseError) {
+	t.lock(stream)
+	defer t.unlock()
+	red.Printf("+- WS %v\n", err.Code)
+	red.Printf("| %s\n", err.Reason)
+	red.Printf("|\n")
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+var testMaskKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// Frame envoyée par le client, toujours masquée
+func clientWSFrame(fin bool, opcode byte, payload []byte) WSFrame {
+	return WSFrame{Fin: fin, Opcode: opcode, Masked: true, MaskKey: testMaskKey, Payload: payload}
+}
+
+// Les frames du serveur ne sont pas masquées, ReadWSFrame les refuse
+func readServerWSFrame(r io.Reader) (WSFrame, error) {
+	f := WSFrame{}
+	header, err := readBytes(r, 2)
+	if err != nil {
+		return f, err
+	}
+	f.Fin, f.Opcode, f.Masked = header[0]&0x80 != 0, header[0]&0x0f, header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		b, err := readBytes(r, 2)
+		if err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b, err := readBytes(r, 8)
+		if err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+	f.Payload, err = readBytes(r, int(length))
+	return f, err
+}
+
+func TestWSFrameLength(t *testing.T) {
+	tests := []struct {
+		length int
+		// En-tête sans la clé de masque
+		header []byte
+	}{
+		{0, []byte{0x82, 0x80}},
+		{125, []byte{0x82, 0x80 | 125}},
+		{126, []byte{0x82, 0x80 | 126, 0x00, 0x7e}},
+		{0xffff, []byte{0x82, 0x80 | 126, 0xff, 0xff}},
+		{0x10000, []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		payload := bytes.Repeat([]byte("gohttp"), tt.length/6+1)[:tt.length]
+		var buf bytes.Buffer
+		if err := clientWSFrame(true, wsOpBinary, payload).Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		if !bytes.HasPrefix(b, tt.header) || !bytes.Equal(b[len(tt.header):len(tt.header)+4], testMaskKey[:]) {
+			t.Errorf("%v octets : en-tête %x, %x attendu", tt.length, b[:min(len(b), len(tt.header)+4)], tt.header)
+			continue
+		}
+		// Le contenu est masqué sur le réseau et démasqué à la lecture
+		if tt.length > 0 && bytes.Equal(b[len(tt.header)+4:], payload) {
+			t.Errorf("%v octets : contenu non masqué", tt.length)
+		}
+		f, err := ReadWSFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Fin || f.Opcode != wsOpBinary || !bytes.Equal(f.Payload, payload) {
+			t.Errorf("%v octets : frame relue différente", tt.length)
+		}
+	}
+}
+
+func TestReadWSFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		code  uint16
+	}{
+		{"bits RSV", []byte{0x80 | 0x40 | wsOpText, 0x80}, wsCloseProtocolError},
+		{"opcode inconnu", []byte{0x80 | 0x3, 0x80}, wsCloseProtocolError},
+		{"opcode de contrôle inconnu", []byte{0x80 | 0xb, 0x80}, wsCloseProtocolError},
+		{"PING fragmenté", []byte{wsOpPing, 0x80}, wsCloseProtocolError},
+		{"PING de plus de 125 octets", []byte{0x80 | wsOpPing, 0x80 | 126, 0x00, 0x7e}, wsCloseProtocolError},
+		{"CLOSE de plus de 125 octets", []byte{0x80 | wsOpClose, 0x80 | 126, 0x00, 0x7e}, wsCloseProtocolError},
+		{"frame de plus de 1 Mio", []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0x10, 0x00, 0x01}, wsCloseTooBig},
+		{"frame non masquée", []byte{0x81, 0x02, 'o', 'k'}, wsCloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadWSFrame(bytes.NewReader(tt.frame))
+			var closeErr *wsCloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tt.code {
+				t.Fatalf("erreur %v, code %v attendu", err, tt.code)
+			}
+		})
+	}
+	// Une frame coupée n'est pas une erreur de protocole, la connexion est simplement perdue
+	if _, err := ReadWSFrame(bytes.NewReader([]byte{0x81, 0x85, 0x00})); err == nil || errors.As(err, new(*wsCloseError)) {
+		t.Errorf("erreur %v pour une frame tronquée", err)
+	}
+}
+
+func TestParseWSClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		code    uint16
+		reason  string
+		errCode uint16
+	}{
+		{"sans code", nil, wsCloseNoStatus, "", 0},
+		{"code normal", []byte{0x03, 0xe8}, wsCloseNormal, "", 0},
+		{"avec une raison", append([]byte{0x03, 0xe9}, "au revoir"...), wsCloseGoingAway, "au revoir", 0},
+		{"code applicatif", []byte{0x0f, 0xa0}, 4000, "", 0},
+		{"code tronqué", []byte{0x03}, 0, "", wsCloseProtocolError},
+		{"code inférieur à 1000", []byte{0x03, 0xe7}, 0, "", wsCloseProtocolError},
+		{"1005 réservé", []byte{0x03, 0xed}, 0, "", wsCloseProtocolError},
+		{"1006 réservé", []byte{0x03, 0xee}, 0, "", wsCloseProtocolError},
+		{"1015 réservé", []byte{0x03, 0xf7}, 0, "", wsCloseProtocolError},
+		{"code non attribué", []byte{0x07, 0xd0}, 0, "", wsCloseProtocolError},
+		{"code hors limites", []byte{0x13, 0x88}, 0, "", wsCloseProtocolError},
+		{"raison en UTF-8 invalide", []byte{0x03, 0xe8, 0xff}, 0, "", wsCloseInvalidPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reason, err := parseWSClose(tt.payload)
+			if tt.errCode != 0 {
+				if err == nil || err.Code != tt.errCode {
+					t.Fatalf("erreur %v, code %v attendu", err, tt.errCode)
+				}
+				return
+			}
+			if err != nil || code != tt.code || reason != tt.reason {
+				t.Fatalf("%v %q %v, %v %q attendus", code, reason, err, tt.code, tt.reason)
+			}
+		})
+	}
+}
+
+// Session d'écho rejouée : les frames du client sont lues d'un coup, les réponses sont comparées
+func TestServeWebSocket(t *testing.T) {
+	big := bytes.Repeat([]byte("a"), maxWSMessageSize/2+1)
+	closeCode := func(code uint16) WSFrame { return closeWSFrame(code, "") }
+	tests := []struct {
+		name   string
+		client []WSFrame
+		// Réponses attendues, une frame CLOSE n'est comparée que par son code
+		server []WSFrame
+	}{
+		{
+			"écho texte et binaire",
+			[]WSFrame{clientWSFrame(true, wsOpText, []byte("bonjour")), clientWSFrame(true, wsOpBinary, []byte{0, 1, 2})},
+			[]WSFrame{{Opcode: wsOpText, Payload: []byte("bonjour")}, {Opcode: wsOpBinary, Payload: []byte{0, 1, 2}}},
+		},
+		{
+			"message fragmenté avec un PING au milieu",
+			[]WSFrame{
+				clientWSFrame(false, wsOpText, []byte("bon")),
+				clientWSFrame(true, wsOpPing, []byte("p")),
+				clientWSFrame(true, wsOpContinuation, []byte("jour")),
+			},
+			[]WSFrame{{Opcode: wsOpPong, Payload: []byte("p")}, {Opcode: wsOpText, Payload: []byte("bonjour")}},
+		},
+		{
+			"PONG ignoré",
+			[]WSFrame{clientWSFrame(true, wsOpPong, nil), clientWSFrame(true, wsOpText, []byte("ok"))},
+			[]WSFrame{{Opcode: wsOpText, Payload: []byte("ok")}},
+		},
+		{
+			"continuation sans message",
+			[]WSFrame{clientWSFrame(true, wsOpContinuation, []byte("x"))},
+			[]WSFrame{closeCode(wsCloseProtocolError)},
+		},
+		{
+			"nouveau message avant la fin du précédent",
+			[]WSFrame{clientWSFrame(false, wsOpText, []byte("a")), clientWSFrame(true, wsOpText, []byte("b"))},
+			[]WSFrame{closeCode(wsCloseProtocolError)},
+		},
+		{
+			"UTF-8 invalide",
+			[]WSFrame{clientWSFrame(true, wsOpText, []byte{0xc3})},
+			[]WSFrame{closeCode(wsCloseInvalidPayload)},
+		},
+		{
+			"UTF-8 coupé entre deux fragments",
+			[]WSFrame{clientWSFrame(false, wsOpText, []byte{0xc3}), clientWSFrame(true, wsOpContinuation, []byte{0xa9})},
+			[]WSFrame{{Opcode: wsOpText, Payload: []byte("é")}},
+		},
+		{
+			"message de plus de 1 Mio en fragments",
+			[]WSFrame{clientWSFrame(false, wsOpBinary, big), clientWSFrame(true, wsOpContinuation, big)},
+			[]WSFrame{closeCode(wsCloseTooBig)},
+		},
+		{
+			"fermeture avec un code",
+			[]WSFrame{clientWSFrame(true, wsOpClose, closeWSFrame(wsCloseGoingAway, "bye").Payload)},
+			[]WSFrame{closeCode(wsCloseGoingAway)},
+		},
+		{
+			"fermeture sans code",
+			[]WSFrame{clientWSFrame(true, wsOpClose, nil)},
+			[]WSFrame{{Opcode: wsOpClose}},
+		},
+		{
+			"code de fermeture invalide",
+			[]WSFrame{clientWSFrame(true, wsOpClose, []byte{0x03, 0xee})},
+			[]WSFrame{closeCode(wsCloseProtocolError)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in, out bytes.Buffer
+			for _, f := range tt.client {
+				f.Write(&in)
+			}
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{&in, &out}
+			if err := serveWebSocket(rw, newTraceConn(HTTP1, "test"), noStream); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			for i, want := range tt.server {
+				f, err := readServerWSFrame(&out)
+				if err != nil {
+					t.Fatalf("réponse %v : %v", i, err)
+				}
+				if f.Masked || !f.Fin || f.Opcode != want.Opcode {
+					t.Fatalf("réponse %v : %s (fin %v, masquée %v), %s attendue", i, wsOpNames[f.Opcode], f.Fin, f.Masked, wsOpNames[want.Opcode])
+				}
+				if want.Opcode == wsOpClose && len(want.Payload) > 0 {
+					if len(f.Payload) < 2 || !bytes.Equal(f.Payload[:2], want.Payload[:2]) {
+						t.Fatalf("code de fermeture %x, %x attendu", f.Payload, want.Payload[:2])
+					}
+				} else if !bytes.Equal(f.Payload, want.Payload) {
+					t.Fatalf("réponse %v : %q, %q attendu", i, f.Payload, want.Payload)
+				}
+			}
+			if out.Len() > 0 {
+				t.Errorf("%v octets de trop dans la réponse", out.Len())
+			}
+		})
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// Exemple de la RFC 6455 section 1.3
+	if accept := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", accept)
+	}
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"dGhlIHNhbXBsZSBub25jZQ==", true},
+		{"dGhlIHNhbXBsZQ==", false},
+		{"pas du base64", false},
+		{strings.Repeat("A", 22) + "==", true},
+		{strings.Repeat("A", 24), false},
+	}
+	for _, tt := range tests {
+		if ok := validWebSocketKey(tt.key); ok != tt.ok {
+			t.Errorf("validWebSocketKey(%q) = %v", tt.key, ok)
+		}
+	}
+}
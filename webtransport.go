@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Types de flux WebTransport (draft-ietf-webtrans-http3)
+const (
+	wtBidiStreamType = 0x41
+	wtUniStreamType  = 0x54
+)
+
+// Types de capsules (RFC 9297 et draft WebTransport)
+const (
+	capsuleDatagram       = 0x00
+	capsuleCloseWTSession = 0x2843
+	capsuleDrainWTSession = 0x78ae
+)
+
+const maxQuarterStreamID = 1<<60 - 1
+
+const (
+	webTransportEchoPath   = "/echo"
+	webTransportDraftValue = "draft02"
+)
+
+var capsuleNames = map[uint64]string{
+	capsuleDatagram:       "DATAGRAM",
+	capsuleCloseWTSession: "CLOSE_WEBTRANSPORT_SESSION",
+	capsuleDrainWTSession: "DRAIN_WEBTRANSPORT_SESSION",
+}
+
+// Session WebTransport établie par une requête Extended CONNECT,
+// identifiée par l'identifiant du stream de la requête
+type wtSession struct {
+	conn *h3Conn
+	str  quic.Stream
+}
+
+// Une capsule est transportée dans les frames DATA du stream CONNECT
+// Format : type (varint), longueur (varint), valeur
+type Capsule struct {
+	Type  uint64
+	Value []byte
+}
+
+// Gère une requête CONNECT, seul l'Extended CONNECT vers l'endpoint d'écho WebTransport est accepté
+// Pour tester : https://webtransport.day/ ou tout client WebTransport vers https://localhost/echo
+func (c *h3Conn) serveConnect(str quic.Stream, hf HeadersFrame, fp *framerParser, entry *accessEntry) error {
+	// Le CONNECT classique est refusé comme en HTTP1 et HTTP2, sans lire le tunnel
+	if hf.Header(":protocol", "") == "" {
+		str.CancelRead(quic.StreamErrorCode(ErrCodeNoError))
+		return c.respondFile(str, connectFile(hf.Header(":authority", "")), entry)
+	}
+	status := "200"
+	switch {
+	case hf.Header(":protocol", "") != "webtransport":
+		status = "501"
+	case hf.Header(":path", "") != webTransportEchoPath:
+		status = "404"
+	}
+	res := HeadersFrame{Headers: Header{{Name: ":status", Value: status}}}
+	if status == "200" {
+		res.Headers.Add("sec-webtransport-http3-draft", webTransportDraftValue)
+	}
+	if err := c.writeHeaders(str, res); err != nil {
+		return err
+	}
+	code, _ := strconv.Atoi(status)
+	defer entry.log(code, 0)
+	if status != "200" {
+		return str.Close()
+	}
+
+	s := &wtSession{conn: c, str: str}
+	c.mu.Lock()
+	c.sessions[str.StreamID()] = s
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.sessions, str.StreamID())
+		c.mu.Unlock()
+	}()
+
+	// Le stream reste ouvert pendant toute la session et transporte des capsules
+	var buf []byte
+	for {
+		f, err := fp.NextFrame()
+		if err == io.EOF {
+			return str.Close()
+		}
+		if err != nil {
+			return err
+		}
+		df, ok := f.(DataFrame)
+		if !ok {
+			return newH3Error(ErrCodeFrameUnexpected, "frame %s inattendue dans une session WebTransport", frameName(f))
+		}
+		buf = append(buf, df.Data...)
+		for {
+			capsule, n, ok := parseCapsule(buf)
+			if !ok {
+				break
+			}
+			buf = buf[n:]
+			printCapsule(c.trace, str.StreamID(), capsule, true)
+			closed, err := s.handleCapsule(capsule)
+			if err != nil || closed {
+				return err
+			}
+		}
+	}
+}
+
+// Traite une capsule reçue, renvoie true si la session est terminée
+func (s *wtSession) handleCapsule(capsule Capsule) (bool, error) {
+	switch capsule.Type {
+	case capsuleDatagram:
+		// Un datagramme envoyé sous forme de capsule est renvoyé de la même façon
+		printCapsule(s.conn.trace, s.str.StreamID(), capsule, false)
+		return false, DataFrame{Data: capsule.Append(nil)}.Write(s.str)
+	case capsuleCloseWTSession:
+		return true, s.str.Close()
+	}
+	// Les capsules inconnues (et DRAIN) sont ignorées
+	return false, nil
+}
+
+// Renvoie le datagramme reçu tel quel à l'expéditeur
+func (s *wtSession) handleDatagram(payload []byte) {
+	printH3Datagram(s.conn.trace, s.str.StreamID(), payload, false)
+	b := quicvarint.Append(nil, uint64(s.str.StreamID()/4))
+	if err := s.conn.SendDatagram(append(b, payload...)); err != nil {
+		log.Printf("impossible d'envoyer le datagramme %v", err)
+	}
+}
+
+// Les datagrammes HTTP (RFC 9297) commencent par l'identifiant du stream CONNECT divisé par 4
+func (c *h3Conn) receiveDatagrams() {
+	for {
+		b, err := c.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		qid, n, err := quicvarint.Parse(b)
+		if err != nil || qid > maxQuarterStreamID {
+			c.closeWithError(newH3Error(ErrCodeDatagramError, "identifiant de stream du datagramme invalide"))
+			return
+		}
+		sessionID := quic.StreamID(qid * 4)
+		printH3Datagram(c.trace, sessionID, b[n:], true)
+		c.mu.Lock()
+		s := c.sessions[sessionID]
+		c.mu.Unlock()
+		// Datagramme pour une session inconnue ou terminée : ignoré
+		if s != nil {
+			s.handleDatagram(b[n:])
+		}
+	}
+}
+
+// Renvoie la session associée à l'identifiant lu en début de flux WebTransport
+func (c *h3Conn) readSession(r io.Reader) (*wtSession, error) {
+	id, err := quicvarint.Read(quicvarint.NewReader(r))
+	if err != nil {
+		return nil, frameReadError("impossible de lire l'identifiant de session", err)
+	}
+	c.mu.Lock()
+	s := c.sessions[quic.StreamID(id)]
+	c.mu.Unlock()
+	if s == nil {
+		return nil, fmt.Errorf("session WebTransport #%v inconnue", id)
+	}
+	return s, nil
+}
+
+// Flux bidirectionnel WebTransport : les données reçues sont renvoyées sur le même flux
+func (c *h3Conn) serveWebTransportStream(str quic.Stream) error {
+	s, err := c.readSession(str)
+	if err != nil {
+		str.CancelRead(quic.StreamErrorCode(ErrCodeStreamCreationError))
+		str.CancelWrite(quic.StreamErrorCode(ErrCodeStreamCreationError))
+		return err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := str.Read(buf)
+		if n > 0 {
+			printWTStream(c.trace, s.str.StreamID(), str.StreamID(), buf[:n], true)
+			printWTStream(c.trace, s.str.StreamID(), str.StreamID(), buf[:n], false)
+			if _, err := str.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return str.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Flux unidirectionnel WebTransport : le contenu est renvoyé sur un nouveau flux unidirectionnel
+func (c *h3Conn) serveWebTransportUniStream(str quic.ReceiveStream) {
+	s, err := c.readSession(str)
+	if err != nil {
+		str.CancelRead(quic.StreamErrorCode(ErrCodeStreamCreationError))
+		log.Print(err)
+		return
+	}
+	data, err := io.ReadAll(str)
+	if err != nil {
+		return
+	}
+	printWTStream(c.trace, s.str.StreamID(), str.StreamID(), data, true)
+
+	out, err := c.OpenUniStreamSync(context.Background())
+	if err != nil {
+		log.Printf("impossible d'ouvrir un flux unidirectionnel %v", err)
+		return
+	}
+	b := quicvarint.Append(nil, wtUniStreamType)
+	b = quicvarint.Append(b, uint64(s.str.StreamID()))
+	printWTStream(c.trace, s.str.StreamID(), out.StreamID(), data, false)
+	out.Write(append(b, data...))
+	out.Close()
+}
+
+func parseCapsule(b []byte) (Capsule, int, bool) {
+	t, n1, err := quicvarint.Parse(b)
+	if err != nil {
+		return Capsule{}, 0, false
+	}
+	l, n2, err := quicvarint.Parse(b[n1:])
+	if err != nil || uint64(len(b)-n1-n2) < l {
+		return Capsule{}, 0, false
+	}
+	start := n1 + n2
+	return Capsule{Type: t, Value: b[start : start+int(l)]}, start + int(l), true
+}
+
+func (c Capsule) Append(b []byte) []byte {
+	b = quicvarint.Append(b, c.Type)
+	b = quicvarint.Append(b, uint64(len(c.Value)))
+	return append(b, c.Value...)
+}
+
+func printCapsule(t *traceConn, sessionID quic.StreamID, c Capsule, in bool) {
+	t.lock(uint64(sessionID))
+	defer t.unlock()
+	color := dirColor(in)
+	defer color.Printf("|\n")
+	name, ok := capsuleNames[c.Type]
+	if !ok {
+		name = fmt.Sprintf("%#x", c.Type)
+	}
+	color.Printf("+- CAPSULE %s", name)
+	tracef(" #%v", sessionID)
+	tracef("\n")
+	if c.Type == capsuleCloseWTSession && len(c.Value) >= 4 {
+		printKeyValue("Code", binary.BigEndian.Uint32(c.Value), in)
+		printKeyValue("Message", string(c.Value[4:]), in)
+		return
+	}
+	printKeyValue("Data", fmt.Sprintf("%q", c.Value), in)
+}
+
+func printH3Datagram(t *traceConn, sessionID quic.StreamID, payload []byte, in bool) {
+	t.lock(uint64(sessionID))
+	defer t.unlock()
+	color := dirColor(in)
+	defer color.Printf("|\n")
+	color.Printf("+- DATAGRAM")
+	tracef(" #%v", sessionID)
+	tracef("\n")
+	printKeyValue("Data", fmt.Sprintf("%q", payload), in)
+}
+
+func printWTStream(t *traceConn, sessionID quic.StreamID, streamID quic.StreamID, data []byte, in bool) {
+	t.lock(uint64(streamID))
+	defer t.unlock()
+	color := dirColor(in)
+	defer color.Printf("|\n")
+	color.Printf("+- WT_STREAM")
+	tracef(" #%v (session #%v)", streamID, sessionID)
+	tracef("\n")
+	printKeyValue("Data", fmt.Sprintf("%q", data), in)
+}